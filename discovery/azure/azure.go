@@ -31,8 +31,9 @@ type SDConfig struct {
 	ClientSecret   *promauth.Secret `yaml:"client_secret,omitempty"`
 	ResourceGroup  string           `yaml:"resource_group,omitempty"`
 
-	// RefreshInterval time.Duration `yaml:"refresh_interval"`
-	// refresh_interval is obtained from `-promscrape.azureSDCheckInterval` command-line option.
+	// RefreshInterval is the interval for refreshing the discovered targets in background.
+	// The scrape_interval of the job is used if it isn't set.
+	RefreshInterval *promutils.Duration `yaml:"refresh_interval,omitempty"`
 
 	Port int `yaml:"port"`
 
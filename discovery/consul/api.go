@@ -0,0 +1,221 @@
+package consul
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cprobe/cprobe/lib/discoveryutils"
+	"github.com/cprobe/cprobe/lib/logger"
+	"github.com/cprobe/cprobe/lib/promauth"
+)
+
+var waitTime = flag.Duration("scrape.consul.waitTime", 0, "Wait time used by Consul service discovery for blocking queries. Default value is used if not set")
+
+// apiConfig contains config for API server.
+type apiConfig struct {
+	tagSeparator  string
+	consulWatcher *consulWatcher
+}
+
+func (ac *apiConfig) mustStop() {
+	ac.consulWatcher.mustStop()
+}
+
+var configMap = discoveryutils.NewConfigMap()
+
+func getAPIConfig(sdc *SDConfig, baseDir string) (*apiConfig, error) {
+	v, err := configMap.Get(sdc, func() (interface{}, error) { return newAPIConfig(sdc, baseDir) })
+	if err != nil {
+		return nil, err
+	}
+	return v.(*apiConfig), nil
+}
+
+func newAPIConfig(sdc *SDConfig, baseDir string) (*apiConfig, error) {
+	hcc := sdc.HTTPClientConfig
+	token, err := getToken(sdc.Token)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		if hcc.BearerToken != nil {
+			return nil, fmt.Errorf("cannot set both `token` and `bearer_token`")
+		}
+		hcc.BearerToken = promauth.NewSecret(token)
+	}
+	if sdc.Username != "" {
+		if hcc.BasicAuth != nil {
+			return nil, fmt.Errorf("cannot set both `username` and `basic_auth`")
+		}
+		hcc.BasicAuth = &promauth.BasicAuthConfig{
+			Username: sdc.Username,
+			Password: sdc.Password,
+		}
+	}
+	ac, err := hcc.NewConfig(baseDir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse auth config: %w", err)
+	}
+	proxyAC, err := sdc.ProxyClientConfig.NewConfig(baseDir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse proxy auth config: %w", err)
+	}
+	apiServer := sdc.Server
+	if apiServer == "" {
+		apiServer = "localhost:8500"
+	}
+	if !strings.Contains(apiServer, "://") {
+		scheme := sdc.Scheme
+		if scheme == "" {
+			scheme = "http"
+			if hcc.TLSConfig != nil {
+				scheme = "https"
+			}
+		}
+		apiServer = scheme + "://" + apiServer
+	}
+	client, err := discoveryutils.NewClient(apiServer, ac, sdc.ProxyURL, proxyAC, &hcc)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create HTTP client for %q: %w", apiServer, err)
+	}
+	tagSeparator := ","
+	if sdc.TagSeparator != nil {
+		tagSeparator = *sdc.TagSeparator
+	}
+	dc, err := getDatacenter(client, sdc.Datacenter)
+	if err != nil {
+		client.Stop()
+		return nil, fmt.Errorf("cannot obtain consul datacenter: %w", err)
+	}
+	namespace := sdc.Namespace
+	if namespace == "" {
+		// The default namespace can be set via env var in the same way as for Consul CLI.
+		namespace = os.Getenv("CONSUL_NAMESPACE")
+	}
+
+	cw, err := newConsulWatcher(client, sdc, dc, namespace)
+	if err != nil {
+		client.Stop()
+		return nil, err
+	}
+	cfg := &apiConfig{
+		tagSeparator:  tagSeparator,
+		consulWatcher: cw,
+	}
+	return cfg, nil
+}
+
+// getToken returns Consul token.
+//
+// CONSUL_HTTP_TOKEN_FILE and CONSUL_HTTP_TOKEN env vars are used if token isn't set in the config, like Consul CLI does.
+func getToken(token *promauth.Secret) (string, error) {
+	if token != nil {
+		return token.String(), nil
+	}
+	if tokenFile := os.Getenv("CONSUL_HTTP_TOKEN_FILE"); tokenFile != "" {
+		data, err := os.ReadFile(tokenFile)
+		if err != nil {
+			return "", fmt.Errorf("cannot read consul token file %q; probably, `token` arg is missing in `consul_sd_config`? error: %w", tokenFile, err)
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+	// An empty token is allowed - it works if authorization is disabled in Consul.
+	return os.Getenv("CONSUL_HTTP_TOKEN"), nil
+}
+
+func getDatacenter(client *discoveryutils.Client, dc string) (string, error) {
+	if dc != "" {
+		return dc, nil
+	}
+	// See https://developer.hashicorp.com/consul/api-docs/agent#read-configuration
+	data, err := client.GetAPIResponse("/v1/agent/self")
+	if err != nil {
+		return "", fmt.Errorf("cannot query consul agent info: %w", err)
+	}
+	a, err := parseAgent(data)
+	if err != nil {
+		return "", err
+	}
+	return a.Config.Datacenter, nil
+}
+
+// agent is Consul agent.
+//
+// See https://developer.hashicorp.com/consul/api-docs/agent#read-configuration
+type agent struct {
+	Config agentConfig
+}
+
+// agentConfig is Consul agent config.
+//
+// See https://developer.hashicorp.com/consul/api-docs/agent#read-configuration
+type agentConfig struct {
+	Datacenter string
+}
+
+func parseAgent(data []byte) (*agent, error) {
+	var a agent
+	if err := json.Unmarshal(data, &a); err != nil {
+		return nil, fmt.Errorf("cannot unmarshal agent info from %q: %w", data, err)
+	}
+	return &a, nil
+}
+
+// maxWaitTime returns the wait time for Consul blocking requests.
+func maxWaitTime() time.Duration {
+	d := discoveryutils.BlockingClientReadTimeout
+	// Consul adds random delay up to wait/16, so reduce the timeout in order to keep it below BlockingClientReadTimeout.
+	// See https://developer.hashicorp.com/consul/api-docs/features/blocking
+	d -= d / 16
+	// The timeout cannot exceed 10 minutes. See https://developer.hashicorp.com/consul/api-docs/features/blocking
+	if d > 10*time.Minute {
+		d = 10 * time.Minute
+	}
+	// Apply `-scrape.consul.waitTime` if it is lower than d.
+	if *waitTime > time.Second && *waitTime < d {
+		d = *waitTime
+	}
+	return d
+}
+
+// getBlockingAPIResponse performs blocking request to Consul via client and returns the response and the new index.
+//
+// See https://developer.hashicorp.com/consul/api-docs/features/blocking
+func getBlockingAPIResponse(ctx context.Context, client *discoveryutils.Client, path string, index int64) ([]byte, int64, error) {
+	path += "&index=" + strconv.FormatInt(index, 10)
+	path += "&wait=" + fmt.Sprintf("%ds", int(maxWaitTime().Seconds()))
+	newIndex := index
+	getMeta := func(resp *http.Response) {
+		ind := resp.Header.Get("X-Consul-Index")
+		if len(ind) == 0 {
+			logger.Errorf("cannot find X-Consul-Index header in response from %q", path)
+			return
+		}
+		n, err := strconv.ParseInt(ind, 10, 64)
+		if err != nil {
+			logger.Errorf("cannot parse X-Consul-Index header value in response from %q: %s", path, err)
+			return
+		}
+		// Properly handle the returned index according to https://developer.hashicorp.com/consul/api-docs/features/blocking#implementation-details
+		switch {
+		case n < 1:
+			newIndex = 1
+		case index > n:
+			newIndex = 0
+		default:
+			newIndex = n
+		}
+	}
+	data, err := client.GetBlockingAPIResponseCtx(ctx, path, getMeta)
+	if err != nil {
+		return nil, index, fmt.Errorf("cannot perform blocking Consul API request at %q: %w", path, err)
+	}
+	return data, newIndex, nil
+}
@@ -0,0 +1,65 @@
+package consul
+
+import (
+	"fmt"
+
+	"github.com/cprobe/cprobe/lib/promauth"
+	"github.com/cprobe/cprobe/lib/promutils"
+	"github.com/cprobe/cprobe/lib/proxy"
+)
+
+// SDConfig represents service discovery config for Consul.
+//
+// See https://prometheus.io/docs/prometheus/latest/configuration/configuration/#consul_sd_config
+type SDConfig struct {
+	Server     string           `yaml:"server,omitempty"`
+	Token      *promauth.Secret `yaml:"token,omitempty"`
+	Datacenter string           `yaml:"datacenter,omitempty"`
+	// Namespace is supported only by Consul Enterprise.
+	// See https://developer.hashicorp.com/consul/docs/enterprise/namespaces
+	Namespace string `yaml:"namespace,omitempty"`
+	// Partition is supported only by Consul Enterprise.
+	// See https://developer.hashicorp.com/consul/docs/enterprise/admin-partitions
+	Partition         string                     `yaml:"partition,omitempty"`
+	Scheme            string                     `yaml:"scheme,omitempty"`
+	Username          string                     `yaml:"username,omitempty"`
+	Password          *promauth.Secret           `yaml:"password,omitempty"`
+	HTTPClientConfig  promauth.HTTPClientConfig  `yaml:",inline"`
+	ProxyURL          *proxy.URL                 `yaml:"proxy_url,omitempty"`
+	ProxyClientConfig promauth.ProxyClientConfig `yaml:",inline"`
+	Services          []string                   `yaml:"services,omitempty"`
+	Tags              []string                   `yaml:"tags,omitempty"`
+	NodeMeta          map[string]string          `yaml:"node_meta,omitempty"`
+	TagSeparator      *string                    `yaml:"tag_separator,omitempty"`
+	AllowStale        *bool                      `yaml:"allow_stale,omitempty"`
+	// Filter is applied to the nodes of each service.
+	// See https://developer.hashicorp.com/consul/api-docs/features/filtering
+	Filter string `yaml:"filter,omitempty"`
+	// RefreshInterval is the interval for generating targets from the service nodes cached by the watcher.
+	// The service nodes themselves are updated via Consul blocking queries as soon as they change.
+	// The scrape_interval of the job is used if it isn't set.
+	RefreshInterval *promutils.Duration `yaml:"refresh_interval,omitempty"`
+}
+
+// GetLabels returns Consul labels according to sdc.
+//
+// The first call starts watching the services in background,
+// so the subsequent calls generate labels from the cached service nodes without querying Consul.
+func (sdc *SDConfig) GetLabels(baseDir string) ([]*promutils.Labels, error) {
+	cfg, err := getAPIConfig(sdc, baseDir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get API config: %w", err)
+	}
+	ms := getServiceNodesLabels(cfg)
+	return ms, nil
+}
+
+// MustStop stops further usage for sdc.
+func (sdc *SDConfig) MustStop() {
+	v := configMap.Delete(sdc)
+	if v != nil {
+		// v can be nil if GetLabels wasn't called yet.
+		cfg := v.(*apiConfig)
+		cfg.mustStop()
+	}
+}
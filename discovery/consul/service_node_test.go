@@ -0,0 +1,141 @@
+package consul
+
+import (
+	"testing"
+
+	"github.com/cprobe/cprobe/lib/discoveryutils"
+	"github.com/cprobe/cprobe/lib/promutils"
+)
+
+const testServiceNodes = `[
+  {
+    "Node": {
+      "ID": "40e4a748-2192-161a-0510-9bf59fe950b5",
+      "Node": "foobar",
+      "Address": "10.1.10.12",
+      "Datacenter": "dc1",
+      "TaggedAddresses": {
+        "lan": "10.1.10.12",
+        "wan": "10.1.10.12"
+      },
+      "Meta": {
+        "instance_type": "t2.medium"
+      }
+    },
+    "Service": {
+      "ID": "redis",
+      "Service": "redis",
+      "Tags": ["primary", "v1=foo"],
+      "Address": "10.1.10.13",
+      "Meta": {
+        "redis_version": "4.0"
+      },
+      "Port": 8000
+    },
+    "Checks": [
+      {
+        "Node": "foobar",
+        "CheckID": "service:redis",
+        "Name": "Service 'redis' check",
+        "Status": "passing"
+      },
+      {
+        "Node": "foobar",
+        "CheckID": "serfHealth",
+        "Name": "Serf Health Status",
+        "Status": "warning"
+      }
+    ]
+  }
+]`
+
+func TestParseServiceNodesFailure(t *testing.T) {
+	f := func(data string) {
+		t.Helper()
+		sns, err := ParseServiceNodes([]byte(data))
+		if err == nil {
+			t.Fatalf("expecting non-nil error")
+		}
+		if sns != nil {
+			t.Fatalf("unexpected non-nil ServiceNodes: %v", sns)
+		}
+	}
+	f(``)
+	f(`[1,23`)
+	f(`{"items":[{"metadata":1}]}`)
+}
+
+func TestParseServiceNodesSuccess(t *testing.T) {
+	sns, err := ParseServiceNodes([]byte(testServiceNodes))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(sns) != 1 {
+		t.Fatalf("unexpected length of ServiceNodes; got %d; want %d", len(sns), 1)
+	}
+	sn := sns[0]
+
+	// Check sn.Node
+	node := sn.Node
+	if node.Node != "foobar" {
+		t.Fatalf("unexpected Node.Node; got %q; want %q", node.Node, "foobar")
+	}
+	if node.Address != "10.1.10.12" {
+		t.Fatalf("unexpected Node.Address; got %q; want %q", node.Address, "10.1.10.12")
+	}
+
+	// Check sn.Service
+	service := sn.Service
+	if service.ID != "redis" {
+		t.Fatalf("unexpected Service.ID; got %q; want %q", service.ID, "redis")
+	}
+	if service.Port != 8000 {
+		t.Fatalf("unexpected Service.Port; got %d; want %d", service.Port, 8000)
+	}
+
+	// Check sn.Checks
+	if len(sn.Checks) != 2 {
+		t.Fatalf("unexpected number of checks; got %d; want %d", len(sn.Checks), 2)
+	}
+
+	// Check labels.
+	labelss := sn.appendTargetLabels(nil, "redis", ",")
+	discoveryutils.TestEqualLabelss(t, labelss, []*promutils.Labels{
+		promutils.NewLabelsFromMap(map[string]string{
+			"__address__":                                  "10.1.10.13:8000",
+			"__meta_consul_address":                        "10.1.10.12",
+			"__meta_consul_dc":                             "dc1",
+			"__meta_consul_health":                         "warning",
+			"__meta_consul_metadata_instance_type":         "t2.medium",
+			"__meta_consul_namespace":                      "",
+			"__meta_consul_partition":                      "",
+			"__meta_consul_node":                           "foobar",
+			"__meta_consul_service":                        "redis",
+			"__meta_consul_service_address":                "10.1.10.13",
+			"__meta_consul_service_id":                     "redis",
+			"__meta_consul_service_metadata_redis_version": "4.0",
+			"__meta_consul_service_port":                   "8000",
+			"__meta_consul_tagged_address_lan":             "10.1.10.12",
+			"__meta_consul_tagged_address_wan":             "10.1.10.12",
+			"__meta_consul_tags":                           ",primary,v1=foo,",
+			"__meta_consul_tag_primary":                    "",
+			"__meta_consul_tagpresent_primary":             "true",
+			"__meta_consul_tag_v1":                         "foo",
+			"__meta_consul_tagpresent_v1":                  "true",
+		}),
+	})
+}
+
+func TestAggregatedStatus(t *testing.T) {
+	f := func(checks []Check, want string) {
+		t.Helper()
+		if got := aggregatedStatus(checks); got != want {
+			t.Fatalf("unexpected status; got %q; want %q", got, want)
+		}
+	}
+	f(nil, "passing")
+	f([]Check{{CheckID: "a", Status: "passing"}}, "passing")
+	f([]Check{{CheckID: "a", Status: "passing"}, {CheckID: "b", Status: "critical"}}, "critical")
+	f([]Check{{CheckID: "a", Status: "critical"}, {CheckID: "_node_maintenance", Status: "critical"}}, "maintenance")
+	f([]Check{{CheckID: "a", Status: "unknown"}}, "")
+}
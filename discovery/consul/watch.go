@@ -0,0 +1,341 @@
+package consul
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/cprobe/cprobe/lib/discoveryutils"
+	"github.com/cprobe/cprobe/lib/logger"
+)
+
+const (
+	// minQueryInterval is the minimum interval between subsequent blocking queries for the same path.
+	// It protects Consul from a storm of requests when the index changes too frequently.
+	minQueryInterval = time.Second
+
+	// retryInterval is the interval for retrying failed requests to Consul.
+	retryInterval = 10 * time.Second
+)
+
+// consulWatcher is a watcher for Consul services and their nodes.
+//
+// It uses Consul blocking queries, so the changes are picked up as soon as they happen.
+type consulWatcher struct {
+	client *discoveryutils.Client
+
+	serviceNamesQueryArgs string
+	serviceNodesQueryArgs string
+	watchServices         []string
+	watchTags             []string
+
+	// servicesLock protects services
+	servicesLock sync.Mutex
+	services     map[string]*serviceWatcher
+
+	stoppedCh chan struct{}
+}
+
+type serviceWatcher struct {
+	serviceName  string
+	serviceNodes []ServiceNode
+
+	stoppedCh chan struct{}
+
+	requestCtx    context.Context
+	requestCancel context.CancelFunc
+}
+
+// newConsulWatcher creates new watcher and starts background service discovery for Consul.
+//
+// It returns after the first discovery iteration is done.
+func newConsulWatcher(client *discoveryutils.Client, sdc *SDConfig, datacenter, namespace string) (*consulWatcher, error) {
+	baseQueryArgs := "?dc=" + url.QueryEscape(datacenter)
+	if sdc.AllowStale == nil || *sdc.AllowStale {
+		baseQueryArgs += "&stale"
+	}
+	if namespace != "" {
+		baseQueryArgs += "&ns=" + url.QueryEscape(namespace)
+	}
+	if sdc.Partition != "" {
+		baseQueryArgs += "&partition=" + url.QueryEscape(sdc.Partition)
+	}
+	nodeMetaKeys := make([]string, 0, len(sdc.NodeMeta))
+	for k := range sdc.NodeMeta {
+		nodeMetaKeys = append(nodeMetaKeys, k)
+	}
+	sort.Strings(nodeMetaKeys)
+	for _, k := range nodeMetaKeys {
+		baseQueryArgs += "&node-meta=" + url.QueryEscape(k+":"+sdc.NodeMeta[k])
+	}
+
+	serviceNodesQueryArgs := baseQueryArgs
+	for _, tag := range sdc.Tags {
+		serviceNodesQueryArgs += "&tag=" + url.QueryEscape(tag)
+	}
+	if sdc.Filter != "" {
+		serviceNodesQueryArgs += "&filter=" + url.QueryEscape(sdc.Filter)
+	}
+
+	cw := &consulWatcher{
+		client:                client,
+		serviceNamesQueryArgs: baseQueryArgs,
+		serviceNodesQueryArgs: serviceNodesQueryArgs,
+		watchServices:         sdc.Services,
+		watchTags:             sdc.Tags,
+		services:              make(map[string]*serviceWatcher),
+		stoppedCh:             make(chan struct{}),
+	}
+	serviceNames, index, err := cw.getBlockingServiceNames(0)
+	if err != nil {
+		return nil, fmt.Errorf("cannot obtain Consul services from %q: %w", client.APIServer(), err)
+	}
+	cw.updateServices(serviceNames)
+	go func() {
+		cw.watchForServicesUpdates(index)
+		close(cw.stoppedCh)
+	}()
+	return cw, nil
+}
+
+func (cw *consulWatcher) mustStop() {
+	cw.client.Stop()
+	<-cw.stoppedCh
+}
+
+// updateServices starts watchers for new services and stops watchers for removed services.
+//
+// It returns after the first discovery iteration is done for the new services.
+func (cw *consulWatcher) updateServices(serviceNames []string) {
+	var initWG sync.WaitGroup
+
+	// Start watchers for new services.
+	cw.servicesLock.Lock()
+	for _, serviceName := range serviceNames {
+		if _, ok := cw.services[serviceName]; ok {
+			// The watcher for serviceName already exists.
+			continue
+		}
+		ctx, cancel := context.WithCancel(cw.client.Context())
+		sw := &serviceWatcher{
+			serviceName:   serviceName,
+			stoppedCh:     make(chan struct{}),
+			requestCtx:    ctx,
+			requestCancel: cancel,
+		}
+		cw.services[serviceName] = sw
+		serviceWatchersCreated.Inc()
+		initWG.Add(1)
+		go func() {
+			serviceWatchersCount.Inc()
+			sw.watchForServiceNodesUpdates(cw, &initWG)
+			serviceWatchersCount.Dec()
+			close(sw.stoppedCh)
+		}()
+	}
+
+	// Stop watchers for removed services.
+	newServiceNamesMap := make(map[string]struct{}, len(serviceNames))
+	for _, serviceName := range serviceNames {
+		newServiceNamesMap[serviceName] = struct{}{}
+	}
+	var swsStopped []*serviceWatcher
+	for serviceName, sw := range cw.services {
+		if _, ok := newServiceNamesMap[serviceName]; ok {
+			continue
+		}
+		sw.requestCancel()
+		delete(cw.services, serviceName)
+		swsStopped = append(swsStopped, sw)
+	}
+	cw.servicesLock.Unlock()
+
+	// Wait until deleted service watchers are stopped.
+	for _, sw := range swsStopped {
+		<-sw.stoppedCh
+		serviceWatchersStopped.Inc()
+	}
+
+	// Wait until new service watchers are initialized.
+	initWG.Wait()
+}
+
+// watchForServicesUpdates watches for new services starting from the given index and updates them in cw.
+func (cw *consulWatcher) watchForServicesUpdates(index int64) {
+	apiServer := cw.client.APIServer()
+	ctx := cw.client.Context()
+	for {
+		startTime := time.Now()
+		serviceNames, newIndex, err := cw.getBlockingServiceNames(index)
+		if err != nil {
+			if errors.Is(err, context.Canceled) || ctx.Err() != nil {
+				break
+			}
+			logger.Errorf("cannot obtain Consul serviceNames from %q: %s", apiServer, err)
+			if !discoveryutils.SleepCtx(ctx, retryInterval) {
+				break
+			}
+			continue
+		}
+		if index != newIndex {
+			cw.updateServices(serviceNames)
+			index = newIndex
+		}
+		if !waitForNextQuery(ctx, startTime) {
+			break
+		}
+	}
+
+	var swsStopped []*serviceWatcher
+	cw.servicesLock.Lock()
+	for _, sw := range cw.services {
+		sw.requestCancel()
+		swsStopped = append(swsStopped, sw)
+	}
+	cw.servicesLock.Unlock()
+	for _, sw := range swsStopped {
+		<-sw.stoppedCh
+	}
+}
+
+var (
+	serviceWatchersCreated = metrics.NewCounter("cprobe_discovery_consul_service_watchers_created_total")
+	serviceWatchersStopped = metrics.NewCounter("cprobe_discovery_consul_service_watchers_stopped_total")
+	serviceWatchersCount   = metrics.NewCounter("cprobe_discovery_consul_service_watchers")
+)
+
+// getBlockingServiceNames obtains serviceNames via blocking request to Consul.
+//
+// It returns an empty serviceNames list if response contains the same index.
+func (cw *consulWatcher) getBlockingServiceNames(index int64) ([]string, int64, error) {
+	path := "/v1/catalog/services" + cw.serviceNamesQueryArgs
+	data, newIndex, err := getBlockingAPIResponse(cw.client.Context(), cw.client, path, index)
+	if err != nil {
+		return nil, index, err
+	}
+	if index == newIndex {
+		// Nothing changed - return an empty serviceNames list.
+		return nil, index, nil
+	}
+	var m map[string][]string
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, index, fmt.Errorf("cannot parse response from %q: %w; data=%q", path, err, data)
+	}
+	serviceNames := make([]string, 0, len(m))
+	for serviceName, tags := range m {
+		if !shouldCollectServiceByName(cw.watchServices, serviceName) {
+			continue
+		}
+		if !shouldCollectServiceByTags(cw.watchTags, tags) {
+			continue
+		}
+		serviceNames = append(serviceNames, serviceName)
+	}
+	return serviceNames, newIndex, nil
+}
+
+// watchForServiceNodesUpdates watches for Consul serviceNode changes for the given serviceName.
+//
+// watchForServiceNodesUpdates calls initWG.Done() once the first discovery iteration is done.
+func (sw *serviceWatcher) watchForServiceNodesUpdates(cw *consulWatcher, initWG *sync.WaitGroup) {
+	apiServer := cw.client.APIServer()
+	ctx := sw.requestCtx
+	index := int64(0)
+	path := "/v1/health/service/" + url.PathEscape(sw.serviceName) + cw.serviceNodesQueryArgs
+	f := func() bool {
+		data, newIndex, err := getBlockingAPIResponse(ctx, cw.client, path, index)
+		if err != nil {
+			if errors.Is(err, context.Canceled) || ctx.Err() != nil {
+				return false
+			}
+			logger.Errorf("cannot obtain Consul serviceNodes for serviceName=%q from %q: %s", sw.serviceName, apiServer, err)
+			return discoveryutils.SleepCtx(ctx, retryInterval)
+		}
+		if index == newIndex {
+			// Nothing changed.
+			return true
+		}
+		sns, err := ParseServiceNodes(data)
+		if err != nil {
+			logger.Errorf("cannot parse Consul serviceNodes response for serviceName=%q from %q: %s", sw.serviceName, apiServer, err)
+			return discoveryutils.SleepCtx(ctx, retryInterval)
+		}
+
+		cw.servicesLock.Lock()
+		sw.serviceNodes = sns
+		cw.servicesLock.Unlock()
+
+		index = newIndex
+		return true
+	}
+
+	startTime := time.Now()
+	ok := f()
+	// Notify caller that initialization is complete
+	initWG.Done()
+	for ok && waitForNextQuery(ctx, startTime) {
+		startTime = time.Now()
+		ok = f()
+	}
+}
+
+// waitForNextQuery waits until minQueryInterval passes since startTime.
+//
+// It returns false if ctx is canceled.
+func waitForNextQuery(ctx context.Context, startTime time.Time) bool {
+	d := minQueryInterval - time.Since(startTime)
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	return discoveryutils.SleepCtx(ctx, d)
+}
+
+// getServiceNodesSnapshot returns a snapshot of discovered ServiceNodes.
+func (cw *consulWatcher) getServiceNodesSnapshot() map[string][]ServiceNode {
+	cw.servicesLock.Lock()
+	sns := make(map[string][]ServiceNode, len(cw.services))
+	for svc, sw := range cw.services {
+		sns[svc] = sw.serviceNodes
+	}
+	cw.servicesLock.Unlock()
+	return sns
+}
+
+func shouldCollectServiceByName(filterServices []string, serviceName string) bool {
+	if len(filterServices) == 0 {
+		return true
+	}
+	for _, filterService := range filterServices {
+		// Use case-insensitive comparison for service names according to https://github.com/VictoriaMetrics/VictoriaMetrics/issues/1422
+		if strings.EqualFold(filterService, serviceName) {
+			return true
+		}
+	}
+	return false
+}
+
+func shouldCollectServiceByTags(filterTags, tags []string) bool {
+	if len(filterTags) == 0 {
+		return true
+	}
+	for _, filterTag := range filterTags {
+		hasTag := false
+		for _, tag := range tags {
+			if tag == filterTag {
+				hasTag = true
+				break
+			}
+		}
+		if !hasTag {
+			return false
+		}
+	}
+	return true
+}
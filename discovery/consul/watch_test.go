@@ -0,0 +1,149 @@
+package consul
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cprobe/cprobe/lib/promauth"
+)
+
+func TestShouldCollectServiceByName(t *testing.T) {
+	f := func(filterServices []string, serviceName string, want bool) {
+		t.Helper()
+		if got := shouldCollectServiceByName(filterServices, serviceName); got != want {
+			t.Fatalf("unexpected result for filterServices=%q, serviceName=%q; got %v; want %v", filterServices, serviceName, got, want)
+		}
+	}
+	f(nil, "redis", true)
+	f([]string{"redis", "mysql"}, "redis", true)
+	f([]string{"Redis"}, "redis", true)
+	f([]string{"mysql"}, "redis", false)
+}
+
+func TestShouldCollectServiceByTags(t *testing.T) {
+	f := func(filterTags, tags []string, want bool) {
+		t.Helper()
+		if got := shouldCollectServiceByTags(filterTags, tags); got != want {
+			t.Fatalf("unexpected result for filterTags=%q, tags=%q; got %v; want %v", filterTags, tags, got, want)
+		}
+	}
+	f(nil, []string{"primary"}, true)
+	f([]string{"redis"}, []string{"primary", "redis"}, true)
+	f([]string{"redis", "primary"}, []string{"redis"}, false)
+	f([]string{"redis"}, nil, false)
+}
+
+func testServiceNode(node, addr string, port int) string {
+	return fmt.Sprintf(`{"Node": {"Node": %q, "Address": %q, "Datacenter": "dc1"}, "Service": {"ID": "redis-%s", "Service": "redis", "Tags": ["redis"], "Port": %d}, "Checks": [{"CheckID": "serfHealth", "Status": "passing"}]}`,
+		node, addr, node, port)
+}
+
+// TestConsulWatcher checks blocking queries against a local Consul-compatible stub.
+func TestConsulWatcher(t *testing.T) {
+	var mu sync.Mutex
+	var healthQueries []string
+	changeCh := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got != "Bearer consul-token" {
+			http.Error(w, "unexpected Authorization header: "+got, http.StatusForbidden)
+			return
+		}
+		q := r.URL.Query()
+		switch r.URL.Path {
+		case "/v1/agent/self":
+			fmt.Fprintf(w, `{"Config": {"Datacenter": "dc1"}}`)
+		case "/v1/catalog/services":
+			if q.Get("dc") != "dc1" || !q.Has("stale") || q.Get("node-meta") != "rack:r1" {
+				http.Error(w, "unexpected query args: "+r.URL.RawQuery, http.StatusBadRequest)
+				return
+			}
+			if q.Get("index") != "0" {
+				// Nothing changes.
+				<-r.Context().Done()
+				return
+			}
+			w.Header().Set("X-Consul-Index", "5")
+			fmt.Fprintf(w, `{"redis": ["redis", "primary"], "mysql": ["mysql"], "consul": []}`)
+		case "/v1/health/service/redis":
+			mu.Lock()
+			healthQueries = append(healthQueries, r.URL.RawQuery)
+			mu.Unlock()
+			if q.Get("tag") != "redis" {
+				http.Error(w, "unexpected query args: "+r.URL.RawQuery, http.StatusBadRequest)
+				return
+			}
+			switch q.Get("index") {
+			case "0":
+				w.Header().Set("X-Consul-Index", "10")
+				fmt.Fprintf(w, `[%s]`, testServiceNode("n1", "10.0.0.1", 6379))
+			case "10":
+				select {
+				case <-changeCh:
+				case <-r.Context().Done():
+					return
+				}
+				w.Header().Set("X-Consul-Index", "11")
+				fmt.Fprintf(w, `[%s, %s]`, testServiceNode("n1", "10.0.0.1", 6379), testServiceNode("n2", "10.0.0.2", 6379))
+			default:
+				<-r.Context().Done()
+			}
+		default:
+			http.Error(w, "unexpected path: "+r.URL.Path, http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	sdc := &SDConfig{
+		Server:   srv.URL,
+		Token:    promauth.NewSecret("consul-token"),
+		Tags:     []string{"redis"},
+		NodeMeta: map[string]string{"rack": "r1"},
+	}
+	defer sdc.MustStop()
+
+	getAddrs := func() string {
+		t.Helper()
+		labelss, err := sdc.GetLabels("")
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		var addrs []string
+		for _, labels := range labelss {
+			addrs = append(addrs, labels.Get("__meta_consul_service")+"/"+labels.Get("__address__"))
+		}
+		sort.Strings(addrs)
+		return strings.Join(addrs, ",")
+	}
+
+	// The first call waits for the initial discovery.
+	if got, want := getAddrs(), "redis/10.0.0.1:6379"; got != want {
+		t.Fatalf("unexpected targets; got %q; want %q", got, want)
+	}
+
+	// The blocking query returns as soon as the service changes.
+	close(changeCh)
+	want := "redis/10.0.0.1:6379,redis/10.0.0.2:6379"
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		got := getAddrs()
+		if got == want {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected targets after update; got %q; want %q", got, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(healthQueries) < 2 || !strings.Contains(healthQueries[1], "index=10") || !strings.Contains(healthQueries[1], "wait=") {
+		t.Fatalf("unexpected blocking queries: %q", healthQueries)
+	}
+}
@@ -26,6 +26,9 @@ type SDConfig struct {
 	ProxyURL          *proxy.URL                 `yaml:"proxy_url,omitempty"`
 	ProxyClientConfig promauth.ProxyClientConfig `yaml:",inline"`
 	Port              int                        `yaml:"port,omitempty"`
+	// RefreshInterval is the interval for refreshing the discovered targets in background.
+	// The scrape_interval of the job is used if it isn't set.
+	RefreshInterval *promutils.Duration `yaml:"refresh_interval,omitempty"`
 }
 
 // GetLabels returns Digital Ocean droplet labels according to sdc.
@@ -25,8 +25,9 @@ type SDConfig struct {
 	Names []string `yaml:"names"`
 	Type  string   `yaml:"type,omitempty"`
 	Port  *int     `yaml:"port,omitempty"`
-	// RefreshInterval time.Duration `yaml:"refresh_interval"`
-	// refresh_interval is obtained from `-promscrape.dnsSDCheckInterval` command-line option.
+	// RefreshInterval is the interval for refreshing the discovered targets in background.
+	// The scrape_interval of the job is used if it isn't set.
+	RefreshInterval *promutils.Duration `yaml:"refresh_interval,omitempty"`
 }
 
 // GetLabels returns DNS labels according to sdc.
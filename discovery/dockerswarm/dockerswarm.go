@@ -25,7 +25,9 @@ type SDConfig struct {
 	HTTPClientConfig  promauth.HTTPClientConfig  `yaml:",inline"`
 	ProxyURL          *proxy.URL                 `yaml:"proxy_url,omitempty"`
 	ProxyClientConfig promauth.ProxyClientConfig `yaml:",inline"`
-	// refresh_interval is obtained from `-promscrape.dockerswarmSDCheckInterval` command-line option
+	// RefreshInterval is the interval for refreshing the discovered targets in background.
+	// The scrape_interval of the job is used if it isn't set.
+	RefreshInterval *promutils.Duration `yaml:"refresh_interval,omitempty"`
 }
 
 // Filter is a filter, which can be passed to SDConfig.
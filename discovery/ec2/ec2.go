@@ -25,11 +25,12 @@ type SDConfig struct {
 	// TODO add support for Profile, not working atm
 	// Profile string `yaml:"profile,omitempty"`
 	RoleARN string `yaml:"role_arn,omitempty"`
-	// RefreshInterval time.Duration `yaml:"refresh_interval"`
-	// refresh_interval is obtained from `-promscrape.ec2SDCheckInterval` command-line option.
-	Port            *int            `yaml:"port,omitempty"`
-	InstanceFilters []awsapi.Filter `yaml:"filters,omitempty"`
-	AZFilters       []awsapi.Filter `yaml:"az_filters,omitempty"`
+	// RefreshInterval is the interval for refreshing the discovered targets in background.
+	// The scrape_interval of the job is used if it isn't set.
+	RefreshInterval *promutils.Duration `yaml:"refresh_interval,omitempty"`
+	Port            *int                `yaml:"port,omitempty"`
+	InstanceFilters []awsapi.Filter     `yaml:"filters,omitempty"`
+	AZFilters       []awsapi.Filter     `yaml:"az_filters,omitempty"`
 }
 
 // GetLabels returns ec2 labels according to sdc.
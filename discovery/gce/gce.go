@@ -18,10 +18,11 @@ type SDConfig struct {
 	Project string   `yaml:"project"`
 	Zone    ZoneYAML `yaml:"zone"`
 	Filter  string   `yaml:"filter,omitempty"`
-	// RefreshInterval time.Duration `yaml:"refresh_interval"`
-	// refresh_interval is obtained from `-promscrape.gceSDCheckInterval` command-line option.
-	Port         *int    `yaml:"port,omitempty"`
-	TagSeparator *string `yaml:"tag_separator,omitempty"`
+	// RefreshInterval is the interval for refreshing the discovered targets in background.
+	// The scrape_interval of the job is used if it isn't set.
+	RefreshInterval *promutils.Duration `yaml:"refresh_interval,omitempty"`
+	Port            *int                `yaml:"port,omitempty"`
+	TagSeparator    *string             `yaml:"tag_separator,omitempty"`
 }
 
 // ZoneYAML holds info about zones.
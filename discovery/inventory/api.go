@@ -0,0 +1,163 @@
+package inventory
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/cprobe/cprobe/lib/discoveryutils"
+	"github.com/cprobe/cprobe/lib/fs"
+)
+
+var configMap = discoveryutils.NewConfigMap()
+
+type apiConfig struct {
+	// client and path are set if CMDB export is read from URL
+	client *discoveryutils.Client
+	path   string
+	// file is set if CMDB export is read from local file
+	file string
+
+	source        string
+	format        string
+	paths         []string
+	addressColumn string
+	pathColumn    string
+	columns       map[string]string
+	port          int
+}
+
+func newAPIConfig(sdc *SDConfig, baseDir string) (*apiConfig, error) {
+	if (sdc.File == "") == (sdc.URL == "") {
+		return nil, fmt.Errorf("exactly one of `file` or `url` must be set")
+	}
+	cfg := &apiConfig{
+		addressColumn: sdc.AddressColumn,
+		pathColumn:    sdc.PathColumn,
+		columns:       sdc.Columns,
+		port:          sdc.Port,
+	}
+	if cfg.addressColumn == "" {
+		cfg.addressColumn = "address"
+	}
+	if cfg.pathColumn == "" {
+		cfg.pathColumn = "path"
+	}
+	if cfg.port < 0 || cfg.port > 65535 {
+		return nil, fmt.Errorf("invalid `port`: %d", cfg.port)
+	}
+	for _, p := range sdc.Paths {
+		cfg.paths = append(cfg.paths, NormalizePath(p))
+	}
+
+	var ext string
+	if sdc.File != "" {
+		cfg.file = fs.GetFilepath(baseDir, sdc.File)
+		cfg.source = cfg.file
+		ext = filepath.Ext(cfg.file)
+	} else {
+		ac, err := sdc.HTTPClientConfig.NewConfig(baseDir)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse auth config: %w", err)
+		}
+		parsedURL, err := url.Parse(sdc.URL)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse `url` %q: %w", sdc.URL, err)
+		}
+		if parsedURL.Scheme != "http" && parsedURL.Scheme != "https" {
+			return nil, fmt.Errorf("unsupported scheme in `url` %q; supported values: http, https", sdc.URL)
+		}
+		apiServer := fmt.Sprintf("%s://%s", parsedURL.Scheme, parsedURL.Host)
+		proxyAC, err := sdc.ProxyClientConfig.NewConfig(baseDir)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse proxy auth config: %w", err)
+		}
+		client, err := discoveryutils.NewClient(apiServer, ac, sdc.ProxyURL, proxyAC, &sdc.HTTPClientConfig)
+		if err != nil {
+			return nil, fmt.Errorf("cannot create HTTP client for %q: %w", apiServer, err)
+		}
+		cfg.client = client
+		cfg.path = parsedURL.RequestURI()
+		cfg.source = sdc.URL
+		ext = path.Ext(parsedURL.Path)
+	}
+
+	cfg.format = strings.ToLower(sdc.Format)
+	if cfg.format == "" {
+		cfg.format = getFormatByExt(ext)
+	}
+	switch cfg.format {
+	case formatCSV, formatJSON, formatYAML:
+	case "":
+		if cfg.client != nil {
+			cfg.client.Stop()
+		}
+		return nil, fmt.Errorf("cannot detect the format of %q; set `format` to csv, json or yaml", cfg.source)
+	default:
+		if cfg.client != nil {
+			cfg.client.Stop()
+		}
+		return nil, fmt.Errorf("unsupported `format` %q; supported values: csv, json, yaml", sdc.Format)
+	}
+	return cfg, nil
+}
+
+func getAPIConfig(sdc *SDConfig, baseDir string) (*apiConfig, error) {
+	v, err := configMap.Get(sdc, func() (interface{}, error) { return newAPIConfig(sdc, baseDir) })
+	if err != nil {
+		return nil, err
+	}
+	return v.(*apiConfig), nil
+}
+
+func getFormatByExt(ext string) string {
+	switch strings.ToLower(ext) {
+	case ".csv":
+		return formatCSV
+	case ".json":
+		return formatJSON
+	case ".yaml", ".yml":
+		return formatYAML
+	default:
+		return ""
+	}
+}
+
+// readInventory reads CMDB export from the file or from the URL.
+func (cfg *apiConfig) readInventory() ([]byte, error) {
+	if cfg.client == nil {
+		data, err := os.ReadFile(cfg.file)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read CMDB export: %w", err)
+		}
+		return data, nil
+	}
+	data, err := cfg.client.GetAPIResponse(cfg.path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read CMDB export from %q: %w", cfg.source, err)
+	}
+	return data, nil
+}
+
+// NormalizePath returns business path p in the canonical form such as `/bj/trade/order`.
+func NormalizePath(p string) string {
+	return path.Clean("/" + strings.TrimSpace(p))
+}
+
+// matchPaths returns true if p equals to one of paths or is a descendant of it.
+//
+// Every path must be normalized with NormalizePath.
+func matchPaths(p string, paths []string) bool {
+	if len(paths) == 0 {
+		return true
+	}
+	for _, prefix := range paths {
+		if prefix == "/" || p == prefix || strings.HasPrefix(p, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
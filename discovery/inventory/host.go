@@ -0,0 +1,233 @@
+package inventory
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cprobe/cprobe/lib/discoveryutils"
+	"github.com/cprobe/cprobe/lib/promutils"
+	"gopkg.in/yaml.v2"
+)
+
+// host is a single host from CMDB export.
+type host struct {
+	// path is the normalized business path of the host
+	path string
+	// fields contains all the columns of the host including address and path columns
+	fields map[string]string
+}
+
+// utf8BOM is added by Excel to the beginning of csv files.
+var utf8BOM = []byte("\xef\xbb\xbf")
+
+// parseHosts parses hosts from CMDB export data in the given format.
+func parseHosts(data []byte, format, addressColumn, pathColumn string) ([]host, error) {
+	data = bytes.TrimPrefix(data, utf8BOM)
+	var v interface{}
+	switch format {
+	case formatCSV:
+		return parseCSVHosts(data, pathColumn)
+	case formatJSON:
+		if err := json.Unmarshal(data, &v); err != nil {
+			return nil, err
+		}
+	case formatYAML:
+		if err := yaml.Unmarshal(data, &v); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported format %q", format)
+	}
+
+	if items, ok := v.([]interface{}); ok {
+		// The list of hosts with path column.
+		var hosts []host
+		for i, item := range items {
+			h, err := newHost("", item, addressColumn)
+			if err != nil {
+				return nil, fmt.Errorf("cannot parse host #%d: %w", i, err)
+			}
+			h.path = NormalizePath(h.fields[pathColumn])
+			hosts = append(hosts, h)
+		}
+		return hosts, nil
+	}
+	return appendTreeHosts(nil, "/", v, addressColumn)
+}
+
+func parseCSVHosts(data []byte, pathColumn string) ([]host, error) {
+	r := csv.NewReader(bytes.NewReader(data))
+	r.TrimLeadingSpace = true
+	r.Comment = '#'
+	rows, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+	columns := rows[0]
+	for i := range columns {
+		columns[i] = strings.TrimSpace(columns[i])
+	}
+	hosts := make([]host, 0, len(rows)-1)
+	for _, row := range rows[1:] {
+		fields := make(map[string]string, len(columns))
+		for i, column := range columns {
+			fields[column] = strings.TrimSpace(row[i])
+		}
+		hosts = append(hosts, host{
+			path:   NormalizePath(fields[pathColumn]),
+			fields: fields,
+		})
+	}
+	return hosts, nil
+}
+
+// appendTreeHosts appends hosts from the tree node v with the given business path to dst.
+func appendTreeHosts(dst []host, path string, v interface{}, addressColumn string) ([]host, error) {
+	switch t := v.(type) {
+	case nil:
+		return dst, nil
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, child := range t {
+			m[fmt.Sprint(k)] = child
+		}
+		return appendTreeChildrenHosts(dst, path, m, addressColumn)
+	case map[string]interface{}:
+		return appendTreeChildrenHosts(dst, path, t, addressColumn)
+	case []interface{}:
+		for i, item := range t {
+			h, err := newHost(path, item, addressColumn)
+			if err != nil {
+				return nil, fmt.Errorf("cannot parse host #%d at %q: %w", i, path, err)
+			}
+			dst = append(dst, h)
+		}
+		return dst, nil
+	default:
+		// A single host address.
+		h, err := newHost(path, v, addressColumn)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse host at %q: %w", path, err)
+		}
+		return append(dst, h), nil
+	}
+}
+
+func appendTreeChildrenHosts(dst []host, path string, m map[string]interface{}, addressColumn string) ([]host, error) {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var err error
+	for _, k := range keys {
+		dst, err = appendTreeHosts(dst, NormalizePath(path+"/"+k), m[k], addressColumn)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return dst, nil
+}
+
+// newHost returns host with the given path from v, which is either an address or an object with fields.
+//
+// Fields with non-scalar values are ignored.
+func newHost(path string, v interface{}, addressColumn string) (host, error) {
+	var m map[string]interface{}
+	switch t := v.(type) {
+	case map[interface{}]interface{}:
+		m = make(map[string]interface{}, len(t))
+		for k, fv := range t {
+			m[fmt.Sprint(k)] = fv
+		}
+	case map[string]interface{}:
+		m = t
+	case []interface{}:
+		return host{}, fmt.Errorf("unexpected list; want an address or an object")
+	default:
+		return host{
+			path: path,
+			fields: map[string]string{
+				addressColumn: formatValue(v),
+			},
+		}, nil
+	}
+	fields := make(map[string]string, len(m))
+	for k, fv := range m {
+		switch fv.(type) {
+		case map[interface{}]interface{}, map[string]interface{}, []interface{}:
+			continue
+		}
+		fields[k] = formatValue(fv)
+	}
+	return host{
+		path:   path,
+		fields: fields,
+	}, nil
+}
+
+func formatValue(v interface{}) string {
+	switch t := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return strings.TrimSpace(t)
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64)
+	default:
+		return fmt.Sprint(t)
+	}
+}
+
+// appendHostsLabels appends labels for hosts matching cfg.paths to ms.
+func appendHostsLabels(ms []*promutils.Labels, hosts []host, cfg *apiConfig) []*promutils.Labels {
+	for _, h := range hosts {
+		addr := h.fields[cfg.addressColumn]
+		if addr == "" || !matchPaths(h.path, cfg.paths) {
+			continue
+		}
+		if cfg.port > 0 {
+			if _, _, err := net.SplitHostPort(addr); err != nil {
+				addr = discoveryutils.JoinHostPort(addr, cfg.port)
+			}
+		}
+
+		m := promutils.NewLabels(2 + strings.Count(h.path, "/") + len(h.fields))
+		for k, v := range h.fields {
+			if k == cfg.addressColumn || k == cfg.pathColumn {
+				continue
+			}
+			if name, ok := cfg.columns[k]; ok {
+				k = name
+			}
+			m.Add(discoveryutils.SanitizeLabelName("__meta_cmdb_"+k), v)
+		}
+		AddPathLabels(m, h.path)
+		m.Add("__address__", addr)
+		m.RemoveDuplicates()
+		ms = append(ms, m)
+	}
+	return ms
+}
+
+// AddPathLabels adds `__meta_cmdb_path` label with the normalized business path p to m
+// together with `__meta_cmdb_path_level_<n>` labels for its segments.
+func AddPathLabels(m *promutils.Labels, p string) {
+	p = NormalizePath(p)
+	m.Add("__meta_cmdb_path", p)
+	if p == "/" {
+		return
+	}
+	for i, segment := range strings.Split(p[1:], "/") {
+		m.Add("__meta_cmdb_path_level_"+strconv.Itoa(i+1), segment)
+	}
+}
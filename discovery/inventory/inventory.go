@@ -0,0 +1,94 @@
+package inventory
+
+import (
+	"fmt"
+
+	"github.com/cprobe/cprobe/lib/promauth"
+	"github.com/cprobe/cprobe/lib/promutils"
+	"github.com/cprobe/cprobe/lib/proxy"
+)
+
+// SDConfig represents service discovery config for hosts exported from CMDB.
+//
+// The export is read either from File or from URL. The following formats are supported:
+//
+//   - csv: the first line contains column names. Every other line is a host.
+//     The business path of the host is read from the path_column.
+//   - json and yaml: either a list of hosts with the same fields as csv columns,
+//     or a tree keyed by business path segments, where leaves are lists of hosts.
+//     Every host in the tree is either an address or an object with fields.
+//
+// For example, the following yaml tree contains two hosts with `/bj/trade/order` business path:
+//
+//	bj:
+//	  trade:
+//	    order:
+//	    - address: 10.0.0.1
+//	      owner: alice
+//	    - 10.0.0.2
+//
+// The address of the host is read from the address_column. Hosts without address are skipped.
+// The business path is exposed as `__meta_cmdb_path` label and its segments as `__meta_cmdb_path_level_<n>` labels
+// starting from 1. The remaining columns are exposed as `__meta_cmdb_<column>` labels.
+type SDConfig struct {
+	// File is the path to CMDB export. Relative paths are resolved against the directory of the config file.
+	File string `yaml:"file,omitempty"`
+	// URL is http or https URL to CMDB export.
+	URL               string                     `yaml:"url,omitempty"`
+	HTTPClientConfig  promauth.HTTPClientConfig  `yaml:",inline"`
+	ProxyURL          *proxy.URL                 `yaml:"proxy_url,omitempty"`
+	ProxyClientConfig promauth.ProxyClientConfig `yaml:",inline"`
+	// Format is the format of CMDB export: csv, json or yaml.
+	// It is detected by the extension of File or URL path if it isn't set.
+	Format string `yaml:"format,omitempty"`
+	// Paths limits the discovered hosts to the given business paths and their descendants.
+	// All the hosts are discovered if it isn't set.
+	Paths []string `yaml:"paths,omitempty"`
+	// AddressColumn is the column with host address. `address` is used if it isn't set.
+	AddressColumn string `yaml:"address_column,omitempty"`
+	// PathColumn is the column with business path for csv and for lists of hosts. `path` is used if it isn't set.
+	PathColumn string `yaml:"path_column,omitempty"`
+	// Columns maps column names to the names of `__meta_cmdb_<name>` labels, for example `机房: idc`.
+	// Columns without mapping are exposed as `__meta_cmdb_<column>` labels.
+	Columns map[string]string `yaml:"columns,omitempty"`
+	// Port is added to host addresses without port.
+	Port int `yaml:"port,omitempty"`
+	// RefreshInterval is the interval for refreshing the discovered targets in background.
+	// The scrape_interval of the job is used if it isn't set.
+	RefreshInterval *promutils.Duration `yaml:"refresh_interval,omitempty"`
+}
+
+// Supported values for `format` option.
+const (
+	formatCSV  = "csv"
+	formatJSON = "json"
+	formatYAML = "yaml"
+)
+
+// GetLabels returns CMDB labels according to sdc.
+func (sdc *SDConfig) GetLabels(baseDir string) ([]*promutils.Labels, error) {
+	cfg, err := getAPIConfig(sdc, baseDir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get API config: %w", err)
+	}
+	data, err := cfg.readInventory()
+	if err != nil {
+		return nil, err
+	}
+	hosts, err := parseHosts(data, cfg.format, cfg.addressColumn, cfg.pathColumn)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse CMDB export from %q: %w", cfg.source, err)
+	}
+	return appendHostsLabels(nil, hosts, cfg), nil
+}
+
+// MustStop stops further usage for sdc.
+func (sdc *SDConfig) MustStop() {
+	v := configMap.Delete(sdc)
+	if v != nil {
+		cfg := v.(*apiConfig)
+		if cfg.client != nil {
+			cfg.client.Stop()
+		}
+	}
+}
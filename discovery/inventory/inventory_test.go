@@ -0,0 +1,214 @@
+package inventory
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/cprobe/cprobe/lib/discoveryutils"
+	"github.com/cprobe/cprobe/lib/promutils"
+)
+
+func TestGetLabels(t *testing.T) {
+	f := func(sdc *SDConfig, want []map[string]string) {
+		t.Helper()
+		defer sdc.MustStop()
+		labelss, err := sdc.GetLabels("testdata")
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		var wantLabelss []*promutils.Labels
+		for _, m := range want {
+			wantLabelss = append(wantLabelss, promutils.NewLabelsFromMap(m))
+		}
+		discoveryutils.TestEqualLabelss(t, labelss, wantLabelss)
+	}
+
+	order1 := map[string]string{
+		"__address__":              "10.0.0.1",
+		"__meta_cmdb_path":         "/bj/trade/order",
+		"__meta_cmdb_path_level_1": "bj",
+		"__meta_cmdb_path_level_2": "trade",
+		"__meta_cmdb_path_level_3": "order",
+		"__meta_cmdb_hostname":     "order-1",
+	}
+	with := func(m map[string]string, kvs ...string) map[string]string {
+		result := make(map[string]string, len(m)+len(kvs)/2)
+		for k, v := range m {
+			result[k] = v
+		}
+		for i := 0; i < len(kvs); i += 2 {
+			result[kvs[i]] = kvs[i+1]
+		}
+		return result
+	}
+
+	// csv with path prefix filter, column mapping and default port
+	f(&SDConfig{
+		File:    "hosts.csv",
+		Paths:   []string{"bj/trade/"},
+		Columns: map[string]string{"机房": "idc"},
+		Port:    9100,
+	}, []map[string]string{
+		with(order1, "__address__", "10.0.0.1:9100", "__meta_cmdb_idc", "bj-01", "__meta_cmdb_owner", "alice"),
+		{
+			"__address__":              "10.0.0.2:9100",
+			"__meta_cmdb_path":         "/bj/trade/order",
+			"__meta_cmdb_path_level_1": "bj",
+			"__meta_cmdb_path_level_2": "trade",
+			"__meta_cmdb_path_level_3": "order",
+			"__meta_cmdb_hostname":     "order-2",
+			"__meta_cmdb_idc":          "bj-02",
+			"__meta_cmdb_owner":        "alice",
+		},
+		{
+			"__address__":              "10.0.1.1:9100",
+			"__meta_cmdb_path":         "/bj/trade/pay",
+			"__meta_cmdb_path_level_1": "bj",
+			"__meta_cmdb_path_level_2": "trade",
+			"__meta_cmdb_path_level_3": "pay",
+			"__meta_cmdb_hostname":     "pay-1",
+			"__meta_cmdb_idc":          "bj-01",
+			"__meta_cmdb_owner":        "bob",
+		},
+	})
+
+	// the path prefix must match whole segments
+	f(&SDConfig{
+		File:  "hosts.csv",
+		Paths: []string{"/bj/trade/ord", "/sh/search"},
+	}, []map[string]string{
+		{
+			"__address__":              "10.0.2.1",
+			"__meta_cmdb_path":         "/sh/search",
+			"__meta_cmdb_path_level_1": "sh",
+			"__meta_cmdb_path_level_2": "search",
+			"__meta_cmdb_hostname":     "search-1",
+			"__meta_cmdb___":           "sh-01",
+			"__meta_cmdb_owner":        "carol",
+		},
+	})
+
+	// yaml tree
+	f(&SDConfig{
+		File: "tree.yaml",
+	}, []map[string]string{
+		with(order1, "__meta_cmdb_owner", "alice"),
+		{
+			"__address__":              "10.0.0.2:9100",
+			"__meta_cmdb_path":         "/bj/trade/order",
+			"__meta_cmdb_path_level_1": "bj",
+			"__meta_cmdb_path_level_2": "trade",
+			"__meta_cmdb_path_level_3": "order",
+		},
+		{
+			"__address__":              "10.0.1.1",
+			"__meta_cmdb_path":         "/bj/trade/pay",
+			"__meta_cmdb_path_level_1": "bj",
+			"__meta_cmdb_path_level_2": "trade",
+			"__meta_cmdb_path_level_3": "pay",
+		},
+		{
+			"__address__":              "10.0.2.1",
+			"__meta_cmdb_path":         "/sh/search",
+			"__meta_cmdb_path_level_1": "sh",
+			"__meta_cmdb_path_level_2": "search",
+			"__meta_cmdb_hostname":     "search-1",
+		},
+	})
+
+	// json tree
+	f(&SDConfig{
+		File: "tree.json",
+	}, []map[string]string{
+		order1,
+	})
+
+	// json list of hosts with custom address column in explicitly set format
+	f(&SDConfig{
+		File:          "hosts.json",
+		Format:        "json",
+		AddressColumn: "hostname",
+		Paths:         []string{"/bj"},
+	}, []map[string]string{
+		{
+			"__address__":              "order-1",
+			"__meta_cmdb_path":         "/bj/trade/order",
+			"__meta_cmdb_path_level_1": "bj",
+			"__meta_cmdb_path_level_2": "trade",
+			"__meta_cmdb_path_level_3": "order",
+			"__meta_cmdb_address":      "10.0.0.1",
+			"__meta_cmdb_cpu":          "8",
+		},
+	})
+}
+
+func TestGetLabelsHTTP(t *testing.T) {
+	data, err := os.ReadFile("testdata/tree.json")
+	if err != nil {
+		t.Fatalf("cannot read test data: %s", err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/export/hosts.json" {
+			http.Error(w, "unexpected path", http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write(data)
+	}))
+	defer srv.Close()
+
+	sdc := &SDConfig{
+		URL: srv.URL + "/export/hosts.json",
+	}
+	defer sdc.MustStop()
+	labelss, err := sdc.GetLabels("")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	discoveryutils.TestEqualLabelss(t, labelss, []*promutils.Labels{
+		promutils.NewLabelsFromMap(map[string]string{
+			"__address__":              "10.0.0.1",
+			"__meta_cmdb_path":         "/bj/trade/order",
+			"__meta_cmdb_path_level_1": "bj",
+			"__meta_cmdb_path_level_2": "trade",
+			"__meta_cmdb_path_level_3": "order",
+			"__meta_cmdb_hostname":     "order-1",
+		}),
+	})
+}
+
+func TestNewAPIConfigFailure(t *testing.T) {
+	f := func(sdc *SDConfig) {
+		t.Helper()
+		if _, err := newAPIConfig(sdc, "testdata"); err == nil {
+			t.Fatalf("expecting non-nil error")
+		}
+	}
+	// neither file nor url
+	f(&SDConfig{})
+	// both file and url
+	f(&SDConfig{File: "hosts.csv", URL: "http://cmdb/hosts.csv"})
+	// unsupported url scheme
+	f(&SDConfig{URL: "ftp://cmdb/hosts.csv"})
+	// unknown format
+	f(&SDConfig{File: "hosts.txt"})
+	f(&SDConfig{File: "hosts.csv", Format: "xml"})
+	// invalid port
+	f(&SDConfig{File: "hosts.csv", Port: 70000})
+}
+
+func TestParseHostsFailure(t *testing.T) {
+	f := func(data, format string) {
+		t.Helper()
+		if _, err := parseHosts([]byte(data), format, "address", "path"); err == nil {
+			t.Fatalf("expecting non-nil error")
+		}
+	}
+	// inconsistent number of csv columns
+	f("address,path\n10.0.0.1\n", formatCSV)
+	// invalid json
+	f(`{"bj": [`, formatJSON)
+	// nested list of hosts
+	f("bj:\n- [10.0.0.1]\n", formatYAML)
+}
@@ -0,0 +1,148 @@
+package kubernetes
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cprobe/cprobe/lib/discoveryutils"
+	"github.com/cprobe/cprobe/lib/fs"
+	"github.com/cprobe/cprobe/lib/promauth"
+)
+
+var configMap = discoveryutils.NewConfigMap()
+
+type apiConfig struct {
+	aw *apiWatcher
+}
+
+// serviceAccountDir is the directory with the service account credentials, which are mounted into every pod.
+//
+// It is used for connecting to Kubernetes API server when cprobe runs inside Kubernetes and `api_server` isn't set.
+var serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+func getAPIConfig(sdc *SDConfig, baseDir string) (*apiConfig, error) {
+	v, err := configMap.Get(sdc, func() (interface{}, error) { return newAPIConfig(sdc, baseDir) })
+	if err != nil {
+		return nil, err
+	}
+	return v.(*apiConfig), nil
+}
+
+func newAPIConfig(sdc *SDConfig, baseDir string) (*apiConfig, error) {
+	if err := checkRole(sdc.Role); err != nil {
+		return nil, err
+	}
+	for _, s := range sdc.Selectors {
+		if err := checkRole(s.Role); err != nil {
+			return nil, fmt.Errorf("invalid `selectors`: %w", err)
+		}
+	}
+
+	asc, err := getAPIServerConfig(sdc, baseDir)
+	if err != nil {
+		return nil, err
+	}
+	ac, err := asc.opts.NewConfig()
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse auth config: %w", err)
+	}
+	proxyAC, err := sdc.ProxyClientConfig.NewConfig(baseDir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse proxy auth config: %w", err)
+	}
+	proxyURL := sdc.ProxyURL
+	if proxyURL == nil {
+		proxyURL = asc.proxyURL
+	}
+
+	namespaces := append([]string{}, sdc.Namespaces.Names...)
+	if sdc.Namespaces.OwnNamespace {
+		if asc.namespace == "" {
+			return nil, fmt.Errorf("cannot determine own namespace for `namespaces: {own_namespace: true}`; " +
+				"set `namespace` in the current context of `kubeconfig_file` or run cprobe inside Kubernetes")
+		}
+		namespaces = append(namespaces, asc.namespace)
+	}
+
+	aw, err := newAPIWatcher(asc.server, ac, proxyURL, proxyAC, sdc.Role, namespaces, sdc.Selectors, sdc.AttachMetadata.Node)
+	if err != nil {
+		return nil, err
+	}
+	return &apiConfig{
+		aw: aw,
+	}, nil
+}
+
+// getAPIServerConfig returns the address of Kubernetes API server and the auth options for it.
+//
+// The options are taken from `kubeconfig_file` if it is set, from `api_server` and the http client options if `api_server` is set,
+// otherwise the in-cluster config based on the service account of the pod is used.
+func getAPIServerConfig(sdc *SDConfig, baseDir string) (*apiServerConfig, error) {
+	if sdc.KubeConfigFile != "" {
+		if sdc.APIServer != "" {
+			return nil, fmt.Errorf("`api_server` cannot be set together with `kubeconfig_file`")
+		}
+		asc, err := loadKubeConfig(fs.GetFilepath(baseDir, sdc.KubeConfigFile))
+		if err != nil {
+			return nil, err
+		}
+		asc.opts.Headers = sdc.HTTPClientConfig.Headers
+		if asc.namespace == "" {
+			asc.namespace = readOwnNamespace()
+		}
+		return asc, nil
+	}
+
+	if sdc.APIServer != "" {
+		hcc := &sdc.HTTPClientConfig
+		return &apiServerConfig{
+			server:    strings.TrimSuffix(sdc.APIServer, "/"),
+			namespace: readOwnNamespace(),
+			opts: &promauth.Options{
+				BaseDir:         baseDir,
+				Authorization:   hcc.Authorization,
+				BasicAuth:       hcc.BasicAuth,
+				BearerToken:     hcc.BearerToken.String(),
+				BearerTokenFile: hcc.BearerTokenFile,
+				OAuth2:          hcc.OAuth2,
+				TLSConfig:       hcc.TLSConfig,
+				Headers:         hcc.Headers,
+			},
+		}, nil
+	}
+
+	host := os.Getenv("KUBERNETES_SERVICE_HOST")
+	port := os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("either `api_server` or `kubeconfig_file` must be set when cprobe runs outside Kubernetes; " +
+			"KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT env vars are missing")
+	}
+	tlsConfig := sdc.HTTPClientConfig.TLSConfig
+	if tlsConfig == nil {
+		tlsConfig = &promauth.TLSConfig{
+			CAFile: filepath.Join(serviceAccountDir, "ca.crt"),
+		}
+	}
+	return &apiServerConfig{
+		server:    "https://" + net.JoinHostPort(host, port),
+		namespace: readOwnNamespace(),
+		opts: &promauth.Options{
+			BaseDir:         baseDir,
+			BearerTokenFile: filepath.Join(serviceAccountDir, "token"),
+			TLSConfig:       tlsConfig,
+			Headers:         sdc.HTTPClientConfig.Headers,
+		},
+	}, nil
+}
+
+// readOwnNamespace returns the namespace of the pod cprobe runs in or an empty string if cprobe runs outside Kubernetes.
+func readOwnNamespace() string {
+	data, err := os.ReadFile(filepath.Join(serviceAccountDir, "namespace"))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
@@ -0,0 +1,599 @@
+package kubernetes
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/cprobe/cprobe/lib/logger"
+	"github.com/cprobe/cprobe/lib/promauth"
+	"github.com/cprobe/cprobe/lib/promutils"
+	"github.com/cprobe/cprobe/lib/proxy"
+)
+
+const (
+	// listLimit is the maximum number of objects returned by a single LIST request.
+	listLimit = 500
+
+	// listTimeout is the maximum duration for a single LIST request.
+	listTimeout = time.Minute
+
+	// watchTimeout is the duration after which Kubernetes API server closes the WATCH request.
+	// The request is re-opened from the last seen resourceVersion after that.
+	watchTimeout = 10 * time.Minute
+)
+
+// errResourceVersionExpired is returned when the resourceVersion passed to WATCH request is too old.
+// All the objects must be re-listed in this case.
+var errResourceVersionExpired = errors.New("resourceVersion is too old")
+
+// apiWatcher lists and watches Kubernetes objects needed for generating targets for a single `kubernetes_sd_config`.
+type apiWatcher struct {
+	role               string
+	apiServer          string
+	namespaces         []string
+	selectors          []Selector
+	attachNodeMetadata bool
+
+	client     *http.Client
+	setHeaders func(req *http.Request) error
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu sync.Mutex
+	// watchers contains urlWatcher per role and namespace. The key is `role/namespace`.
+	watchers map[string]*urlWatcher
+}
+
+func newAPIWatcher(apiServer string, ac *promauth.Config, proxyURL *proxy.URL, proxyAC *promauth.Config, role string,
+	namespaces []string, selectors []Selector, attachNodeMetadata bool) (*apiWatcher, error) {
+	u, err := url.Parse(apiServer)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse api_server=%q: %w", apiServer, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported scheme in api_server=%q; supported schemes: http, https", apiServer)
+	}
+	tr := &http.Transport{
+		TLSHandshakeTimeout: 10 * time.Second,
+		MaxIdleConnsPerHost: 100,
+	}
+	if u.Scheme == "https" {
+		tlsCfg, err := ac.NewTLSConfig()
+		if err != nil {
+			return nil, fmt.Errorf("cannot initialize tls config: %w", err)
+		}
+		tr.TLSClientConfig = tlsCfg
+	}
+	if pu := proxyURL.GetURL(); pu != nil {
+		tr.Proxy = http.ProxyURL(pu)
+	}
+	setHeaders := func(req *http.Request) error {
+		if ac != nil {
+			if err := ac.SetHeaders(req, true); err != nil {
+				return err
+			}
+		}
+		if proxyAC != nil {
+			return proxyURL.SetHeaders(proxyAC, req)
+		}
+		return nil
+	}
+	if len(namespaces) == 0 {
+		// An empty namespace means all the namespaces.
+		namespaces = []string{""}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	aw := &apiWatcher{
+		role:               role,
+		apiServer:          apiServer,
+		namespaces:         namespaces,
+		selectors:          selectors,
+		attachNodeMetadata: attachNodeMetadata,
+		client: &http.Client{
+			// There is no client-side timeout, since WATCH requests are long-living.
+			// Requests are canceled via context instead.
+			Transport: tr,
+		},
+		setHeaders: setHeaders,
+		ctx:        ctx,
+		cancel:     cancel,
+		watchers:   make(map[string]*urlWatcher),
+	}
+	return aw, nil
+}
+
+// getLabels returns labels for the targets of aw.role.
+//
+// The objects are listed at the first call, and then they are kept up to date by watchers running in background.
+func (aw *apiWatcher) getLabels() ([]*promutils.Labels, error) {
+	if err := aw.startWatchers(); err != nil {
+		return nil, err
+	}
+	var objs []object
+	for _, uw := range aw.getWatchers(aw.role) {
+		objs = uw.appendObjects(objs)
+	}
+	sort.Slice(objs, func(i, j int) bool {
+		return objs[i].metadata().key() < objs[j].metadata().key()
+	})
+	var ms []*promutils.Labels
+	for _, o := range objs {
+		ms = append(ms, o.getTargetLabels(aw)...)
+	}
+	return ms, nil
+}
+
+// startWatchers lists and starts watching all the objects needed for aw.role if this isn't done yet.
+func (aw *apiWatcher) startWatchers() error {
+	aw.mu.Lock()
+	defer aw.mu.Unlock()
+	if aw.ctx.Err() != nil {
+		return fmt.Errorf("kubernetes_sd_config is already stopped")
+	}
+	for _, role := range aw.getDependentRoles() {
+		namespaces := aw.namespaces
+		if role == roleNode {
+			// Nodes aren't namespaced.
+			namespaces = []string{""}
+		}
+		for _, ns := range namespaces {
+			key := role + "/" + ns
+			if aw.watchers[key] != nil {
+				continue
+			}
+			uw := newURLWatcher(aw, role, ns)
+			if err := uw.reloadObjects(); err != nil {
+				return err
+			}
+			aw.watchers[key] = uw
+			aw.wg.Add(1)
+			go func() {
+				defer aw.wg.Done()
+				uw.watchForUpdates()
+			}()
+		}
+	}
+	return nil
+}
+
+// getDependentRoles returns aw.role plus the roles of the objects needed for generating labels for aw.role.
+func (aw *apiWatcher) getDependentRoles() []string {
+	roles := []string{aw.role}
+	switch aw.role {
+	case roleEndpoints, roleEndpointSlice:
+		roles = append(roles, rolePod, roleService)
+	}
+	if aw.attachNodeMetadata {
+		switch aw.role {
+		case rolePod, roleEndpoints, roleEndpointSlice:
+			roles = append(roles, roleNode)
+		}
+	}
+	return roles
+}
+
+func (aw *apiWatcher) getWatchers(role string) []*urlWatcher {
+	aw.mu.Lock()
+	defer aw.mu.Unlock()
+	var uws []*urlWatcher
+	for _, uw := range aw.watchers {
+		if uw.role == role {
+			uws = append(uws, uw)
+		}
+	}
+	return uws
+}
+
+// getObject returns the object with the given role, namespace and name or nil if it isn't found.
+func (aw *apiWatcher) getObject(role, namespace, name string) object {
+	key := namespace + "/" + name
+	for _, uw := range aw.getWatchers(role) {
+		if o := uw.getObject(key); o != nil {
+			return o
+		}
+	}
+	return nil
+}
+
+// mustStop stops all the watchers for aw and waits until they are finished.
+func (aw *apiWatcher) mustStop() {
+	aw.mu.Lock()
+	aw.cancel()
+	aw.watchers = make(map[string]*urlWatcher)
+	aw.mu.Unlock()
+	aw.wg.Wait()
+}
+
+// getSelectors returns labelSelector and fieldSelector query args for the given role.
+func (aw *apiWatcher) getSelectors(role string) url.Values {
+	var labelSelectors, fieldSelectors []string
+	for _, s := range aw.selectors {
+		if s.Role != role {
+			continue
+		}
+		if s.Label != "" {
+			labelSelectors = append(labelSelectors, s.Label)
+		}
+		if s.Field != "" {
+			fieldSelectors = append(fieldSelectors, s.Field)
+		}
+	}
+	args := url.Values{}
+	if len(labelSelectors) > 0 {
+		args.Set("labelSelector", strings.Join(labelSelectors, ","))
+	}
+	if len(fieldSelectors) > 0 {
+		args.Set("fieldSelector", strings.Join(fieldSelectors, ","))
+	}
+	return args
+}
+
+// urlWatcher keeps up to date the objects for the given role and namespace.
+type urlWatcher struct {
+	aw        *apiWatcher
+	role      string
+	namespace string
+	apiPath   string
+
+	mu              sync.Mutex
+	objects         map[string]object
+	resourceVersion string
+
+	listRequests  *metrics.Counter
+	watchRequests *metrics.Counter
+	watchErrors   *metrics.Counter
+	objectUpdates *metrics.Counter
+}
+
+func newURLWatcher(aw *apiWatcher, role, namespace string) *urlWatcher {
+	return &urlWatcher{
+		aw:        aw,
+		role:      role,
+		namespace: namespace,
+		apiPath:   getAPIPath(role, namespace),
+		objects:   make(map[string]object),
+
+		listRequests:  metrics.GetOrCreateCounter(fmt.Sprintf(`cprobe_discovery_kubernetes_list_requests_total{role=%q}`, role)),
+		watchRequests: metrics.GetOrCreateCounter(fmt.Sprintf(`cprobe_discovery_kubernetes_watch_requests_total{role=%q}`, role)),
+		watchErrors:   metrics.GetOrCreateCounter(fmt.Sprintf(`cprobe_discovery_kubernetes_watch_errors_total{role=%q}`, role)),
+		objectUpdates: metrics.GetOrCreateCounter(fmt.Sprintf(`cprobe_discovery_kubernetes_object_updates_total{role=%q}`, role)),
+	}
+}
+
+func (uw *urlWatcher) appendObjects(dst []object) []object {
+	uw.mu.Lock()
+	defer uw.mu.Unlock()
+	for _, o := range uw.objects {
+		dst = append(dst, o)
+	}
+	return dst
+}
+
+func (uw *urlWatcher) getObject(key string) object {
+	uw.mu.Lock()
+	defer uw.mu.Unlock()
+	return uw.objects[key]
+}
+
+// reloadObjects lists all the objects for uw and replaces the cached objects with them.
+func (uw *urlWatcher) reloadObjects() error {
+	uw.listRequests.Inc()
+	objects := make(map[string]object)
+	var resourceVersion, continueToken string
+	for {
+		args := uw.aw.getSelectors(uw.role)
+		args.Set("limit", fmt.Sprint(listLimit))
+		if continueToken != "" {
+			args.Set("continue", continueToken)
+		}
+		data, err := uw.doListRequest(args)
+		if err != nil {
+			return err
+		}
+		lm, err := parseObjectList(uw.role, data, objects)
+		if err != nil {
+			return fmt.Errorf("cannot parse objects from %s: %w", uw.apiPath, err)
+		}
+		resourceVersion = lm.ResourceVersion
+		continueToken = lm.Continue
+		if continueToken == "" {
+			break
+		}
+	}
+	uw.mu.Lock()
+	uw.objects = objects
+	uw.resourceVersion = resourceVersion
+	uw.mu.Unlock()
+	return nil
+}
+
+func (uw *urlWatcher) doListRequest(args url.Values) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(uw.aw.ctx, listTimeout)
+	defer cancel()
+	resp, err := uw.doRequest(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read response from %s: %w", uw.apiPath, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code for %s: %d; want %d; response body: %q", uw.apiPath, resp.StatusCode, http.StatusOK, data)
+	}
+	return data, nil
+}
+
+func (uw *urlWatcher) doRequest(ctx context.Context, args url.Values) (*http.Response, error) {
+	requestURL := uw.aw.apiServer + uw.apiPath + "?" + args.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, requestURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create request for %s: %w", requestURL, err)
+	}
+	if err := uw.aw.setHeaders(req); err != nil {
+		return nil, fmt.Errorf("cannot set request headers for %s: %w", requestURL, err)
+	}
+	resp, err := uw.aw.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("cannot perform request to %s: %w", requestURL, err)
+	}
+	return resp, nil
+}
+
+// watchForUpdates watches for object updates starting from uw.resourceVersion until uw.aw is stopped.
+func (uw *urlWatcher) watchForUpdates() {
+	ctx := uw.aw.ctx
+	backoff := time.Second
+	for ctx.Err() == nil {
+		err := uw.watchOnce()
+		if ctx.Err() != nil {
+			return
+		}
+		if errors.Is(err, errResourceVersionExpired) {
+			err = uw.reloadObjects()
+		}
+		if err == nil {
+			backoff = time.Second
+			continue
+		}
+		uw.watchErrors.Inc()
+		logger.Errorf("kubernetes_sd_config: error when watching %s at %s: %s; retrying in %s", uw.apiPath, uw.aw.apiServer, err, backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff < time.Minute {
+			backoff *= 2
+		}
+	}
+}
+
+// watchEvent is a single event from Kubernetes WATCH API.
+//
+// See https://kubernetes.io/docs/reference/using-api/api-concepts/#efficient-detection-of-changes
+type watchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// status is returned in ERROR watch events.
+//
+// See https://kubernetes.io/docs/reference/generated/kubernetes-api/v1.27/#status-v1-meta
+type status struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// bookmark is sent in BOOKMARK watch events.
+type bookmark struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+}
+
+// watchOnce performs a single WATCH request and applies the received events until the request is closed.
+func (uw *urlWatcher) watchOnce() error {
+	uw.watchRequests.Inc()
+	uw.mu.Lock()
+	resourceVersion := uw.resourceVersion
+	uw.mu.Unlock()
+
+	args := uw.aw.getSelectors(uw.role)
+	args.Set("watch", "1")
+	args.Set("allowWatchBookmarks", "true")
+	args.Set("resourceVersion", resourceVersion)
+	args.Set("timeoutSeconds", fmt.Sprint(int(watchTimeout.Seconds())))
+	resp, err := uw.doRequest(uw.aw.ctx, args)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusGone {
+		return errResourceVersionExpired
+	}
+	if resp.StatusCode != http.StatusOK {
+		data, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected status code: %d; want %d; response body: %q", resp.StatusCode, http.StatusOK, data)
+	}
+	d := json.NewDecoder(resp.Body)
+	for {
+		var we watchEvent
+		if err := d.Decode(&we); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("cannot read watch event: %w", err)
+		}
+		if err := uw.applyWatchEvent(&we); err != nil {
+			return err
+		}
+	}
+}
+
+func (uw *urlWatcher) applyWatchEvent(we *watchEvent) error {
+	switch we.Type {
+	case "ADDED", "MODIFIED", "DELETED":
+		o, err := parseObject(uw.role, we.Object)
+		if err != nil {
+			return fmt.Errorf("cannot parse %s event: %w", we.Type, err)
+		}
+		om := o.metadata()
+		uw.mu.Lock()
+		if we.Type == "DELETED" {
+			delete(uw.objects, om.key())
+		} else {
+			uw.objects[om.key()] = o
+		}
+		uw.resourceVersion = om.ResourceVersion
+		uw.mu.Unlock()
+		uw.objectUpdates.Inc()
+	case "BOOKMARK":
+		var bm bookmark
+		if err := json.Unmarshal(we.Object, &bm); err != nil {
+			return fmt.Errorf("cannot parse BOOKMARK event: %w", err)
+		}
+		uw.mu.Lock()
+		uw.resourceVersion = bm.Metadata.ResourceVersion
+		uw.mu.Unlock()
+	case "ERROR":
+		var st status
+		if err := json.Unmarshal(we.Object, &st); err != nil {
+			return fmt.Errorf("cannot parse ERROR event: %w", err)
+		}
+		if st.Code == http.StatusGone {
+			return errResourceVersionExpired
+		}
+		return fmt.Errorf("ERROR event with code %d: %s", st.Code, st.Message)
+	default:
+		return fmt.Errorf("unexpected watch event type: %q", we.Type)
+	}
+	return nil
+}
+
+// getAPIPath returns the path for listing and watching objects with the given role in the given namespace.
+//
+// An empty namespace means all the namespaces.
+func getAPIPath(role, namespace string) string {
+	var prefix, resource string
+	switch role {
+	case rolePod:
+		prefix, resource = "/api/v1", "pods"
+	case roleService:
+		prefix, resource = "/api/v1", "services"
+	case roleEndpoints:
+		prefix, resource = "/api/v1", "endpoints"
+	case roleEndpointSlice:
+		prefix, resource = "/apis/discovery.k8s.io/v1", "endpointslices"
+	case roleNode:
+		prefix, resource = "/api/v1", "nodes"
+	case roleIngress:
+		prefix, resource = "/apis/networking.k8s.io/v1", "ingresses"
+	default:
+		panic(fmt.Errorf("BUG: unexpected role=%q", role))
+	}
+	if namespace == "" {
+		return prefix + "/" + resource
+	}
+	return prefix + "/namespaces/" + url.PathEscape(namespace) + "/" + resource
+}
+
+// parseObjectList parses the list of objects with the given role from data and adds them to dst.
+func parseObjectList(role string, data []byte, dst map[string]object) (*ListMeta, error) {
+	switch role {
+	case rolePod:
+		var l PodList
+		if err := json.Unmarshal(data, &l); err != nil {
+			return nil, err
+		}
+		for _, o := range l.Items {
+			dst[o.Metadata.key()] = o
+		}
+		return &l.Metadata, nil
+	case roleService:
+		var l ServiceList
+		if err := json.Unmarshal(data, &l); err != nil {
+			return nil, err
+		}
+		for _, o := range l.Items {
+			dst[o.Metadata.key()] = o
+		}
+		return &l.Metadata, nil
+	case roleEndpoints:
+		var l EndpointsList
+		if err := json.Unmarshal(data, &l); err != nil {
+			return nil, err
+		}
+		for _, o := range l.Items {
+			dst[o.Metadata.key()] = o
+		}
+		return &l.Metadata, nil
+	case roleEndpointSlice:
+		var l EndpointSliceList
+		if err := json.Unmarshal(data, &l); err != nil {
+			return nil, err
+		}
+		for _, o := range l.Items {
+			dst[o.Metadata.key()] = o
+		}
+		return &l.Metadata, nil
+	case roleNode:
+		var l NodeList
+		if err := json.Unmarshal(data, &l); err != nil {
+			return nil, err
+		}
+		for _, o := range l.Items {
+			dst[o.Metadata.key()] = o
+		}
+		return &l.Metadata, nil
+	case roleIngress:
+		var l IngressList
+		if err := json.Unmarshal(data, &l); err != nil {
+			return nil, err
+		}
+		for _, o := range l.Items {
+			dst[o.Metadata.key()] = o
+		}
+		return &l.Metadata, nil
+	default:
+		return nil, fmt.Errorf("BUG: unexpected role=%q", role)
+	}
+}
+
+// parseObject parses a single object with the given role from data.
+func parseObject(role string, data []byte) (object, error) {
+	var o object
+	switch role {
+	case rolePod:
+		o = &Pod{}
+	case roleService:
+		o = &Service{}
+	case roleEndpoints:
+		o = &Endpoints{}
+	case roleEndpointSlice:
+		o = &EndpointSlice{}
+	case roleNode:
+		o = &Node{}
+	case roleIngress:
+		o = &Ingress{}
+	default:
+		return nil, fmt.Errorf("BUG: unexpected role=%q", role)
+	}
+	if err := json.Unmarshal(data, o); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
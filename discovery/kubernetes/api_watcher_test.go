@@ -0,0 +1,170 @@
+package kubernetes
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cprobe/cprobe/lib/promauth"
+)
+
+func TestGetAPIPath(t *testing.T) {
+	f := func(role, namespace, want string) {
+		t.Helper()
+		if got := getAPIPath(role, namespace); got != want {
+			t.Fatalf("unexpected path for role=%q, namespace=%q; got %q; want %q", role, namespace, got, want)
+		}
+	}
+	f(rolePod, "", "/api/v1/pods")
+	f(rolePod, "default", "/api/v1/namespaces/default/pods")
+	f(roleService, "kube-system", "/api/v1/namespaces/kube-system/services")
+	f(roleEndpoints, "", "/api/v1/endpoints")
+	f(roleEndpointSlice, "default", "/apis/discovery.k8s.io/v1/namespaces/default/endpointslices")
+	f(roleNode, "", "/api/v1/nodes")
+	f(roleIngress, "default", "/apis/networking.k8s.io/v1/namespaces/default/ingresses")
+}
+
+func TestGetSelectors(t *testing.T) {
+	aw := &apiWatcher{
+		selectors: []Selector{
+			{Role: rolePod, Label: "app=foo"},
+			{Role: rolePod, Label: "env!=dev", Field: "status.phase=Running"},
+			{Role: roleService, Label: "app=bar"},
+		},
+	}
+	if got, want := aw.getSelectors(rolePod).Encode(), "fieldSelector=status.phase%3DRunning&labelSelector=app%3Dfoo%2Cenv%21%3Ddev"; got != want {
+		t.Fatalf("unexpected selectors for pods; got %q; want %q", got, want)
+	}
+	if got := aw.getSelectors(roleNode).Encode(); got != "" {
+		t.Fatalf("unexpected selectors for nodes; got %q; want empty", got)
+	}
+}
+
+func testPodJSON(name, ip string) string {
+	return fmt.Sprintf(`{"metadata": {"name": %q, "namespace": "default"}, "spec": {"containers": [{"name": "app", "ports": [{"containerPort": 8080}]}]}, "status": {"podIP": %q}}`, name, ip)
+}
+
+// TestAPIWatcher checks list with pagination, relisting on expired resourceVersion and applying watch events against a fake API server.
+func TestAPIWatcher(t *testing.T) {
+	var mu sync.Mutex
+	var requests []string
+	listCalls := 0
+	watchCalls := 0
+	watchDone := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/namespaces/default/pods" {
+			http.Error(w, "unexpected path", http.StatusNotFound)
+			return
+		}
+		if got := r.Header.Get("Authorization"); got != "Bearer secret-token" {
+			http.Error(w, "unexpected Authorization header: "+got, http.StatusUnauthorized)
+			return
+		}
+		q := r.URL.Query()
+		mu.Lock()
+		requests = append(requests, q.Encode())
+		if q.Get("watch") == "" {
+			listCalls++
+			n := listCalls
+			mu.Unlock()
+			switch {
+			case n == 1:
+				fmt.Fprintf(w, `{"metadata": {"resourceVersion": "10", "continue": "page2"}, "items": [%s]}`, testPodJSON("a", "10.0.0.1"))
+			case n == 2:
+				fmt.Fprintf(w, `{"metadata": {"resourceVersion": "10"}, "items": [%s]}`, testPodJSON("b", "10.0.0.2"))
+			default:
+				fmt.Fprintf(w, `{"metadata": {"resourceVersion": "20"}, "items": [%s, %s, %s]}`,
+					testPodJSON("a", "10.0.0.1"), testPodJSON("b", "10.0.0.2"), testPodJSON("c", "10.0.0.3"))
+			}
+			return
+		}
+		watchCalls++
+		n := watchCalls
+		mu.Unlock()
+		switch n {
+		case 1:
+			// The resourceVersion from the list is too old.
+			fmt.Fprintf(w, `{"type": "ERROR", "object": {"code": 410, "message": "too old resource version"}}`+"\n")
+		case 2:
+			fmt.Fprintf(w, `{"type": "DELETED", "object": {"metadata": {"name": "a", "namespace": "default", "resourceVersion": "21"}}}`+"\n")
+			fmt.Fprintf(w, `{"type": "BOOKMARK", "object": {"metadata": {"resourceVersion": "22"}}}`+"\n")
+			w.(http.Flusher).Flush()
+			close(watchDone)
+			<-r.Context().Done()
+		default:
+			<-r.Context().Done()
+		}
+	}))
+	defer srv.Close()
+
+	sdc := &SDConfig{
+		APIServer: srv.URL,
+		Role:      rolePod,
+		HTTPClientConfig: promauth.HTTPClientConfig{
+			BearerToken: promauth.NewSecret("secret-token"),
+		},
+		Namespaces: Namespaces{
+			Names: []string{"default"},
+		},
+	}
+	defer sdc.MustStop()
+
+	getAddrs := func() string {
+		t.Helper()
+		labelss, err := sdc.GetLabels("")
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		var addrs []string
+		for _, labels := range labelss {
+			addrs = append(addrs, labels.Get("__address__"))
+		}
+		sort.Strings(addrs)
+		return fmt.Sprint(addrs)
+	}
+
+	// The first call lists all the pages synchronously.
+	if got, want := getAddrs(), "[10.0.0.1:8080 10.0.0.2:8080]"; got != want {
+		t.Fatalf("unexpected targets after list; got %s; want %s", got, want)
+	}
+
+	select {
+	case <-watchDone:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("timeout when waiting for watch events")
+	}
+	want := "[10.0.0.2:8080 10.0.0.3:8080]"
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		got := getAddrs()
+		if got == want {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected targets after watch events; got %s; want %s", got, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	wantRequests := []string{
+		"limit=500",
+		"continue=page2&limit=500",
+		"allowWatchBookmarks=true&resourceVersion=10&timeoutSeconds=600&watch=1",
+		"limit=500",
+		"allowWatchBookmarks=true&resourceVersion=20&timeoutSeconds=600&watch=1",
+	}
+	if len(requests) < len(wantRequests) {
+		t.Fatalf("unexpected requests; got %q; want %q", requests, wantRequests)
+	}
+	for i, want := range wantRequests {
+		if requests[i] != want {
+			t.Fatalf("unexpected request #%d; got %q; want %q", i, requests[i], want)
+		}
+	}
+}
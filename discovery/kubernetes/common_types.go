@@ -0,0 +1,74 @@
+package kubernetes
+
+import (
+	"github.com/cprobe/cprobe/lib/discoveryutils"
+	"github.com/cprobe/cprobe/lib/promutils"
+)
+
+// ObjectMeta represents ObjectMeta from k8s API.
+//
+// See https://kubernetes.io/docs/reference/generated/kubernetes-api/v1.27/#objectmeta-v1-meta
+type ObjectMeta struct {
+	Name            string            `json:"name"`
+	Namespace       string            `json:"namespace"`
+	UID             string            `json:"uid"`
+	ResourceVersion string            `json:"resourceVersion"`
+	Labels          map[string]string `json:"labels"`
+	Annotations     map[string]string `json:"annotations"`
+	OwnerReferences []OwnerReference  `json:"ownerReferences"`
+}
+
+func (om *ObjectMeta) key() string {
+	return om.Namespace + "/" + om.Name
+}
+
+// ListMeta is a Kubernetes list metadata.
+//
+// See https://kubernetes.io/docs/reference/generated/kubernetes-api/v1.27/#listmeta-v1-meta
+type ListMeta struct {
+	ResourceVersion string `json:"resourceVersion"`
+	Continue        string `json:"continue"`
+}
+
+// OwnerReference represents OwnerReference from k8s API.
+//
+// See https://kubernetes.io/docs/reference/generated/kubernetes-api/v1.27/#ownerreference-v1-meta
+type OwnerReference struct {
+	Name       string `json:"name"`
+	Kind       string `json:"kind"`
+	Controller bool   `json:"controller"`
+}
+
+// ObjectReference represents ObjectReference from k8s API.
+//
+// See https://kubernetes.io/docs/reference/generated/kubernetes-api/v1.27/#objectreference-v1-core
+type ObjectReference struct {
+	Kind      string `json:"kind"`
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+}
+
+// object is a Kubernetes object such as Pod or Service.
+type object interface {
+	// metadata returns the metadata of the object.
+	metadata() *ObjectMeta
+
+	// getTargetLabels returns labels for the targets of the object.
+	//
+	// aw is used for looking up the related objects, e.g. pods and services for endpoints.
+	getTargetLabels(aw *apiWatcher) []*promutils.Labels
+}
+
+// registerLabelsAndAnnotations adds labels and annotations from om to m with the given prefix.
+func (om *ObjectMeta) registerLabelsAndAnnotations(prefix string, m *promutils.Labels) {
+	for k, v := range om.Labels {
+		name := discoveryutils.SanitizeLabelName(k)
+		m.Add(prefix+"_label_"+name, v)
+		m.Add(prefix+"_labelpresent_"+name, "true")
+	}
+	for k, v := range om.Annotations {
+		name := discoveryutils.SanitizeLabelName(k)
+		m.Add(prefix+"_annotation_"+name, v)
+		m.Add(prefix+"_annotationpresent_"+name, "true")
+	}
+}
@@ -0,0 +1,203 @@
+package kubernetes
+
+import (
+	"strconv"
+
+	"github.com/cprobe/cprobe/lib/discoveryutils"
+	"github.com/cprobe/cprobe/lib/promutils"
+)
+
+// EndpointsList implements k8s endpoints list.
+//
+// See https://kubernetes.io/docs/reference/generated/kubernetes-api/v1.27/#endpointslist-v1-core
+type EndpointsList struct {
+	Metadata ListMeta     `json:"metadata"`
+	Items    []*Endpoints `json:"items"`
+}
+
+// Endpoints implements k8s endpoints.
+//
+// See https://kubernetes.io/docs/reference/generated/kubernetes-api/v1.27/#endpoints-v1-core
+type Endpoints struct {
+	Metadata ObjectMeta       `json:"metadata"`
+	Subsets  []EndpointSubset `json:"subsets"`
+}
+
+// EndpointSubset implements k8s endpoint subset.
+//
+// See https://kubernetes.io/docs/reference/generated/kubernetes-api/v1.27/#endpointsubset-v1-core
+type EndpointSubset struct {
+	Addresses         []EndpointAddress `json:"addresses"`
+	NotReadyAddresses []EndpointAddress `json:"notReadyAddresses"`
+	Ports             []EndpointPort    `json:"ports"`
+}
+
+// EndpointAddress implements k8s endpoint address.
+//
+// See https://kubernetes.io/docs/reference/generated/kubernetes-api/v1.27/#endpointaddress-v1-core
+type EndpointAddress struct {
+	Hostname  string          `json:"hostname"`
+	IP        string          `json:"ip"`
+	NodeName  string          `json:"nodeName"`
+	TargetRef ObjectReference `json:"targetRef"`
+}
+
+// EndpointPort implements k8s endpoint port.
+//
+// See https://kubernetes.io/docs/reference/generated/kubernetes-api/v1.27/#endpointport-v1-discovery-k8s-io
+type EndpointPort struct {
+	AppProtocol string `json:"appProtocol"`
+	Name        string `json:"name"`
+	Port        int    `json:"port"`
+	Protocol    string `json:"protocol"`
+}
+
+func (eps *Endpoints) metadata() *ObjectMeta {
+	return &eps.Metadata
+}
+
+// getTargetLabels returns labels for each endpoint in eps.
+//
+// The labels of the service with the same name and the labels of the pod the endpoint points to are added.
+// Container ports of such pods, which aren't exposed via eps, are returned as separate targets like Prometheus does.
+//
+// See https://prometheus.io/docs/prometheus/latest/configuration/configuration/#endpoints
+func (eps *Endpoints) getTargetLabels(aw *apiWatcher) []*promutils.Labels {
+	var svc *Service
+	if o := aw.getObject(roleService, eps.Metadata.Namespace, eps.Metadata.Name); o != nil {
+		svc = o.(*Service)
+	}
+	pps := newPodPorts()
+	var ms []*promutils.Labels
+	for _, ess := range eps.Subsets {
+		for _, epp := range ess.Ports {
+			ms = eps.appendAddressLabels(ms, aw, pps, ess.Addresses, epp, svc, "true")
+			ms = eps.appendAddressLabels(ms, aw, pps, ess.NotReadyAddresses, epp, svc, "false")
+		}
+	}
+	return pps.appendUnseenPortLabels(ms, aw, func(m *promutils.Labels) {
+		m.Add("__meta_kubernetes_namespace", eps.Metadata.Namespace)
+		m.Add("__meta_kubernetes_endpoints_name", eps.Metadata.Name)
+		eps.Metadata.registerLabelsAndAnnotations("__meta_kubernetes_endpoints", m)
+		if svc != nil {
+			svc.appendCommonLabels(m)
+		}
+	})
+}
+
+func (eps *Endpoints) appendAddressLabels(ms []*promutils.Labels, aw *apiWatcher, pps *podPorts, eas []EndpointAddress,
+	epp EndpointPort, svc *Service, ready string) []*promutils.Labels {
+	for _, ea := range eas {
+		m := promutils.NewLabels(32)
+		m.Add("__address__", discoveryutils.JoinHostPort(ea.IP, epp.Port))
+		m.Add("__meta_kubernetes_namespace", eps.Metadata.Namespace)
+		m.Add("__meta_kubernetes_endpoints_name", eps.Metadata.Name)
+		m.Add("__meta_kubernetes_endpoint_ready", ready)
+		m.Add("__meta_kubernetes_endpoint_port_name", epp.Name)
+		m.Add("__meta_kubernetes_endpoint_port_protocol", epp.Protocol)
+		if epp.AppProtocol != "" {
+			m.Add("__meta_kubernetes_endpoint_port_app_protocol", epp.AppProtocol)
+		}
+		if ea.TargetRef.Kind != "" {
+			m.Add("__meta_kubernetes_endpoint_address_target_kind", ea.TargetRef.Kind)
+			m.Add("__meta_kubernetes_endpoint_address_target_name", ea.TargetRef.Name)
+		}
+		if ea.NodeName != "" {
+			m.Add("__meta_kubernetes_endpoint_node_name", ea.NodeName)
+		}
+		if ea.Hostname != "" {
+			m.Add("__meta_kubernetes_endpoint_hostname", ea.Hostname)
+		}
+		eps.Metadata.registerLabelsAndAnnotations("__meta_kubernetes_endpoints", m)
+		if svc != nil {
+			svc.appendCommonLabels(m)
+		}
+		if p := getTargetPod(aw, ea.TargetRef, eps.Metadata.Namespace); p != nil {
+			pps.appendPodLabels(m, aw, p, epp.Port)
+		}
+		ms = append(ms, m)
+	}
+	return ms
+}
+
+// getTargetPod returns the pod ref points to or nil if ref doesn't point to a pod or the pod is missing.
+func getTargetPod(aw *apiWatcher, ref ObjectReference, namespace string) *Pod {
+	if ref.Kind != "Pod" {
+		return nil
+	}
+	if ref.Namespace != "" {
+		namespace = ref.Namespace
+	}
+	o := aw.getObject(rolePod, namespace, ref.Name)
+	if o == nil {
+		return nil
+	}
+	return o.(*Pod)
+}
+
+// podPorts remembers container ports of pods, which are exposed via endpoints or endpointslices.
+type podPorts struct {
+	// pods contains pods in the order they are seen, so the generated labels are stable.
+	pods  []*Pod
+	ports map[*Pod]map[int]bool
+}
+
+func newPodPorts() *podPorts {
+	return &podPorts{
+		ports: make(map[*Pod]map[int]bool),
+	}
+}
+
+// appendPodLabels adds labels for p and for its container with the given port to m.
+func (pps *podPorts) appendPodLabels(m *promutils.Labels, aw *apiWatcher, p *Pod, port int) {
+	p.appendCommonLabels(m, aw)
+	ports := pps.ports[p]
+	if ports == nil {
+		ports = make(map[int]bool)
+		pps.ports[p] = ports
+		pps.pods = append(pps.pods, p)
+	}
+	for i := range p.Spec.Containers {
+		c := &p.Spec.Containers[i]
+		for j := range c.Ports {
+			cp := &c.Ports[j]
+			if cp.ContainerPort == port {
+				ports[port] = true
+				p.appendContainerLabels(m, c, cp, false)
+				return
+			}
+		}
+	}
+}
+
+// appendUnseenPortLabels returns labels for container ports of the seen pods, which aren't exposed via endpoints.
+//
+// appendCommonLabels must add the labels of the endpoints or endpointslice object.
+func (pps *podPorts) appendUnseenPortLabels(ms []*promutils.Labels, aw *apiWatcher, appendCommonLabels func(m *promutils.Labels)) []*promutils.Labels {
+	for _, p := range pps.pods {
+		ports := pps.ports[p]
+		for i := range p.Spec.Containers {
+			c := &p.Spec.Containers[i]
+			for j := range c.Ports {
+				cp := &c.Ports[j]
+				if ports[cp.ContainerPort] {
+					continue
+				}
+				m := promutils.NewLabels(32)
+				m.Add("__address__", discoveryutils.JoinHostPort(p.Status.PodIP, cp.ContainerPort))
+				appendCommonLabels(m)
+				p.appendCommonLabels(m, aw)
+				p.appendContainerLabels(m, c, cp, false)
+				ms = append(ms, m)
+			}
+		}
+	}
+	return ms
+}
+
+func formatOptionalBool(b *bool) string {
+	if b == nil {
+		return "unknown"
+	}
+	return strconv.FormatBool(*b)
+}
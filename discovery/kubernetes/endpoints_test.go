@@ -0,0 +1,93 @@
+package kubernetes
+
+import (
+	"testing"
+
+	"github.com/cprobe/cprobe/lib/discoveryutils"
+	"github.com/cprobe/cprobe/lib/promutils"
+)
+
+func TestEndpointsGetTargetLabels(t *testing.T) {
+	aw := newTestAPIWatcher(t, roleEndpoints, false, map[string][]string{
+		roleEndpoints: {`{
+  "metadata": {"name": "etcd", "namespace": "kube-system"},
+  "subsets": [
+    {
+      "addresses": [
+        {"ip": "172.17.0.2", "nodeName": "m01", "targetRef": {"kind": "Pod", "name": "etcd-m01", "namespace": "kube-system"}}
+      ],
+      "notReadyAddresses": [
+        {"ip": "172.17.0.3", "hostname": "etcd-1"}
+      ],
+      "ports": [{"name": "metrics", "port": 2381, "protocol": "TCP"}]
+    }
+  ]
+}`},
+		rolePod:     {testPod},
+		roleService: {testService},
+	})
+	labelss, err := aw.getLabels()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	serviceLabels := map[string]string{
+		"__meta_kubernetes_namespace":                "kube-system",
+		"__meta_kubernetes_endpoints_name":           "etcd",
+		"__meta_kubernetes_service_name":             "etcd",
+		"__meta_kubernetes_service_type":             "ClusterIP",
+		"__meta_kubernetes_service_cluster_ip":       "10.96.0.10",
+		"__meta_kubernetes_service_label_app":        "etcd",
+		"__meta_kubernetes_service_labelpresent_app": "true",
+	}
+	podLabels := map[string]string{
+		"__meta_kubernetes_pod_name":                                        "etcd-m01",
+		"__meta_kubernetes_pod_ip":                                          "172.17.0.2",
+		"__meta_kubernetes_pod_ready":                                       "true",
+		"__meta_kubernetes_pod_phase":                                       "Running",
+		"__meta_kubernetes_pod_node_name":                                   "m01",
+		"__meta_kubernetes_pod_host_ip":                                     "192.168.0.10",
+		"__meta_kubernetes_pod_uid":                                         "9d328156-75d1-411a-bdd0-aeacb53a38de",
+		"__meta_kubernetes_pod_controller_kind":                             "Node",
+		"__meta_kubernetes_pod_controller_name":                             "m01",
+		"__meta_kubernetes_pod_label_component":                             "etcd",
+		"__meta_kubernetes_pod_labelpresent_component":                      "true",
+		"__meta_kubernetes_pod_annotation_kubernetes_io_config_hash":        "3ec2a3bc",
+		"__meta_kubernetes_pod_annotationpresent_kubernetes_io_config_hash": "true",
+	}
+	merge := func(ms ...map[string]string) *promutils.Labels {
+		result := make(map[string]string)
+		for _, m := range ms {
+			for k, v := range m {
+				result[k] = v
+			}
+		}
+		return promutils.NewLabelsFromMap(result)
+	}
+
+	discoveryutils.TestEqualLabelss(t, labelss, []*promutils.Labels{
+		merge(serviceLabels, podLabels, map[string]string{
+			"__address__":                                    "172.17.0.2:2381",
+			"__meta_kubernetes_endpoint_ready":               "true",
+			"__meta_kubernetes_endpoint_port_name":           "metrics",
+			"__meta_kubernetes_endpoint_port_protocol":       "TCP",
+			"__meta_kubernetes_endpoint_address_target_kind": "Pod",
+			"__meta_kubernetes_endpoint_address_target_name": "etcd-m01",
+			"__meta_kubernetes_endpoint_node_name":           "m01",
+			"__meta_kubernetes_pod_container_image":          "k8s.gcr.io/etcd:3.4.3-0",
+			"__meta_kubernetes_pod_container_name":           "etcd",
+			"__meta_kubernetes_pod_container_init":           "false",
+			"__meta_kubernetes_pod_container_id":             "docker://a28f0800",
+			"__meta_kubernetes_pod_container_port_name":      "metrics",
+			"__meta_kubernetes_pod_container_port_number":    "2381",
+			"__meta_kubernetes_pod_container_port_protocol":  "TCP",
+		}),
+		merge(serviceLabels, map[string]string{
+			"__address__":                              "172.17.0.3:2381",
+			"__meta_kubernetes_endpoint_ready":         "false",
+			"__meta_kubernetes_endpoint_port_name":     "metrics",
+			"__meta_kubernetes_endpoint_port_protocol": "TCP",
+			"__meta_kubernetes_endpoint_hostname":      "etcd-1",
+		}),
+	})
+}
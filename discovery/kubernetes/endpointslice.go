@@ -0,0 +1,120 @@
+package kubernetes
+
+import (
+	"strconv"
+
+	"github.com/cprobe/cprobe/lib/discoveryutils"
+	"github.com/cprobe/cprobe/lib/promutils"
+)
+
+// EndpointSliceList implements k8s endpoint slice list.
+//
+// See https://kubernetes.io/docs/reference/generated/kubernetes-api/v1.27/#endpointslicelist-v1-discovery-k8s-io
+type EndpointSliceList struct {
+	Metadata ListMeta         `json:"metadata"`
+	Items    []*EndpointSlice `json:"items"`
+}
+
+// EndpointSlice implements k8s endpoint slice.
+//
+// See https://kubernetes.io/docs/reference/generated/kubernetes-api/v1.27/#endpointslice-v1-discovery-k8s-io
+type EndpointSlice struct {
+	Metadata    ObjectMeta     `json:"metadata"`
+	Endpoints   []Endpoint     `json:"endpoints"`
+	AddressType string         `json:"addressType"`
+	Ports       []EndpointPort `json:"ports"`
+}
+
+// Endpoint implements k8s endpoint.
+//
+// See https://kubernetes.io/docs/reference/generated/kubernetes-api/v1.27/#endpoint-v1-discovery-k8s-io
+type Endpoint struct {
+	Addresses  []string           `json:"addresses"`
+	Conditions EndpointConditions `json:"conditions"`
+	Hostname   string             `json:"hostname"`
+	NodeName   string             `json:"nodeName"`
+	TargetRef  ObjectReference    `json:"targetRef"`
+	Zone       string             `json:"zone"`
+}
+
+// EndpointConditions implements k8s endpoint conditions.
+//
+// See https://kubernetes.io/docs/reference/generated/kubernetes-api/v1.27/#endpointconditions-v1-discovery-k8s-io
+type EndpointConditions struct {
+	Ready       *bool `json:"ready"`
+	Serving     *bool `json:"serving"`
+	Terminating *bool `json:"terminating"`
+}
+
+func (eps *EndpointSlice) metadata() *ObjectMeta {
+	return &eps.Metadata
+}
+
+// getTargetLabels returns labels for each endpoint address and port in eps.
+//
+// The labels of the service from `kubernetes.io/service-name` label and the labels of the pod the endpoint points to are added.
+//
+// See https://prometheus.io/docs/prometheus/latest/configuration/configuration/#endpointslice
+func (eps *EndpointSlice) getTargetLabels(aw *apiWatcher) []*promutils.Labels {
+	var svc *Service
+	if svcName := eps.Metadata.Labels["kubernetes.io/service-name"]; svcName != "" {
+		if o := aw.getObject(roleService, eps.Metadata.Namespace, svcName); o != nil {
+			svc = o.(*Service)
+		}
+	}
+	pps := newPodPorts()
+	var ms []*promutils.Labels
+	for _, ess := range eps.Endpoints {
+		p := getTargetPod(aw, ess.TargetRef, eps.Metadata.Namespace)
+		for _, epp := range eps.Ports {
+			for _, addr := range ess.Addresses {
+				m := promutils.NewLabels(32)
+				m.Add("__address__", discoveryutils.JoinHostPort(addr, epp.Port))
+				eps.appendCommonLabels(m, svc)
+				eps.appendEndpointLabels(m, ess)
+				m.Add("__meta_kubernetes_endpointslice_port", strconv.Itoa(epp.Port))
+				m.Add("__meta_kubernetes_endpointslice_port_name", epp.Name)
+				m.Add("__meta_kubernetes_endpointslice_port_protocol", epp.Protocol)
+				if epp.AppProtocol != "" {
+					m.Add("__meta_kubernetes_endpointslice_port_app_protocol", epp.AppProtocol)
+				}
+				if p != nil {
+					pps.appendPodLabels(m, aw, p, epp.Port)
+				}
+				ms = append(ms, m)
+			}
+		}
+	}
+	return pps.appendUnseenPortLabels(ms, aw, func(m *promutils.Labels) {
+		eps.appendCommonLabels(m, svc)
+	})
+}
+
+func (eps *EndpointSlice) appendCommonLabels(m *promutils.Labels, svc *Service) {
+	m.Add("__meta_kubernetes_namespace", eps.Metadata.Namespace)
+	m.Add("__meta_kubernetes_endpointslice_name", eps.Metadata.Name)
+	m.Add("__meta_kubernetes_endpointslice_address_type", eps.AddressType)
+	eps.Metadata.registerLabelsAndAnnotations("__meta_kubernetes_endpointslice", m)
+	if svc != nil {
+		svc.appendCommonLabels(m)
+	}
+}
+
+func (eps *EndpointSlice) appendEndpointLabels(m *promutils.Labels, ess Endpoint) {
+	m.Add("__meta_kubernetes_endpointslice_endpoint_conditions_ready", formatOptionalBool(ess.Conditions.Ready))
+	m.Add("__meta_kubernetes_endpointslice_endpoint_conditions_serving", formatOptionalBool(ess.Conditions.Serving))
+	m.Add("__meta_kubernetes_endpointslice_endpoint_conditions_terminating", formatOptionalBool(ess.Conditions.Terminating))
+	if ess.Hostname != "" {
+		m.Add("__meta_kubernetes_endpointslice_endpoint_hostname", ess.Hostname)
+	}
+	if ess.NodeName != "" {
+		m.Add("__meta_kubernetes_endpointslice_endpoint_node_name", ess.NodeName)
+	}
+	if ess.Zone != "" {
+		m.Add("__meta_kubernetes_endpointslice_endpoint_zone", ess.Zone)
+	}
+	if ess.TargetRef.Kind != "" {
+		m.Add("__meta_kubernetes_endpointslice_address_target_kind", ess.TargetRef.Kind)
+		m.Add("__meta_kubernetes_endpointslice_address_target_name", ess.TargetRef.Name)
+	}
+}
@@ -0,0 +1,101 @@
+package kubernetes
+
+import (
+	"testing"
+
+	"github.com/cprobe/cprobe/lib/discoveryutils"
+	"github.com/cprobe/cprobe/lib/promutils"
+)
+
+func TestEndpointSliceGetTargetLabels(t *testing.T) {
+	aw := newTestAPIWatcher(t, roleEndpointSlice, false, map[string][]string{
+		roleEndpointSlice: {`{
+  "metadata": {
+    "name": "etcd-abcde",
+    "namespace": "kube-system",
+    "labels": {"kubernetes.io/service-name": "etcd"}
+  },
+  "addressType": "IPv4",
+  "endpoints": [
+    {
+      "addresses": ["172.17.0.2"],
+      "conditions": {"ready": true},
+      "nodeName": "m01",
+      "zone": "us-east-1a",
+      "targetRef": {"kind": "Pod", "name": "etcd-m01", "namespace": "kube-system"}
+    }
+  ],
+  "ports": [{"name": "client", "port": 2379, "protocol": "TCP", "appProtocol": "https"}]
+}`},
+		rolePod:     {testPod},
+		roleService: {testService},
+	})
+	labelss, err := aw.getLabels()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	commonLabels := map[string]string{
+		"__meta_kubernetes_namespace":                                             "kube-system",
+		"__meta_kubernetes_endpointslice_name":                                    "etcd-abcde",
+		"__meta_kubernetes_endpointslice_address_type":                            "IPv4",
+		"__meta_kubernetes_endpointslice_label_kubernetes_io_service_name":        "etcd",
+		"__meta_kubernetes_endpointslice_labelpresent_kubernetes_io_service_name": "true",
+		"__meta_kubernetes_service_name":                                          "etcd",
+		"__meta_kubernetes_service_type":                                          "ClusterIP",
+		"__meta_kubernetes_service_cluster_ip":                                    "10.96.0.10",
+		"__meta_kubernetes_service_label_app":                                     "etcd",
+		"__meta_kubernetes_service_labelpresent_app":                              "true",
+		"__meta_kubernetes_pod_name":                                              "etcd-m01",
+		"__meta_kubernetes_pod_ip":                                                "172.17.0.2",
+		"__meta_kubernetes_pod_ready":                                             "true",
+		"__meta_kubernetes_pod_phase":                                             "Running",
+		"__meta_kubernetes_pod_node_name":                                         "m01",
+		"__meta_kubernetes_pod_host_ip":                                           "192.168.0.10",
+		"__meta_kubernetes_pod_uid":                                               "9d328156-75d1-411a-bdd0-aeacb53a38de",
+		"__meta_kubernetes_pod_controller_kind":                                   "Node",
+		"__meta_kubernetes_pod_controller_name":                                   "m01",
+		"__meta_kubernetes_pod_label_component":                                   "etcd",
+		"__meta_kubernetes_pod_labelpresent_component":                            "true",
+		"__meta_kubernetes_pod_annotation_kubernetes_io_config_hash":              "3ec2a3bc",
+		"__meta_kubernetes_pod_annotationpresent_kubernetes_io_config_hash":       "true",
+	}
+	merge := func(m map[string]string) *promutils.Labels {
+		result := make(map[string]string)
+		for k, v := range commonLabels {
+			result[k] = v
+		}
+		for k, v := range m {
+			result[k] = v
+		}
+		return promutils.NewLabelsFromMap(result)
+	}
+
+	discoveryutils.TestEqualLabelss(t, labelss, []*promutils.Labels{
+		merge(map[string]string{
+			"__address__": "172.17.0.2:2379",
+			"__meta_kubernetes_endpointslice_endpoint_conditions_ready":       "true",
+			"__meta_kubernetes_endpointslice_endpoint_conditions_serving":     "unknown",
+			"__meta_kubernetes_endpointslice_endpoint_conditions_terminating": "unknown",
+			"__meta_kubernetes_endpointslice_endpoint_node_name":              "m01",
+			"__meta_kubernetes_endpointslice_endpoint_zone":                   "us-east-1a",
+			"__meta_kubernetes_endpointslice_address_target_kind":             "Pod",
+			"__meta_kubernetes_endpointslice_address_target_name":             "etcd-m01",
+			"__meta_kubernetes_endpointslice_port":                            "2379",
+			"__meta_kubernetes_endpointslice_port_name":                       "client",
+			"__meta_kubernetes_endpointslice_port_protocol":                   "TCP",
+			"__meta_kubernetes_endpointslice_port_app_protocol":               "https",
+		}),
+		// the container port of the pod, which isn't exposed via the endpointslice
+		merge(map[string]string{
+			"__address__":                                   "172.17.0.2:2381",
+			"__meta_kubernetes_pod_container_image":         "k8s.gcr.io/etcd:3.4.3-0",
+			"__meta_kubernetes_pod_container_name":          "etcd",
+			"__meta_kubernetes_pod_container_init":          "false",
+			"__meta_kubernetes_pod_container_id":            "docker://a28f0800",
+			"__meta_kubernetes_pod_container_port_name":     "metrics",
+			"__meta_kubernetes_pod_container_port_number":   "2381",
+			"__meta_kubernetes_pod_container_port_protocol": "TCP",
+		}),
+	})
+}
@@ -0,0 +1,111 @@
+package kubernetes
+
+import (
+	"github.com/cprobe/cprobe/lib/promutils"
+)
+
+// IngressList represents ingress list in k8s.
+//
+// See https://kubernetes.io/docs/reference/generated/kubernetes-api/v1.27/#ingresslist-v1-networking-k8s-io
+type IngressList struct {
+	Metadata ListMeta   `json:"metadata"`
+	Items    []*Ingress `json:"items"`
+}
+
+// Ingress represents ingress in k8s.
+//
+// See https://kubernetes.io/docs/reference/generated/kubernetes-api/v1.27/#ingress-v1-networking-k8s-io
+type Ingress struct {
+	Metadata ObjectMeta  `json:"metadata"`
+	Spec     IngressSpec `json:"spec"`
+}
+
+// IngressSpec represents ingress spec in k8s.
+//
+// See https://kubernetes.io/docs/reference/generated/kubernetes-api/v1.27/#ingressspec-v1-networking-k8s-io
+type IngressSpec struct {
+	TLS              []IngressTLS  `json:"tls"`
+	Rules            []IngressRule `json:"rules"`
+	IngressClassName string        `json:"ingressClassName"`
+}
+
+// IngressTLS represents ingress TLS spec in k8s.
+//
+// See https://kubernetes.io/docs/reference/generated/kubernetes-api/v1.27/#ingresstls-v1-networking-k8s-io
+type IngressTLS struct {
+	Hosts []string `json:"hosts"`
+}
+
+// IngressRule represents ingress rule in k8s.
+//
+// See https://kubernetes.io/docs/reference/generated/kubernetes-api/v1.27/#ingressrule-v1-networking-k8s-io
+type IngressRule struct {
+	Host string               `json:"host"`
+	HTTP HTTPIngressRuleValue `json:"http"`
+}
+
+// HTTPIngressRuleValue represents HTTP ingress rule value in k8s.
+//
+// See https://kubernetes.io/docs/reference/generated/kubernetes-api/v1.27/#httpingressrulevalue-v1-networking-k8s-io
+type HTTPIngressRuleValue struct {
+	Paths []HTTPIngressPath `json:"paths"`
+}
+
+// HTTPIngressPath represents HTTP ingress path in k8s.
+//
+// See https://kubernetes.io/docs/reference/generated/kubernetes-api/v1.27/#httpingresspath-v1-networking-k8s-io
+type HTTPIngressPath struct {
+	Path string `json:"path"`
+}
+
+func (ig *Ingress) metadata() *ObjectMeta {
+	return &ig.Metadata
+}
+
+// getTargetLabels returns labels for each path of each rule in ig.
+//
+// See https://prometheus.io/docs/prometheus/latest/configuration/configuration/#ingress
+func (ig *Ingress) getTargetLabels(_ *apiWatcher) []*promutils.Labels {
+	tlsHosts := make(map[string]bool)
+	for _, tls := range ig.Spec.TLS {
+		for _, host := range tls.Hosts {
+			tlsHosts[host] = true
+		}
+	}
+	var ms []*promutils.Labels
+	for _, r := range ig.Spec.Rules {
+		paths := getIngressRulePaths(r.HTTP.Paths)
+		scheme := "http"
+		if tlsHosts[r.Host] {
+			scheme = "https"
+		}
+		for _, path := range paths {
+			m := promutils.NewLabels(16)
+			m.Add("__address__", r.Host)
+			m.Add("__meta_kubernetes_namespace", ig.Metadata.Namespace)
+			m.Add("__meta_kubernetes_ingress_name", ig.Metadata.Name)
+			m.Add("__meta_kubernetes_ingress_scheme", scheme)
+			m.Add("__meta_kubernetes_ingress_host", r.Host)
+			m.Add("__meta_kubernetes_ingress_path", path)
+			m.Add("__meta_kubernetes_ingress_class_name", ig.Spec.IngressClassName)
+			ig.Metadata.registerLabelsAndAnnotations("__meta_kubernetes_ingress", m)
+			ms = append(ms, m)
+		}
+	}
+	return ms
+}
+
+func getIngressRulePaths(paths []HTTPIngressPath) []string {
+	if len(paths) == 0 {
+		return []string{"/"}
+	}
+	var result []string
+	for _, p := range paths {
+		path := p.Path
+		if path == "" {
+			path = "/"
+		}
+		result = append(result, path)
+	}
+	return result
+}
@@ -0,0 +1,44 @@
+package kubernetes
+
+import (
+	"testing"
+
+	"github.com/cprobe/cprobe/lib/discoveryutils"
+	"github.com/cprobe/cprobe/lib/promutils"
+)
+
+func TestIngressGetTargetLabels(t *testing.T) {
+	aw := newTestAPIWatcher(t, roleIngress, false, map[string][]string{
+		roleIngress: {`{
+  "metadata": {"name": "web", "namespace": "default"},
+  "spec": {
+    "ingressClassName": "nginx",
+    "tls": [{"hosts": ["secure.example.com"]}],
+    "rules": [
+      {"host": "secure.example.com", "http": {"paths": [{"path": "/api"}, {"path": ""}]}},
+      {"host": "example.com"}
+    ]
+  }
+}`},
+	})
+	labelss, err := aw.getLabels()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	f := func(host, scheme, path string) *promutils.Labels {
+		return promutils.NewLabelsFromMap(map[string]string{
+			"__address__":                          host,
+			"__meta_kubernetes_namespace":          "default",
+			"__meta_kubernetes_ingress_name":       "web",
+			"__meta_kubernetes_ingress_class_name": "nginx",
+			"__meta_kubernetes_ingress_host":       host,
+			"__meta_kubernetes_ingress_scheme":     scheme,
+			"__meta_kubernetes_ingress_path":       path,
+		})
+	}
+	discoveryutils.TestEqualLabelss(t, labelss, []*promutils.Labels{
+		f("secure.example.com", "https", "/api"),
+		f("secure.example.com", "https", "/"),
+		f("example.com", "http", "/"),
+	})
+}
@@ -0,0 +1,202 @@
+package kubernetes
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	"github.com/cprobe/cprobe/lib/fs"
+	"github.com/cprobe/cprobe/lib/promauth"
+	"github.com/cprobe/cprobe/lib/proxy"
+	"gopkg.in/yaml.v2"
+)
+
+// kubeConfig represents the parts of kubeconfig file needed for connecting to Kubernetes API server.
+//
+// See https://kubernetes.io/docs/concepts/configuration/organize-cluster-access-kubeconfig/
+type kubeConfig struct {
+	Kind           string         `yaml:"kind,omitempty"`
+	APIVersion     string         `yaml:"apiVersion,omitempty"`
+	Clusters       []namedCluster `yaml:"clusters"`
+	AuthInfos      []namedAuth    `yaml:"users"`
+	Contexts       []namedContext `yaml:"contexts"`
+	CurrentContext string         `yaml:"current-context"`
+}
+
+type namedCluster struct {
+	Name    string  `yaml:"name"`
+	Cluster cluster `yaml:"cluster"`
+}
+
+type cluster struct {
+	Server                   string `yaml:"server"`
+	TLSServerName            string `yaml:"tls-server-name,omitempty"`
+	InsecureSkipTLSVerify    bool   `yaml:"insecure-skip-tls-verify,omitempty"`
+	CertificateAuthority     string `yaml:"certificate-authority,omitempty"`
+	CertificateAuthorityData string `yaml:"certificate-authority-data,omitempty"`
+	ProxyURL                 string `yaml:"proxy-url,omitempty"`
+}
+
+type namedAuth struct {
+	Name     string   `yaml:"name"`
+	AuthInfo authInfo `yaml:"user"`
+}
+
+type authInfo struct {
+	ClientCertificate     string      `yaml:"client-certificate,omitempty"`
+	ClientCertificateData string      `yaml:"client-certificate-data,omitempty"`
+	ClientKey             string      `yaml:"client-key,omitempty"`
+	ClientKeyData         string      `yaml:"client-key-data,omitempty"`
+	Token                 string      `yaml:"token,omitempty"`
+	TokenFile             string      `yaml:"tokenFile,omitempty"`
+	Username              string      `yaml:"username,omitempty"`
+	Password              string      `yaml:"password,omitempty"`
+	Exec                  interface{} `yaml:"exec,omitempty"`
+	AuthProvider          interface{} `yaml:"auth-provider,omitempty"`
+}
+
+type namedContext struct {
+	Name    string      `yaml:"name"`
+	Context kubeContext `yaml:"context"`
+}
+
+type kubeContext struct {
+	Cluster   string `yaml:"cluster"`
+	AuthInfo  string `yaml:"user"`
+	Namespace string `yaml:"namespace,omitempty"`
+}
+
+// apiServerConfig holds the settings for connecting to Kubernetes API server obtained from the current context of kubeconfig file.
+type apiServerConfig struct {
+	server    string
+	namespace string
+	proxyURL  *proxy.URL
+	opts      *promauth.Options
+}
+
+func loadKubeConfig(path string) (*apiServerConfig, error) {
+	data, err := fs.ReadFileOrHTTP(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %q: %w", path, err)
+	}
+	var kc kubeConfig
+	if err := yaml.Unmarshal(data, &kc); err != nil {
+		return nil, fmt.Errorf("cannot parse %q: %w", path, err)
+	}
+	cfg, err := kc.getAPIServerConfig(filepath.Dir(path))
+	if err != nil {
+		return nil, fmt.Errorf("invalid kubeconfig %q: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// getAPIServerConfig returns the config for the current context of kc.
+//
+// Relative paths in kc are resolved against baseDir, i.e. the directory with kubeconfig file.
+func (kc *kubeConfig) getAPIServerConfig(baseDir string) (*apiServerConfig, error) {
+	if kc.CurrentContext == "" {
+		return nil, fmt.Errorf("missing `current-context`")
+	}
+	var kctx *kubeContext
+	for i := range kc.Contexts {
+		if kc.Contexts[i].Name == kc.CurrentContext {
+			kctx = &kc.Contexts[i].Context
+			break
+		}
+	}
+	if kctx == nil {
+		return nil, fmt.Errorf("cannot find context %q", kc.CurrentContext)
+	}
+	var c *cluster
+	for i := range kc.Clusters {
+		if kc.Clusters[i].Name == kctx.Cluster {
+			c = &kc.Clusters[i].Cluster
+			break
+		}
+	}
+	if c == nil {
+		return nil, fmt.Errorf("cannot find cluster %q for context %q", kctx.Cluster, kc.CurrentContext)
+	}
+	if c.Server == "" {
+		return nil, fmt.Errorf("missing `server` for cluster %q", kctx.Cluster)
+	}
+	var ai *authInfo
+	if kctx.AuthInfo != "" {
+		for i := range kc.AuthInfos {
+			if kc.AuthInfos[i].Name == kctx.AuthInfo {
+				ai = &kc.AuthInfos[i].AuthInfo
+				break
+			}
+		}
+		if ai == nil {
+			return nil, fmt.Errorf("cannot find user %q for context %q", kctx.AuthInfo, kc.CurrentContext)
+		}
+	}
+
+	tlsConfig := &promauth.TLSConfig{
+		CAFile:             c.CertificateAuthority,
+		ServerName:         c.TLSServerName,
+		InsecureSkipVerify: c.InsecureSkipTLSVerify,
+	}
+	if c.CertificateAuthorityData != "" {
+		ca, err := base64.StdEncoding.DecodeString(c.CertificateAuthorityData)
+		if err != nil {
+			return nil, fmt.Errorf("cannot decode `certificate-authority-data` for cluster %q: %w", kctx.Cluster, err)
+		}
+		tlsConfig.CA = string(ca)
+		tlsConfig.CAFile = ""
+	}
+	opts := &promauth.Options{
+		BaseDir:   baseDir,
+		TLSConfig: tlsConfig,
+	}
+	if ai != nil {
+		if ai.Exec != nil || ai.AuthProvider != nil {
+			return nil, fmt.Errorf("`exec` and `auth-provider` aren't supported for user %q; use `token`, `tokenFile`, client certificates or `username` and `password` instead", kctx.AuthInfo)
+		}
+		tlsConfig.CertFile = ai.ClientCertificate
+		tlsConfig.KeyFile = ai.ClientKey
+		if ai.ClientCertificateData != "" || ai.ClientKeyData != "" {
+			cert, err := base64.StdEncoding.DecodeString(ai.ClientCertificateData)
+			if err != nil {
+				return nil, fmt.Errorf("cannot decode `client-certificate-data` for user %q: %w", kctx.AuthInfo, err)
+			}
+			key, err := base64.StdEncoding.DecodeString(ai.ClientKeyData)
+			if err != nil {
+				return nil, fmt.Errorf("cannot decode `client-key-data` for user %q: %w", kctx.AuthInfo, err)
+			}
+			tlsConfig.Cert = string(cert)
+			tlsConfig.Key = string(key)
+			tlsConfig.CertFile = ""
+			tlsConfig.KeyFile = ""
+		}
+		opts.BearerToken = ai.Token
+		if ai.Token == "" {
+			opts.BearerTokenFile = ai.TokenFile
+		}
+		if ai.Username != "" {
+			opts.BasicAuth = &promauth.BasicAuthConfig{
+				Username: ai.Username,
+				Password: promauth.NewSecret(ai.Password),
+			}
+		}
+	}
+
+	var proxyURL *proxy.URL
+	if c.ProxyURL != "" {
+		pu, err := url.Parse(c.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse `proxy-url` for cluster %q: %w", kctx.Cluster, err)
+		}
+		proxyURL = &proxy.URL{URL: pu}
+	}
+
+	return &apiServerConfig{
+		server:    strings.TrimSuffix(c.Server, "/"),
+		namespace: kctx.Namespace,
+		proxyURL:  proxyURL,
+		opts:      opts,
+	}, nil
+}
@@ -0,0 +1,153 @@
+package kubernetes
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/cprobe/cprobe/lib/promauth"
+	"gopkg.in/yaml.v2"
+)
+
+func TestKubeConfigGetAPIServerConfig(t *testing.T) {
+	f := func(data string, want *apiServerConfig) {
+		t.Helper()
+		var kc kubeConfig
+		if err := yaml.UnmarshalStrict([]byte(data), &kc); err != nil {
+			t.Fatalf("cannot parse kubeconfig: %s", err)
+		}
+		got, err := kc.getAPIServerConfig("/etc/kube")
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("unexpected config\ngot\n%#v\nwant\n%#v", got, want)
+		}
+	}
+
+	// token and base64-encoded CA
+	f(`
+apiVersion: v1
+kind: Config
+current-context: prod
+clusters:
+- name: prod
+  cluster:
+    server: https://10.0.0.1:6443/
+    certificate-authority-data: Y2EtZGF0YQ==
+users:
+- name: admin
+  user:
+    token: abc
+contexts:
+- name: dev
+  context:
+    cluster: dev
+- name: prod
+  context:
+    cluster: prod
+    user: admin
+    namespace: monitoring
+`, &apiServerConfig{
+		server:    "https://10.0.0.1:6443",
+		namespace: "monitoring",
+		opts: &promauth.Options{
+			BaseDir:     "/etc/kube",
+			BearerToken: "abc",
+			TLSConfig: &promauth.TLSConfig{
+				CA: "ca-data",
+			},
+		},
+	})
+
+	// client certificate files and basic auth
+	f(`
+current-context: test
+clusters:
+- name: test
+  cluster:
+    server: https://test:6443
+    certificate-authority: ca.crt
+    insecure-skip-tls-verify: true
+users:
+- name: user
+  user:
+    client-certificate: client.crt
+    client-key: client.key
+    username: foo
+    password: bar
+contexts:
+- name: test
+  context:
+    cluster: test
+    user: user
+`, &apiServerConfig{
+		server: "https://test:6443",
+		opts: &promauth.Options{
+			BaseDir: "/etc/kube",
+			BasicAuth: &promauth.BasicAuthConfig{
+				Username: "foo",
+				Password: promauth.NewSecret("bar"),
+			},
+			TLSConfig: &promauth.TLSConfig{
+				CAFile:             "ca.crt",
+				CertFile:           "client.crt",
+				KeyFile:            "client.key",
+				InsecureSkipVerify: true,
+			},
+		},
+	})
+}
+
+func TestKubeConfigGetAPIServerConfigFailure(t *testing.T) {
+	f := func(data string) {
+		t.Helper()
+		var kc kubeConfig
+		if err := yaml.UnmarshalStrict([]byte(data), &kc); err != nil {
+			t.Fatalf("cannot parse kubeconfig: %s", err)
+		}
+		if _, err := kc.getAPIServerConfig("/etc/kube"); err == nil {
+			t.Fatalf("expecting non-nil error")
+		}
+	}
+
+	// missing current-context
+	f(`
+clusters:
+- name: test
+  cluster:
+    server: https://test:6443
+`)
+
+	// missing context
+	f(`
+current-context: test
+`)
+
+	// missing cluster
+	f(`
+current-context: test
+contexts:
+- name: test
+  context:
+    cluster: test
+`)
+
+	// unsupported exec
+	f(`
+current-context: test
+clusters:
+- name: test
+  cluster:
+    server: https://test:6443
+users:
+- name: user
+  user:
+    exec:
+      command: aws
+contexts:
+- name: test
+  context:
+    cluster: test
+    user: user
+`)
+}
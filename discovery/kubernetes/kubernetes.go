@@ -0,0 +1,93 @@
+package kubernetes
+
+import (
+	"fmt"
+
+	"github.com/cprobe/cprobe/lib/promauth"
+	"github.com/cprobe/cprobe/lib/promutils"
+	"github.com/cprobe/cprobe/lib/proxy"
+)
+
+// SDConfig represents kubernetes-based service discovery config.
+//
+// See https://prometheus.io/docs/prometheus/latest/configuration/configuration/#kubernetes_sd_config
+type SDConfig struct {
+	APIServer         string                     `yaml:"api_server,omitempty"`
+	Role              string                     `yaml:"role"`
+	KubeConfigFile    string                     `yaml:"kubeconfig_file,omitempty"`
+	HTTPClientConfig  promauth.HTTPClientConfig  `yaml:",inline"`
+	ProxyURL          *proxy.URL                 `yaml:"proxy_url,omitempty"`
+	ProxyClientConfig promauth.ProxyClientConfig `yaml:",inline"`
+	Namespaces        Namespaces                 `yaml:"namespaces,omitempty"`
+	Selectors         []Selector                 `yaml:"selectors,omitempty"`
+	AttachMetadata    AttachMetadataConfig       `yaml:"attach_metadata,omitempty"`
+	// RefreshInterval is the interval for generating targets from the objects cached by the watcher.
+	// The objects themselves are updated via Kubernetes watch API as soon as they change.
+	// The scrape_interval of the job is used if it isn't set.
+	RefreshInterval *promutils.Duration `yaml:"refresh_interval,omitempty"`
+}
+
+// Namespaces represents namespaces for SDConfig
+type Namespaces struct {
+	OwnNamespace bool     `yaml:"own_namespace,omitempty"`
+	Names        []string `yaml:"names,omitempty"`
+}
+
+// Selector represents kubernetes selector.
+//
+// See https://kubernetes.io/docs/concepts/overview/working-with-objects/labels/
+// and https://kubernetes.io/docs/concepts/overview/working-with-objects/field-selectors/
+type Selector struct {
+	Role  string `yaml:"role"`
+	Label string `yaml:"label,omitempty"`
+	Field string `yaml:"field,omitempty"`
+}
+
+// AttachMetadataConfig represents `attach_metadata` option at `kubernetes_sd_config`.
+//
+// See https://prometheus.io/docs/prometheus/latest/configuration/configuration/#kubernetes_sd_config
+type AttachMetadataConfig struct {
+	Node bool `yaml:"node,omitempty"`
+}
+
+// Supported values for `role` option.
+const (
+	rolePod           = "pod"
+	roleService       = "service"
+	roleEndpoints     = "endpoints"
+	roleEndpointSlice = "endpointslice"
+	roleNode          = "node"
+	roleIngress       = "ingress"
+)
+
+func checkRole(role string) error {
+	switch role {
+	case rolePod, roleService, roleEndpoints, roleEndpointSlice, roleNode, roleIngress:
+		return nil
+	case "":
+		return fmt.Errorf("missing `role`; supported values: pod, service, endpoints, endpointslice, node, ingress")
+	default:
+		return fmt.Errorf("unsupported `role`: %q; supported values: pod, service, endpoints, endpointslice, node, ingress", role)
+	}
+}
+
+// GetLabels returns labels for the given sdc and baseDir.
+//
+// The first call lists the objects for sdc.Role and starts watching them in background,
+// so the subsequent calls generate labels from the cached objects without querying Kubernetes API.
+func (sdc *SDConfig) GetLabels(baseDir string) ([]*promutils.Labels, error) {
+	cfg, err := getAPIConfig(sdc, baseDir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create API config: %w", err)
+	}
+	return cfg.aw.getLabels()
+}
+
+// MustStop stops further usage for sdc.
+func (sdc *SDConfig) MustStop() {
+	v := configMap.Delete(sdc)
+	if v != nil {
+		cfg := v.(*apiConfig)
+		cfg.aw.mustStop()
+	}
+}
@@ -0,0 +1,100 @@
+package kubernetes
+
+import (
+	"github.com/cprobe/cprobe/lib/discoveryutils"
+	"github.com/cprobe/cprobe/lib/promutils"
+)
+
+// NodeList represents NodeList from k8s API.
+//
+// See https://kubernetes.io/docs/reference/generated/kubernetes-api/v1.27/#nodelist-v1-core
+type NodeList struct {
+	Metadata ListMeta `json:"metadata"`
+	Items    []*Node  `json:"items"`
+}
+
+// Node represents Node from k8s API.
+//
+// See https://kubernetes.io/docs/reference/generated/kubernetes-api/v1.27/#node-v1-core
+type Node struct {
+	Metadata ObjectMeta `json:"metadata"`
+	Status   NodeStatus `json:"status"`
+	Spec     NodeSpec   `json:"spec"`
+}
+
+// NodeStatus represents NodeStatus from k8s API.
+//
+// See https://kubernetes.io/docs/reference/generated/kubernetes-api/v1.27/#nodestatus-v1-core
+type NodeStatus struct {
+	Addresses       []NodeAddress       `json:"addresses"`
+	DaemonEndpoints NodeDaemonEndpoints `json:"daemonEndpoints"`
+}
+
+// NodeSpec represents NodeSpec from k8s API.
+//
+// See https://kubernetes.io/docs/reference/generated/kubernetes-api/v1.27/#nodespec-v1-core
+type NodeSpec struct {
+	ProviderID string `json:"providerID"`
+}
+
+// NodeAddress represents NodeAddress from k8s API.
+//
+// See https://kubernetes.io/docs/reference/generated/kubernetes-api/v1.27/#nodeaddress-v1-core
+type NodeAddress struct {
+	Type    string `json:"type"`
+	Address string `json:"address"`
+}
+
+// NodeDaemonEndpoints represents NodeDaemonEndpoints from k8s API.
+//
+// See https://kubernetes.io/docs/reference/generated/kubernetes-api/v1.27/#nodedaemonendpoints-v1-core
+type NodeDaemonEndpoints struct {
+	KubeletEndpoint DaemonEndpoint `json:"kubeletEndpoint"`
+}
+
+// DaemonEndpoint represents DaemonEndpoint from k8s API.
+type DaemonEndpoint struct {
+	Port int `json:"Port"`
+}
+
+func (n *Node) metadata() *ObjectMeta {
+	return &n.Metadata
+}
+
+// getTargetLabels returns labels for the given n.
+//
+// See https://prometheus.io/docs/prometheus/latest/configuration/configuration/#node
+func (n *Node) getTargetLabels(_ *apiWatcher) []*promutils.Labels {
+	addr := getNodeAddr(n.Status.Addresses)
+	if len(addr) == 0 {
+		// Skip node without address
+		return nil
+	}
+	m := promutils.NewLabels(16)
+	m.Add("__address__", discoveryutils.JoinHostPort(addr, n.Status.DaemonEndpoints.KubeletEndpoint.Port))
+	m.Add("instance", n.Metadata.Name)
+	m.Add("__meta_kubernetes_node_name", n.Metadata.Name)
+	m.Add("__meta_kubernetes_node_provider_id", n.Spec.ProviderID)
+	n.Metadata.registerLabelsAndAnnotations("__meta_kubernetes_node", m)
+	seen := make(map[string]bool)
+	for _, a := range n.Status.Addresses {
+		if seen[a.Type] {
+			continue
+		}
+		seen[a.Type] = true
+		m.Add("__meta_kubernetes_node_address_"+discoveryutils.SanitizeLabelName(a.Type), a.Address)
+	}
+	return []*promutils.Labels{m}
+}
+
+// getNodeAddr returns the address of the node in the same order of preference as Prometheus does.
+func getNodeAddr(nas []NodeAddress) string {
+	for _, typ := range []string{"InternalIP", "InternalDNS", "ExternalIP", "ExternalDNS", "LegacyHostIP", "Hostname"} {
+		for _, na := range nas {
+			if na.Type == typ {
+				return na.Address
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,35 @@
+package kubernetes
+
+import (
+	"testing"
+
+	"github.com/cprobe/cprobe/lib/discoveryutils"
+	"github.com/cprobe/cprobe/lib/promutils"
+)
+
+func TestNodeGetTargetLabels(t *testing.T) {
+	aw := newTestAPIWatcher(t, roleNode, false, map[string][]string{
+		roleNode: {
+			testNode,
+			`{"metadata": {"name": "no-address"}}`,
+		},
+	})
+	labelss, err := aw.getLabels()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	discoveryutils.TestEqualLabelss(t, labelss, []*promutils.Labels{
+		promutils.NewLabelsFromMap(map[string]string{
+			"__address__":                                                           "192.168.0.10:10250",
+			"instance":                                                              "m01",
+			"__meta_kubernetes_node_name":                                           "m01",
+			"__meta_kubernetes_node_provider_id":                                    "aws:///us-east-1a/i-0e8b5d3c",
+			"__meta_kubernetes_node_address_Hostname":                               "m01",
+			"__meta_kubernetes_node_address_InternalIP":                             "192.168.0.10",
+			"__meta_kubernetes_node_label_kubernetes_io_os":                         "linux",
+			"__meta_kubernetes_node_labelpresent_kubernetes_io_os":                  "true",
+			"__meta_kubernetes_node_annotation_node_alpha_kubernetes_io_ttl":        "0",
+			"__meta_kubernetes_node_annotationpresent_node_alpha_kubernetes_io_ttl": "true",
+		}),
+	})
+}
@@ -0,0 +1,192 @@
+package kubernetes
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/cprobe/cprobe/lib/discoveryutils"
+	"github.com/cprobe/cprobe/lib/promutils"
+)
+
+// PodList implements k8s pod list.
+//
+// See https://kubernetes.io/docs/reference/generated/kubernetes-api/v1.27/#podlist-v1-core
+type PodList struct {
+	Metadata ListMeta `json:"metadata"`
+	Items    []*Pod   `json:"items"`
+}
+
+// Pod implements k8s pod.
+//
+// See https://kubernetes.io/docs/reference/generated/kubernetes-api/v1.27/#pod-v1-core
+type Pod struct {
+	Metadata ObjectMeta `json:"metadata"`
+	Spec     PodSpec    `json:"spec"`
+	Status   PodStatus  `json:"status"`
+}
+
+// PodSpec implements k8s pod spec.
+//
+// See https://kubernetes.io/docs/reference/generated/kubernetes-api/v1.27/#podspec-v1-core
+type PodSpec struct {
+	NodeName       string      `json:"nodeName"`
+	Containers     []Container `json:"containers"`
+	InitContainers []Container `json:"initContainers"`
+}
+
+// Container implements k8s container.
+//
+// See https://kubernetes.io/docs/reference/generated/kubernetes-api/v1.27/#container-v1-core
+type Container struct {
+	Name  string          `json:"name"`
+	Image string          `json:"image"`
+	Ports []ContainerPort `json:"ports"`
+}
+
+// ContainerPort implements k8s container port.
+type ContainerPort struct {
+	Name          string `json:"name"`
+	ContainerPort int    `json:"containerPort"`
+	Protocol      string `json:"protocol"`
+}
+
+// PodStatus implements k8s pod status.
+//
+// See https://kubernetes.io/docs/reference/generated/kubernetes-api/v1.27/#podstatus-v1-core
+type PodStatus struct {
+	Phase                 string            `json:"phase"`
+	PodIP                 string            `json:"podIP"`
+	HostIP                string            `json:"hostIP"`
+	Conditions            []PodCondition    `json:"conditions"`
+	ContainerStatuses     []ContainerStatus `json:"containerStatuses"`
+	InitContainerStatuses []ContainerStatus `json:"initContainerStatuses"`
+}
+
+// PodCondition implements k8s pod condition.
+type PodCondition struct {
+	Type   string `json:"type"`
+	Status string `json:"status"`
+}
+
+// ContainerStatus implements k8s container status.
+type ContainerStatus struct {
+	Name        string `json:"name"`
+	ContainerID string `json:"containerID"`
+}
+
+func (p *Pod) metadata() *ObjectMeta {
+	return &p.Metadata
+}
+
+// getTargetLabels returns labels for each port of the given p.
+//
+// A single target without port is returned for each container without ports.
+//
+// See https://prometheus.io/docs/prometheus/latest/configuration/configuration/#pod
+func (p *Pod) getTargetLabels(aw *apiWatcher) []*promutils.Labels {
+	if len(p.Status.PodIP) == 0 {
+		// Skip pods without IP, since they cannot be scraped.
+		return nil
+	}
+	var ms []*promutils.Labels
+	ms = p.appendContainerTargets(ms, aw, p.Spec.Containers, false)
+	ms = p.appendContainerTargets(ms, aw, p.Spec.InitContainers, true)
+	return ms
+}
+
+func (p *Pod) appendContainerTargets(ms []*promutils.Labels, aw *apiWatcher, containers []Container, isInit bool) []*promutils.Labels {
+	for i := range containers {
+		c := &containers[i]
+		if len(c.Ports) == 0 {
+			m := promutils.NewLabels(16)
+			m.Add("__address__", p.Status.PodIP)
+			m.Add("__meta_kubernetes_namespace", p.Metadata.Namespace)
+			p.appendContainerLabels(m, c, nil, isInit)
+			p.appendCommonLabels(m, aw)
+			ms = append(ms, m)
+			continue
+		}
+		for j := range c.Ports {
+			cp := &c.Ports[j]
+			m := promutils.NewLabels(16)
+			m.Add("__address__", discoveryutils.JoinHostPort(p.Status.PodIP, cp.ContainerPort))
+			m.Add("__meta_kubernetes_namespace", p.Metadata.Namespace)
+			p.appendContainerLabels(m, c, cp, isInit)
+			p.appendCommonLabels(m, aw)
+			ms = append(ms, m)
+		}
+	}
+	return ms
+}
+
+func (p *Pod) appendContainerLabels(m *promutils.Labels, c *Container, cp *ContainerPort, isInit bool) {
+	m.Add("__meta_kubernetes_pod_container_image", c.Image)
+	m.Add("__meta_kubernetes_pod_container_name", c.Name)
+	m.Add("__meta_kubernetes_pod_container_init", strconv.FormatBool(isInit))
+	if containerID := p.getContainerID(c.Name, isInit); containerID != "" {
+		m.Add("__meta_kubernetes_pod_container_id", containerID)
+	}
+	if cp != nil {
+		m.Add("__meta_kubernetes_pod_container_port_name", cp.Name)
+		m.Add("__meta_kubernetes_pod_container_port_number", strconv.Itoa(cp.ContainerPort))
+		m.Add("__meta_kubernetes_pod_container_port_protocol", cp.Protocol)
+	}
+}
+
+// appendCommonLabels adds pod labels except of __meta_kubernetes_namespace, which is added by the caller,
+// since it is shared with endpoints and endpointslice labels.
+func (p *Pod) appendCommonLabels(m *promutils.Labels, aw *apiWatcher) {
+	if aw != nil && aw.attachNodeMetadata {
+		if o := aw.getObject(roleNode, "", p.Spec.NodeName); o != nil {
+			n := o.(*Node)
+			n.Metadata.registerLabelsAndAnnotations("__meta_kubernetes_node", m)
+		}
+	}
+	m.Add("__meta_kubernetes_pod_name", p.Metadata.Name)
+	m.Add("__meta_kubernetes_pod_ip", p.Status.PodIP)
+	m.Add("__meta_kubernetes_pod_ready", getPodReadyStatus(p.Status.Conditions))
+	m.Add("__meta_kubernetes_pod_phase", p.Status.Phase)
+	m.Add("__meta_kubernetes_pod_node_name", p.Spec.NodeName)
+	m.Add("__meta_kubernetes_pod_host_ip", p.Status.HostIP)
+	m.Add("__meta_kubernetes_pod_uid", p.Metadata.UID)
+	if pc := getPodController(p.Metadata.OwnerReferences); pc != nil {
+		if pc.Kind != "" {
+			m.Add("__meta_kubernetes_pod_controller_kind", pc.Kind)
+		}
+		if pc.Name != "" {
+			m.Add("__meta_kubernetes_pod_controller_name", pc.Name)
+		}
+	}
+	p.Metadata.registerLabelsAndAnnotations("__meta_kubernetes_pod", m)
+}
+
+func (p *Pod) getContainerID(name string, isInit bool) string {
+	statuses := p.Status.ContainerStatuses
+	if isInit {
+		statuses = p.Status.InitContainerStatuses
+	}
+	for _, cs := range statuses {
+		if cs.Name == name {
+			return cs.ContainerID
+		}
+	}
+	return ""
+}
+
+func getPodController(ors []OwnerReference) *OwnerReference {
+	for i := range ors {
+		if ors[i].Controller {
+			return &ors[i]
+		}
+	}
+	return nil
+}
+
+func getPodReadyStatus(conds []PodCondition) string {
+	for _, c := range conds {
+		if c.Type == "Ready" {
+			return strings.ToLower(c.Status)
+		}
+	}
+	return "unknown"
+}
@@ -0,0 +1,204 @@
+package kubernetes
+
+import (
+	"testing"
+
+	"github.com/cprobe/cprobe/lib/discoveryutils"
+	"github.com/cprobe/cprobe/lib/promutils"
+)
+
+// newTestAPIWatcher returns apiWatcher for the given role with the given objects, which doesn't talk to Kubernetes API server.
+//
+// objects must contain JSON-encoded objects per role.
+func newTestAPIWatcher(t *testing.T, role string, attachNodeMetadata bool, objects map[string][]string) *apiWatcher {
+	t.Helper()
+	aw, err := newAPIWatcher("http://127.0.0.1:1", nil, nil, nil, role, nil, nil, attachNodeMetadata)
+	if err != nil {
+		t.Fatalf("cannot create apiWatcher: %s", err)
+	}
+	for _, r := range aw.getDependentRoles() {
+		aw.watchers[r+"/"] = newURLWatcher(aw, r, "")
+	}
+	for r, items := range objects {
+		uw := aw.watchers[r+"/"]
+		if uw == nil {
+			t.Fatalf("unexpected role %q for apiWatcher with role %q", r, role)
+		}
+		for _, item := range items {
+			o, err := parseObject(r, []byte(item))
+			if err != nil {
+				t.Fatalf("cannot parse %s: %s", r, err)
+			}
+			uw.objects[o.metadata().key()] = o
+		}
+	}
+	return aw
+}
+
+const testPod = `{
+  "metadata": {
+    "name": "etcd-m01",
+    "namespace": "kube-system",
+    "uid": "9d328156-75d1-411a-bdd0-aeacb53a38de",
+    "labels": {"component": "etcd"},
+    "annotations": {"kubernetes.io/config.hash": "3ec2a3bc"},
+    "ownerReferences": [{"kind": "Node", "name": "m01", "controller": true}]
+  },
+  "spec": {
+    "nodeName": "m01",
+    "containers": [
+      {
+        "name": "etcd",
+        "image": "k8s.gcr.io/etcd:3.4.3-0",
+        "ports": [{"name": "metrics", "containerPort": 2381, "protocol": "TCP"}]
+      },
+      {
+        "name": "sidecar",
+        "image": "busybox"
+      }
+    ],
+    "initContainers": [
+      {
+        "name": "init",
+        "image": "busybox",
+        "ports": [{"name": "init-port", "containerPort": 9000, "protocol": "TCP"}]
+      }
+    ]
+  },
+  "status": {
+    "phase": "Running",
+    "podIP": "172.17.0.2",
+    "hostIP": "192.168.0.10",
+    "conditions": [{"type": "Ready", "status": "True"}],
+    "containerStatuses": [{"name": "etcd", "containerID": "docker://a28f0800"}]
+  }
+}`
+
+const testNode = `{
+  "metadata": {
+    "name": "m01",
+    "labels": {"kubernetes.io/os": "linux"},
+    "annotations": {"node.alpha.kubernetes.io/ttl": "0"}
+  },
+  "spec": {"providerID": "aws:///us-east-1a/i-0e8b5d3c"},
+  "status": {
+    "addresses": [
+      {"type": "Hostname", "address": "m01"},
+      {"type": "InternalIP", "address": "192.168.0.10"}
+    ],
+    "daemonEndpoints": {"kubeletEndpoint": {"Port": 10250}}
+  }
+}`
+
+func TestPodGetTargetLabels(t *testing.T) {
+	f := func(attachNodeMetadata bool, pod string, want []map[string]string) {
+		t.Helper()
+		objects := map[string][]string{
+			rolePod: {pod},
+		}
+		if attachNodeMetadata {
+			objects[roleNode] = []string{testNode}
+		}
+		aw := newTestAPIWatcher(t, rolePod, attachNodeMetadata, objects)
+		labelss, err := aw.getLabels()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		var wantLabelss []*promutils.Labels
+		for _, m := range want {
+			wantLabelss = append(wantLabelss, promutils.NewLabelsFromMap(m))
+		}
+		discoveryutils.TestEqualLabelss(t, labelss, wantLabelss)
+	}
+
+	commonLabels := func(m map[string]string) map[string]string {
+		for k, v := range map[string]string{
+			"__meta_kubernetes_namespace":                                       "kube-system",
+			"__meta_kubernetes_pod_name":                                        "etcd-m01",
+			"__meta_kubernetes_pod_ip":                                          "172.17.0.2",
+			"__meta_kubernetes_pod_ready":                                       "true",
+			"__meta_kubernetes_pod_phase":                                       "Running",
+			"__meta_kubernetes_pod_node_name":                                   "m01",
+			"__meta_kubernetes_pod_host_ip":                                     "192.168.0.10",
+			"__meta_kubernetes_pod_uid":                                         "9d328156-75d1-411a-bdd0-aeacb53a38de",
+			"__meta_kubernetes_pod_controller_kind":                             "Node",
+			"__meta_kubernetes_pod_controller_name":                             "m01",
+			"__meta_kubernetes_pod_label_component":                             "etcd",
+			"__meta_kubernetes_pod_labelpresent_component":                      "true",
+			"__meta_kubernetes_pod_annotation_kubernetes_io_config_hash":        "3ec2a3bc",
+			"__meta_kubernetes_pod_annotationpresent_kubernetes_io_config_hash": "true",
+		} {
+			m[k] = v
+		}
+		return m
+	}
+
+	// pod with a port, a container without ports and an init container
+	f(false, testPod, []map[string]string{
+		commonLabels(map[string]string{
+			"__address__":                                   "172.17.0.2:2381",
+			"__meta_kubernetes_pod_container_image":         "k8s.gcr.io/etcd:3.4.3-0",
+			"__meta_kubernetes_pod_container_name":          "etcd",
+			"__meta_kubernetes_pod_container_init":          "false",
+			"__meta_kubernetes_pod_container_id":            "docker://a28f0800",
+			"__meta_kubernetes_pod_container_port_name":     "metrics",
+			"__meta_kubernetes_pod_container_port_number":   "2381",
+			"__meta_kubernetes_pod_container_port_protocol": "TCP",
+		}),
+		commonLabels(map[string]string{
+			"__address__":                           "172.17.0.2",
+			"__meta_kubernetes_pod_container_image": "busybox",
+			"__meta_kubernetes_pod_container_name":  "sidecar",
+			"__meta_kubernetes_pod_container_init":  "false",
+		}),
+		commonLabels(map[string]string{
+			"__address__":                                   "172.17.0.2:9000",
+			"__meta_kubernetes_pod_container_image":         "busybox",
+			"__meta_kubernetes_pod_container_name":          "init",
+			"__meta_kubernetes_pod_container_init":          "true",
+			"__meta_kubernetes_pod_container_port_name":     "init-port",
+			"__meta_kubernetes_pod_container_port_number":   "9000",
+			"__meta_kubernetes_pod_container_port_protocol": "TCP",
+		}),
+	})
+
+	// attach_metadata: {node: true}
+	nodeLabels := func(m map[string]string) map[string]string {
+		m = commonLabels(m)
+		m["__meta_kubernetes_node_label_kubernetes_io_os"] = "linux"
+		m["__meta_kubernetes_node_labelpresent_kubernetes_io_os"] = "true"
+		m["__meta_kubernetes_node_annotation_node_alpha_kubernetes_io_ttl"] = "0"
+		m["__meta_kubernetes_node_annotationpresent_node_alpha_kubernetes_io_ttl"] = "true"
+		return m
+	}
+	f(true, testPod, []map[string]string{
+		nodeLabels(map[string]string{
+			"__address__":                                   "172.17.0.2:2381",
+			"__meta_kubernetes_pod_container_image":         "k8s.gcr.io/etcd:3.4.3-0",
+			"__meta_kubernetes_pod_container_name":          "etcd",
+			"__meta_kubernetes_pod_container_init":          "false",
+			"__meta_kubernetes_pod_container_id":            "docker://a28f0800",
+			"__meta_kubernetes_pod_container_port_name":     "metrics",
+			"__meta_kubernetes_pod_container_port_number":   "2381",
+			"__meta_kubernetes_pod_container_port_protocol": "TCP",
+		}),
+		nodeLabels(map[string]string{
+			"__address__":                           "172.17.0.2",
+			"__meta_kubernetes_pod_container_image": "busybox",
+			"__meta_kubernetes_pod_container_name":  "sidecar",
+			"__meta_kubernetes_pod_container_init":  "false",
+		}),
+		nodeLabels(map[string]string{
+			"__address__":                                   "172.17.0.2:9000",
+			"__meta_kubernetes_pod_container_image":         "busybox",
+			"__meta_kubernetes_pod_container_name":          "init",
+			"__meta_kubernetes_pod_container_init":          "true",
+			"__meta_kubernetes_pod_container_port_name":     "init-port",
+			"__meta_kubernetes_pod_container_port_number":   "9000",
+			"__meta_kubernetes_pod_container_port_protocol": "TCP",
+		}),
+	})
+
+	// pod without IP is skipped
+	f(false, `{"metadata": {"name": "pending", "namespace": "default"}, "status": {"phase": "Pending"}}`, nil)
+}
@@ -0,0 +1,78 @@
+package kubernetes
+
+import (
+	"strconv"
+
+	"github.com/cprobe/cprobe/lib/discoveryutils"
+	"github.com/cprobe/cprobe/lib/promutils"
+)
+
+// ServiceList is k8s service list.
+//
+// See https://kubernetes.io/docs/reference/generated/kubernetes-api/v1.27/#servicelist-v1-core
+type ServiceList struct {
+	Metadata ListMeta   `json:"metadata"`
+	Items    []*Service `json:"items"`
+}
+
+// Service is k8s service.
+//
+// See https://kubernetes.io/docs/reference/generated/kubernetes-api/v1.27/#service-v1-core
+type Service struct {
+	Metadata ObjectMeta  `json:"metadata"`
+	Spec     ServiceSpec `json:"spec"`
+}
+
+// ServiceSpec is k8s service spec.
+//
+// See https://kubernetes.io/docs/reference/generated/kubernetes-api/v1.27/#servicespec-v1-core
+type ServiceSpec struct {
+	ClusterIP    string        `json:"clusterIP"`
+	ExternalName string        `json:"externalName"`
+	Type         string        `json:"type"`
+	Ports        []ServicePort `json:"ports"`
+}
+
+// ServicePort is k8s service port.
+//
+// See https://kubernetes.io/docs/reference/generated/kubernetes-api/v1.27/#serviceport-v1-core
+type ServicePort struct {
+	Name     string `json:"name"`
+	Protocol string `json:"protocol"`
+	Port     int    `json:"port"`
+}
+
+func (s *Service) metadata() *ObjectMeta {
+	return &s.Metadata
+}
+
+// getTargetLabels returns labels for each port of the given s.
+//
+// See https://prometheus.io/docs/prometheus/latest/configuration/configuration/#service
+func (s *Service) getTargetLabels(_ *apiWatcher) []*promutils.Labels {
+	host := s.Metadata.Name + "." + s.Metadata.Namespace + ".svc"
+	var ms []*promutils.Labels
+	for _, sp := range s.Spec.Ports {
+		m := promutils.NewLabels(16)
+		m.Add("__address__", discoveryutils.JoinHostPort(host, sp.Port))
+		m.Add("__meta_kubernetes_namespace", s.Metadata.Namespace)
+		m.Add("__meta_kubernetes_service_port_name", sp.Name)
+		m.Add("__meta_kubernetes_service_port_number", strconv.Itoa(sp.Port))
+		m.Add("__meta_kubernetes_service_port_protocol", sp.Protocol)
+		s.appendCommonLabels(m)
+		ms = append(ms, m)
+	}
+	return ms
+}
+
+// appendCommonLabels adds service labels except of __meta_kubernetes_namespace, which is added by the caller.
+func (s *Service) appendCommonLabels(m *promutils.Labels) {
+	m.Add("__meta_kubernetes_service_name", s.Metadata.Name)
+	m.Add("__meta_kubernetes_service_type", s.Spec.Type)
+	if s.Spec.Type == "ExternalName" {
+		m.Add("__meta_kubernetes_service_external_name", s.Spec.ExternalName)
+	} else {
+		m.Add("__meta_kubernetes_service_cluster_ip", s.Spec.ClusterIP)
+	}
+	s.Metadata.registerLabelsAndAnnotations("__meta_kubernetes_service", m)
+}
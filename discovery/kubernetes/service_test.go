@@ -0,0 +1,45 @@
+package kubernetes
+
+import (
+	"testing"
+
+	"github.com/cprobe/cprobe/lib/discoveryutils"
+	"github.com/cprobe/cprobe/lib/promutils"
+)
+
+const testService = `{
+  "metadata": {
+    "name": "etcd",
+    "namespace": "kube-system",
+    "labels": {"app": "etcd"}
+  },
+  "spec": {
+    "clusterIP": "10.96.0.10",
+    "type": "ClusterIP",
+    "ports": [{"name": "metrics", "protocol": "TCP", "port": 2381}]
+  }
+}`
+
+func TestServiceGetTargetLabels(t *testing.T) {
+	aw := newTestAPIWatcher(t, roleService, false, map[string][]string{
+		roleService: {testService},
+	})
+	labelss, err := aw.getLabels()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	discoveryutils.TestEqualLabelss(t, labelss, []*promutils.Labels{
+		promutils.NewLabelsFromMap(map[string]string{
+			"__address__":                                "etcd.kube-system.svc:2381",
+			"__meta_kubernetes_namespace":                "kube-system",
+			"__meta_kubernetes_service_name":             "etcd",
+			"__meta_kubernetes_service_type":             "ClusterIP",
+			"__meta_kubernetes_service_cluster_ip":       "10.96.0.10",
+			"__meta_kubernetes_service_port_name":        "metrics",
+			"__meta_kubernetes_service_port_number":      "2381",
+			"__meta_kubernetes_service_port_protocol":    "TCP",
+			"__meta_kubernetes_service_label_app":        "etcd",
+			"__meta_kubernetes_service_labelpresent_app": "true",
+		}),
+	})
+}
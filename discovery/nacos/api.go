@@ -0,0 +1,217 @@
+package nacos
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cprobe/cprobe/lib/discoveryutils"
+)
+
+const (
+	defaultGroup = "DEFAULT_GROUP"
+
+	// servicesPageSize is the number of services requested per page from Nacos.
+	servicesPageSize = 500
+)
+
+var configMap = discoveryutils.NewConfigMap()
+
+type apiConfig struct {
+	client *discoveryutils.Client
+
+	namespace   string
+	group       string
+	clusters    string
+	healthyOnly bool
+
+	username string
+	password string
+
+	// tokenLock protects accessToken and tokenExpireAt.
+	tokenLock     sync.Mutex
+	accessToken   string
+	tokenExpireAt time.Time
+}
+
+func getAPIConfig(sdc *SDConfig, baseDir string) (*apiConfig, error) {
+	v, err := configMap.Get(sdc, func() (interface{}, error) { return newAPIConfig(sdc, baseDir) })
+	if err != nil {
+		return nil, err
+	}
+	return v.(*apiConfig), nil
+}
+
+func newAPIConfig(sdc *SDConfig, baseDir string) (*apiConfig, error) {
+	ac, err := sdc.HTTPClientConfig.NewConfig(baseDir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse auth config: %w", err)
+	}
+	apiServer := sdc.Server
+	if apiServer == "" {
+		apiServer = "localhost:8848"
+	}
+	if !strings.Contains(apiServer, "://") {
+		scheme := "http"
+		if sdc.HTTPClientConfig.TLSConfig != nil {
+			scheme = "https"
+		}
+		apiServer = scheme + "://" + apiServer
+	}
+	apiServer = strings.TrimSuffix(apiServer, "/")
+	if !strings.HasSuffix(apiServer, "/nacos") {
+		apiServer += "/nacos"
+	}
+	proxyAC, err := sdc.ProxyClientConfig.NewConfig(baseDir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse proxy auth config: %w", err)
+	}
+	client, err := discoveryutils.NewClient(apiServer, ac, sdc.ProxyURL, proxyAC, &sdc.HTTPClientConfig)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create HTTP client for %q: %w", apiServer, err)
+	}
+	group := sdc.Group
+	if group == "" {
+		group = defaultGroup
+	}
+	cfg := &apiConfig{
+		client:      client,
+		namespace:   sdc.Namespace,
+		group:       group,
+		clusters:    strings.Join(sdc.Clusters, ","),
+		healthyOnly: sdc.HealthyOnly,
+		username:    sdc.Username,
+		password:    sdc.Password.String(),
+	}
+	return cfg, nil
+}
+
+// getServiceNames returns the names of all the services in cfg.namespace and cfg.group.
+//
+// See https://nacos.io/en-us/docs/open-api.html#2.7
+func (cfg *apiConfig) getServiceNames() ([]string, error) {
+	var serviceNames []string
+	for pageNo := 1; ; pageNo++ {
+		args := url.Values{}
+		args.Set("pageNo", strconv.Itoa(pageNo))
+		args.Set("pageSize", strconv.Itoa(servicesPageSize))
+		args.Set("groupName", cfg.group)
+		if cfg.namespace != "" {
+			args.Set("namespaceId", cfg.namespace)
+		}
+		data, err := cfg.getAPIResponse("/v1/ns/service/list", args)
+		if err != nil {
+			return nil, err
+		}
+		var sl serviceList
+		if err := json.Unmarshal(data, &sl); err != nil {
+			return nil, fmt.Errorf("cannot parse Nacos service list %q: %w", data, err)
+		}
+		serviceNames = append(serviceNames, sl.Doms...)
+		if len(sl.Doms) < servicesPageSize || len(serviceNames) >= sl.Count {
+			return serviceNames, nil
+		}
+	}
+}
+
+// serviceList is the response of Nacos API for the list of services.
+//
+// See https://nacos.io/en-us/docs/open-api.html#2.7
+type serviceList struct {
+	Count int      `json:"count"`
+	Doms  []string `json:"doms"`
+}
+
+// getServiceInstances returns the instances of the given serviceName.
+//
+// See https://nacos.io/en-us/docs/open-api.html#2.4
+func (cfg *apiConfig) getServiceInstances(serviceName string) (*serviceInstances, error) {
+	args := url.Values{}
+	args.Set("serviceName", serviceName)
+	args.Set("groupName", cfg.group)
+	if cfg.namespace != "" {
+		args.Set("namespaceId", cfg.namespace)
+	}
+	if cfg.clusters != "" {
+		args.Set("clusters", cfg.clusters)
+	}
+	args.Set("healthyOnly", strconv.FormatBool(cfg.healthyOnly))
+	data, err := cfg.getAPIResponse("/v1/ns/instance/list", args)
+	if err != nil {
+		return nil, err
+	}
+	var sis serviceInstances
+	if err := json.Unmarshal(data, &sis); err != nil {
+		return nil, fmt.Errorf("cannot parse Nacos instances for service %q: %q: %w", serviceName, data, err)
+	}
+	return &sis, nil
+}
+
+func (cfg *apiConfig) getAPIResponse(path string, args url.Values) ([]byte, error) {
+	accessToken, err := cfg.getAccessToken()
+	if err != nil {
+		return nil, err
+	}
+	if accessToken != "" {
+		args.Set("accessToken", accessToken)
+	}
+	return cfg.client.GetAPIResponse(path + "?" + args.Encode())
+}
+
+// getAccessToken returns the access token for Nacos API.
+//
+// An empty token is returned if username isn't set, i.e. Nacos authentication is disabled.
+// The token is obtained via login API and is refreshed before it expires.
+//
+// See https://nacos.io/en-us/docs/auth.html
+func (cfg *apiConfig) getAccessToken() (string, error) {
+	if cfg.username == "" {
+		return "", nil
+	}
+	cfg.tokenLock.Lock()
+	defer cfg.tokenLock.Unlock()
+	if cfg.accessToken != "" && time.Now().Before(cfg.tokenExpireAt) {
+		return cfg.accessToken, nil
+	}
+	form := url.Values{}
+	form.Set("username", cfg.username)
+	form.Set("password", cfg.password)
+	body := form.Encode()
+	data, err := cfg.client.GetAPIResponseWithReqParams("/v1/auth/login", func(req *http.Request) {
+		// The credentials are passed in the request body, so they don't appear in the logs with request urls.
+		req.Method = http.MethodPost
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(strings.NewReader(body)), nil
+		}
+		req.Body, _ = req.GetBody()
+		req.ContentLength = int64(len(body))
+	})
+	if err != nil {
+		return "", fmt.Errorf("cannot login to Nacos: %w", err)
+	}
+	var lr loginResponse
+	if err := json.Unmarshal(data, &lr); err != nil {
+		return "", fmt.Errorf("cannot parse Nacos login response: %w", err)
+	}
+	if lr.AccessToken == "" {
+		return "", fmt.Errorf("missing accessToken in Nacos login response")
+	}
+	ttl := time.Duration(lr.TokenTTL) * time.Second
+	// Refresh the token a bit earlier than it expires.
+	cfg.accessToken = lr.AccessToken
+	cfg.tokenExpireAt = time.Now().Add(ttl - ttl/10)
+	return cfg.accessToken, nil
+}
+
+// loginResponse is the response of Nacos login API.
+type loginResponse struct {
+	AccessToken string `json:"accessToken"`
+	TokenTTL    int64  `json:"tokenTtl"`
+}
@@ -0,0 +1,121 @@
+package nacos
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/cprobe/cprobe/lib/discoveryutils"
+	"github.com/cprobe/cprobe/lib/promauth"
+	"github.com/cprobe/cprobe/lib/promutils"
+	"github.com/cprobe/cprobe/lib/proxy"
+)
+
+// SDConfig represents service discovery config for Nacos.
+//
+// See https://nacos.io/en-us/docs/open-api.html
+type SDConfig struct {
+	Server string `yaml:"server,omitempty"`
+	// Namespace is the id of Nacos namespace. The public namespace is used if it isn't set.
+	Namespace string `yaml:"namespace,omitempty"`
+	// Group is Nacos group. DEFAULT_GROUP is used if it isn't set.
+	Group string `yaml:"group,omitempty"`
+	// Services is the list of services to discover. All the services in the group are discovered if it is empty.
+	Services []string `yaml:"services,omitempty"`
+	// Clusters is the list of clusters to discover the instances from. All the clusters are used if it is empty.
+	Clusters []string `yaml:"clusters,omitempty"`
+	// HealthyOnly limits the discovered instances to healthy ones.
+	HealthyOnly bool `yaml:"healthy_only,omitempty"`
+	// Username and Password are used for obtaining access token when Nacos authentication is enabled.
+	Username          string                     `yaml:"username,omitempty"`
+	Password          *promauth.Secret           `yaml:"password,omitempty"`
+	HTTPClientConfig  promauth.HTTPClientConfig  `yaml:",inline"`
+	ProxyURL          *proxy.URL                 `yaml:"proxy_url,omitempty"`
+	ProxyClientConfig promauth.ProxyClientConfig `yaml:",inline"`
+	// RefreshInterval is the interval for refreshing the discovered targets in background.
+	// The scrape_interval of the job is used if it isn't set.
+	RefreshInterval *promutils.Duration `yaml:"refresh_interval,omitempty"`
+}
+
+// GetLabels returns Nacos labels according to sdc.
+func (sdc *SDConfig) GetLabels(baseDir string) ([]*promutils.Labels, error) {
+	cfg, err := getAPIConfig(sdc, baseDir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get API config: %w", err)
+	}
+	serviceNames := sdc.Services
+	if len(serviceNames) == 0 {
+		serviceNames, err = cfg.getServiceNames()
+		if err != nil {
+			return nil, err
+		}
+	}
+	var ms []*promutils.Labels
+	for _, serviceName := range serviceNames {
+		sis, err := cfg.getServiceInstances(serviceName)
+		if err != nil {
+			return nil, err
+		}
+		ms = appendInstanceLabels(ms, cfg.namespace, cfg.group, serviceName, sis)
+	}
+	return ms, nil
+}
+
+// MustStop stops further usage for sdc.
+func (sdc *SDConfig) MustStop() {
+	v := configMap.Delete(sdc)
+	if v != nil {
+		cfg := v.(*apiConfig)
+		cfg.client.Stop()
+	}
+}
+
+// serviceInstances is the response of Nacos API for the instances of a service.
+//
+// See https://nacos.io/en-us/docs/open-api.html#2.4
+type serviceInstances struct {
+	Name  string     `json:"name"`
+	Hosts []Instance `json:"hosts"`
+}
+
+// Instance is Nacos service instance.
+//
+// See https://nacos.io/en-us/docs/open-api.html#2.4
+type Instance struct {
+	InstanceID  string            `json:"instanceId"`
+	IP          string            `json:"ip"`
+	Port        int               `json:"port"`
+	Weight      float64           `json:"weight"`
+	Healthy     bool              `json:"healthy"`
+	Enabled     bool              `json:"enabled"`
+	Ephemeral   bool              `json:"ephemeral"`
+	ClusterName string            `json:"clusterName"`
+	Metadata    map[string]string `json:"metadata"`
+}
+
+func appendInstanceLabels(ms []*promutils.Labels, namespace, group, serviceName string, sis *serviceInstances) []*promutils.Labels {
+	hosts := sis.Hosts
+	sort.SliceStable(hosts, func(i, j int) bool {
+		return hosts[i].InstanceID < hosts[j].InstanceID
+	})
+	for _, inst := range hosts {
+		m := promutils.NewLabels(16)
+		m.Add("__address__", discoveryutils.JoinHostPort(inst.IP, inst.Port))
+		m.Add("__meta_nacos_namespace", namespace)
+		m.Add("__meta_nacos_group", group)
+		m.Add("__meta_nacos_service", serviceName)
+		m.Add("__meta_nacos_cluster", inst.ClusterName)
+		m.Add("__meta_nacos_instance_id", inst.InstanceID)
+		m.Add("__meta_nacos_instance_ip", inst.IP)
+		m.Add("__meta_nacos_instance_port", strconv.Itoa(inst.Port))
+		m.Add("__meta_nacos_instance_weight", strconv.FormatFloat(inst.Weight, 'f', -1, 64))
+		m.Add("__meta_nacos_instance_healthy", strconv.FormatBool(inst.Healthy))
+		m.Add("__meta_nacos_instance_enabled", strconv.FormatBool(inst.Enabled))
+		m.Add("__meta_nacos_instance_ephemeral", strconv.FormatBool(inst.Ephemeral))
+		for k, v := range inst.Metadata {
+			m.Add(discoveryutils.SanitizeLabelName("__meta_nacos_instance_metadata_"+k), v)
+		}
+		ms = append(ms, m)
+	}
+	return ms
+}
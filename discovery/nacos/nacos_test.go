@@ -0,0 +1,143 @@
+package nacos
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/cprobe/cprobe/lib/discoveryutils"
+	"github.com/cprobe/cprobe/lib/promauth"
+	"github.com/cprobe/cprobe/lib/promutils"
+)
+
+func TestAppendInstanceLabels(t *testing.T) {
+	sis := &serviceInstances{
+		Name: "DEFAULT_GROUP@@order-service",
+		Hosts: []Instance{
+			{
+				InstanceID:  "10.0.0.2#8080#DEFAULT#DEFAULT_GROUP@@order-service",
+				IP:          "10.0.0.2",
+				Port:        8080,
+				Weight:      1,
+				Healthy:     false,
+				Enabled:     true,
+				Ephemeral:   true,
+				ClusterName: "DEFAULT",
+			},
+			{
+				InstanceID:  "10.0.0.1#8080#DEFAULT#DEFAULT_GROUP@@order-service",
+				IP:          "10.0.0.1",
+				Port:        8080,
+				Weight:      0.5,
+				Healthy:     true,
+				Enabled:     true,
+				Ephemeral:   true,
+				ClusterName: "DEFAULT",
+				Metadata: map[string]string{
+					"preserved.register.source": "SPRING_CLOUD",
+				},
+			},
+		},
+	}
+	labelss := appendInstanceLabels(nil, "prod", "DEFAULT_GROUP", "order-service", sis)
+	discoveryutils.TestEqualLabelss(t, labelss, []*promutils.Labels{
+		promutils.NewLabelsFromMap(map[string]string{
+			"__address__":                                              "10.0.0.1:8080",
+			"__meta_nacos_namespace":                                   "prod",
+			"__meta_nacos_group":                                       "DEFAULT_GROUP",
+			"__meta_nacos_service":                                     "order-service",
+			"__meta_nacos_cluster":                                     "DEFAULT",
+			"__meta_nacos_instance_id":                                 "10.0.0.1#8080#DEFAULT#DEFAULT_GROUP@@order-service",
+			"__meta_nacos_instance_ip":                                 "10.0.0.1",
+			"__meta_nacos_instance_port":                               "8080",
+			"__meta_nacos_instance_weight":                             "0.5",
+			"__meta_nacos_instance_healthy":                            "true",
+			"__meta_nacos_instance_enabled":                            "true",
+			"__meta_nacos_instance_ephemeral":                          "true",
+			"__meta_nacos_instance_metadata_preserved_register_source": "SPRING_CLOUD",
+		}),
+		promutils.NewLabelsFromMap(map[string]string{
+			"__address__":                     "10.0.0.2:8080",
+			"__meta_nacos_namespace":          "prod",
+			"__meta_nacos_group":              "DEFAULT_GROUP",
+			"__meta_nacos_service":            "order-service",
+			"__meta_nacos_cluster":            "DEFAULT",
+			"__meta_nacos_instance_id":        "10.0.0.2#8080#DEFAULT#DEFAULT_GROUP@@order-service",
+			"__meta_nacos_instance_ip":        "10.0.0.2",
+			"__meta_nacos_instance_port":      "8080",
+			"__meta_nacos_instance_weight":    "1",
+			"__meta_nacos_instance_healthy":   "false",
+			"__meta_nacos_instance_enabled":   "true",
+			"__meta_nacos_instance_ephemeral": "true",
+		}),
+	})
+}
+
+func TestGetLabels(t *testing.T) {
+	var logins atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/nacos/v1/auth/login" {
+			if r.Method != http.MethodPost || r.FormValue("username") != "nacos" || r.FormValue("password") != "secret" {
+				http.Error(w, "unknown user", http.StatusForbidden)
+				return
+			}
+			logins.Add(1)
+			fmt.Fprintf(w, `{"accessToken": "token-1", "tokenTtl": 18000, "globalAdmin": true}`)
+			return
+		}
+		q := r.URL.Query()
+		if q.Get("accessToken") != "token-1" {
+			http.Error(w, "unknown user", http.StatusForbidden)
+			return
+		}
+		if q.Get("namespaceId") != "prod" || q.Get("groupName") != "DEFAULT_GROUP" {
+			http.Error(w, "unexpected query: "+r.URL.RawQuery, http.StatusBadRequest)
+			return
+		}
+		switch r.URL.Path {
+		case "/nacos/v1/ns/service/list":
+			fmt.Fprintf(w, `{"count": 2, "doms": ["order-service", "user-service"]}`)
+		case "/nacos/v1/ns/instance/list":
+			switch q.Get("serviceName") {
+			case "order-service":
+				fmt.Fprintf(w, `{"name": "DEFAULT_GROUP@@order-service", "hosts": [{"instanceId": "a", "ip": "10.0.0.1", "port": 8080, "weight": 1, "healthy": true, "enabled": true, "clusterName": "DEFAULT"}]}`)
+			case "user-service":
+				fmt.Fprintf(w, `{"name": "DEFAULT_GROUP@@user-service", "hosts": [{"instanceId": "b", "ip": "10.0.0.2", "port": 9090, "weight": 1, "healthy": true, "enabled": true, "clusterName": "DEFAULT"}]}`)
+			default:
+				http.Error(w, "unknown service", http.StatusNotFound)
+			}
+		default:
+			http.Error(w, "unexpected path: "+r.URL.Path, http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	sdc := &SDConfig{
+		Server:    srv.URL,
+		Namespace: "prod",
+		Username:  "nacos",
+		Password:  promauth.NewSecret("secret"),
+	}
+	defer sdc.MustStop()
+	for i := 0; i < 2; i++ {
+		labelss, err := sdc.GetLabels("")
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(labelss) != 2 {
+			t.Fatalf("unexpected number of targets; got %d; want 2", len(labelss))
+		}
+		if got := labelss[0].Get("__address__"); got != "10.0.0.1:8080" {
+			t.Fatalf("unexpected address for order-service; got %q; want %q", got, "10.0.0.1:8080")
+		}
+		if got := labelss[1].Get("__meta_nacos_service"); got != "user-service" {
+			t.Fatalf("unexpected service; got %q; want %q", got, "user-service")
+		}
+	}
+	// The access token is reused until it expires.
+	if n := logins.Load(); n != 1 {
+		t.Fatalf("unexpected number of logins; got %d; want 1", n)
+	}
+}
@@ -29,12 +29,13 @@ type SDConfig struct {
 	ApplicationCredentialSecret *promauth.Secret `yaml:"application_credential_secret,omitempty"`
 	Role                        string           `yaml:"role"`
 	Region                      string           `yaml:"region"`
-	// RefreshInterval time.Duration `yaml:"refresh_interval"`
-	// refresh_interval is obtained from `-promscrape.openstackSDCheckInterval` command-line option.
-	Port         int                 `yaml:"port,omitempty"`
-	AllTenants   bool                `yaml:"all_tenants,omitempty"`
-	TLSConfig    *promauth.TLSConfig `yaml:"tls_config,omitempty"`
-	Availability string              `yaml:"availability,omitempty"`
+	// RefreshInterval is the interval for refreshing the discovered targets in background.
+	// The scrape_interval of the job is used if it isn't set.
+	RefreshInterval *promutils.Duration `yaml:"refresh_interval,omitempty"`
+	Port            int                 `yaml:"port,omitempty"`
+	AllTenants      bool                `yaml:"all_tenants,omitempty"`
+	TLSConfig       *promauth.TLSConfig `yaml:"tls_config,omitempty"`
+	Availability    string              `yaml:"availability,omitempty"`
 }
 
 // GetLabels returns OpenStack labels according to sdc.
@@ -21,6 +21,9 @@ type SDConfig struct {
 	YandexPassportOAuthToken *promauth.Secret    `yaml:"yandex_passport_oauth_token,omitempty"`
 	APIEndpoint              string              `yaml:"api_endpoint,omitempty"`
 	TLSConfig                *promauth.TLSConfig `yaml:"tls_config,omitempty"`
+	// RefreshInterval is the interval for refreshing the discovered targets in background.
+	// The scrape_interval of the job is used if it isn't set.
+	RefreshInterval *promutils.Duration `yaml:"refresh_interval,omitempty"`
 }
 
 // GetLabels returns labels for Yandex Cloud according to service discover config.
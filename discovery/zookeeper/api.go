@@ -0,0 +1,163 @@
+package zookeeper
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cprobe/cprobe/lib/discoveryutils"
+	"github.com/cprobe/cprobe/lib/logger"
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+const defaultSessionTimeout = 10 * time.Second
+
+var configMap = discoveryutils.NewConfigMap()
+
+type apiConfig struct {
+	conn   zkConn
+	format string
+	paths  []string
+}
+
+// zkConn is a connection to ZooKeeper.
+//
+// It is an interface, so tests could use ZooKeeper tree in memory.
+type zkConn interface {
+	// Children returns the names of the children of the node at the given path.
+	Children(path string) ([]string, error)
+
+	// Get returns the data of the node at the given path.
+	Get(path string) ([]byte, error)
+
+	// Close closes the connection.
+	Close()
+}
+
+func getAPIConfig(sdc *SDConfig, baseDir string) (*apiConfig, error) {
+	v, err := configMap.Get(sdc, func() (interface{}, error) { return newAPIConfig(sdc, baseDir) })
+	if err != nil {
+		return nil, err
+	}
+	return v.(*apiConfig), nil
+}
+
+func newAPIConfig(sdc *SDConfig, _ string) (*apiConfig, error) {
+	if len(sdc.Servers) == 0 {
+		return nil, fmt.Errorf("`servers` cannot be empty")
+	}
+	if len(sdc.Paths) == 0 {
+		return nil, fmt.Errorf("`paths` cannot be empty")
+	}
+	paths := make([]string, 0, len(sdc.Paths))
+	for _, p := range sdc.Paths {
+		if !strings.HasPrefix(p, "/") {
+			return nil, fmt.Errorf("path %q must start with /", p)
+		}
+		paths = append(paths, path.Clean(p))
+	}
+	format := sdc.Format
+	switch format {
+	case "":
+		format = formatServerset
+	case formatServerset, formatDubbo:
+	default:
+		return nil, fmt.Errorf("unsupported `format`: %q; supported values: serverset, dubbo", format)
+	}
+	timeout := sdc.Timeout.Duration()
+	if timeout <= 0 {
+		timeout = defaultSessionTimeout
+	}
+	conn, err := newSessionConn(sdc.Servers, timeout)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &apiConfig{
+		conn:   conn,
+		format: format,
+		paths:  paths,
+	}
+	return cfg, nil
+}
+
+// sessionConn is zkConn, which fails requests when there is no session with ZooKeeper
+// instead of waiting until the session is re-established.
+type sessionConn struct {
+	servers []string
+	conn    *zk.Conn
+}
+
+func newSessionConn(servers []string, timeout time.Duration) (*sessionConn, error) {
+	conn, events, err := zk.Connect(servers, timeout, zk.WithLogger(zkLogger{}))
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to ZooKeeper %q: %w", servers, err)
+	}
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	for {
+		select {
+		case e := <-events:
+			if e.State == zk.StateHasSession {
+				return &sessionConn{
+					servers: servers,
+					conn:    conn,
+				}, nil
+			}
+		case <-t.C:
+			conn.Close()
+			return nil, fmt.Errorf("cannot establish session with ZooKeeper %q in %s", servers, timeout)
+		}
+	}
+}
+
+func (sc *sessionConn) checkSession() error {
+	if state := sc.conn.State(); state != zk.StateHasSession {
+		return fmt.Errorf("no session with ZooKeeper %q; state: %s", sc.servers, state)
+	}
+	return nil
+}
+
+func (sc *sessionConn) Children(path string) ([]string, error) {
+	if err := sc.checkSession(); err != nil {
+		return nil, err
+	}
+	children, _, err := sc.conn.Children(path)
+	return children, err
+}
+
+func (sc *sessionConn) Get(path string) ([]byte, error) {
+	if err := sc.checkSession(); err != nil {
+		return nil, err
+	}
+	data, _, err := sc.conn.Get(path)
+	return data, err
+}
+
+func (sc *sessionConn) Close() {
+	sc.conn.Close()
+}
+
+// zkLogger sends the logs of ZooKeeper client to lib/logger.
+type zkLogger struct{}
+
+func (zkLogger) Printf(format string, args ...interface{}) {
+	logger.Infof("zookeeper_sd: "+format, args...)
+}
+
+// getSortedChildren returns the sorted names of the children of the node at the given path.
+//
+// An empty list is returned if the node doesn't exist, e.g. when there are no registered services yet.
+func getSortedChildren(conn zkConn, p string) ([]string, error) {
+	children, err := conn.Children(p)
+	if err != nil {
+		if errors.Is(err, zk.ErrNoNode) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("cannot list children of %q: %w", p, err)
+	}
+	sort.Strings(children)
+	return children, nil
+}
@@ -0,0 +1,87 @@
+package zookeeper
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"sort"
+
+	"github.com/cprobe/cprobe/lib/discoveryutils"
+	"github.com/cprobe/cprobe/lib/logger"
+	"github.com/cprobe/cprobe/lib/promutils"
+)
+
+// dubboProvidersNode is the name of the node with the providers of Dubbo service interface.
+const dubboProvidersNode = "providers"
+
+// appendDubboLabels appends labels for Dubbo providers registered at the given path to ms.
+//
+// The path is either the Dubbo root node such as `/dubbo` or the providers node of a single service interface
+// such as `/dubbo/com.example.DemoService/providers`.
+func appendDubboLabels(ms []*promutils.Labels, conn zkConn, p string) ([]*promutils.Labels, error) {
+	if path.Base(p) == dubboProvidersNode {
+		return appendDubboProvidersLabels(ms, conn, p, path.Base(path.Dir(p)))
+	}
+	services, err := getSortedChildren(conn, p)
+	if err != nil {
+		return nil, err
+	}
+	for _, service := range services {
+		providersPath := joinPath(joinPath(p, service), dubboProvidersNode)
+		ms, err = appendDubboProvidersLabels(ms, conn, providersPath, service)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ms, nil
+}
+
+func appendDubboProvidersLabels(ms []*promutils.Labels, conn zkConn, providersPath, service string) ([]*promutils.Labels, error) {
+	providers, err := getSortedChildren(conn, providersPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, provider := range providers {
+		labels, err := getDubboProviderLabels(providersPath, service, provider)
+		if err != nil {
+			logger.Errorf("zookeeper_sd: skipping Dubbo provider %q at %q: %s", provider, providersPath, err)
+			continue
+		}
+		ms = append(ms, labels)
+	}
+	return ms, nil
+}
+
+// getDubboProviderLabels returns labels for the given provider node name, which is URL-encoded provider url
+// such as `dubbo%3A%2F%2F10.0.0.1%3A20880%2Fcom.example.DemoService%3Fapplication%3Ddemo`.
+func getDubboProviderLabels(providersPath, service, provider string) (*promutils.Labels, error) {
+	s, err := url.QueryUnescape(provider)
+	if err != nil {
+		return nil, fmt.Errorf("cannot unescape provider url: %w", err)
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse provider url: %w", err)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("missing host in provider url %q", s)
+	}
+	params := u.Query()
+	m := promutils.NewLabels(16)
+	m.Add("__address__", u.Host)
+	m.Add("__meta_dubbo_path", providersPath)
+	m.Add("__meta_dubbo_service", service)
+	m.Add("__meta_dubbo_protocol", u.Scheme)
+	m.Add("__meta_dubbo_application", params.Get("application"))
+	m.Add("__meta_dubbo_version", params.Get("version"))
+	m.Add("__meta_dubbo_group", params.Get("group"))
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		m.Add(discoveryutils.SanitizeLabelName("__meta_dubbo_param_"+k), params.Get(k))
+	}
+	return m, nil
+}
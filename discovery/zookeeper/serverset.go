@@ -0,0 +1,89 @@
+package zookeeper
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/cprobe/cprobe/lib/discoveryutils"
+	"github.com/cprobe/cprobe/lib/logger"
+	"github.com/cprobe/cprobe/lib/promutils"
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+// serversetMember is the data of serverset member node.
+//
+// See https://github.com/twitter/finagle/blob/develop/finagle-serversets/src/main/thrift/endpoint.thrift
+type serversetMember struct {
+	ServiceEndpoint     serversetEndpoint            `json:"serviceEndpoint"`
+	AdditionalEndpoints map[string]serversetEndpoint `json:"additionalEndpoints"`
+	Status              string                       `json:"status"`
+	Shard               int                          `json:"shard"`
+}
+
+type serversetEndpoint struct {
+	Host string `json:"host"`
+	Port int    `json:"port"`
+}
+
+func parseServersetMember(data []byte) (*serversetMember, error) {
+	var m serversetMember
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// appendServersetLabels appends labels for the serverset members at the given path to ms.
+//
+// See https://prometheus.io/docs/prometheus/latest/configuration/configuration/#serverset_sd_config
+func appendServersetLabels(ms []*promutils.Labels, conn zkConn, path string) ([]*promutils.Labels, error) {
+	children, err := getSortedChildren(conn, path)
+	if err != nil {
+		return nil, err
+	}
+	for _, child := range children {
+		memberPath := joinPath(path, child)
+		data, err := conn.Get(memberPath)
+		if err != nil {
+			if errors.Is(err, zk.ErrNoNode) {
+				// The member has been removed after listing the children.
+				continue
+			}
+			return nil, fmt.Errorf("cannot read %q: %w", memberPath, err)
+		}
+		if len(data) == 0 {
+			continue
+		}
+		member, err := parseServersetMember(data)
+		if err != nil {
+			logger.Errorf("zookeeper_sd: skipping serverset member %q, since it cannot be parsed: %s", memberPath, err)
+			continue
+		}
+		ms = append(ms, member.getTargetLabels(memberPath))
+	}
+	return ms, nil
+}
+
+func (m *serversetMember) getTargetLabels(memberPath string) *promutils.Labels {
+	labels := promutils.NewLabels(16)
+	labels.Add("__address__", discoveryutils.JoinHostPort(m.ServiceEndpoint.Host, m.ServiceEndpoint.Port))
+	labels.Add("__meta_serverset_path", memberPath)
+	labels.Add("__meta_serverset_endpoint_host", m.ServiceEndpoint.Host)
+	labels.Add("__meta_serverset_endpoint_port", strconv.Itoa(m.ServiceEndpoint.Port))
+	for name, ep := range m.AdditionalEndpoints {
+		labels.Add(discoveryutils.SanitizeLabelName("__meta_serverset_endpoint_host_"+name), ep.Host)
+		labels.Add(discoveryutils.SanitizeLabelName("__meta_serverset_endpoint_port_"+name), strconv.Itoa(ep.Port))
+	}
+	labels.Add("__meta_serverset_status", m.Status)
+	labels.Add("__meta_serverset_shard", strconv.Itoa(m.Shard))
+	return labels
+}
+
+func joinPath(parent, child string) string {
+	if parent == "/" {
+		return "/" + child
+	}
+	return parent + "/" + child
+}
@@ -0,0 +1,64 @@
+package zookeeper
+
+import (
+	"fmt"
+
+	"github.com/cprobe/cprobe/lib/promutils"
+)
+
+// SDConfig represents service discovery config for services registered in ZooKeeper.
+//
+// The following formats of the registered services are supported:
+//
+//   - serverset: the members of Twitter/Finagle serversets. Every path contains member nodes with JSON data.
+//     See https://prometheus.io/docs/prometheus/latest/configuration/configuration/#serverset_sd_config
+//   - dubbo: Apache Dubbo providers. Every path is either the Dubbo root node such as `/dubbo`,
+//     which contains service interfaces, or the `providers` node of a single interface such as `/dubbo/com.example.DemoService/providers`.
+//     See https://dubbo.apache.org/en/overview/reference/integrations/zookeeper/
+type SDConfig struct {
+	Servers []string `yaml:"servers"`
+	Paths   []string `yaml:"paths"`
+	// Format is the format of the registered services: serverset or dubbo. serverset is used if it isn't set.
+	Format string `yaml:"format,omitempty"`
+	// Timeout is ZooKeeper session timeout. 10s is used if it isn't set.
+	Timeout *promutils.Duration `yaml:"timeout,omitempty"`
+	// RefreshInterval is the interval for refreshing the discovered targets in background.
+	// The scrape_interval of the job is used if it isn't set.
+	RefreshInterval *promutils.Duration `yaml:"refresh_interval,omitempty"`
+}
+
+// Supported values for `format` option.
+const (
+	formatServerset = "serverset"
+	formatDubbo     = "dubbo"
+)
+
+// GetLabels returns ZooKeeper labels according to sdc.
+func (sdc *SDConfig) GetLabels(baseDir string) ([]*promutils.Labels, error) {
+	cfg, err := getAPIConfig(sdc, baseDir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get API config: %w", err)
+	}
+	var ms []*promutils.Labels
+	for _, path := range cfg.paths {
+		switch cfg.format {
+		case formatServerset:
+			ms, err = appendServersetLabels(ms, cfg.conn, path)
+		case formatDubbo:
+			ms, err = appendDubboLabels(ms, cfg.conn, path)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ms, nil
+}
+
+// MustStop stops further usage for sdc.
+func (sdc *SDConfig) MustStop() {
+	v := configMap.Delete(sdc)
+	if v != nil {
+		cfg := v.(*apiConfig)
+		cfg.conn.Close()
+	}
+}
@@ -0,0 +1,151 @@
+package zookeeper
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/cprobe/cprobe/lib/discoveryutils"
+	"github.com/cprobe/cprobe/lib/promutils"
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+// fakeConn is zkConn with ZooKeeper tree in memory. The keys are node paths, the values are node data.
+type fakeConn map[string]string
+
+func (fc fakeConn) Children(path string) ([]string, error) {
+	if _, ok := fc[path]; !ok {
+		return nil, zk.ErrNoNode
+	}
+	prefix := strings.TrimSuffix(path, "/") + "/"
+	var children []string
+	for p := range fc {
+		if strings.HasPrefix(p, prefix) && !strings.Contains(p[len(prefix):], "/") {
+			children = append(children, p[len(prefix):])
+		}
+	}
+	return children, nil
+}
+
+func (fc fakeConn) Get(path string) ([]byte, error) {
+	data, ok := fc[path]
+	if !ok {
+		return nil, zk.ErrNoNode
+	}
+	return []byte(data), nil
+}
+
+func (fc fakeConn) Close() {}
+
+func TestAppendServersetLabels(t *testing.T) {
+	conn := fakeConn{
+		"/aurora/jobs/web":                   "",
+		"/aurora/jobs/web/member_0000000001": `{"serviceEndpoint": {"host": "10.0.0.2", "port": 8080}, "additionalEndpoints": {"admin": {"host": "10.0.0.2", "port": 9990}}, "status": "ALIVE", "shard": 1}`,
+		"/aurora/jobs/web/member_0000000000": `{"serviceEndpoint": {"host": "10.0.0.1", "port": 8080}, "status": "ALIVE", "shard": 0}`,
+		"/aurora/jobs/web/member_0000000003": `invalid json`,
+		"/aurora/jobs/web/lock":              ``,
+	}
+	labelss, err := appendServersetLabels(nil, conn, "/aurora/jobs/web")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	discoveryutils.TestEqualLabelss(t, labelss, []*promutils.Labels{
+		promutils.NewLabelsFromMap(map[string]string{
+			"__address__":                    "10.0.0.1:8080",
+			"__meta_serverset_path":          "/aurora/jobs/web/member_0000000000",
+			"__meta_serverset_endpoint_host": "10.0.0.1",
+			"__meta_serverset_endpoint_port": "8080",
+			"__meta_serverset_status":        "ALIVE",
+			"__meta_serverset_shard":         "0",
+		}),
+		promutils.NewLabelsFromMap(map[string]string{
+			"__address__":                          "10.0.0.2:8080",
+			"__meta_serverset_path":                "/aurora/jobs/web/member_0000000001",
+			"__meta_serverset_endpoint_host":       "10.0.0.2",
+			"__meta_serverset_endpoint_port":       "8080",
+			"__meta_serverset_endpoint_host_admin": "10.0.0.2",
+			"__meta_serverset_endpoint_port_admin": "9990",
+			"__meta_serverset_status":              "ALIVE",
+			"__meta_serverset_shard":               "1",
+		}),
+	})
+
+	// missing path means there are no members yet
+	labelss, err = appendServersetLabels(nil, conn, "/aurora/jobs/missing")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(labelss) != 0 {
+		t.Fatalf("unexpected labels for missing path: %v", labelss)
+	}
+}
+
+func TestAppendDubboLabels(t *testing.T) {
+	provider := func(s string) string {
+		return url.QueryEscape(s)
+	}
+	conn := fakeConn{
+		"/dubbo":                         "",
+		"/dubbo/com.example.DemoService": "",
+		"/dubbo/com.example.DemoService/consumers": "",
+		"/dubbo/com.example.DemoService/providers": "",
+		"/dubbo/com.example.DemoService/providers/" + provider("dubbo://10.0.0.1:20880/com.example.DemoService?application=demo-provider&side=provider&version=1.0.0"): "",
+		"/dubbo/com.example.DemoService/providers/" + provider("tri://10.0.0.2:50051/com.example.DemoService?application=demo-provider&group=g1"):                      "",
+		"/dubbo/com.example.DemoService/providers/%zz": "",
+		"/dubbo/com.example.EmptyService":              "",
+	}
+	labelsDemo1 := promutils.NewLabelsFromMap(map[string]string{
+		"__address__":                    "10.0.0.1:20880",
+		"__meta_dubbo_path":              "/dubbo/com.example.DemoService/providers",
+		"__meta_dubbo_service":           "com.example.DemoService",
+		"__meta_dubbo_protocol":          "dubbo",
+		"__meta_dubbo_application":       "demo-provider",
+		"__meta_dubbo_version":           "1.0.0",
+		"__meta_dubbo_group":             "",
+		"__meta_dubbo_param_application": "demo-provider",
+		"__meta_dubbo_param_side":        "provider",
+		"__meta_dubbo_param_version":     "1.0.0",
+	})
+	labelsDemo2 := promutils.NewLabelsFromMap(map[string]string{
+		"__address__":                    "10.0.0.2:50051",
+		"__meta_dubbo_path":              "/dubbo/com.example.DemoService/providers",
+		"__meta_dubbo_service":           "com.example.DemoService",
+		"__meta_dubbo_protocol":          "tri",
+		"__meta_dubbo_application":       "demo-provider",
+		"__meta_dubbo_version":           "",
+		"__meta_dubbo_group":             "g1",
+		"__meta_dubbo_param_application": "demo-provider",
+		"__meta_dubbo_param_group":       "g1",
+	})
+
+	f := func(path string, want []*promutils.Labels) {
+		t.Helper()
+		labelss, err := appendDubboLabels(nil, conn, path)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		discoveryutils.TestEqualLabelss(t, labelss, want)
+	}
+
+	// Dubbo root
+	f("/dubbo", []*promutils.Labels{labelsDemo1, labelsDemo2})
+
+	// providers of a single service
+	f("/dubbo/com.example.DemoService/providers", []*promutils.Labels{labelsDemo1, labelsDemo2})
+
+	// missing root
+	f("/missing", nil)
+}
+
+func TestNewAPIConfigFailure(t *testing.T) {
+	f := func(sdc *SDConfig) {
+		t.Helper()
+		if _, err := newAPIConfig(sdc, ""); err == nil {
+			t.Fatalf("expecting non-nil error")
+		}
+	}
+	f(&SDConfig{Paths: []string{"/dubbo"}})
+	f(&SDConfig{Servers: []string{"localhost:2181"}})
+	f(&SDConfig{Servers: []string{"localhost:2181"}, Paths: []string{"dubbo"}})
+	f(&SDConfig{Servers: []string{"localhost:2181"}, Paths: []string{"/dubbo"}, Format: "nerve"})
+}
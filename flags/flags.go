@@ -8,6 +8,9 @@ import (
 
 var (
 	ConfigDirectory string
+
+	// PullMode 打开之后，每个 target 最近一次抓取的数据会保存在内存里，通过 /metrics/probe 和 /federate 暴露出去
+	PullMode bool
 )
 
 func Check() error {
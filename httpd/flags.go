@@ -7,6 +7,8 @@ var (
 	HTTPPort                        int
 	HTTPUsername                    string
 	HTTPPassword                    string
+	HTTPAdminUsername               string
+	HTTPAdminPassword               string
 	HTTPMode                        string
 	HTTPPProf                       bool
 	HTTPReadHeaderTimeout           time.Duration
@@ -14,9 +14,9 @@ import (
 	"strings"
 	"time"
 
+	"github.com/VictoriaMetrics/metrics"
 	"github.com/cprobe/cprobe/flags"
 	"github.com/cprobe/cprobe/lib/flagutil"
-	"github.com/cprobe/cprobe/lib/fs"
 	"github.com/cprobe/cprobe/probe"
 	"github.com/cprobe/cprobe/writer"
 	"gopkg.in/yaml.v2"
@@ -26,6 +26,8 @@ import (
 	"github.com/cprobe/cprobe/lib/ginx"
 	"github.com/cprobe/cprobe/lib/httptls"
 	"github.com/cprobe/cprobe/lib/logger"
+	"github.com/cprobe/cprobe/lib/prompbmarshal"
+	"github.com/cprobe/cprobe/lib/redact"
 	"github.com/gin-contrib/pprof"
 	"github.com/gin-gonic/gin"
 	"github.com/valyala/fastrand"
@@ -44,12 +46,44 @@ plugins:
     {{ range $key, $value := .Plugins }}
        <li><a href='plugins/{{ $key }}'>{{ $key }}</a></li>
     {{ end }}`
+
+	targetsHtml = `<h2>Active targets</h2>
+<table border="1" cellpadding="4" style="border-collapse: collapse">
+<tr><th>job</th><th>plugin</th><th>endpoint</th><th>state</th><th>labels</th><th>last scrape</th><th>duration</th><th>samples</th><th>error</th><th>discovered labels</th></tr>
+{{ range .Active }}
+<tr>
+  <td>{{ .ScrapePool }}</td>
+  <td>{{ .Plugin }}</td>
+  <td>{{ .ScrapeURL }}</td>
+  <td>{{ .Health }}</td>
+  <td>{{ range $k, $v := .Labels }}{{ $k }}="{{ $v }}" {{ end }}</td>
+  <td>{{ if .LastScrape.IsZero }}never{{ else }}{{ .LastScrape.Format "2006-01-02 15:04:05" }}{{ end }}</td>
+  <td>{{ printf "%.3fs" .LastScrapeDuration }}</td>
+  <td>{{ .LastSamplesScraped }}</td>
+  <td>{{ .LastError }}</td>
+  <td>{{ range $k, $v := .DiscoveredLabels }}{{ $k }}="{{ $v }}" {{ end }}</td>
+</tr>
+{{ end }}
+</table>
+<h2>Dropped targets</h2>
+<table border="1" cellpadding="4" style="border-collapse: collapse">
+<tr><th>job</th><th>discovered labels</th></tr>
+{{ range .Dropped }}
+<tr>
+  <td>{{ .ScrapePool }}</td>
+  <td>{{ range $k, $v := .DiscoveredLabels }}{{ $k }}="{{ $v }}" {{ end }}</td>
+</tr>
+{{ end }}
+</table>`
 )
 
 func init() {
 	flag.StringVar(&HTTPListen, "http.listen", "0.0.0.0:5858", "Address to listen for http connections.")
 	flag.StringVar(&HTTPUsername, "http.username", "", "Username for basic http authentication. No authentication is performed if username is empty.")
 	flag.StringVar(&HTTPPassword, "http.password", "", "Password for basic http authentication. No authentication is performed if password is empty.")
+	flag.StringVar(&HTTPAdminUsername, "http.adminUsername", "", "Username of the admin for basic http authentication. Only the admin may see secrets on /config, /plugins/<name>, /targets and /api/v1/targets pages with ?show_secrets=true query arg. "+
+		"-http.adminUsername and -http.adminPassword must be set together with -http.username and -http.password")
+	flag.StringVar(&HTTPAdminPassword, "http.adminPassword", "", "Password of the admin for basic http authentication. See -http.adminUsername")
 	flag.StringVar(&HTTPMode, "http.mode", "release", "Gin mode. One of: {debug|release|test}")
 	flag.BoolVar(&HTTPPProf, "http.pprof", false, "Enable pprof http handlers. This is insecure and should be disabled in production.")
 	flag.DurationVar(&HTTPReadHeaderTimeout, "http.readTimeout", time.Second*5, "Maximum duration for reading request header.")
@@ -91,9 +125,13 @@ func Router() *HTTPRouter {
 	r.Use(gin.Recovery())
 	r.Use(ginx.BombRecovery())
 	if HTTPUsername != "" && HTTPPassword != "" {
-		r.Use(gin.BasicAuth(gin.Accounts{
+		accounts := gin.Accounts{
 			HTTPUsername: HTTPPassword,
-		}))
+		}
+		if adminEnabled() {
+			accounts[HTTPAdminUsername] = HTTPAdminPassword
+		}
+		r.Use(gin.BasicAuth(accounts))
 	}
 
 	if HTTPPProf {
@@ -102,11 +140,14 @@ func Router() *HTTPRouter {
 
 	r.GET("/", func(c *gin.Context) {
 		endpoints := map[string]string{
-			"targets": "status for discovered active targets",
-			"metrics": "available service metrics",
-			"flags":   "command-line flags",
-			"config":  "cprobe config contents",
-			"reload":  "reload configuration",
+			"targets":        "status for discovered active targets",
+			"api/v1/targets": "advanced information about discovered targets in JSON format",
+			"metrics":        "available service metrics",
+			"metrics/probe":  "latest scraped samples of all the targets, requires -pull",
+			"federate":       "latest scraped samples of the given ?job=..., requires -pull",
+			"flags":          "command-line flags",
+			"config":         "cprobe config contents",
+			"reload":         "reload configuration",
 		}
 		if HTTPPProf {
 			endpoints["/debug/pprof"] = "pprof"
@@ -117,40 +158,74 @@ func Router() *HTTPRouter {
 			Plugins   map[string][]*probe.Config
 		}{
 			Endpoints: endpoints,
-			Plugins:   probe.PluginCfgs,
+			Plugins:   probe.GetPluginConfigs(),
 		}
 		c.Header("Content-Type", "text/html; charset=utf-8")
 		parse, _ := template.New("index").Parse(indexHtlm)
 		parse.Execute(c.Writer, temp)
 	})
+	r.GET("/targets", func(c *gin.Context) {
+		temp := struct {
+			Active  []probe.ActiveTarget
+			Dropped []probe.DroppedTarget
+		}{
+			Active:  filterActiveTargets(getActiveTargets(showSecrets(c)), c.Query("scrapePool")),
+			Dropped: filterDroppedTargets(getDroppedTargets(showSecrets(c)), c.Query("scrapePool")),
+		}
+		c.Header("Content-Type", "text/html; charset=utf-8")
+		parse, _ := template.New("targets").Parse(targetsHtml)
+		parse.Execute(c.Writer, temp)
+	})
+	r.GET("/api/v1/targets", func(c *gin.Context) {
+		// 和 Prometheus 的 /api/v1/targets 保持一致，支持 state=active|dropped|any 以及 scrapePool 过滤
+		state := c.DefaultQuery("state", "any")
+		scrapePool := c.Query("scrapePool")
+
+		data := gin.H{
+			"activeTargets":  []probe.ActiveTarget{},
+			"droppedTargets": []probe.DroppedTarget{},
+		}
+		if state == "active" || state == "any" {
+			data["activeTargets"] = filterActiveTargets(getActiveTargets(showSecrets(c)), scrapePool)
+		}
+		if state == "dropped" || state == "any" {
+			data["droppedTargets"] = filterDroppedTargets(getDroppedTargets(showSecrets(c)), scrapePool)
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"status": "success",
+			"data":   data,
+		})
+	})
+	r.GET("/metrics", func(c *gin.Context) {
+		c.Header("Content-Type", "text/plain; charset=utf-8")
+		metrics.WritePrometheus(c.Writer, true)
+	})
+	r.GET("/metrics/probe", func(c *gin.Context) {
+		writeLatestSeries(c)
+	})
+	r.GET("/federate", func(c *gin.Context) {
+		jobs := c.QueryArray("job")
+		if len(jobs) == 0 {
+			c.String(http.StatusBadRequest, "missing `job` query arg")
+			return
+		}
+		writeLatestSeries(c, jobs...)
+	})
 	r.GET("/flags", func(c *gin.Context) {
 		flagutil.WriteFlags(c.Writer)
 	})
 	r.GET("/config", func(c *gin.Context) {
 		config := writer.WriterConfig
-		out, _ := yaml.Marshal(config)
+		var out []byte
+		if showSecrets(c) {
+			out, _ = yaml.Marshal(config)
+		} else {
+			out, _ = redact.Marshal(config)
+		}
 		fmt.Fprint(c.Writer, string(out))
 	})
 	r.GET("/plugins/:name", func(c *gin.Context) {
-		name := c.Param("name")
-		if cfg, ok := probe.PluginCfgs[name]; ok {
-			out, _ := yaml.Marshal(cfg)
-			fmt.Fprintln(c.Writer, string(out))
-			for _, config := range cfg {
-				for _, scrapeConfig := range config.ScrapeConfigs {
-					fmt.Fprintf(c.Writer, "--- job: %s ---\n", scrapeConfig.JobName)
-					for _, ruleFile := range scrapeConfig.ScrapeRuleFiles {
-						fmt.Fprintf(c.Writer, "- %s:\n", ruleFile)
-						ruleFilePath := fs.GetFilepath(scrapeConfig.ConfigRef.BaseDir, ruleFile)
-						data := probe.CacheGetBytes(ruleFilePath)
-						if data == nil {
-							data, _ = fs.ReadFileOrHTTP(ruleFilePath)
-						}
-						fmt.Fprintf(c.Writer, "%s\n", string(data))
-					}
-				}
-			}
-		}
+		probe.WritePluginConfigs(c.Writer, c.Param("name"), showSecrets(c))
 	})
 	r.GET("/reload", func(c *gin.Context) {
 		probe.Reload(c, flags.ConfigDirectory)
@@ -180,6 +255,70 @@ func Router() *HTTPRouter {
 	return &HTTPRouter{engine: r}
 }
 
+// adminEnabled 只有同时开启了 basic auth 并且配置了单独的管理员账号（和普通账号不同名），才有管理员
+func adminEnabled() bool {
+	return HTTPUsername != "" && HTTPPassword != "" && HTTPAdminUsername != "" && HTTPAdminPassword != "" && HTTPAdminUsername != HTTPUsername
+}
+
+// showSecrets 只有管理员带上 ?show_secrets=true 才展示配置里的密码等敏感信息，其他情况一律打码
+func showSecrets(c *gin.Context) bool {
+	if !adminEnabled() || c.GetString(gin.AuthUserKey) != HTTPAdminUsername {
+		return false
+	}
+	v, _ := strconv.ParseBool(c.Query("show_secrets"))
+	return v
+}
+
+// writeLatestSeries 按照 Accept header 返回 OpenMetrics 或者 Prometheus text 格式的数据
+func writeLatestSeries(c *gin.Context, jobs ...string) {
+	if !flags.PullMode {
+		c.String(http.StatusNotFound, "pull mode is disabled, restart cprobe with -pull")
+		return
+	}
+
+	openMetrics := strings.Contains(c.GetHeader("Accept"), "application/openmetrics-text")
+	if openMetrics {
+		c.Header("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+	} else {
+		c.Header("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	}
+
+	tss := probe.GetLatestSeries(jobs...)
+	c.Writer.Write(prompbmarshal.MarshalExposition(nil, tss, openMetrics))
+}
+
+// /targets 和 /api/v1/targets 通过这两个变量拿 targets，测试的时候可以替换掉
+var (
+	getActiveTargets  = probe.GetActiveTargets
+	getDroppedTargets = probe.GetDroppedTargets
+)
+
+func filterActiveTargets(targets []probe.ActiveTarget, scrapePool string) []probe.ActiveTarget {
+	if scrapePool == "" {
+		return targets
+	}
+	ret := make([]probe.ActiveTarget, 0, len(targets))
+	for i := range targets {
+		if targets[i].ScrapePool == scrapePool {
+			ret = append(ret, targets[i])
+		}
+	}
+	return ret
+}
+
+func filterDroppedTargets(targets []probe.DroppedTarget, scrapePool string) []probe.DroppedTarget {
+	if scrapePool == "" {
+		return targets
+	}
+	ret := make([]probe.DroppedTarget, 0, len(targets))
+	for i := range targets {
+		if targets[i].ScrapePool == scrapePool {
+			ret = append(ret, targets[i])
+		}
+	}
+	return ret
+}
+
 // Init initializes http server and return close function
 func (r *HTTPRouter) Start() func() error {
 	server := &http.Server{
@@ -0,0 +1,97 @@
+package httpd
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/cprobe/cprobe/probe"
+)
+
+func TestAPIV1Targets(t *testing.T) {
+	oldActive, oldDropped := getActiveTargets, getDroppedTargets
+	defer func() {
+		getActiveTargets, getDroppedTargets = oldActive, oldDropped
+	}()
+
+	getActiveTargets = func(showSecrets bool) []probe.ActiveTarget {
+		if showSecrets {
+			t.Fatalf("secrets must not be shown without admin auth")
+		}
+		return []probe.ActiveTarget{
+			{ScrapePool: "mysql", ScrapeURL: "10.0.0.1:3306", Health: "up"},
+			{ScrapePool: "mysql", ScrapeURL: "10.0.0.2:3306", Health: "down", LastError: "connection refused"},
+			{ScrapePool: "redis", ScrapeURL: "10.0.0.3:6379", Health: "unknown"},
+		}
+	}
+	getDroppedTargets = func(showSecrets bool) []probe.DroppedTarget {
+		return []probe.DroppedTarget{
+			{ScrapePool: "mysql", DiscoveredLabels: map[string]string{"__address__": "10.0.0.4:3306"}},
+			{ScrapePool: "redis", DiscoveredLabels: map[string]string{"__address__": "10.0.0.5:6379"}},
+		}
+	}
+
+	router := Router()
+
+	// active 和 dropped 都用 scrapePool/address 表示，方便比较
+	f := func(query string, activeExpected, droppedExpected []string) {
+		t.Helper()
+
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/targets"+query, nil)
+		w := httptest.NewRecorder()
+		router.engine.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("unexpected status code for %q; got %d; want %d", query, w.Code, http.StatusOK)
+		}
+
+		var resp struct {
+			Status string `json:"status"`
+			Data   struct {
+				ActiveTargets  []probe.ActiveTarget  `json:"activeTargets"`
+				DroppedTargets []probe.DroppedTarget `json:"droppedTargets"`
+			} `json:"data"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("cannot parse response for %q: %s; body: %s", query, err, w.Body.String())
+		}
+		if resp.Status != "success" {
+			t.Fatalf("unexpected status for %q; got %q; want %q", query, resp.Status, "success")
+		}
+		if resp.Data.ActiveTargets == nil || resp.Data.DroppedTargets == nil {
+			t.Fatalf("activeTargets and droppedTargets must be arrays for %q; body: %s", query, w.Body.String())
+		}
+
+		active := []string{}
+		for _, target := range resp.Data.ActiveTargets {
+			active = append(active, target.ScrapePool+"/"+target.ScrapeURL)
+		}
+		if !reflect.DeepEqual(active, activeExpected) {
+			t.Fatalf("unexpected active targets for %q;\ngot\n%q\nwant\n%q", query, active, activeExpected)
+		}
+
+		dropped := []string{}
+		for _, target := range resp.Data.DroppedTargets {
+			dropped = append(dropped, target.ScrapePool+"/"+target.DiscoveredLabels["__address__"])
+		}
+		if !reflect.DeepEqual(dropped, droppedExpected) {
+			t.Fatalf("unexpected dropped targets for %q;\ngot\n%q\nwant\n%q", query, dropped, droppedExpected)
+		}
+	}
+
+	allActive := []string{"mysql/10.0.0.1:3306", "mysql/10.0.0.2:3306", "redis/10.0.0.3:6379"}
+	allDropped := []string{"mysql/10.0.0.4:3306", "redis/10.0.0.5:6379"}
+
+	// state
+	f("", allActive, allDropped)
+	f("?state=any", allActive, allDropped)
+	f("?state=active", allActive, []string{})
+	f("?state=dropped", []string{}, allDropped)
+
+	// scrapePool
+	f("?scrapePool=mysql", []string{"mysql/10.0.0.1:3306", "mysql/10.0.0.2:3306"}, []string{"mysql/10.0.0.4:3306"})
+	f("?scrapePool=redis&state=active", []string{"redis/10.0.0.3:6379"}, []string{})
+	f("?scrapePool=redis&state=dropped", []string{}, []string{"redis/10.0.0.5:6379"})
+	f("?scrapePool=kafka", []string{}, []string{})
+}
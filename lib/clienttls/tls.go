@@ -12,7 +12,7 @@ type ClientConfig struct {
 	TLSCA              string `yaml:"tls_ca" toml:"tls_ca"`
 	TLSCert            string `yaml:"tls_cert" toml:"tls_cert"`
 	TLSKey             string `yaml:"tls_key" toml:"tls_key"`
-	TLSKeyPwd          string `yaml:"tls_key_pwd" toml:"tls_key_pwd"`
+	TLSKeyPwd          string `yaml:"tls_key_pwd" toml:"tls_key_pwd" secret:"true"`
 	InsecureSkipVerify bool   `yaml:"tls_skip_verify" toml:"tls_skip_verify"`
 	ServerName         string `yaml:"tls_server_name" toml:"tls_server_name"`
 	TLSMinVersion      string `yaml:"tls_min_version" toml:"tls_min_version"`
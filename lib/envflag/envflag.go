@@ -65,10 +65,12 @@ func ParseFlagSet(fs *flag.FlagSet, args []string) {
 
 // expandArgs substitutes %{ENV_VAR} placeholders inside args
 // with the corresponding environment variable values.
+//
+// Secret placeholders such as %{secret:...} are left as is, since -secret.* flags aren't parsed yet.
 func expandArgs(args []string) []string {
 	dstArgs := make([]string, 0, len(args))
 	for _, arg := range args {
-		s, err := envtemplate.ReplaceString(arg)
+		s, err := envtemplate.ReplaceEnvString(arg)
 		if err != nil {
 			// Do not use lib/logger here, since it is uninitialized yet.
 			log.Fatalf("cannot process arg %q: %s", arg, err)
@@ -13,26 +13,65 @@ import (
 
 // ReplaceBytes replaces `%{ENV_VAR}` placeholders in b with the corresponding ENV_VAR values.
 //
-// Error is returned if ENV_VAR isn't set for some `%{ENV_VAR}` placeholder.
+// The following placeholders for secrets are replaced too:
+//
+//   - `%{file:/path/to/file}` - with the contents of the file without trailing newlines
+//   - `%{exec:command arg1 ... argN}` - with the stdout of the command without trailing newlines; the command is executed without shell
+//   - `%{secret:name}` - with the secret from the HTTP secret store at -secret.httpURL
+//
+// The values of `%{exec:...}` and `%{secret:...}` placeholders are cached for -secret.cacheTTL.
+// `%{exec:...}` placeholders are resolved only if -secret.allowExec is set.
+//
+// ReplaceBytes must be used only for local config files written by the operator, see ReplaceEnvBytes.
+//
+// Error is returned if ENV_VAR isn't set for some `%{ENV_VAR}` placeholder or if some secret cannot be resolved.
 func ReplaceBytes(b []byte) ([]byte, error) {
-	result, err := expand(envVars, string(b))
+	result, err := expand(envVars, string(b), true)
 	if err != nil {
 		return nil, err
 	}
 	return []byte(result), nil
 }
 
-// ReplaceString replaces `%{ENV_VAR}` placeholders in b with the corresponding ENV_VAR values.
+// ReplaceEnvBytes replaces only `%{ENV_VAR}` placeholders in b with the corresponding ENV_VAR values.
+//
+// The placeholders for secrets are left as is. It must be used instead of ReplaceBytes for the content,
+// which isn't written by the operator, such as files fetched over HTTP and files supplied by service discovery,
+// since secret placeholders there could read arbitrary local files or run arbitrary commands.
 //
 // Error is returned if ENV_VAR isn't set for some `%{ENV_VAR}` placeholder.
+func ReplaceEnvBytes(b []byte) ([]byte, error) {
+	result, err := expand(envVars, string(b), false)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(result), nil
+}
+
+// ReplaceString replaces `%{ENV_VAR}` placeholders in s with the corresponding ENV_VAR values.
+//
+// The placeholders for secrets are replaced too, see ReplaceBytes.
+// It must be called after command-line flags are parsed, since secrets depend on -secret.* flags.
+//
+// Error is returned if ENV_VAR isn't set for some `%{ENV_VAR}` placeholder or if some secret cannot be resolved.
 func ReplaceString(s string) (string, error) {
-	result, err := expand(envVars, s)
+	result, err := expand(envVars, s, true)
 	if err != nil {
 		return "", err
 	}
 	return result, nil
 }
 
+// ReplaceEnvString replaces only `%{ENV_VAR}` placeholders in s with the corresponding ENV_VAR values.
+//
+// The placeholders for secrets are left as is, see ReplaceEnvBytes.
+// It is used for command-line args, which are expanded before the -secret.* flags are parsed.
+//
+// Error is returned if ENV_VAR isn't set for some `%{ENV_VAR}` placeholder.
+func ReplaceEnvString(s string) (string, error) {
+	return expand(envVars, s, false)
+}
+
 // LookupEnv returns the expanded environment variable value for the given name.
 //
 // The expanded means that `%{ENV_VAR}` placeholders in env var value are replaced
@@ -70,7 +109,8 @@ func expandTemplates(m map[string]string) map[string]string {
 		mExpanded := make(map[string]string, len(m))
 		expands := 0
 		for name, value := range m {
-			valueExpanded, err := expand(m, value)
+			// Secrets aren't resolved in env vars, since flags aren't parsed yet.
+			valueExpanded, err := expand(m, value, false)
 			if err != nil {
 				// Do not use lib/logger here, since it is uninitialized yet.
 				log.Fatalf("cannot expand %q env var value %q: %s", name, value, err)
@@ -88,12 +128,21 @@ func expandTemplates(m map[string]string) map[string]string {
 	return m
 }
 
-func expand(m map[string]string, s string) (string, error) {
+func expand(m map[string]string, s string, resolveSecrets bool) (string, error) {
 	if !strings.Contains(s, "%{") {
 		// Fast path - nothing to expand
 		return s, nil
 	}
 	result, err := fasttemplate.ExecuteFuncStringWithErr(s, "%{", "}", func(w io.Writer, tag string) (int, error) {
+		if resolveSecrets {
+			v, ok, err := resolveSecret(tag)
+			if err != nil {
+				return 0, err
+			}
+			if ok {
+				return io.WriteString(w, v)
+			}
+		}
 		if !isValidEnvVarName(tag) {
 			return fmt.Fprintf(w, "%%{%s}", tag)
 		}
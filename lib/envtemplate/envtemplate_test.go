@@ -1,7 +1,13 @@
 package envtemplate
 
 import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"reflect"
+	"runtime"
 	"sort"
 	"testing"
 )
@@ -94,3 +100,122 @@ func TestReplaceFailure(t *testing.T) {
 	f("%{Foo-Bar-2}")
 	f("%{Foo.Baz.3}")
 }
+
+func TestReplaceSecrets(t *testing.T) {
+	envVars = map[string]string{
+		"foo": "bar",
+	}
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "password")
+	if err := os.WriteFile(path, []byte("file-secret\n"), 0600); err != nil {
+		t.Fatalf("cannot write secret file: %s", err)
+	}
+
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("Authorization") != "Bearer store-token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/mysql":
+			fmt.Fprintf(w, `{"data":{"password":"http-secret"}}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	tokenPath := filepath.Join(dir, "token")
+	if err := os.WriteFile(tokenPath, []byte("store-token\n"), 0600); err != nil {
+		t.Fatalf("cannot write token file: %s", err)
+	}
+	*secretStoreURL = srv.URL + "/v1/{name}"
+	*secretStoreBearerTokenFile = tokenPath
+	*secretStoreJSONField = "data.password"
+	defer func() {
+		*secretStoreURL = ""
+		*secretStoreBearerTokenFile = ""
+		*secretStoreJSONField = ""
+		secrets.reset()
+	}()
+
+	f := func(s, resultExpected string) {
+		t.Helper()
+		result, err := ReplaceString(s)
+		if err != nil {
+			t.Fatalf("unexpected error for ReplaceString(%q): %s", s, err)
+		}
+		if result != resultExpected {
+			t.Fatalf("unexpected result for ReplaceString(%q);\ngot\n%q\nwant\n%q", s, result, resultExpected)
+		}
+	}
+	f("password = '%{file:"+path+"}'", "password = 'file-secret'")
+	f("%{foo}:%{secret:mysql}", "bar:http-secret")
+
+	// the value is cached
+	f("%{secret:mysql}", "http-secret")
+	if requests != 1 {
+		t.Fatalf("unexpected number of requests to secret store; got %d; want 1", requests)
+	}
+
+	// exec is disabled by default
+	if _, err := ReplaceString("%{exec:echo exec-secret}"); err == nil {
+		t.Fatalf("expecting non-nil error for %%{exec:...} without -secret.allowExec")
+	}
+	*secretAllowExec = true
+	defer func() {
+		*secretAllowExec = false
+	}()
+	if runtime.GOOS != "windows" {
+		f("%{exec:echo exec-secret}", "exec-secret")
+	}
+
+	fFailure := func(s string) {
+		t.Helper()
+		if _, err := ReplaceString(s); err == nil {
+			t.Fatalf("expecting non-nil error for ReplaceString(%q)", s)
+		}
+	}
+	fFailure("%{file:" + filepath.Join(dir, "missing") + "}")
+	fFailure("%{file:}")
+	fFailure("%{exec:}")
+	fFailure("%{exec:" + filepath.Join(dir, "missing-command") + "}")
+	fFailure("%{secret:missing}")
+}
+
+func TestReplaceEnvBytes(t *testing.T) {
+	envVars = map[string]string{
+		"foo": "bar",
+	}
+	*secretAllowExec = true
+	defer func() {
+		*secretAllowExec = false
+	}()
+
+	f := func(s, resultExpected string) {
+		t.Helper()
+		result, err := ReplaceEnvBytes([]byte(s))
+		if err != nil {
+			t.Fatalf("unexpected error for ReplaceEnvBytes(%q): %s", s, err)
+		}
+		if string(result) != resultExpected {
+			t.Fatalf("unexpected result for ReplaceEnvBytes(%q);\ngot\n%q\nwant\n%q", s, result, resultExpected)
+		}
+		resultS, err := ReplaceEnvString(s)
+		if err != nil {
+			t.Fatalf("unexpected error for ReplaceEnvString(%q): %s", s, err)
+		}
+		if resultS != resultExpected {
+			t.Fatalf("unexpected result for ReplaceEnvString(%q);\ngot\n%q\nwant\n%q", s, resultS, resultExpected)
+		}
+	}
+	f("%{foo}", "bar")
+
+	// secret placeholders are left as is
+	f("%{file:/etc/passwd}", "%{file:/etc/passwd}")
+	f("%{foo} %{exec:touch /tmp/pwned}", "bar %{exec:touch /tmp/pwned}")
+	f("%{secret:mysql}", "%{secret:mysql}")
+}
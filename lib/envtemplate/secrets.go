@@ -0,0 +1,230 @@
+package envtemplate
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	secretCacheTTL = flag.Duration("secret.cacheTTL", 5*time.Minute, "How long to cache the values of %{exec:...} and %{secret:...} placeholders. "+
+		"Zero disables the cache, so the command is executed and the secret store is queried every time a config or rule file is loaded")
+	secretAllowExec = flag.Bool("secret.allowExec", false, "Whether to allow %{exec:...} placeholders in local config and rule files. "+
+		"The commands are executed as the cprobe user, so enable it only if the config files are writable by trusted users only")
+	secretExecTimeout = flag.Duration("secret.execTimeout", 10*time.Second, "Timeout for commands from %{exec:...} placeholders")
+
+	secretStoreURL = flag.String("secret.httpURL", "", "URL of the HTTP secret store used for %{secret:name} placeholders, e.g. http://vault:8200/v1/secret/data/{name} . "+
+		"The {name} is replaced with the name from the placeholder; the name is appended to the URL after a slash if the URL has no {name}")
+	secretStoreBearerTokenFile = flag.String("secret.httpBearerTokenFile", "", "Optional path to the file with bearer token for -secret.httpURL")
+	secretStoreJSONField       = flag.String("secret.httpJSONField", "", "Optional dot-separated path to the field with the secret value in JSON response of -secret.httpURL, e.g. data.data.password . "+
+		"The whole response body is used as the secret value if empty")
+	secretStoreTimeout = flag.Duration("secret.httpTimeout", 10*time.Second, "Timeout for requests to -secret.httpURL")
+)
+
+// Placeholder prefixes for secrets, which are resolved by ReplaceBytes and ReplaceString in addition to `%{ENV_VAR}`.
+const (
+	filePrefix   = "file:"
+	execPrefix   = "exec:"
+	secretPrefix = "secret:"
+)
+
+// resolveSecret returns the value for the `%{file:...}`, `%{exec:...}` or `%{secret:...}` placeholder tag.
+//
+// ok is false if tag isn't a secret placeholder.
+func resolveSecret(tag string) (value string, ok bool, err error) {
+	switch {
+	case strings.HasPrefix(tag, filePrefix):
+		path := strings.TrimSpace(tag[len(filePrefix):])
+		value, err := readSecretFile(path)
+		return value, true, err
+	case strings.HasPrefix(tag, execPrefix):
+		command := strings.TrimSpace(tag[len(execPrefix):])
+		value, err := secrets.get(tag, func() (string, error) {
+			return execSecret(command)
+		})
+		return value, true, err
+	case strings.HasPrefix(tag, secretPrefix):
+		name := strings.TrimSpace(tag[len(secretPrefix):])
+		value, err := secrets.get(tag, func() (string, error) {
+			return fetchSecret(name)
+		})
+		return value, true, err
+	}
+	return "", false, nil
+}
+
+func readSecretFile(path string) (string, error) {
+	if path == "" {
+		return "", fmt.Errorf("missing path in %%{%s}", filePrefix)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("cannot read secret file: %w", err)
+	}
+	return trimSecret(data), nil
+}
+
+// execSecret runs the command without shell and returns its stdout.
+func execSecret(command string) (string, error) {
+	if !*secretAllowExec {
+		return "", fmt.Errorf("%%{%s} placeholders are disabled; pass -secret.allowExec command-line flag for enabling them", execPrefix)
+	}
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return "", fmt.Errorf("missing command in %%{%s}", execPrefix)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *secretExecTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		// Do not put stdout into the error message, since it may contain the secret.
+		return "", fmt.Errorf("cannot execute %q: %w; stderr: %q", args[0], err, stderr.String())
+	}
+	return trimSecret(out), nil
+}
+
+// fetchSecret reads the secret with the given name from -secret.httpURL.
+func fetchSecret(name string) (string, error) {
+	if name == "" {
+		return "", fmt.Errorf("missing name in %%{%s}", secretPrefix)
+	}
+	if *secretStoreURL == "" {
+		return "", fmt.Errorf("-secret.httpURL must be set for resolving %%{%s%s}", secretPrefix, name)
+	}
+
+	u := *secretStoreURL
+	if strings.Contains(u, "{name}") {
+		u = strings.ReplaceAll(u, "{name}", url.PathEscape(name))
+	} else {
+		u = strings.TrimSuffix(u, "/") + "/" + url.PathEscape(name)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *secretStoreTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return "", fmt.Errorf("cannot create request to secret store: %w", err)
+	}
+	if *secretStoreBearerTokenFile != "" {
+		token, err := readSecretFile(*secretStoreBearerTokenFile)
+		if err != nil {
+			return "", fmt.Errorf("cannot read -secret.httpBearerTokenFile: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("cannot fetch secret %q: %w", name, err)
+	}
+	data, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		return "", fmt.Errorf("cannot read secret %q: %w", name, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status code when fetching secret %q: %d, expecting %d", name, resp.StatusCode, http.StatusOK)
+	}
+
+	if *secretStoreJSONField == "" {
+		return trimSecret(data), nil
+	}
+	return jsonField(data, *secretStoreJSONField)
+}
+
+// jsonField returns the string value at the dot-separated path in JSON data.
+func jsonField(data []byte, path string) (string, error) {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return "", fmt.Errorf("cannot parse secret store response as JSON: %w", err)
+	}
+	for _, key := range strings.Split(path, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return "", fmt.Errorf("cannot find %q in secret store response", path)
+		}
+		if v, ok = m[key]; !ok {
+			return "", fmt.Errorf("cannot find %q in secret store response", path)
+		}
+	}
+	s, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("%q in secret store response must be a string", path)
+	}
+	return s, nil
+}
+
+func trimSecret(data []byte) string {
+	return strings.TrimRight(string(data), "\r\n")
+}
+
+var secrets = &secretCache{
+	m: make(map[string]cachedSecret),
+}
+
+// secretCache caches the resolved secrets for -secret.cacheTTL,
+// so rule files, which are re-read every few seconds, do not run commands and query the secret store every time.
+type secretCache struct {
+	mu sync.Mutex
+	m  map[string]cachedSecret
+}
+
+type cachedSecret struct {
+	value    string
+	deadline time.Time
+}
+
+func (sc *secretCache) get(key string, resolve func() (string, error)) (string, error) {
+	ttl := *secretCacheTTL
+	now := time.Now()
+
+	sc.mu.Lock()
+	cs, ok := sc.m[key]
+	sc.mu.Unlock()
+	if ok && now.Before(cs.deadline) {
+		return cs.value, nil
+	}
+
+	value, err := resolve()
+	if err != nil {
+		return "", err
+	}
+	if ttl <= 0 {
+		return value, nil
+	}
+
+	sc.mu.Lock()
+	for k, cs := range sc.m {
+		if now.After(cs.deadline) {
+			delete(sc.m, k)
+		}
+	}
+	sc.m[key] = cachedSecret{
+		value:    value,
+		deadline: now.Add(ttl),
+	}
+	sc.mu.Unlock()
+
+	return value, nil
+}
+
+func (sc *secretCache) reset() {
+	sc.mu.Lock()
+	sc.m = make(map[string]cachedSecret)
+	sc.mu.Unlock()
+}
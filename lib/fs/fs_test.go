@@ -26,7 +26,7 @@ func TestIsTemporaryFileName(t *testing.T) {
 func TestIsHTTPURLSuccess(t *testing.T) {
 	f := func(s string, expected bool) {
 		t.Helper()
-		res := isHTTPURL(s)
+		res := IsHTTPURL(s)
 		if res != expected {
 			t.Fatalf("expecting %t, got %t", expected, res)
 		}
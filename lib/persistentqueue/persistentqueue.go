@@ -0,0 +1,503 @@
+package persistentqueue
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/cprobe/cprobe/lib/encoding"
+	"github.com/cprobe/cprobe/lib/filestream"
+	"github.com/cprobe/cprobe/lib/fs"
+	"github.com/cprobe/cprobe/lib/logger"
+)
+
+// MaxBlockSize is the maximum size of a block, which can be written to the queue.
+const MaxBlockSize = 256 * 1024 * 1024
+
+// chunkFileSize is the soft limit for chunk file size.
+//
+// A new chunk file is started when the current one reaches this size.
+// It is a var, so tests could lower it.
+var chunkFileSize = uint64(32 * 1024 * 1024)
+
+const (
+	metainfoFilename = "metainfo.json"
+	flushInterval    = time.Second
+)
+
+// Queue is a file-backed FIFO queue for byte blocks.
+//
+// Blocks are appended to chunk files in the queue directory. Every block is prefixed by its length.
+// A block returned by MustReadBlockNonblocking stays on disk until the returned ack func is called,
+// so blocks, which were in flight when the process stopped, are read again after restart.
+type Queue struct {
+	path            string
+	maxPendingBytes uint64
+
+	flockF *os.File
+
+	mu sync.Mutex
+
+	// chunks contains ids of all the chunk files in the queue directory in ascending order.
+	// The last item is the chunk being written.
+	chunks []uint64
+
+	writer       *filestream.Writer
+	writerOffset uint64
+
+	reader       *filestream.Reader
+	readerChunk  uint64
+	readerOffset uint64
+
+	// pendingBytes and pendingBlocks refer to blocks, which weren't read yet.
+	pendingBytes  uint64
+	pendingBlocks int
+
+	// inflight contains blocks, which were read but weren't acknowledged yet, in read order.
+	inflight []*inflightBlock
+
+	// flushedPos is the reader position stored in metainfo file.
+	flushedPos position
+
+	closed bool
+
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+
+	blocksWritten *metrics.Counter
+	blocksRead    *metrics.Counter
+	blocksDropped *metrics.Counter
+	bytesDropped  *metrics.Counter
+}
+
+type position struct {
+	chunk  uint64
+	offset uint64
+}
+
+type inflightBlock struct {
+	pos   position
+	acked bool
+}
+
+type metainfo struct {
+	ReaderChunk  uint64 `json:"readerChunk"`
+	ReaderOffset uint64 `json:"readerOffset"`
+}
+
+// MustOpen opens the queue at the given path.
+//
+// Blocks left in the queue by the previous run are read first.
+// If maxPendingBytes > 0, then the oldest blocks are dropped when the size of not yet read blocks exceeds it.
+//
+// MustClose must be called when the queue is no longer needed.
+func MustOpen(path string, maxPendingBytes uint64) *Queue {
+	fs.MustMkdirIfNotExist(path)
+
+	q := &Queue{
+		path:            path,
+		maxPendingBytes: maxPendingBytes,
+		flockF:          fs.MustCreateFlockFile(path),
+		stopCh:          make(chan struct{}),
+	}
+
+	var mi metainfo
+	metainfoPath := filepath.Join(path, metainfoFilename)
+	if fs.IsPathExist(metainfoPath) {
+		data, err := os.ReadFile(metainfoPath)
+		if err != nil {
+			logger.Panicf("FATAL: cannot read %q: %s", metainfoPath, err)
+		}
+		if err := json.Unmarshal(data, &mi); err != nil {
+			logger.Errorf("cannot parse %q: %s; reading the queue from the first chunk file", metainfoPath, err)
+			mi = metainfo{}
+		}
+	}
+
+	q.chunks = q.mustReadChunkIDs()
+	q.readerChunk = mi.ReaderChunk
+	q.readerOffset = mi.ReaderOffset
+
+	// Chunks before the reader chunk have been read and acknowledged, but weren't removed before the stop.
+	for len(q.chunks) > 0 && q.chunks[0] < q.readerChunk {
+		fs.MustRemoveAll(q.chunkPath(q.chunks[0]))
+		q.chunks = q.chunks[1:]
+	}
+	if len(q.chunks) == 0 {
+		q.chunks = append(q.chunks, q.readerChunk)
+		q.readerOffset = 0
+	} else if q.chunks[0] != q.readerChunk {
+		logger.Errorf("missing chunk file %q; continue reading from %q", q.chunkPath(q.readerChunk), q.chunkPath(q.chunks[0]))
+		q.readerChunk = q.chunks[0]
+		q.readerOffset = 0
+	}
+
+	for _, id := range q.chunks {
+		offset := uint64(0)
+		if id == q.readerChunk {
+			offset = q.readerOffset
+		}
+		size, blocks := q.mustCheckChunk(id, offset)
+		if id == q.readerChunk && q.readerOffset > size {
+			q.readerOffset = size
+		}
+		q.pendingBlocks += blocks
+		if size > offset {
+			q.pendingBytes += size - offset
+		}
+		q.writerOffset = size
+	}
+
+	writerPath := q.chunkPath(q.chunks[len(q.chunks)-1])
+	w, err := filestream.OpenWriterAt(writerPath, int64(q.writerOffset), false)
+	if err != nil {
+		logger.Panicf("FATAL: cannot open chunk file %q for writing: %s", writerPath, err)
+	}
+	q.writer = w
+	q.flushedPos = position{chunk: q.readerChunk, offset: q.readerOffset}
+	q.mustWriteMetainfo(q.flushedPos)
+
+	q.blocksWritten = metrics.GetOrCreateCounter(fmt.Sprintf(`cprobe_persistentqueue_blocks_written_total{path=%q}`, path))
+	q.blocksRead = metrics.GetOrCreateCounter(fmt.Sprintf(`cprobe_persistentqueue_blocks_read_total{path=%q}`, path))
+	q.blocksDropped = metrics.GetOrCreateCounter(fmt.Sprintf(`cprobe_persistentqueue_blocks_dropped_total{path=%q}`, path))
+	q.bytesDropped = metrics.GetOrCreateCounter(fmt.Sprintf(`cprobe_persistentqueue_bytes_dropped_total{path=%q}`, path))
+	metrics.GetOrCreateGauge(q.pendingBytesMetricName(), func() float64 {
+		return float64(q.PendingBytes())
+	})
+
+	if q.pendingBlocks > 0 {
+		logger.Infof("opened persistent queue %q with %d pending blocks (%d bytes)", path, q.pendingBlocks, q.pendingBytes)
+	}
+
+	q.wg.Add(1)
+	go func() {
+		defer q.wg.Done()
+		q.flusher()
+	}()
+
+	return q
+}
+
+// MustClose flushes the queue state to disk and closes the queue.
+//
+// Blocks, which weren't acknowledged yet, are read again after the queue is re-opened.
+func (q *Queue) MustClose() {
+	close(q.stopCh)
+	q.wg.Wait()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.flushLocked()
+	q.writer.MustClose()
+	q.writer = nil
+	if q.reader != nil {
+		q.reader.MustClose()
+		q.reader = nil
+	}
+	fs.MustClose(q.flockF)
+	q.closed = true
+
+	metrics.UnregisterMetric(q.pendingBytesMetricName())
+}
+
+// MustWriteBlock appends block to the queue.
+//
+// If the pending bytes exceed the limit passed to MustOpen, then the oldest blocks are dropped.
+// The block is dropped if the queue is already closed.
+func (q *Queue) MustWriteBlock(block []byte) {
+	if len(block) > MaxBlockSize {
+		logger.Errorf("dropping too big block with %d bytes for persistent queue %q; max block size is %d bytes", len(block), q.path, MaxBlockSize)
+		q.blocksDropped.Inc()
+		q.bytesDropped.Add(len(block))
+		return
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		q.blocksDropped.Inc()
+		q.bytesDropped.Add(len(block))
+		return
+	}
+
+	if q.writerOffset >= chunkFileSize {
+		q.writer.MustClose()
+		id := q.chunks[len(q.chunks)-1] + 1
+		q.writer = filestream.MustCreate(q.chunkPath(id), false)
+		q.writerOffset = 0
+		q.chunks = append(q.chunks, id)
+	}
+
+	header := encoding.MarshalUint64(nil, uint64(len(block)))
+	fs.MustWriteData(q.writer, header)
+	fs.MustWriteData(q.writer, block)
+	// Make the block visible to the reader, fsync is done by flusher.
+	q.writer.MustFlush(false)
+
+	n := uint64(len(header) + len(block))
+	q.writerOffset += n
+	q.pendingBytes += n
+	q.pendingBlocks++
+	q.blocksWritten.Inc()
+
+	if q.maxPendingBytes == 0 || q.pendingBytes <= q.maxPendingBytes {
+		return
+	}
+
+	dropped := 0
+	droppedBytes := 0
+	var buf []byte
+	for q.pendingBytes > q.maxPendingBytes && q.pendingBlocks > 0 {
+		buf, _ = q.readBlockLocked(buf[:0])
+		dropped++
+		droppedBytes += len(buf)
+	}
+	q.blocksDropped.Add(dropped)
+	q.bytesDropped.Add(droppedBytes)
+	logger.Warnf("dropped %d oldest blocks (%d bytes) from persistent queue %q, since it exceeds the max size of %d bytes",
+		dropped, droppedBytes, q.path, q.maxPendingBytes)
+}
+
+// MustReadBlockNonblocking appends the oldest block from the queue to dst and returns the result.
+//
+// ok is false if the queue has no pending blocks. Otherwise ack must be called after the block
+// is processed, so the block could be removed from disk.
+func (q *Queue) MustReadBlockNonblocking(dst []byte) (data []byte, ack func(), ok bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed || q.pendingBlocks == 0 {
+		return dst, nil, false
+	}
+
+	data, pos := q.readBlockLocked(dst)
+	ib := &inflightBlock{
+		pos: pos,
+	}
+	q.inflight = append(q.inflight, ib)
+	q.blocksRead.Inc()
+
+	return data, func() {
+		q.ack(ib)
+	}, true
+}
+
+// PendingBytes returns the number of bytes in blocks, which weren't read yet.
+func (q *Queue) PendingBytes() uint64 {
+	q.mu.Lock()
+	n := q.pendingBytes
+	q.mu.Unlock()
+	return n
+}
+
+// PendingBlocks returns the number of blocks, which weren't read yet.
+func (q *Queue) PendingBlocks() int {
+	q.mu.Lock()
+	n := q.pendingBlocks
+	q.mu.Unlock()
+	return n
+}
+
+func (q *Queue) ack(ib *inflightBlock) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	ib.acked = true
+	n := 0
+	for n < len(q.inflight) && q.inflight[n].acked {
+		q.inflight[n] = nil
+		n++
+	}
+	q.inflight = q.inflight[n:]
+}
+
+// readBlockLocked reads the next pending block. The caller must make sure that pendingBlocks > 0.
+func (q *Queue) readBlockLocked(dst []byte) ([]byte, position) {
+	var header [8]byte
+	for {
+		if q.reader == nil {
+			readerPath := q.chunkPath(q.readerChunk)
+			r, err := filestream.OpenReaderAt(readerPath, int64(q.readerOffset), false)
+			if err != nil {
+				logger.Panicf("FATAL: cannot open chunk file %q for reading: %s", readerPath, err)
+			}
+			q.reader = r
+		}
+
+		_, err := io.ReadFull(q.reader, header[:])
+		if err == nil {
+			break
+		}
+		if err != io.EOF || q.readerChunk == q.chunks[len(q.chunks)-1] {
+			logger.Panicf("FATAL: cannot read block header from %q at offset %d: %s", q.reader.Path(), q.readerOffset, err)
+		}
+
+		// The reader chunk is fully read. Switch to the next one.
+		q.reader.MustClose()
+		q.reader = nil
+		idx := sort.Search(len(q.chunks), func(i int) bool {
+			return q.chunks[i] > q.readerChunk
+		})
+		q.readerChunk = q.chunks[idx]
+		q.readerOffset = 0
+	}
+
+	pos := position{
+		chunk:  q.readerChunk,
+		offset: q.readerOffset,
+	}
+
+	blockLen := encoding.UnmarshalUint64(header[:])
+	dstLen := len(dst)
+	if n := dstLen + int(blockLen) - cap(dst); n > 0 {
+		dst = append(dst[:cap(dst)], make([]byte, n)...)
+	}
+	dst = dst[:dstLen+int(blockLen)]
+	fs.MustReadData(q.reader, dst[dstLen:])
+
+	n := uint64(len(header)) + blockLen
+	q.readerOffset += n
+	q.pendingBytes -= n
+	q.pendingBlocks--
+
+	return dst, pos
+}
+
+func (q *Queue) flusher() {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-q.stopCh:
+			return
+		case <-ticker.C:
+			q.mu.Lock()
+			q.flushLocked()
+			q.mu.Unlock()
+		}
+	}
+}
+
+// flushLocked syncs written blocks to disk, stores the position of the oldest not acknowledged block
+// in metainfo file and removes chunk files, which are no longer needed.
+func (q *Queue) flushLocked() {
+	q.writer.MustFlush(true)
+
+	pos := position{
+		chunk:  q.readerChunk,
+		offset: q.readerOffset,
+	}
+	if len(q.inflight) > 0 {
+		pos = q.inflight[0].pos
+	}
+	if pos == q.flushedPos {
+		return
+	}
+	q.mustWriteMetainfo(pos)
+	q.flushedPos = pos
+
+	for q.chunks[0] < pos.chunk {
+		fs.MustRemoveAll(q.chunkPath(q.chunks[0]))
+		q.chunks = q.chunks[1:]
+	}
+}
+
+func (q *Queue) mustWriteMetainfo(pos position) {
+	mi := metainfo{
+		ReaderChunk:  pos.chunk,
+		ReaderOffset: pos.offset,
+	}
+	data, err := json.Marshal(&mi)
+	if err != nil {
+		logger.Panicf("BUG: cannot marshal persistent queue metainfo: %s", err)
+	}
+	fs.MustWriteAtomic(filepath.Join(q.path, metainfoFilename), data, true)
+}
+
+func (q *Queue) mustReadChunkIDs() []uint64 {
+	var ids []uint64
+	for _, de := range fs.MustReadDir(q.path) {
+		name := de.Name()
+		if fs.IsTemporaryFileName(name) {
+			fs.MustRemoveAll(filepath.Join(q.path, name))
+			continue
+		}
+		if name == metainfoFilename || name == fs.FlockFilename {
+			continue
+		}
+		id, err := strconv.ParseUint(name, 16, 64)
+		if err != nil || len(name) != 16 || !de.Type().IsRegular() {
+			logger.Warnf("skipping unknown file %q in persistent queue %q", name, q.path)
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+	return ids
+}
+
+// mustCheckChunk verifies blocks in the chunk file starting from the given offset
+// and returns the size of valid data in the chunk and the number of blocks after offset.
+//
+// The chunk file is truncated at the first broken block, e.g. if the process was killed in the middle of the write.
+func (q *Queue) mustCheckChunk(id, offset uint64) (uint64, int) {
+	path := q.chunkPath(id)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		logger.Panicf("FATAL: cannot open chunk file %q: %s", path, err)
+	}
+	defer fs.MustClose(f)
+
+	fi, err := f.Stat()
+	if err != nil {
+		logger.Panicf("FATAL: cannot stat chunk file %q: %s", path, err)
+	}
+	size := uint64(fi.Size())
+	if offset >= size {
+		return size, 0
+	}
+
+	blocks := 0
+	var header [8]byte
+	for offset < size {
+		if offset+uint64(len(header)) <= size {
+			if _, err := f.ReadAt(header[:], int64(offset)); err != nil {
+				logger.Panicf("FATAL: cannot read block header from %q at offset %d: %s", path, offset, err)
+			}
+			blockLen := encoding.UnmarshalUint64(header[:])
+			end := offset + uint64(len(header)) + blockLen
+			if blockLen <= MaxBlockSize && end <= size {
+				blocks++
+				offset = end
+				continue
+			}
+		}
+
+		logger.Errorf("truncating chunk file %q from %d to %d bytes, since it contains broken block", path, size, offset)
+		if err := f.Truncate(int64(offset)); err != nil {
+			logger.Panicf("FATAL: cannot truncate chunk file %q: %s", path, err)
+		}
+		size = offset
+	}
+
+	return size, blocks
+}
+
+func (q *Queue) pendingBytesMetricName() string {
+	return fmt.Sprintf(`cprobe_persistentqueue_bytes_pending{path=%q}`, q.path)
+}
+
+func (q *Queue) chunkPath(id uint64) string {
+	return filepath.Join(q.path, fmt.Sprintf("%016X", id))
+}
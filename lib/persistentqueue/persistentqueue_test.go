@@ -0,0 +1,166 @@
+package persistentqueue
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestQueueReadWrite(t *testing.T) {
+	path := t.TempDir()
+	q := MustOpen(path, 0)
+
+	var blocks []string
+	for i := 0; i < 100; i++ {
+		block := fmt.Sprintf("block #%d", i)
+		q.MustWriteBlock([]byte(block))
+		blocks = append(blocks, block)
+	}
+	if n := q.PendingBlocks(); n != len(blocks) {
+		t.Fatalf("unexpected number of pending blocks; got %d; want %d", n, len(blocks))
+	}
+
+	for _, block := range blocks {
+		data, ack, ok := q.MustReadBlockNonblocking(nil)
+		if !ok {
+			t.Fatalf("cannot read block %q", block)
+		}
+		if string(data) != block {
+			t.Fatalf("unexpected block read; got %q; want %q", data, block)
+		}
+		ack()
+	}
+	if _, _, ok := q.MustReadBlockNonblocking(nil); ok {
+		t.Fatalf("expecting empty queue")
+	}
+	if n := q.PendingBytes(); n != 0 {
+		t.Fatalf("unexpected pending bytes; got %d; want 0", n)
+	}
+	q.MustClose()
+
+	// Acknowledged blocks mustn't be read again after re-opening the queue.
+	q = MustOpen(path, 0)
+	if _, _, ok := q.MustReadBlockNonblocking(nil); ok {
+		t.Fatalf("expecting empty queue after re-opening")
+	}
+	q.MustClose()
+}
+
+func TestQueueReplayAfterReopen(t *testing.T) {
+	defer func(n uint64) {
+		chunkFileSize = n
+	}(chunkFileSize)
+	chunkFileSize = 100
+
+	path := t.TempDir()
+	q := MustOpen(path, 0)
+	for i := 0; i < 50; i++ {
+		q.MustWriteBlock([]byte(fmt.Sprintf("block #%d", i)))
+	}
+
+	// Acknowledge the first 10 blocks, keep the next 5 blocks in flight and don't read the rest.
+	var acks []func()
+	for i := 0; i < 15; i++ {
+		_, ack, ok := q.MustReadBlockNonblocking(nil)
+		if !ok {
+			t.Fatalf("cannot read block #%d", i)
+		}
+		acks = append(acks, ack)
+	}
+	for _, ack := range acks[:10] {
+		ack()
+	}
+	q.MustClose()
+
+	q = MustOpen(path, 0)
+	if n := q.PendingBlocks(); n != 40 {
+		t.Fatalf("unexpected number of pending blocks after re-opening; got %d; want 40", n)
+	}
+	for i := 10; i < 50; i++ {
+		data, ack, ok := q.MustReadBlockNonblocking(nil)
+		if !ok {
+			t.Fatalf("cannot read block #%d", i)
+		}
+		if want := fmt.Sprintf("block #%d", i); string(data) != want {
+			t.Fatalf("unexpected block read; got %q; want %q", data, want)
+		}
+		ack()
+	}
+	q.MustClose()
+
+	// All the chunks except of the last one must be removed.
+	q = MustOpen(path, 0)
+	q.MustClose()
+	chunks := 0
+	des, err := os.ReadDir(path)
+	if err != nil {
+		t.Fatalf("cannot read %q: %s", path, err)
+	}
+	for _, de := range des {
+		if len(de.Name()) == 16 {
+			chunks++
+		}
+	}
+	if chunks != 1 {
+		t.Fatalf("unexpected number of chunk files left; got %d; want 1", chunks)
+	}
+}
+
+func TestQueueMaxPendingBytes(t *testing.T) {
+	path := t.TempDir()
+	// Every block occupies 8 bytes for the header and 10 bytes for the data.
+	q := MustOpen(path, 18*5)
+	for i := 0; i < 20; i++ {
+		q.MustWriteBlock([]byte(fmt.Sprintf("block #%03d", i)[:10]))
+	}
+	if n := q.PendingBlocks(); n != 5 {
+		t.Fatalf("unexpected number of pending blocks; got %d; want 5", n)
+	}
+
+	// The oldest blocks must be dropped.
+	data, _, ok := q.MustReadBlockNonblocking(nil)
+	if !ok {
+		t.Fatalf("cannot read block")
+	}
+	if want := "block #015"[:10]; string(data) != want {
+		t.Fatalf("unexpected block read; got %q; want %q", data, want)
+	}
+	q.MustClose()
+}
+
+func TestQueueTruncateBrokenBlock(t *testing.T) {
+	path := t.TempDir()
+	q := MustOpen(path, 0)
+	q.MustWriteBlock([]byte("foo"))
+	q.MustWriteBlock([]byte("bar"))
+	q.MustClose()
+
+	// Simulate the crash in the middle of the block write.
+	chunkPath := filepath.Join(path, fmt.Sprintf("%016X", 0))
+	f, err := os.OpenFile(chunkPath, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatalf("cannot open %q: %s", chunkPath, err)
+	}
+	if _, err := f.Write([]byte{0, 0, 0, 0, 0, 0, 0, 10, 'x'}); err != nil {
+		t.Fatalf("cannot write to %q: %s", chunkPath, err)
+	}
+	_ = f.Close()
+
+	q = MustOpen(path, 0)
+	if n := q.PendingBlocks(); n != 2 {
+		t.Fatalf("unexpected number of pending blocks; got %d; want 2", n)
+	}
+	q.MustWriteBlock([]byte("baz"))
+	for _, want := range []string{"foo", "bar", "baz"} {
+		data, ack, ok := q.MustReadBlockNonblocking(nil)
+		if !ok {
+			t.Fatalf("cannot read block %q", want)
+		}
+		if string(data) != want {
+			t.Fatalf("unexpected block read; got %q; want %q", data, want)
+		}
+		ack()
+	}
+	q.MustClose()
+}
@@ -0,0 +1,173 @@
+package prompbmarshal
+
+import (
+	"math"
+	"sort"
+	"strconv"
+)
+
+// MarshalExposition appends tss in Prometheus text exposition format to dst and returns the result.
+//
+// OpenMetrics format is used instead if openMetrics is set.
+// See https://github.com/prometheus/docs/blob/main/content/docs/instrumenting/exposition_formats.md
+// and https://github.com/OpenObservability/OpenMetrics/blob/main/specification/OpenMetrics.md
+//
+// tss is sorted by metric name, so series with the same name are grouped under a single TYPE line.
+// Only the last sample of every series is written.
+func MarshalExposition(dst []byte, tss []TimeSeries, openMetrics bool) []byte {
+	names := make([]string, len(tss))
+	for i := range tss {
+		names[i] = sanitizeName(metricName(tss[i].Labels))
+	}
+	sort.Stable(&seriesByName{tss: tss, names: names})
+
+	typ := "untyped"
+	if openMetrics {
+		typ = "unknown"
+	}
+
+	prevName := ""
+	for i := range tss {
+		ts := &tss[i]
+		if len(ts.Samples) == 0 {
+			continue
+		}
+		name := names[i]
+		if name == "" {
+			continue
+		}
+		if name != prevName {
+			dst = append(dst, "# TYPE "...)
+			dst = append(dst, name...)
+			dst = append(dst, ' ')
+			dst = append(dst, typ...)
+			dst = append(dst, '\n')
+			prevName = name
+		}
+
+		dst = append(dst, name...)
+		dst = marshalLabels(dst, ts.Labels)
+		dst = append(dst, ' ')
+
+		sample := ts.Samples[len(ts.Samples)-1]
+		dst = marshalValue(dst, sample.Value)
+		if sample.Timestamp != 0 {
+			dst = append(dst, ' ')
+			if openMetrics {
+				// OpenMetrics timestamps are in seconds
+				dst = strconv.AppendFloat(dst, float64(sample.Timestamp)/1e3, 'f', -1, 64)
+			} else {
+				dst = strconv.AppendInt(dst, sample.Timestamp, 10)
+			}
+		}
+		dst = append(dst, '\n')
+	}
+
+	if openMetrics {
+		dst = append(dst, "# EOF\n"...)
+	}
+	return dst
+}
+
+type seriesByName struct {
+	tss   []TimeSeries
+	names []string
+}
+
+func (s *seriesByName) Len() int           { return len(s.tss) }
+func (s *seriesByName) Less(i, j int) bool { return s.names[i] < s.names[j] }
+func (s *seriesByName) Swap(i, j int) {
+	s.tss[i], s.tss[j] = s.tss[j], s.tss[i]
+	s.names[i], s.names[j] = s.names[j], s.names[i]
+}
+
+func metricName(labels []Label) string {
+	for i := range labels {
+		if labels[i].Name == "__name__" {
+			return labels[i].Value
+		}
+	}
+	return ""
+}
+
+func marshalLabels(dst []byte, labels []Label) []byte {
+	n := 0
+	for i := range labels {
+		label := &labels[i]
+		if label.Name == "__name__" || label.Value == "" {
+			continue
+		}
+		if n == 0 {
+			dst = append(dst, '{')
+		} else {
+			dst = append(dst, ',')
+		}
+		n++
+		dst = append(dst, sanitizeName(label.Name)...)
+		dst = append(dst, '=', '"')
+		dst = appendEscapedValue(dst, label.Value)
+		dst = append(dst, '"')
+	}
+	if n > 0 {
+		dst = append(dst, '}')
+	}
+	return dst
+}
+
+func marshalValue(dst []byte, v float64) []byte {
+	switch {
+	case math.IsNaN(v):
+		return append(dst, "NaN"...)
+	case math.IsInf(v, 1):
+		return append(dst, "+Inf"...)
+	case math.IsInf(v, -1):
+		return append(dst, "-Inf"...)
+	}
+	return strconv.AppendFloat(dst, v, 'g', -1, 64)
+}
+
+// appendEscapedValue escapes backslash, double-quote and line feed in label values.
+func appendEscapedValue(dst []byte, s string) []byte {
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '\\':
+			dst = append(dst, `\\`...)
+		case '"':
+			dst = append(dst, `\"`...)
+		case '\n':
+			dst = append(dst, `\n`...)
+		default:
+			dst = append(dst, c)
+		}
+	}
+	return dst
+}
+
+// sanitizeName replaces chars, which aren't allowed in metric and label names, with underscores.
+func sanitizeName(s string) string {
+	valid := true
+	for i := 0; i < len(s); i++ {
+		if !isNameChar(s[i], i == 0) {
+			valid = false
+			break
+		}
+	}
+	if valid {
+		return s
+	}
+
+	b := []byte(s)
+	for i := range b {
+		if !isNameChar(b[i], i == 0) {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+func isNameChar(c byte, first bool) bool {
+	if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || c == ':' {
+		return true
+	}
+	return !first && c >= '0' && c <= '9'
+}
@@ -0,0 +1,64 @@
+package prompbmarshal
+
+import (
+	"math"
+	"testing"
+)
+
+func TestMarshalExposition(t *testing.T) {
+	f := func(tss []TimeSeries, openMetrics bool, resultExpected string) {
+		t.Helper()
+		result := MarshalExposition(nil, tss, openMetrics)
+		if string(result) != resultExpected {
+			t.Fatalf("unexpected result;\ngot\n%s\nwant\n%s", result, resultExpected)
+		}
+	}
+
+	newSeries := func(name string, value float64, timestamp int64, kvs ...string) TimeSeries {
+		labels := []Label{{Name: "__name__", Value: name}}
+		for i := 0; i < len(kvs); i += 2 {
+			labels = append(labels, Label{Name: kvs[i], Value: kvs[i+1]})
+		}
+		return TimeSeries{
+			Labels:  labels,
+			Samples: []Sample{{Value: value, Timestamp: timestamp}},
+		}
+	}
+
+	// empty
+	f(nil, false, "")
+	f(nil, true, "# EOF\n")
+
+	// series are grouped by name
+	f([]TimeSeries{
+		newSeries("mysql_up", 1, 1700000000123, "instance", "db1:3306", "job", "mysql"),
+		newSeries("cprobe_up", 0, 1700000000123, "instance", "db2:3306"),
+		newSeries("mysql_up", 0, 1700000000123, "instance", "db2:3306", "job", "mysql"),
+	}, false, `# TYPE cprobe_up untyped
+cprobe_up{instance="db2:3306"} 0 1700000000123
+# TYPE mysql_up untyped
+mysql_up{instance="db1:3306",job="mysql"} 1 1700000000123
+mysql_up{instance="db2:3306",job="mysql"} 0 1700000000123
+`)
+
+	// openmetrics uses timestamps in seconds
+	f([]TimeSeries{
+		newSeries("cprobe_duration_seconds", 0.25, 1700000000123, "instance", "db1:3306"),
+	}, true, `# TYPE cprobe_duration_seconds unknown
+cprobe_duration_seconds{instance="db1:3306"} 0.25 1700000000.123
+# EOF
+`)
+
+	// escaping, special values, invalid names and missing timestamp
+	f([]TimeSeries{
+		newSeries("cprobe_error", 1, 0, "error", "dial \"tcp\": \\ failed\n", "empty", ""),
+		newSeries("net.response-time", math.Inf(1), 0, "1st.label", "x"),
+		newSeries("nan", math.NaN(), 0),
+	}, false, `# TYPE cprobe_error untyped
+cprobe_error{error="dial \"tcp\": \\ failed\n"} 1
+# TYPE nan untyped
+nan NaN
+# TYPE net_response_time untyped
+net_response_time{_st_label="x"} +Inf
+`)
+}
@@ -27,7 +27,7 @@ func ResetWriteRequest(wr *WriteRequest) {
 // ResetTimeSeries clears all the GC references from tss and returns an empty tss ready for further use.
 func ResetTimeSeries(tss []TimeSeries) []TimeSeries {
 	for i := range tss {
-		ts := tss[i]
+		ts := &tss[i]
 		ts.Labels = nil
 		ts.Samples = nil
 	}
@@ -0,0 +1,227 @@
+package redact
+
+import (
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Mask is the string secrets are replaced with.
+//
+// It is the same as the yaml representation of promauth.Secret.
+const Mask = "<secret>"
+
+// secretKeyRegex matches the names of config keys holding secrets, e.g. password, basic_auth_pass, tls_key_pwd or bearer_token.
+//
+// Keys referring to files with secrets such as password_file or bearer_token_file aren't matched.
+var secretKeyRegex = regexp.MustCompile(`(?i)(^|[_.-])(pass|passwd|password|pwd|secret|token|credentials|api_?key|access_?key|secret_?key|private_?key)$`)
+
+// IsSecretKey returns true if the config key with the given name holds a secret.
+func IsSecretKey(name string) bool {
+	return secretKeyRegex.MatchString(name)
+}
+
+// IsSecretHeader returns true if the value of the HTTP header with the given name is a secret,
+// e.g. Authorization, Cookie or X-Api-Key.
+func IsSecretHeader(name string) bool {
+	switch strings.ToLower(name) {
+	case "authorization", "proxy-authorization", "cookie", "set-cookie":
+		return true
+	}
+	return IsSecretKey(strings.ReplaceAll(name, "-", "_"))
+}
+
+// Header replaces the value of `Name: value` header with Mask if IsSecretHeader(Name).
+//
+// header is returned as is if it isn't in `Name: value` form.
+func Header(header string) string {
+	name, _, ok := strings.Cut(header, ":")
+	if !ok || !IsSecretHeader(strings.TrimSpace(name)) {
+		return header
+	}
+	return name + ": " + Mask
+}
+
+// URL removes userinfo such as `user:password@` from u.
+//
+// u is returned as is if it isn't an absolute URL with userinfo.
+func URL(u string) string {
+	if !strings.Contains(u, "://") || !strings.Contains(u, "@") {
+		return u
+	}
+	pu, err := url.Parse(u)
+	if err != nil || pu.User == nil {
+		return u
+	}
+	pu.User = nil
+	return pu.String()
+}
+
+// Labels replaces the values of labels with names matching IsSecretKey in m with Mask, e.g. `__param_password`,
+// and removes userinfo from the values of other labels, see URL.
+//
+// m is modified in place.
+func Labels(m map[string]string) {
+	for name, value := range m {
+		if value == "" {
+			continue
+		}
+		if IsSecretKey(name) {
+			m[name] = Mask
+		} else {
+			m[name] = URL(value)
+		}
+	}
+}
+
+// Marshal marshals v to yaml with secrets replaced with Mask.
+//
+// Secrets are the fields with `secret:"true"` tag and the fields with yaml names matching IsSecretKey.
+// The values of secret headers in `- Name: value` list items are replaced with Mask and userinfo is removed from URLs,
+// see Header and URL.
+func Marshal(v interface{}) ([]byte, error) {
+	data, err := yaml.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	keys := taggedKeys(reflect.TypeOf(v))
+	return redactYAML(data, func(name string) bool {
+		_, ok := keys[name]
+		return ok || IsSecretKey(name)
+	}), nil
+}
+
+// YAML replaces the values of secret keys in yaml data with Mask.
+//
+// Secret headers and userinfo in URLs are redacted too, see Marshal.
+//
+// The data is processed line by line, so comments and formatting are preserved.
+// Values, which consist of a single `%{...}` placeholder, aren't secrets, so they are left as is.
+func YAML(data []byte) []byte {
+	return redactYAML(data, IsSecretKey)
+}
+
+// TOML replaces the values of secret keys in toml data with Mask.
+//
+// Both `key = "value"` lines and inline tables are supported. Multi-line strings aren't supported.
+// Values, which consist of a single `%{...}` placeholder, aren't secrets, so they are left as is.
+func TOML(data []byte) []byte {
+	return tomlKeyValueRegex.ReplaceAllFunc(data, func(b []byte) []byte {
+		m := tomlKeyValueRegex.FindSubmatch(b)
+		key := strings.Trim(string(m[2]), `"'`)
+		if !IsSecretKey(key) || isPlaceholder(string(m[4][1:len(m[4])-1])) {
+			return b
+		}
+		var dst []byte
+		dst = append(dst, m[1]...)
+		dst = append(dst, m[2]...)
+		dst = append(dst, m[3]...)
+		dst = append(dst, '"')
+		dst = append(dst, Mask...)
+		return append(dst, '"')
+	})
+}
+
+var tomlKeyValueRegex = regexp.MustCompile(`(?m)(^|[\s{,])([A-Za-z0-9_.-]+|"[^"\n]*"|'[^'\n]*')(\s*=\s*)("(?:[^"\\\n]|\\.)*"|'[^'\n]*')`)
+
+var yamlKeyValueRegex = regexp.MustCompile(`^(\s*(?:-\s+)?)("[^"]*"|'[^']*'|[^\s:#'"][^:#]*?)(\s*:\s+)(.*?)(\s+#.*)?$`)
+
+func redactYAML(data []byte, isSecret func(name string) bool) []byte {
+	lines := strings.SplitAfter(string(data), "\n")
+	var dst []byte
+	for _, line := range lines {
+		dst = append(dst, redactYAMLLine(line, isSecret)...)
+	}
+	return dst
+}
+
+func redactYAMLLine(line string, isSecret func(name string) bool) string {
+	eol := ""
+	if strings.HasSuffix(line, "\n") {
+		line = line[:len(line)-1]
+		eol = "\n"
+	}
+	if m := yamlListItemRegex.FindStringSubmatch(line); m != nil {
+		return m[1] + redactYAMLScalar(m[2], Header) + m[3] + eol
+	}
+	m := yamlKeyValueRegex.FindStringSubmatch(line)
+	if m == nil {
+		return line + eol
+	}
+	key := strings.Trim(m[2], `"'`)
+	value := m[4]
+	if value == "" || value == "|" || value == ">" || isPlaceholder(strings.Trim(value, `"'`)) {
+		return line + eol
+	}
+	if !isSecret(key) {
+		return m[1] + m[2] + m[3] + redactYAMLScalar(value, URL) + m[5] + eol
+	}
+	return m[1] + m[2] + m[3] + Mask + m[5] + eol
+}
+
+// yamlListItemRegex matches `- value` lines, where value is a quoted string.
+//
+// It must be checked before yamlKeyValueRegex, which matches `- 'Name: value'` too.
+var yamlListItemRegex = regexp.MustCompile(`^(\s*-\s+)("(?:[^"\\]|\\.)*"|'[^']*')(\s+#.*)?$`)
+
+// redactYAMLScalar applies f to the yaml scalar value, which may be quoted.
+func redactYAMLScalar(value string, f func(s string) string) string {
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+		s := value[1 : len(value)-1]
+		if r := f(s); r != s {
+			return string(value[0]) + r + string(value[0])
+		}
+		return value
+	}
+	return f(value)
+}
+
+// isPlaceholder returns true if s is a single `%{...}` placeholder, which is expanded when the config is loaded.
+func isPlaceholder(s string) bool {
+	return len(s) > 3 && strings.HasPrefix(s, "%{") && strings.IndexByte(s, '}') == len(s)-1
+}
+
+var taggedKeysCache sync.Map
+
+// taggedKeys returns the yaml names of the fields with `secret:"true"` tag in t and in the structs t refers to.
+func taggedKeys(t reflect.Type) map[string]struct{} {
+	if t == nil {
+		return nil
+	}
+	if v, ok := taggedKeysCache.Load(t); ok {
+		return v.(map[string]struct{})
+	}
+	keys := make(map[string]struct{})
+	collectTaggedKeys(t, keys, make(map[reflect.Type]bool))
+	taggedKeysCache.Store(t, keys)
+	return keys
+}
+
+func collectTaggedKeys(t reflect.Type, keys map[string]struct{}, seen map[reflect.Type]bool) {
+	for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice || t.Kind() == reflect.Array || t.Kind() == reflect.Map {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct || seen[t] {
+		return
+	}
+	seen[t] = true
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+		if name == "-" {
+			continue
+		}
+		if f.Tag.Get("secret") == "true" {
+			if name == "" {
+				name = strings.ToLower(f.Name)
+			}
+			keys[name] = struct{}{}
+		}
+		collectTaggedKeys(f.Type, keys, seen)
+	}
+}
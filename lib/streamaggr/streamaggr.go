@@ -0,0 +1,469 @@
+package streamaggr
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cprobe/cprobe/lib/prompbmarshal"
+	"github.com/cprobe/cprobe/lib/promrelabel"
+	"github.com/cprobe/cprobe/lib/promutils"
+)
+
+var supportedOutputs = []string{
+	"sum",
+	"avg",
+	"max",
+	"count_series",
+	"total",
+	"rate_sum",
+}
+
+// Config is a configuration for a single stream aggregation rule.
+//
+// The aggregated series are named `<metric>:<interval>[_by_<by>|_without_<without>]_<output>`
+// in the same way as vmagent stream aggregation does,
+// see https://docs.victoriametrics.com/stream-aggregation.html
+type Config struct {
+	// Match is an optional series selector. All the series are aggregated if it is empty.
+	Match *promrelabel.IfExpression `yaml:"match,omitempty"`
+
+	// Interval is the interval for the aggregation. The aggregated series are pushed every Interval.
+	Interval *promutils.Duration `yaml:"interval"`
+
+	// StalenessInterval is the interval after which the input series is forgotten if it has no new samples.
+	// It is 2*Interval by default.
+	StalenessInterval *promutils.Duration `yaml:"staleness_interval,omitempty"`
+
+	// By is an optional list of labels for grouping the input series.
+	By []string `yaml:"by,omitempty"`
+
+	// Without is an optional list of labels, which are removed from the input series before grouping.
+	Without []string `yaml:"without,omitempty"`
+
+	// Outputs is a list of aggregations to calculate for every group:
+	//
+	//   sum          - the sum of the last values of the input series
+	//   avg          - the average of the last values of the input series
+	//   max          - the maximum value among all the input samples
+	//   count_series - the number of unique input series
+	//   total        - the running sum of the increases of the input counters, counter resets are handled
+	//   rate_sum     - the sum of the per-second rates of the input counters
+	Outputs []string `yaml:"outputs"`
+
+	// KeepInput instructs to keep the input series matching Match.
+	// By default only the aggregated series are kept for them.
+	KeepInput bool `yaml:"keep_input,omitempty"`
+}
+
+// PushFunc is called with the aggregated series at every aggregation interval.
+type PushFunc func(tss []prompbmarshal.TimeSeries)
+
+// Aggregators aggregates the input series with a list of rules.
+type Aggregators struct {
+	as []*aggregator
+}
+
+// NewAggregators starts aggregators for cfgs, which push the aggregated series to pushFunc.
+//
+// MustStop must be called when the returned Aggregators are no longer needed.
+func NewAggregators(cfgs []*Config, pushFunc PushFunc) (*Aggregators, error) {
+	if len(cfgs) == 0 {
+		return nil, nil
+	}
+
+	as := make([]*aggregator, 0, len(cfgs))
+	for i, cfg := range cfgs {
+		a, err := newAggregator(cfg, pushFunc)
+		if err != nil {
+			for _, a := range as {
+				a.MustStop()
+			}
+			return nil, fmt.Errorf("cannot initialize aggregator #%d: %w", i+1, err)
+		}
+		as = append(as, a)
+	}
+
+	for _, a := range as {
+		a.start()
+	}
+
+	return &Aggregators{
+		as: as,
+	}, nil
+}
+
+// MustStop stops all the aggregators.
+//
+// The series aggregated since the last interval are pushed to pushFunc before MustStop returns.
+func (a *Aggregators) MustStop() {
+	if a == nil {
+		return
+	}
+	for _, aggr := range a.as {
+		aggr.MustStop()
+	}
+}
+
+// Push aggregates tss and returns the series, which must be sent as is.
+//
+// The series matching at least one aggregator without keep_input are dropped from the returned slice.
+// The returned slice reuses tss.
+func (a *Aggregators) Push(tss []prompbmarshal.TimeSeries) []prompbmarshal.TimeSeries {
+	if a == nil || len(a.as) == 0 {
+		return tss
+	}
+
+	dst := tss[:0]
+	for i := range tss {
+		ts := tss[i]
+		keep := true
+		for _, aggr := range a.as {
+			if !aggr.match.Match(ts.Labels) {
+				continue
+			}
+			aggr.push(&ts)
+			if !aggr.keepInput {
+				keep = false
+			}
+		}
+		if keep {
+			dst = append(dst, ts)
+		}
+	}
+
+	return dst
+}
+
+type aggregator struct {
+	match             *promrelabel.IfExpression
+	interval          time.Duration
+	stalenessInterval time.Duration
+	by                []string
+	without           []string
+	outputs           []string
+	keepInput         bool
+
+	// suffix is added to the metric name of the aggregated series, e.g. `:1m_by_instance`
+	suffix string
+
+	pushFunc PushFunc
+
+	mu     sync.Mutex
+	groups map[string]*groupState
+
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+}
+
+type groupState struct {
+	metricName string
+	labels     []prompbmarshal.Label
+
+	series map[string]*seriesState
+
+	// max is the maximum sample value seen since the last flush.
+	max float64
+	// total is the running sum of the increases of all the series in the group.
+	total float64
+}
+
+type seriesState struct {
+	lastValue     float64
+	lastTimestamp int64
+	// updated is set when the series has samples since the last flush.
+	updated bool
+	// deadline is the time after which the series is forgotten.
+	deadline int64
+
+	// increase is the counter increase since the last flush.
+	increase float64
+	// increaseStart is the timestamp of the sample, from which the increase is calculated.
+	increaseStart int64
+}
+
+func newAggregator(cfg *Config, pushFunc PushFunc) (*aggregator, error) {
+	interval := cfg.Interval.Duration()
+	if interval <= 0 {
+		return nil, fmt.Errorf("interval must be positive; got %s", interval)
+	}
+
+	stalenessInterval := cfg.StalenessInterval.Duration()
+	if stalenessInterval <= 0 {
+		stalenessInterval = 2 * interval
+	}
+	if stalenessInterval < interval {
+		return nil, fmt.Errorf("staleness_interval=%s cannot be smaller than interval=%s", stalenessInterval, interval)
+	}
+
+	if len(cfg.By) > 0 && len(cfg.Without) > 0 {
+		return nil, fmt.Errorf("by and without cannot be set at the same time")
+	}
+
+	if len(cfg.Outputs) == 0 {
+		return nil, fmt.Errorf("outputs cannot be empty; supported outputs: %s", strings.Join(supportedOutputs, ", "))
+	}
+	for _, output := range cfg.Outputs {
+		if !isSupportedOutput(output) {
+			return nil, fmt.Errorf("unsupported output %q; supported outputs: %s", output, strings.Join(supportedOutputs, ", "))
+		}
+	}
+
+	by := sortAndRemoveDuplicates(cfg.By)
+	without := sortAndRemoveDuplicates(cfg.Without)
+
+	suffix := ":" + formatInterval(interval)
+	if len(by) > 0 {
+		suffix += "_by_" + strings.Join(by, "_")
+	}
+	if len(without) > 0 {
+		suffix += "_without_" + strings.Join(without, "_")
+	}
+
+	return &aggregator{
+		match:             cfg.Match,
+		interval:          interval,
+		stalenessInterval: stalenessInterval,
+		by:                by,
+		without:           without,
+		outputs:           cfg.Outputs,
+		keepInput:         cfg.KeepInput,
+		suffix:            suffix,
+		pushFunc:          pushFunc,
+		groups:            make(map[string]*groupState),
+		stopCh:            make(chan struct{}),
+	}, nil
+}
+
+func (a *aggregator) start() {
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+
+		ticker := time.NewTicker(a.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-a.stopCh:
+				// Push the state collected since the last flush, so it isn't lost on shutdown or config reload.
+				a.flush(time.Now().UnixMilli())
+				return
+			case <-ticker.C:
+				a.flush(time.Now().UnixMilli())
+			}
+		}
+	}()
+}
+
+func (a *aggregator) MustStop() {
+	close(a.stopCh)
+	a.wg.Wait()
+}
+
+func (a *aggregator) push(ts *prompbmarshal.TimeSeries) {
+	metricName, groupLabels := a.groupLabels(ts.Labels)
+	groupKey := promutils.NewLabels(0)
+	groupKey.Labels = append(groupKey.Labels, prompbmarshal.Label{Name: "__name__", Value: metricName})
+	groupKey.Labels = append(groupKey.Labels, groupLabels...)
+	gk := groupKey.String()
+
+	seriesKey := promutils.NewLabels(0)
+	seriesKey.Labels = append(seriesKey.Labels, ts.Labels...)
+	seriesKey.Sort()
+	sk := seriesKey.String()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	g, ok := a.groups[gk]
+	if !ok {
+		g = &groupState{
+			metricName: metricName,
+			labels:     groupLabels,
+			series:     make(map[string]*seriesState),
+			max:        math.Inf(-1),
+		}
+		a.groups[gk] = g
+	}
+
+	for _, sample := range ts.Samples {
+		if math.IsNaN(sample.Value) {
+			continue
+		}
+
+		s, ok := g.series[sk]
+		if !ok {
+			// The first sample is used only as a starting point for the increase.
+			s = &seriesState{
+				lastValue:     sample.Value,
+				lastTimestamp: sample.Timestamp,
+				increaseStart: sample.Timestamp,
+			}
+			g.series[sk] = s
+		} else if sample.Timestamp >= s.lastTimestamp {
+			d := sample.Value - s.lastValue
+			if d < 0 {
+				// counter reset
+				d = sample.Value
+			}
+			s.increase += d
+			s.lastValue = sample.Value
+			s.lastTimestamp = sample.Timestamp
+		}
+
+		s.updated = true
+		s.deadline = time.Now().Add(a.stalenessInterval).UnixMilli()
+		if sample.Value > g.max {
+			g.max = sample.Value
+		}
+	}
+}
+
+// flush pushes the aggregated series with the given timestamp for the groups, which received samples since the previous flush.
+func (a *aggregator) flush(timestamp int64) {
+	var tss []prompbmarshal.TimeSeries
+	now := time.Now().UnixMilli()
+
+	a.mu.Lock()
+	for gk, g := range a.groups {
+		var sum, rateSum float64
+		count := 0
+		for sk, s := range g.series {
+			if s.deadline < now {
+				delete(g.series, sk)
+				continue
+			}
+			if !s.updated {
+				continue
+			}
+
+			count++
+			sum += s.lastValue
+			g.total += s.increase
+			if d := s.lastTimestamp - s.increaseStart; d > 0 {
+				rateSum += s.increase / (float64(d) / 1e3)
+			}
+
+			s.updated = false
+			s.increase = 0
+			s.increaseStart = s.lastTimestamp
+		}
+
+		if len(g.series) == 0 {
+			delete(a.groups, gk)
+		}
+		if count == 0 {
+			continue
+		}
+
+		for _, output := range a.outputs {
+			var v float64
+			switch output {
+			case "sum":
+				v = sum
+			case "avg":
+				v = sum / float64(count)
+			case "max":
+				v = g.max
+			case "count_series":
+				v = float64(count)
+			case "total":
+				v = g.total
+			case "rate_sum":
+				v = rateSum
+			}
+			tss = append(tss, a.newTimeSeries(g, output, v, timestamp))
+		}
+		g.max = math.Inf(-1)
+	}
+	a.mu.Unlock()
+
+	if len(tss) > 0 {
+		a.pushFunc(tss)
+	}
+}
+
+func (a *aggregator) newTimeSeries(g *groupState, output string, value float64, timestamp int64) prompbmarshal.TimeSeries {
+	labels := make([]prompbmarshal.Label, 0, len(g.labels)+1)
+	labels = append(labels, prompbmarshal.Label{
+		Name:  "__name__",
+		Value: g.metricName + a.suffix + "_" + output,
+	})
+	labels = append(labels, g.labels...)
+	return prompbmarshal.TimeSeries{
+		Labels: labels,
+		Samples: []prompbmarshal.Sample{{
+			Value:     value,
+			Timestamp: timestamp,
+		}},
+	}
+}
+
+// groupLabels returns the metric name and the labels for grouping the series with the given labels.
+func (a *aggregator) groupLabels(labels []prompbmarshal.Label) (string, []prompbmarshal.Label) {
+	var metricName string
+	ret := make([]prompbmarshal.Label, 0, len(labels))
+	for _, label := range labels {
+		if label.Name == "__name__" {
+			metricName = label.Value
+			continue
+		}
+		if len(a.by) > 0 && !containsString(a.by, label.Name) {
+			continue
+		}
+		if len(a.without) > 0 && containsString(a.without, label.Name) {
+			continue
+		}
+		ret = append(ret, label)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Name < ret[j].Name
+	})
+	return metricName, ret
+}
+
+func isSupportedOutput(output string) bool {
+	return containsString(supportedOutputs, output)
+}
+
+func containsString(a []string, s string) bool {
+	for _, x := range a {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+func sortAndRemoveDuplicates(a []string) []string {
+	if len(a) == 0 {
+		return nil
+	}
+	a = append([]string{}, a...)
+	sort.Strings(a)
+	dst := a[:1]
+	for _, s := range a[1:] {
+		if s != dst[len(dst)-1] {
+			dst = append(dst, s)
+		}
+	}
+	return dst
+}
+
+// formatInterval formats d in the short form used in the names of the aggregated series, e.g. 1m instead of 1m0s.
+func formatInterval(d time.Duration) string {
+	switch {
+	case d%time.Hour == 0:
+		return fmt.Sprintf("%dh", d/time.Hour)
+	case d%time.Minute == 0:
+		return fmt.Sprintf("%dm", d/time.Minute)
+	case d%time.Second == 0:
+		return fmt.Sprintf("%ds", d/time.Second)
+	default:
+		return fmt.Sprintf("%dms", d/time.Millisecond)
+	}
+}
@@ -0,0 +1,219 @@
+package streamaggr
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cprobe/cprobe/lib/prompbmarshal"
+	"gopkg.in/yaml.v2"
+)
+
+func TestNewAggregatorsFailure(t *testing.T) {
+	f := func(config string) {
+		t.Helper()
+		var cfgs []*Config
+		if err := yaml.UnmarshalStrict([]byte(config), &cfgs); err != nil {
+			t.Fatalf("cannot parse config: %s", err)
+		}
+		a, err := NewAggregators(cfgs, func(tss []prompbmarshal.TimeSeries) {})
+		if err == nil {
+			a.MustStop()
+			t.Fatalf("expecting non-nil error for config %q", config)
+		}
+	}
+
+	// missing interval
+	f(`- outputs: [sum]`)
+
+	// missing outputs
+	f(`- interval: 1m`)
+
+	// unsupported output
+	f(`
+- interval: 1m
+  outputs: [foobar]
+`)
+
+	// by and without at the same time
+	f(`
+- interval: 1m
+  by: [foo]
+  without: [bar]
+  outputs: [sum]
+`)
+
+	// too small staleness_interval
+	f(`
+- interval: 1m
+  staleness_interval: 30s
+  outputs: [sum]
+`)
+}
+
+func TestAggregatorsPush(t *testing.T) {
+	f := func(config string, inputs [][]string, outputsExpected, passedExpected string) {
+		t.Helper()
+		var cfgs []*Config
+		if err := yaml.UnmarshalStrict([]byte(config), &cfgs); err != nil {
+			t.Fatalf("cannot parse config: %s", err)
+		}
+
+		var outputs []string
+		pushFunc := func(tss []prompbmarshal.TimeSeries) {
+			for _, ts := range tss {
+				outputs = append(outputs, fmt.Sprintf("%s %v", labelsString(ts.Labels), ts.Samples[0].Value))
+			}
+		}
+		a, err := NewAggregators(cfgs, pushFunc)
+		if err != nil {
+			t.Fatalf("cannot initialize aggregators: %s", err)
+		}
+		defer a.MustStop()
+
+		var passed []string
+		now := time.Now().UnixMilli()
+		for i, input := range inputs {
+			tss := mustParseInput(input, now+int64(i)*10e3)
+			for _, ts := range a.Push(tss) {
+				passed = append(passed, labelsString(ts.Labels))
+			}
+			for _, aggr := range a.as {
+				aggr.flush(now + int64(i)*10e3 + 1)
+			}
+		}
+
+		sort.Strings(outputs)
+		if s := strings.Join(outputs, "\n"); s != outputsExpected {
+			t.Fatalf("unexpected outputs;\ngot\n%s\nwant\n%s", s, outputsExpected)
+		}
+		if s := strings.Join(passed, "\n"); s != passedExpected {
+			t.Fatalf("unexpected passed series;\ngot\n%s\nwant\n%s", s, passedExpected)
+		}
+	}
+
+	// gauges grouped by label
+	f(`
+- interval: 1m
+  match: '{__name__="foo"}'
+  by: [job]
+  outputs: [sum, avg, max, count_series]
+`, [][]string{{
+		`foo{job="a",instance="1"} 1`,
+		`foo{job="a",instance="2"} 3`,
+		`foo{job="b",instance="1"} 5`,
+		`bar{job="a"} 10`,
+	}}, `foo:1m_by_job_avg{job="a"} 2
+foo:1m_by_job_avg{job="b"} 5
+foo:1m_by_job_count_series{job="a"} 2
+foo:1m_by_job_count_series{job="b"} 1
+foo:1m_by_job_max{job="a"} 3
+foo:1m_by_job_max{job="b"} 5
+foo:1m_by_job_sum{job="a"} 4
+foo:1m_by_job_sum{job="b"} 5`, `bar{job="a"}`)
+
+	// counters with reset, keep_input
+	f(`
+- interval: 10s
+  without: [instance]
+  outputs: [total, rate_sum]
+  keep_input: true
+`, [][]string{
+		{`foo{job="a",instance="1"} 10`, `foo{job="a",instance="2"} 100`},
+		{`foo{job="a",instance="1"} 20`, `foo{job="a",instance="2"} 150`},
+		{`foo{job="a",instance="1"} 5`, `foo{job="a",instance="2"} 200`},
+	}, `foo:10s_without_instance_rate_sum{job="a"} 0
+foo:10s_without_instance_rate_sum{job="a"} 5.5
+foo:10s_without_instance_rate_sum{job="a"} 6
+foo:10s_without_instance_total{job="a"} 0
+foo:10s_without_instance_total{job="a"} 115
+foo:10s_without_instance_total{job="a"} 60`, `foo{instance="1",job="a"}
+foo{instance="2",job="a"}
+foo{instance="1",job="a"}
+foo{instance="2",job="a"}
+foo{instance="1",job="a"}
+foo{instance="2",job="a"}`)
+}
+
+func TestAggregatorsMustStopFlush(t *testing.T) {
+	var cfgs []*Config
+	if err := yaml.UnmarshalStrict([]byte(`
+- interval: 1h
+  outputs: [sum]
+`), &cfgs); err != nil {
+		t.Fatalf("cannot parse config: %s", err)
+	}
+
+	var outputs []string
+	pushFunc := func(tss []prompbmarshal.TimeSeries) {
+		for _, ts := range tss {
+			outputs = append(outputs, fmt.Sprintf("%s %v", labelsString(ts.Labels), ts.Samples[0].Value))
+		}
+	}
+	a, err := NewAggregators(cfgs, pushFunc)
+	if err != nil {
+		t.Fatalf("cannot initialize aggregators: %s", err)
+	}
+
+	a.Push(mustParseInput([]string{`foo{job="a"} 1`, `foo{job="a"} 2`}, time.Now().UnixMilli()))
+	if len(outputs) != 0 {
+		t.Fatalf("unexpected outputs before the interval ends: %q", outputs)
+	}
+
+	// The interval never ends during the test, so the pending state is pushed only by MustStop.
+	a.MustStop()
+	if s := strings.Join(outputs, "\n"); s != `foo:1h_sum{job="a"} 2` {
+		t.Fatalf("unexpected outputs after MustStop;\ngot\n%s\nwant\n%s", s, `foo:1h_sum{job="a"} 2`)
+	}
+}
+
+func mustParseInput(lines []string, timestamp int64) []prompbmarshal.TimeSeries {
+	var tss []prompbmarshal.TimeSeries
+	for _, line := range lines {
+		n := strings.LastIndexByte(line, ' ')
+		metric, value := line[:n], line[n+1:]
+		var v float64
+		if _, err := fmt.Sscanf(value, "%g", &v); err != nil {
+			panic(fmt.Errorf("cannot parse value %q: %w", value, err))
+		}
+
+		name := metric
+		var labels []prompbmarshal.Label
+		if n := strings.IndexByte(metric, '{'); n >= 0 {
+			name = metric[:n]
+			for _, kv := range strings.Split(strings.Trim(metric[n:], "{}"), ",") {
+				k, v, _ := strings.Cut(kv, "=")
+				labels = append(labels, prompbmarshal.Label{Name: k, Value: strings.Trim(v, `"`)})
+			}
+		}
+		labels = append([]prompbmarshal.Label{{Name: "__name__", Value: name}}, labels...)
+
+		tss = append(tss, prompbmarshal.TimeSeries{
+			Labels: labels,
+			Samples: []prompbmarshal.Sample{{
+				Value:     v,
+				Timestamp: timestamp,
+			}},
+		})
+	}
+	return tss
+}
+
+func labelsString(labels []prompbmarshal.Label) string {
+	var name string
+	var a []string
+	for _, label := range labels {
+		if label.Name == "__name__" {
+			name = label.Value
+			continue
+		}
+		a = append(a, fmt.Sprintf("%s=%q", label.Name, label.Value))
+	}
+	sort.Strings(a)
+	if name == "" {
+		return "{" + strings.Join(a, ",") + "}"
+	}
+	return name + "{" + strings.Join(a, ",") + "}"
+}
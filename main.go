@@ -33,10 +33,18 @@ var (
 	update     = flag.Bool("update", false, "Update binary")
 	updateFile = flag.String("update.file", "", "new version tar.gz file or url")
 	nohttp     = flag.Bool("no-httpd", false, "Disable http server")
+	dryRun     = flag.Bool("dry-run", false, "Validate all the configs under -conf.d without scraping and exit. The exit code is non-zero if any problem is found")
+	testMode   = flag.Bool("test", false, "Scrape the targets of -test.job once, print the resulting series after all the relabeling and exit. Nothing is sent to the writers")
+	testJob    = flag.String("test.job", "", "Job to scrape if -test is set. May be empty if there is only one job, use -plugins to narrow down the jobs")
+	testTarget = flag.String("test.target", "", "Target to scrape if -test is set, e.g. 10.0.0.1:3306. All the discovered targets of -test.job are scraped if empty")
+	testFormat = flag.String("test.format", "text", "Output format if -test is set. One of: {text|json}")
 )
 
 func main() {
 	flag.StringVar(&flags.ConfigDirectory, "conf.d", "conf.d", "Filepath to conf.d")
+	flag.BoolVar(&flags.PullMode, "pull", false, "Keep the latest scraped samples of every target in memory and expose them at /metrics/probe and /federate?job=... . "+
+		"writer.yaml becomes optional if -pull is set")
+	flag.BoolVar(dryRun, "check-config", false, "Alias for -dry-run")
 	flag.CommandLine.SetOutput(os.Stdout)
 	flag.Usage = usage
 	envflag.Parse()
@@ -57,6 +65,22 @@ func main() {
 
 	buildinfo.Init()
 	logger.Init()
+
+	if *dryRun {
+		if probe.CheckConfig(os.Stdout, flags.ConfigDirectory) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *testMode {
+		if err := scrapeOnce(); err != nil {
+			fmt.Println("error:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	runner.PrintRuntime()
 
 	ctx, cancel := context.WithCancel(context.Background())
@@ -101,6 +125,19 @@ EXIT:
 	}
 
 	cancel()
+	probe.ClosePlugins()
+	writer.Close()
+}
+
+// scrapeOnce 只抓取一次，把最终的 series 打印出来，用来调试 rule 文件
+func scrapeOnce() error {
+	// 没有 writer.yaml 的话就只打印 metric_relabel_configs 之后的结果
+	if err := writer.InitDryRun(flags.ConfigDirectory); err != nil {
+		logger.Warnf("writer relabeling is skipped: %v", err)
+	}
+	defer probe.ClosePlugins()
+
+	return probe.ScrapeOnce(context.Background(), os.Stdout, flags.ConfigDirectory, *testJob, *testTarget, *testFormat)
 }
 
 func usage() {
@@ -31,7 +31,7 @@ func (p *Blackbox) ParseConfig(baseDir string, bs []byte) (any, error) {
 	return &moduleConfig, nil
 }
 
-func (p *Blackbox) Scrape(ctx context.Context, address string, c any, ss *types.Samples) error {
+func (p *Blackbox) Scrape(ctx context.Context, address string, c any, _ plugins.Params, ss *types.Samples) error {
 	err := p.scrape(ctx, address, c, ss)
 	// 冗余一份 probe_success 的指标，方便仪表盘展示，避免用户再去修改仪表盘了
 	if err != nil {
@@ -29,6 +29,10 @@ type Config struct {
 	Meta              MetaConfig    `toml:"meta"`
 	AgentOnly         bool          `toml:"agent_only"`
 }
+
+// Immutable 表示 Scrape 不会修改配置，多个 target 可以共用一份
+func (*Config) Immutable() {}
+
 type KVConfig struct {
 	Prefix string `toml:"prefix"`
 	Filter string `toml:"filter"`
@@ -58,7 +62,7 @@ func (*Consul) ParseConfig(baseDir string, bs []byte) (any, error) {
 	return &c, nil
 }
 
-func (*Consul) Scrape(ctx context.Context, target string, cfg any, ss *types.Samples) error {
+func (*Consul) Scrape(ctx context.Context, target string, cfg any, _ plugins.Params, ss *types.Samples) error {
 	conf := cfg.(*Config)
 	opts := exporter.ConsulOpts{
 		URI:          target,
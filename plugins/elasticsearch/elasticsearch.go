@@ -25,7 +25,7 @@ func (*ElasticSearch) ParseConfig(baseDir string, bs []byte) (any, error) {
 	return &c, nil
 }
 
-func (*ElasticSearch) Scrape(ctx context.Context, target string, c any, ss *types.Samples) error {
+func (*ElasticSearch) Scrape(ctx context.Context, target string, c any, _ plugins.Params, ss *types.Samples) error {
 	cfg := c.(*collector.Config)
 	return cfg.Scrape(ctx, target, ss)
 }
@@ -23,6 +23,9 @@ type Config struct {
 	BeatTimeout time.Duration `toml:"beat_timeout"`
 }
 
+// Immutable 表示 Scrape 不会修改配置，多个 target 可以共用一份
+func (*Config) Immutable() {}
+
 type Filebeat struct {
 }
 
@@ -43,7 +46,7 @@ func (f *Filebeat) ParseConfig(baseDir string, bs []byte) (any, error) {
 	return &c, nil
 }
 
-func (f *Filebeat) Scrape(ctx context.Context, target string, cfg any, ss *types.Samples) error {
+func (f *Filebeat) Scrape(ctx context.Context, target string, cfg any, _ plugins.Params, ss *types.Samples) error {
 	conf := cfg.(*Config)
 
 	if !strings.HasPrefix(target, "http") {
@@ -8,9 +8,63 @@ import (
 
 type Plugin interface {
 	// ParseConfig is used to parse config
+	//
+	// The parsed config is cached per job and shared by all the targets of the job
+	// if it implements Cloner or Immutable (or if it is nil), otherwise ParseConfig is called before every Scrape.
 	ParseConfig(baseDir string, bs []byte) (any, error)
 	// Scrape is used to scrape metrics, cfg need to be cast specific cfg
-	Scrape(ctx context.Context, target string, cfg any, ss *types.Samples) error
+	//
+	// params holds the params of the target taken from its `__param_*` labels, it may be nil.
+	// cfg may be shared by all the targets of a job, so params must be applied to a copy of cfg.
+	Scrape(ctx context.Context, target string, cfg any, params Params, ss *types.Samples) error
+}
+
+// Initializer may be implemented by a Plugin, which needs to set up global resources before the first Scrape.
+//
+// Init is called once before the first scrape of any job of the plugin. It is called again on the next scrape if it fails.
+type Initializer interface {
+	Init() error
+}
+
+// Closer may be implemented by a Plugin, which holds global resources, which must be released on shutdown.
+//
+// Close is called once on shutdown if the plugin has been initialized, i.e. if it has scraped at least one target.
+type Closer interface {
+	Close() error
+}
+
+// Session holds connections to a single target, which are reused between scrapes.
+type Session interface {
+	// Close releases the connections held by the session.
+	Close() error
+}
+
+// SessionPlugin may be implemented by a Plugin, which wants to keep connections to a target between scrapes
+// instead of connecting to the target on every Scrape.
+//
+// ScrapeSession is called instead of Scrape. The session is created with NewSession on the first scrape of a target
+// and it is closed when the target disappears, when the plugin config or params change, after a failed scrape
+// or when it stays idle for longer than session_idle_timeout of the job.
+// A session is never used by concurrent ScrapeSession calls.
+// cfg passed to NewSession is used by all the scrapes of the session, so ScrapeSession must not modify it.
+type SessionPlugin interface {
+	NewSession(ctx context.Context, target string, cfg any, params Params) (Session, error)
+	ScrapeSession(ctx context.Context, session Session, ss *types.Samples) error
+}
+
+// Cloner may be implemented by the config returned from ParseConfig, which is modified inside Scrape.
+//
+// Clone must return a copy of the config, which can be modified without affecting the original one.
+// It is called before every Scrape, while the original config is parsed once and cached.
+type Cloner interface {
+	Clone() any
+}
+
+// Immutable may be implemented by the config returned from ParseConfig, which is never modified inside Scrape.
+//
+// Such config is parsed once and passed as is to concurrent Scrape calls for all the targets of a job.
+type Immutable interface {
+	Immutable()
 }
 
 var registry = make(map[string]Plugin)
@@ -40,7 +40,7 @@ func (p *Json) ParseConfig(_ string, bs []byte) (any, error) {
 	return &moduleConfig, nil
 }
 
-func (p *Json) Scrape(ctx context.Context, address string, c any, ss *types.Samples) error {
+func (p *Json) Scrape(ctx context.Context, address string, c any, _ plugins.Params, ss *types.Samples) error {
 	module := c.(*config.Module)
 
 	registry := prometheus.NewPedanticRegistry()
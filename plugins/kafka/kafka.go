@@ -52,6 +52,9 @@ type Config struct {
 	TopicWorkers     int   `toml:"topic_workers" description:"Number of topic workers"`
 }
 
+// Immutable 表示 Scrape 不会修改配置，多个 target 可以共用一份
+func (*Config) Immutable() {}
+
 type Kafka struct {
 	// 这个数据结构中未来如果有变量，千万要小心并发使用变量的问题
 }
@@ -99,7 +102,7 @@ func (*Kafka) ParseConfig(baseDir string, bs []byte) (any, error) {
 	return &c, nil
 }
 
-func (*Kafka) Scrape(ctx context.Context, target string, c any, ss *types.Samples) error {
+func (*Kafka) Scrape(ctx context.Context, target string, c any, _ plugins.Params, ss *types.Samples) error {
 	// 这个方法中如果要对配置 c 变量做修改，一定要 clone 一份之后再修改，因为并发的多个 target 共享了一个 c 变量
 	conf := c.(*Config)
 
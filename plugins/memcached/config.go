@@ -22,6 +22,12 @@ type Config struct {
 	clienttls.ClientConfig
 }
 
+// Clone 返回配置的拷贝，Scrape 里会按 target 设置 ServerName，所以不能多个 target 共用一份配置
+func (c *Config) Clone() any {
+	cc := *c
+	return &cc
+}
+
 func (c *Config) Scrape(ctx context.Context, target string, ss *types.Samples) error {
 	var (
 		tlsConfig  *tls.Config
@@ -24,7 +24,7 @@ func (*Memcached) ParseConfig(baseDir string, bs []byte) (any, error) {
 	return &c, nil
 }
 
-func (*Memcached) Scrape(ctx context.Context, target string, c any, ss *types.Samples) error {
+func (*Memcached) Scrape(ctx context.Context, target string, c any, _ plugins.Params, ss *types.Samples) error {
 	cfg := c.(*Config)
 	return cfg.Scrape(ctx, target, ss)
 }
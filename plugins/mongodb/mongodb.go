@@ -25,7 +25,7 @@ func (*MongoDB) ParseConfig(baseDir string, bs []byte) (any, error) {
 	return &c, nil
 }
 
-func (*MongoDB) Scrape(ctx context.Context, target string, c any, ss *types.Samples) error {
+func (*MongoDB) Scrape(ctx context.Context, target string, c any, _ plugins.Params, ss *types.Samples) error {
 	cfg := c.(*exporter.Config)
 	err := cfg.Scrape(ctx, target, ss)
 
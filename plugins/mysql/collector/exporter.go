@@ -80,6 +80,7 @@ var (
 type Exporter struct {
 	ctx      context.Context
 	dsn      string
+	db       *sql.DB
 	scrapers []Scraper
 	ss       *types.Samples
 	queries  []sqlc.CustomQuery
@@ -87,6 +88,32 @@ type Exporter struct {
 
 // New returns a new MySQL exporter for the provided DSN.
 func New(ctx context.Context, dsn string, scrapers []Scraper, ss *types.Samples, queries []sqlc.CustomQuery, lockWaitTimeout int, logSlowFilter bool) *Exporter {
+	return &Exporter{
+		ctx:      ctx,
+		dsn:      FormatDSN(dsn, lockWaitTimeout, logSlowFilter),
+		scrapers: scrapers,
+		ss:       ss,
+		queries:  queries,
+	}
+}
+
+// NewWithDB returns a new MySQL exporter, which scrapes metrics over db opened with OpenDB
+// instead of opening a new connection on every scrape.
+//
+// dsn must be the DSN db has been opened with.
+func NewWithDB(ctx context.Context, db *sql.DB, dsn string, scrapers []Scraper, ss *types.Samples, queries []sqlc.CustomQuery) *Exporter {
+	return &Exporter{
+		ctx:      ctx,
+		dsn:      dsn,
+		db:       db,
+		scrapers: scrapers,
+		ss:       ss,
+		queries:  queries,
+	}
+}
+
+// FormatDSN adds the params used by the exporter to dsn.
+func FormatDSN(dsn string, lockWaitTimeout int, logSlowFilter bool) string {
 	// Setup extra params for the DSN, default to having a lock timeout.
 	dsnParams := []string{fmt.Sprintf(timeoutParam, lockWaitTimeout)}
 
@@ -99,15 +126,20 @@ func New(ctx context.Context, dsn string, scrapers []Scraper, ss *types.Samples,
 	} else {
 		dsn = dsn + "?"
 	}
-	dsn += strings.Join(dsnParams, "&")
+	return dsn + strings.Join(dsnParams, "&")
+}
 
-	return &Exporter{
-		ctx:      ctx,
-		dsn:      dsn,
-		scrapers: scrapers,
-		ss:       ss,
-		queries:  queries,
+// OpenDB opens a connection pool for dsn returned by FormatDSN.
+func OpenDB(dsn string) (*sql.DB, error) {
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("cannot opening connection to database: %s, error: %s", dsn, err)
 	}
+
+	// By design exporter should use maximum one connection per request.
+	db.SetMaxOpenConns(1)
+	db.SetMaxIdleConns(1)
+	return db, nil
 }
 
 // Describe implements prometheus.Collector.
@@ -124,18 +156,19 @@ func (e *Exporter) Collect(ch chan<- prometheus.Metric) error {
 // scrape collects metrics from the target, returns an up metric value.
 func (e *Exporter) scrape(ctx context.Context, ch chan<- prometheus.Metric) error {
 	scrapeTime := time.Now()
-	db, err := sql.Open("mysql", e.dsn)
-	if err != nil {
-		return fmt.Errorf("cannot opening connection to database: %s, error: %s", e.dsn, err)
-	}
+	db := e.db
+	if db == nil {
+		var err error
+		db, err = OpenDB(e.dsn)
+		if err != nil {
+			return err
+		}
 
-	defer db.Close()
+		defer db.Close()
 
-	// By design exporter should use maximum one connection per request.
-	db.SetMaxOpenConns(1)
-	db.SetMaxIdleConns(1)
-	// Set max lifetime for a connection.
-	db.SetConnMaxLifetime(1 * time.Minute)
+		// Set max lifetime for a connection.
+		db.SetConnMaxLifetime(1 * time.Minute)
+	}
 
 	if err := db.PingContext(ctx); err != nil {
 		return fmt.Errorf("cannot ping mysql %s, error: %s", e.getTargetFromDsn(), err)
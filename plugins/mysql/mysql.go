@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"database/sql"
 	"fmt"
 	"net"
 	"os"
@@ -22,6 +23,7 @@ import (
 type Global struct {
 	User                  string   `toml:"user"`
 	Password              string   `toml:"password"`
+	Database              string   `toml:"database"`
 	SslCa                 string   `toml:"ssl_ca"`
 	SslCert               string   `toml:"ssl_cert"`
 	SslKey                string   `toml:"ssl_key"`
@@ -40,6 +42,7 @@ func (g Global) FormDSN(target string) (string, error) {
 	config := mysql.NewConfig()
 	config.User = g.User
 	config.Passwd = g.Password
+	config.DBName = g.Database
 	config.Net = "tcp"
 	if prefix := "unix://"; strings.HasPrefix(target, prefix) {
 		config.Net = "unix"
@@ -67,6 +70,29 @@ func (g Global) FormDSN(target string) (string, error) {
 	return config.FormatDSN(), nil
 }
 
+// WithParams 用 target 的 __param_user、__param_password(_file)、__param_database 覆盖全局配置
+// g 是同一个 job 的所有 target 共享的，所以返回的是修改之后的拷贝
+// __param_password_file 只能是插件目录 baseDir 下面的相对路径
+func (g Global) WithParams(params plugins.Params, baseDir string) (Global, error) {
+	if user := params.Get(plugins.ParamUser); user != "" {
+		g.User = user
+	}
+
+	password, err := params.Secret(plugins.ParamPassword, baseDir)
+	if err != nil {
+		return g, err
+	}
+	if password != "" {
+		g.Password = password
+	}
+
+	if database := params.Get(plugins.ParamDatabase); database != "" {
+		g.Database = database
+	}
+
+	return g, nil
+}
+
 func (g Global) CustomizeTLS() error {
 	var tlsCfg tls.Config
 	caBundle := x509.NewCertPool()
@@ -384,6 +410,9 @@ func (c *Config) EnabledScrapers() (ret []collector.Scraper) {
 	return
 }
 
+// Immutable 表示 Scrape 不会修改配置，多个 target 可以共用一份，target 的 params 是在 Global 的拷贝上生效的
+func (*Config) Immutable() {}
+
 type MySQL struct {
 	// 这个数据结构中未来如果有变量，千万要小心并发使用变量的问题
 }
@@ -408,17 +437,66 @@ func (*MySQL) ParseConfig(baseDir string, bs []byte) (any, error) {
 // cprobe 是并发抓取很多个数据库实例的监控数据，不同的数据库实例其抓取参数可能不同
 // 如果直接修改 collector pkg 下面的变量，就会有并发使用变量的问题
 // 把这些自定义参数封装到一个一个的 collector.Scraper 对象中，每个 target 抓取时实例化这些 collector.Scraper 对象
-func (*MySQL) Scrape(ctx context.Context, address string, c any, ss *types.Samples) error {
+func (*MySQL) Scrape(ctx context.Context, address string, c any, params plugins.Params, ss *types.Samples) error {
 	// 这个方法中如果要对配置 c 变量做修改，一定要 clone 一份之后再修改，因为并发的多个 target 共享了一个 c 变量
 	cfg := c.(*Config)
-	dsn, err := cfg.Global.FormDSN(address)
+	dsn, err := formDSN(cfg, address, params)
 	if err != nil {
-		return fmt.Errorf("failed to form dsn for %s: %s", address, err)
+		return err
 	}
 
 	scrapers := cfg.EnabledScrapers()
 	exporter := collector.New(ctx, dsn, scrapers, ss, cfg.Queries, cfg.Global.LockWaitTimeout, cfg.Global.LogSlowFilter)
+	return collect(exporter, ss)
+}
+
+// session 是一个 target 的连接池，抓取之间复用，避免每次抓取都重新建立连接，在 MySQL 里留下大量的认证日志
+type session struct {
+	cfg *Config
+	dsn string
+	db  *sql.DB
+}
+
+func (s *session) Close() error {
+	return s.db.Close()
+}
+
+func (*MySQL) NewSession(ctx context.Context, address string, c any, params plugins.Params) (plugins.Session, error) {
+	cfg := c.(*Config)
+	dsn, err := formDSN(cfg, address, params)
+	if err != nil {
+		return nil, err
+	}
+
+	dsn = collector.FormatDSN(dsn, cfg.Global.LockWaitTimeout, cfg.Global.LogSlowFilter)
+	db, err := collector.OpenDB(dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	return &session{cfg: cfg, dsn: dsn, db: db}, nil
+}
+
+func (*MySQL) ScrapeSession(ctx context.Context, s plugins.Session, ss *types.Samples) error {
+	sess := s.(*session)
+	exporter := collector.NewWithDB(ctx, sess.db, sess.dsn, sess.cfg.EnabledScrapers(), ss, sess.cfg.Queries)
+	return collect(exporter, ss)
+}
+
+func formDSN(cfg *Config, address string, params plugins.Params) (string, error) {
+	global, err := cfg.Global.WithParams(params, cfg.BaseDir)
+	if err != nil {
+		return "", fmt.Errorf("invalid params for %s: %s", address, err)
+	}
+
+	dsn, err := global.FormDSN(address)
+	if err != nil {
+		return "", fmt.Errorf("failed to form dsn for %s: %s", address, err)
+	}
+	return dsn, nil
+}
 
+func collect(exporter *collector.Exporter, ss *types.Samples) error {
 	ch := make(chan prometheus.Metric)
 	errCh := make(chan error, 1)
 	go func() {
@@ -7,7 +7,6 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
-	"time"
 
 	"github.com/cprobe/cprobe/plugins/sqlc"
 	"github.com/cprobe/cprobe/types"
@@ -27,50 +26,84 @@ type Config struct {
 	Queries []sqlc.CustomQuery `toml:"queries"`
 }
 
+// Immutable 表示 Scrape 不会修改配置，多个 target 可以共用一份
+func (*Config) Immutable() {}
+
+// namespace 返回指标名称的前缀，默认是 oracledb，配置成 - 表示不加前缀
+func (c *Config) namespace() string {
+	switch c.Global.Namespace {
+	case "":
+		return "oracledb"
+	case "-":
+		return ""
+	default:
+		return c.Global.Namespace
+	}
+}
+
+// queries 返回加上了指标名称前缀的自定义 SQL，配置是多个 target 共享的，所以返回的是拷贝
+func (c *Config) queries() []sqlc.CustomQuery {
+	queries := append([]sqlc.CustomQuery(nil), c.Queries...)
+	if namespace := c.namespace(); namespace != "" {
+		for i := range queries {
+			queries[i].Mesurement = namespace + "_" + queries[i].Mesurement
+		}
+	}
+	return queries
+}
+
+// open 连接 target 对应的数据库
 // target: ip:port/service
-func (c *Config) Scrape(ctx context.Context, target string, ss *types.Samples) error {
+func (c *Config) open(ctx context.Context, target string) (*sql.DB, error) {
 	ip, port, service, err := explode(target)
 	if err != nil {
-		return fmt.Errorf("invalid target: %s", target)
-	}
-
-	// default settings
-	if c.Global.Namespace == "" {
-		c.Global.Namespace = "oracledb"
-	} else if c.Global.Namespace == "-" {
-		c.Global.Namespace = ""
+		return nil, fmt.Errorf("invalid target: %s", target)
 	}
 
 	connString := go_ora.BuildUrl(ip, port, service, c.Global.Username, c.Global.Password, c.Global.Options)
 	conn, err := sql.Open("oracle", connString)
 	if err != nil {
-		return fmt.Errorf("cannot opening connection to database: %s, error: %s", target, err)
+		return nil, fmt.Errorf("cannot opening connection to database: %s, error: %s", target, err)
 	}
 
 	if conn == nil {
-		return fmt.Errorf("cannot opening connection to database: %s", target)
+		return nil, fmt.Errorf("cannot opening connection to database: %s", target)
 	}
 
-	defer conn.Close()
-
 	conn.SetMaxOpenConns(1)
 	conn.SetMaxIdleConns(1)
-	conn.SetConnMaxLifetime(time.Minute)
 
 	if err := conn.PingContext(ctx); err != nil {
-		return fmt.Errorf("cannot ping database: %s, error: %s", target, err)
+		conn.Close()
+		return nil, fmt.Errorf("cannot ping database: %s, error: %s", target, err)
 	}
 
-	if c.Global.Namespace != "" {
-		for i := 0; i < len(c.Queries); i++ {
-			c.Queries[i].Mesurement = c.Global.Namespace + "_" + c.Queries[i].Mesurement
-		}
+	return conn, nil
+}
+
+// target: ip:port/service
+func (c *Config) Scrape(ctx context.Context, target string, ss *types.Samples) error {
+	conn, err := c.open(ctx, target)
+	if err != nil {
+		return err
 	}
 
-	sqlc.CollectCustomQueries(ctx, conn, ss, c.Queries)
+	defer conn.Close()
+
+	sqlc.CollectCustomQueries(ctx, conn, ss, c.queries())
 	return nil
 }
 
+// session 保存一个 target 的数据库连接，抓取之间复用
+type session struct {
+	db      *sql.DB
+	queries []sqlc.CustomQuery
+}
+
+func (s *session) Close() error {
+	return s.db.Close()
+}
+
 var ErrInvalidTarget = errors.New("invalid target")
 
 func explode(target string) (ip string, port int, service string, err error) {
@@ -2,9 +2,11 @@ package oracledb
 
 import (
 	"context"
+	"fmt"
 
 	"github.com/BurntSushi/toml"
 	"github.com/cprobe/cprobe/plugins"
+	"github.com/cprobe/cprobe/plugins/sqlc"
 	"github.com/cprobe/cprobe/types"
 )
 
@@ -24,7 +26,26 @@ func (*OracleDB) ParseConfig(baseDir string, bs []byte) (any, error) {
 	return &c, nil
 }
 
-func (*OracleDB) Scrape(ctx context.Context, target string, c any, ss *types.Samples) error {
+func (*OracleDB) Scrape(ctx context.Context, target string, c any, _ plugins.Params, ss *types.Samples) error {
 	cfg := c.(*Config)
 	return cfg.Scrape(ctx, target, ss)
 }
+
+func (*OracleDB) NewSession(ctx context.Context, target string, c any, _ plugins.Params) (plugins.Session, error) {
+	cfg := c.(*Config)
+	db, err := cfg.open(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+	return &session{db: db, queries: cfg.queries()}, nil
+}
+
+func (*OracleDB) ScrapeSession(ctx context.Context, s plugins.Session, ss *types.Samples) error {
+	sess := s.(*session)
+	// 连接可能已经断开了，ping 失败的话这次抓取算失败，会话被关掉，下次抓取重新连接
+	if err := sess.db.PingContext(ctx); err != nil {
+		return fmt.Errorf("cannot ping database: %s", err)
+	}
+	sqlc.CollectCustomQueries(ctx, sess.db, ss, sess.queries)
+	return nil
+}
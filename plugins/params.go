@@ -0,0 +1,115 @@
+package plugins
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ParamLabelPrefix is the prefix of target labels, which are passed to plugins as Params.
+//
+// For example, `__param_user` label of a target becomes `user` param.
+// Such labels can be set by service discovery (e.g. file_sd_configs or http_sd_configs) or by relabel_configs.
+const ParamLabelPrefix = "__param_"
+
+// Well-known params. Plugins may support only some of them and may support other params.
+const (
+	// ParamUser is the user for connecting to the target.
+	ParamUser = "user"
+	// ParamPassword is the password for connecting to the target.
+	// The value of `__param_password` label is masked on the /targets page unless an admin asks for secrets,
+	// but ParamPasswordFile is still preferred, since the password doesn't get into service discovery then.
+	ParamPassword = "password"
+	// ParamPasswordFile is the path to the file with the password for connecting to the target.
+	// Only relative paths inside the directory of the plugin configs are allowed, since the label may come from service discovery.
+	ParamPasswordFile = "password_file"
+	// ParamDatabase is the database to connect to.
+	ParamDatabase = "database"
+	// ParamRuleFiles is a comma-separated list of rule files, which are used instead of scrape_rule_files of the job.
+	// It is handled by cprobe itself, so plugins never see it.
+	// Only relative paths inside the directory of the plugin configs are allowed, since the label may come from service discovery.
+	ParamRuleFiles = "rule_files"
+)
+
+// Params holds the plugin params of a single target.
+type Params map[string]string
+
+// Get returns the value of the param with the given name or an empty string if the param is missing.
+func (p Params) Get(name string) string {
+	return p[name]
+}
+
+// Secret returns the value of the param with the given name.
+//
+// If the param is missing, then the contents of the file from the `<name>_file` param is returned.
+// The file path is resolved against baseDir with ParamFilepath.
+// An empty string is returned if both params are missing.
+func (p Params) Secret(name, baseDir string) (string, error) {
+	if v, ok := p[name]; ok {
+		return v, nil
+	}
+
+	fileParam := name + "_file"
+	path := p[fileParam]
+	if path == "" {
+		return "", nil
+	}
+
+	path, err := ParamFilepath(baseDir, fileParam, path)
+	if err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("cannot read %s: %w", fileParam, err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// ParamFilepath returns the path from the param with the given name resolved against baseDir.
+//
+// Params may come from service discovery, which cannot be fully trusted, so only relative paths inside baseDir are allowed.
+// An error is returned for URLs, absolute paths and paths containing `..`.
+func ParamFilepath(baseDir, name, path string) (string, error) {
+	if strings.Contains(path, "://") {
+		return "", fmt.Errorf("%s%s cannot contain URL: %q", ParamLabelPrefix, name, path)
+	}
+	if filepath.IsAbs(path) || strings.HasPrefix(path, "/") || strings.HasPrefix(path, `\`) {
+		return "", fmt.Errorf("%s%s cannot contain absolute path: %q", ParamLabelPrefix, name, path)
+	}
+	for _, elem := range strings.FieldsFunc(path, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if elem == ".." {
+			return "", fmt.Errorf("%s%s cannot contain `..`: %q", ParamLabelPrefix, name, path)
+		}
+	}
+	if baseDir == "" {
+		return "", fmt.Errorf("%s%s cannot be used without the directory of the plugin configs", ParamLabelPrefix, name)
+	}
+	return filepath.Join(baseDir, path), nil
+}
+
+// String returns a string representation of p with the params sorted by name.
+func (p Params) String() string {
+	if len(p) == 0 {
+		return ""
+	}
+
+	names := make([]string, 0, len(p))
+	for name := range p {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=%q", name, p[name])
+	}
+	b.WriteByte('}')
+	return b.String()
+}
@@ -0,0 +1,66 @@
+package plugins
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParamsSecret(t *testing.T) {
+	baseDir := filepath.Join(t.TempDir(), "conf.d", "mysql")
+	if err := os.MkdirAll(filepath.Join(baseDir, "secrets"), 0o755); err != nil {
+		t.Fatalf("cannot create secrets dir: %s", err)
+	}
+	if err := os.WriteFile(filepath.Join(baseDir, "secrets", "db1.pass"), []byte("s3cret\n"), 0o600); err != nil {
+		t.Fatalf("cannot write password file: %s", err)
+	}
+	outside := filepath.Join(filepath.Dir(baseDir), "outside.pass")
+	if err := os.WriteFile(outside, []byte("outside"), 0o600); err != nil {
+		t.Fatalf("cannot write password file: %s", err)
+	}
+
+	f := func(p Params, want string) {
+		t.Helper()
+		got, err := p.Secret(ParamPassword, baseDir)
+		if err != nil {
+			t.Fatalf("unexpected error for %s: %s", p, err)
+		}
+		if got != want {
+			t.Fatalf("unexpected secret for %s; got %q; want %q", p, got, want)
+		}
+	}
+	fError := func(p Params) {
+		t.Helper()
+		if got, err := p.Secret(ParamPassword, baseDir); err == nil {
+			t.Fatalf("expecting non-nil error for %s; got %q", p, got)
+		}
+	}
+
+	// the param wins over the file
+	f(nil, "")
+	f(Params{"password": "plain"}, "plain")
+	f(Params{"password": "plain", "password_file": "secrets/db1.pass"}, "plain")
+
+	// relative paths inside baseDir
+	f(Params{"password_file": "secrets/db1.pass"}, "s3cret")
+	f(Params{"password_file": "./secrets/db1.pass"}, "s3cret")
+
+	// absolute paths, `..` and URLs are rejected even if they point to an existing file
+	fError(Params{"password_file": outside})
+	fError(Params{"password_file": "/etc/shadow"})
+	fError(Params{"password_file": filepath.Join(baseDir, "secrets", "db1.pass")})
+	fError(Params{"password_file": "../outside.pass"})
+	fError(Params{"password_file": "secrets/../../outside.pass"})
+	fError(Params{"password_file": `secrets\..\..\outside.pass`})
+	fError(Params{"password_file": "file:///etc/shadow"})
+	fError(Params{"password_file": "http://attacker/pass"})
+
+	// missing file
+	fError(Params{"password_file": "secrets/missing.pass"})
+}
+
+func TestParamFilepathEmptyBaseDir(t *testing.T) {
+	if _, err := ParamFilepath("", ParamPasswordFile, "secrets/db1.pass"); err == nil {
+		t.Fatalf("expecting non-nil error for empty baseDir")
+	}
+}
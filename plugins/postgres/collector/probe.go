@@ -64,6 +64,24 @@ func (pc *ProbeCollector) Collect(ch chan<- prometheus.Metric) {
 	}
 	defer pc.instance.Close()
 
+	pc.collect(ch)
+}
+
+// CollectSession is like Collect, but keeps the database connection open between calls,
+// so the collector can be reused for all the scrapes of a target. Close must be called when it isn't needed anymore.
+func (pc *ProbeCollector) CollectSession(ch chan<- prometheus.Metric) {
+	if pc.instance.getDB() == nil {
+		if err := pc.instance.setup(); err != nil {
+			logger.Errorf("Error opening connection to database(%s): %v", pc.instance.dsn, err)
+			_ = pc.instance.Close()
+			return
+		}
+	}
+
+	pc.collect(ch)
+}
+
+func (pc *ProbeCollector) collect(ch chan<- prometheus.Metric) {
 	wg := sync.WaitGroup{}
 	wg.Add(len(pc.collectors))
 	for name, c := range pc.collectors {
@@ -20,6 +20,9 @@ type Config struct {
 	EnabledCollectors      []string          `toml:"enabled_collectors"`
 }
 
+// Immutable 表示 Scrape 不会修改配置，多个 target 可以共用一份
+func (*Config) Immutable() {}
+
 func (c *Config) ConfigureTarget(target string) (dsn.DSN, error) {
 	d, err := dsn.DsnFromString(target)
 	if err != nil {
@@ -29,34 +32,26 @@ func (c *Config) ConfigureTarget(target string) (dsn.DSN, error) {
 	return d, nil
 }
 
+func (c *Config) exporterOpts() []ExporterOpt {
+	return []ExporterOpt{
+		DisableDefaultMetrics(c.DisableDefaultMetrics),
+		DisableSettingsMetrics(c.DisableSettingsMetrics),
+	}
+}
+
 func (c *Config) Scrape(ctx context.Context, target string, ss *types.Samples) error {
 	dsn, err := c.ConfigureTarget(target)
 	if err != nil {
 		return err
 	}
 
-	opts := []ExporterOpt{
-		DisableDefaultMetrics(c.DisableDefaultMetrics),
-		DisableSettingsMetrics(c.DisableSettingsMetrics),
-	}
-
 	dsns := []string{dsn.GetConnectionString()}
-	exporter := NewExporter(dsns, opts...)
+	exporter := NewExporter(dsns, c.exporterOpts()...)
 	defer func() {
 		exporter.servers.Close()
 	}()
 
-	ch := make(chan prometheus.Metric)
-	go func() {
-		exporter.Collect(ch)
-		close(ch)
-	}()
-
-	for m := range ch {
-		if err := ss.AddPromMetric(m); err != nil {
-			logger.Warnf("failed to transform metric: %s", err)
-		}
-	}
+	collect(exporter.Collect, ss)
 
 	pc, err := collector.NewProbeCollector(dsn, c.EnabledCollectors)
 	if err != nil {
@@ -65,17 +60,55 @@ func (c *Config) Scrape(ctx context.Context, target string, ss *types.Samples) e
 
 	defer pc.Close()
 
-	pcCh := make(chan prometheus.Metric)
+	collect(pc.Collect, ss)
+
+	return nil
+}
+
+// session 保存一个 target 的 exporter 和 collector，它们的数据库连接在抓取之间复用
+type session struct {
+	exporter *Exporter
+	pc       *collector.ProbeCollector
+}
+
+func (s *session) Close() error {
+	s.exporter.servers.Close()
+	return s.pc.Close()
+}
+
+func (c *Config) newSession(target string) (*session, error) {
+	dsn, err := c.ConfigureTarget(target)
+	if err != nil {
+		return nil, err
+	}
+
+	pc, err := collector.NewProbeCollector(dsn, c.EnabledCollectors)
+	if err != nil {
+		return nil, err
+	}
+
+	return &session{
+		exporter: NewExporter([]string{dsn.GetConnectionString()}, c.exporterOpts()...),
+		pc:       pc,
+	}, nil
+}
+
+func (s *session) scrape(ss *types.Samples) {
+	collect(s.exporter.Collect, ss)
+	collect(s.pc.CollectSession, ss)
+}
+
+// collect 把 f 输出的指标都放到 ss 里
+func collect(f func(ch chan<- prometheus.Metric), ss *types.Samples) {
+	ch := make(chan prometheus.Metric)
 	go func() {
-		pc.Collect(pcCh)
-		close(pcCh)
+		f(ch)
+		close(ch)
 	}()
 
-	for m := range pcCh {
+	for m := range ch {
 		if err := ss.AddPromMetric(m); err != nil {
 			logger.Warnf("failed to transform metric: %s", err)
 		}
 	}
-
-	return nil
 }
@@ -24,7 +24,17 @@ func (*Postgres) ParseConfig(baseDir string, bs []byte) (any, error) {
 	return &c, nil
 }
 
-func (*Postgres) Scrape(ctx context.Context, target string, c any, ss *types.Samples) error {
+func (*Postgres) Scrape(ctx context.Context, target string, c any, _ plugins.Params, ss *types.Samples) error {
 	cfg := c.(*Config)
 	return cfg.Scrape(ctx, target, ss)
 }
+
+func (*Postgres) NewSession(ctx context.Context, target string, c any, _ plugins.Params) (plugins.Session, error) {
+	cfg := c.(*Config)
+	return cfg.newSession(target)
+}
+
+func (*Postgres) ScrapeSession(ctx context.Context, s plugins.Session, ss *types.Samples) error {
+	s.(*session).scrape(ss)
+	return nil
+}
@@ -24,7 +24,7 @@ func (*Prometheus) ParseConfig(baseDir string, bs []byte) (any, error) {
 	return &c, nil
 }
 
-func (*Prometheus) Scrape(ctx context.Context, target string, c any, ss *types.Samples) error {
+func (*Prometheus) Scrape(ctx context.Context, target string, c any, _ plugins.Params, ss *types.Samples) error {
 	cfg := c.(*Config)
 	return cfg.Scrape(ctx, target, ss)
 }
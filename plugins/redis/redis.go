@@ -54,6 +54,9 @@ type Config struct {
 	ExportClientsIncludePort bool `toml:"export_clients_include_port"`
 }
 
+// Immutable 表示 Scrape 不会修改配置，多个 target 可以共用一份
+func (*Config) Immutable() {}
+
 type Redis struct {
 	// 这个数据结构中未来如果有变量，千万要小心并发使用变量的问题
 }
@@ -116,7 +119,7 @@ func (*Redis) ParseConfig(baseDir string, bs []byte) (any, error) {
 	return &c, nil
 }
 
-func (*Redis) Scrape(ctx context.Context, target string, c any, ss *types.Samples) error {
+func (*Redis) Scrape(ctx context.Context, target string, c any, _ plugins.Params, ss *types.Samples) error {
 	// 这个方法中如果要对配置 c 变量做修改，一定要 clone 一份之后再修改，因为并发的多个 target 共享了一个 c 变量
 	conf := c.(*Config)
 	if !strings.Contains(target, "://") {
@@ -24,7 +24,7 @@ func (*Tomcat) ParseConfig(baseDir string, bs []byte) (any, error) {
 	return &c, nil
 }
 
-func (*Tomcat) Scrape(ctx context.Context, target string, c any, ss *types.Samples) error {
+func (*Tomcat) Scrape(ctx context.Context, target string, c any, _ plugins.Params, ss *types.Samples) error {
 	cfg := c.(*Config)
 	return cfg.Scrape(ctx, target, ss)
 }
@@ -28,7 +28,7 @@ func (wh *Whois) ParseConfig(baseDir string, bs []byte) (any, error) {
 	return nil, nil
 }
 
-func (wh *Whois) Scrape(ctx context.Context, target string, cfg any, ss *types.Samples) error {
+func (wh *Whois) Scrape(ctx context.Context, target string, cfg any, _ plugins.Params, ss *types.Samples) error {
 	req, err := whois.NewRequest(target)
 	if err != nil {
 		return err
@@ -53,7 +53,7 @@ func (f *Zookeeper) ParseConfig(baseDir string, bs []byte) (any, error) {
 	return &c, nil
 }
 
-func (f *Zookeeper) Scrape(ctx context.Context, target string, cfg any, ss *types.Samples) error {
+func (f *Zookeeper) Scrape(ctx context.Context, target string, cfg any, _ plugins.Params, ss *types.Samples) error {
 
 	conf := cfg.(*Config)
 
@@ -0,0 +1,89 @@
+package probe
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+
+	"github.com/cprobe/cprobe/plugins"
+)
+
+// CheckConfig validates the configs under configDirectory without scraping anything and writes a report to w.
+//
+// It loads every main*.yaml together with its scrape_config_files, concatenates scrape_rule_files
+// of every job and parses them with the plugin of the job.
+// Every part of the config, which is skipped while loading, is reported too, e.g. a job with invalid
+// relabel_configs or metric_relabel_configs, or a scrape_config_files entry, which cannot be read.
+// The number of found problems is returned.
+func CheckConfig(w io.Writer, configDirectory string) int {
+	problems := 0
+	jobs := 0
+	report := func(format string, args ...interface{}) {
+		problems++
+		fmt.Fprintf(w, "FAIL  "+format+"\n", args...)
+	}
+
+	pluginDirs, err := listPlugins(configDirectory)
+	if err != nil {
+		report("%s: %s", configDirectory, err)
+		return problems
+	}
+	if len(pluginDirs) == 0 {
+		report("%s: no plugin dirs found", configDirectory)
+		return problems
+	}
+
+	for _, pluginDir := range pluginDirs {
+		pluginDirPath := filepath.Join(configDirectory, pluginDir)
+		entryYamlFilePaths, err := filepath.Glob(filepath.Join(pluginDirPath, "main*.yaml"))
+		if err != nil {
+			report("%s: cannot glob main*.yaml: %s", pluginDirPath, err)
+			continue
+		}
+		if len(entryYamlFilePaths) == 0 {
+			continue
+		}
+
+		plugin, has := plugins.GetPlugin(pluginDir)
+		if !has {
+			report("%s: unsupported plugin %s", pluginDirPath, pluginDir)
+			continue
+		}
+
+		for _, entryYamlFilePath := range entryYamlFilePaths {
+			cfg, err := loadConfig(entryYamlFilePath)
+			if err != nil {
+				report("%s: %s", entryYamlFilePath, err)
+				continue
+			}
+
+			for _, msg := range cfg.problems {
+				report("%s: %s", entryYamlFilePath, msg)
+			}
+
+			for _, sc := range cfg.ScrapeConfigs {
+				if sc == nil {
+					continue
+				}
+				jobs++
+
+				// 和抓取的时候一样，先把所有的 rule 文件拼在一起，再交给插件解析
+				tomlBytes, err := readRuleFiles(sc.ConfigRef.BaseDir, sc.ScrapeRuleFiles)
+				if err != nil {
+					report("%s: job(%s) %s", entryYamlFilePath, sc.JobName, err)
+					continue
+				}
+
+				if _, err := plugin.ParseConfig(sc.ConfigRef.BaseDir, tomlBytes); err != nil {
+					report("%s: job(%s) cannot parse plugin config from %v: %s", entryYamlFilePath, sc.JobName, sc.ScrapeRuleFiles, err)
+					continue
+				}
+
+				fmt.Fprintf(w, "OK    %s: job(%s)\n", entryYamlFilePath, sc.JobName)
+			}
+		}
+	}
+
+	fmt.Fprintf(w, "\n%d jobs checked, %d problems found\n", jobs, problems)
+	return problems
+}
@@ -0,0 +1,54 @@
+package probe
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckConfig(t *testing.T) {
+	confd := t.TempDir()
+	pluginDir := filepath.Join(confd, "test_series")
+	mainYaml := filepath.Join(pluginDir, "main.yaml")
+
+	writeTestFile(t, filepath.Join(pluginDir, "rule.toml"), "")
+	writeTestFile(t, mainYaml, `
+scrape_configs:
+- job_name: good
+  scrape_rule_files:
+  - rule.toml
+- job_name: missing_rule_file
+  scrape_rule_files:
+  - missing.toml
+- job_name: bad_relabel
+  scrape_rule_files:
+  - rule.toml
+  relabel_configs:
+  - source_labels: [__address__]
+    regex: '('
+    target_label: instance
+`)
+
+	var bb bytes.Buffer
+	problems := CheckConfig(&bb, confd)
+	report := bb.String()
+	if problems != 2 {
+		t.Fatalf("unexpected number of problems; got %d; want 2; report:\n%s", problems, report)
+	}
+
+	// 每一行都要能定位到具体的文件和 job
+	for _, want := range []string{
+		"OK    " + mainYaml + ": job(good)\n",
+		"FAIL  " + mainYaml + ": job(missing_rule_file) read rule file(missing.toml) error",
+		"FAIL  " + mainYaml + ": skipping `scrape_config` for job_name=bad_relabel because of parse relabel_configs error",
+		"\n2 jobs checked, 2 problems found\n",
+	} {
+		if !strings.Contains(report, want) {
+			t.Fatalf("missing %q in report:\n%s", want, report)
+		}
+	}
+	if strings.Contains(report, "job(bad_relabel)") {
+		t.Fatalf("job with invalid relabel_configs mustn't be checked further; report:\n%s", report)
+	}
+}
@@ -25,7 +25,9 @@ func loadConfig(path string) (*Config, error) {
 	if err != nil {
 		return nil, fmt.Errorf("cannot read Prometheus config from %q: %w", path, err)
 	}
-	var c Config
+	c := Config{
+		files: []string{path},
+	}
 	if err := c.parseData(data, path); err != nil {
 		return nil, fmt.Errorf("cannot parse Prometheus config from %q: %w", path, err)
 	}
@@ -52,7 +54,7 @@ func (cfg *Config) parseData(data []byte, path string) error {
 	}
 
 	// Load cfg.ScrapeConfigFiles into c.ScrapeConfigs
-	scs := mustLoadScrapeConfigFiles(cfg.BaseDir, cfg.ScrapeConfigFiles)
+	scs := cfg.mustLoadScrapeConfigFiles(cfg.BaseDir, cfg.ScrapeConfigFiles)
 	cfg.ScrapeConfigFiles = nil
 	cfg.ScrapeConfigs = append(cfg.ScrapeConfigs, scs...)
 
@@ -71,7 +73,7 @@ func (cfg *Config) parseData(data []byte, path string) error {
 		sc := cfg.ScrapeConfigs[i]
 
 		if sc.JobName == "" {
-			logger.Errorf("skipping `scrape_config` without `job_name` at %q", path)
+			cfg.skipf("skipping `scrape_config` without `job_name` at %q", path)
 			cfg.ScrapeConfigs[i] = nil
 			continue
 		}
@@ -84,14 +86,14 @@ func (cfg *Config) parseData(data []byte, path string) error {
 
 		sc.ParsedRelabelConfigs, err = promrelabel.ParseRelabelConfigs(sc.RelabelConfigs)
 		if err != nil {
-			logger.Errorf("skipping `scrape_config` for job_name=%s because of parse relabel_configs error: %s", sc.JobName, err)
+			cfg.skipf("skipping `scrape_config` for job_name=%s because of parse relabel_configs error: %s", sc.JobName, err)
 			cfg.ScrapeConfigs[i] = nil
 			continue
 		}
 
 		sc.ParsedMetricRelabelConfigs, err = promrelabel.ParseRelabelConfigs(sc.MetricRelabelConfigs)
 		if err != nil {
-			logger.Errorf("skipping `scrape_config` for job_name=%s because of parse metric_relabel_configs error: %s", sc.JobName, err)
+			cfg.skipf("skipping `scrape_config` for job_name=%s because of parse metric_relabel_configs error: %s", sc.JobName, err)
 			cfg.ScrapeConfigs[i] = nil
 			continue
 		}
@@ -111,23 +113,40 @@ func (cfg *Config) parseData(data []byte, path string) error {
 				scrapeInterval = defaultScrapeInterval
 			}
 		}
-		// scrapeTimeout := sc.ScrapeTimeout.Duration()
-		// if scrapeTimeout <= 0 {
-		// 	scrapeTimeout = cfg.Global.ScrapeTimeout.Duration()
-		// 	if scrapeTimeout <= 0 {
-		// 		scrapeTimeout = defaultScrapeTimeout
-		// 	}
-		// }
-		// if scrapeTimeout > scrapeInterval {
-		// 	// Limit the `scrape_timeout` with `scrape_interval` like Prometheus does.
-		// 	// This guarantees that the scraper can miss only a single scrape if the target sometimes responds slowly.
-		// 	// See https://github.com/VictoriaMetrics/VictoriaMetrics/issues/1281#issuecomment-840538907
-		// 	scrapeTimeout = scrapeInterval
-		// }
+		scrapeTimeout := sc.ScrapeTimeout.Duration()
+		if scrapeTimeout <= 0 {
+			scrapeTimeout = cfg.Global.ScrapeTimeout.Duration()
+			if scrapeTimeout <= 0 {
+				scrapeTimeout = defaultScrapeTimeout
+			}
+		}
+		if scrapeTimeout > scrapeInterval {
+			// Limit the `scrape_timeout` with `scrape_interval` like Prometheus does.
+			// This guarantees that the scraper can miss only a single scrape if the target sometimes responds slowly.
+			// See https://github.com/VictoriaMetrics/VictoriaMetrics/issues/1281#issuecomment-840538907
+			scrapeTimeout = scrapeInterval
+		}
+
+		if sc.SampleLimit < 0 || sc.SeriesLimit < 0 {
+			cfg.skipf("skipping `scrape_config` for job_name=%s because of negative sample_limit=%d or series_limit=%d", sc.JobName, sc.SampleLimit, sc.SeriesLimit)
+			cfg.ScrapeConfigs[i] = nil
+			continue
+		}
+		if sc.SeriesLimitInterval.Duration() <= 0 {
+			sc.SeriesLimitInterval = promutils.NewDuration(defaultSeriesLimitInterval)
+		}
+		if sc.SessionIdleTimeout.Duration() <= 0 {
+			sc.SessionIdleTimeout = promutils.NewDuration(defaultSessionIdleTimeout)
+		}
+
+		if sc.HonorTimestamps == nil {
+			honorTimestamps := true
+			sc.HonorTimestamps = &honorTimestamps
+		}
 
 		sc.ScrapeConcurrency = scrapeConcurrency
 		sc.ScrapeInterval = promutils.NewDuration(scrapeInterval)
-		// sc.ScrapeTimeout = promutils.NewDuration(scrapeTimeout)
+		sc.ScrapeTimeout = promutils.NewDuration(scrapeTimeout)
 
 		sc.ConfigRef = cfg
 	}
@@ -135,7 +154,7 @@ func (cfg *Config) parseData(data []byte, path string) error {
 	return nil
 }
 
-func mustLoadScrapeConfigFiles(baseDir string, scrapeConfigFiles []string) []*ScrapeConfig {
+func (cfg *Config) mustLoadScrapeConfigFiles(baseDir string, scrapeConfigFiles []string) []*ScrapeConfig {
 	var scrapeConfigs []*ScrapeConfig
 	for _, filePath := range scrapeConfigFiles {
 		filePath := fs.GetFilepath(baseDir, filePath)
@@ -143,7 +162,7 @@ func mustLoadScrapeConfigFiles(baseDir string, scrapeConfigFiles []string) []*Sc
 		if strings.Contains(filePath, "*") {
 			ps, err := filepath.Glob(filePath)
 			if err != nil {
-				logger.Errorf("skipping pattern %q at `scrape_config_files` because of error: %s", filePath, err)
+				cfg.skipf("skipping pattern %q at `scrape_config_files` because of error: %s", filePath, err)
 				continue
 			}
 			sort.Strings(ps)
@@ -152,21 +171,34 @@ func mustLoadScrapeConfigFiles(baseDir string, scrapeConfigFiles []string) []*Sc
 		for _, path := range paths {
 			data, err := fs.ReadFileOrHTTP(path)
 			if err != nil {
-				logger.Errorf("skipping %q at `scrape_config_files` because of error: %s", path, err)
+				cfg.skipf("skipping %q at `scrape_config_files` because of error: %s", path, err)
 				continue
 			}
-			data, err = envtemplate.ReplaceBytes(data)
+			// 通过 HTTP 拉取的 scrape_config_files 只展开环境变量，不展开密钥占位符
+			if fs.IsHTTPURL(path) {
+				data, err = envtemplate.ReplaceEnvBytes(data)
+			} else {
+				data, err = envtemplate.ReplaceBytes(data)
+			}
 			if err != nil {
-				logger.Errorf("skipping %q at `scrape_config_files` because of failure to expand environment vars: %s", path, err)
+				cfg.skipf("skipping %q at `scrape_config_files` because of failure to expand environment vars: %s", path, err)
 				continue
 			}
 			var scs []*ScrapeConfig
 			if err = yaml.UnmarshalStrict(data, &scs); err != nil {
-				logger.Errorf("skipping %q at `scrape_config_files` because of failure to parse it: %s", path, err)
+				cfg.skipf("skipping %q at `scrape_config_files` because of failure to parse it: %s", path, err)
 				continue
 			}
 			scrapeConfigs = append(scrapeConfigs, scs...)
+			cfg.files = append(cfg.files, path)
 		}
 	}
 	return scrapeConfigs
 }
+
+// skipf logs the reason why a part of the config is skipped and keeps it for -dry-run report.
+func (cfg *Config) skipf(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	logger.Errorf("%s", msg)
+	cfg.problems = append(cfg.problems, msg)
+}
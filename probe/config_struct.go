@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/cprobe/cprobe/discovery/azure"
+	"github.com/cprobe/cprobe/discovery/consul"
 	"github.com/cprobe/cprobe/discovery/digitalocean"
 	"github.com/cprobe/cprobe/discovery/dns"
 	"github.com/cprobe/cprobe/discovery/docker"
@@ -13,8 +14,12 @@ import (
 	"github.com/cprobe/cprobe/discovery/eureka"
 	"github.com/cprobe/cprobe/discovery/gce"
 	"github.com/cprobe/cprobe/discovery/http"
+	"github.com/cprobe/cprobe/discovery/inventory"
+	"github.com/cprobe/cprobe/discovery/kubernetes"
+	"github.com/cprobe/cprobe/discovery/nacos"
 	"github.com/cprobe/cprobe/discovery/openstack"
 	"github.com/cprobe/cprobe/discovery/yandexcloud"
+	"github.com/cprobe/cprobe/discovery/zookeeper"
 	"github.com/cprobe/cprobe/lib/envtemplate"
 	"github.com/cprobe/cprobe/lib/promrelabel"
 	"github.com/cprobe/cprobe/lib/promutils"
@@ -25,6 +30,9 @@ const (
 	defaultScrapeInterval    = time.Minute
 	defaultScrapeTimeout     = 10 * time.Second
 	defaultScrapeConcurrency = 50
+
+	defaultSeriesLimitInterval = 24 * time.Hour
+	defaultSessionIdleTimeout  = 5 * time.Minute
 )
 
 type Config struct {
@@ -34,6 +42,12 @@ type Config struct {
 
 	// This is set to the directory from where the config has been loaded.
 	BaseDir string
+
+	// 加载配置的时候被跳过的 scrape_config、scrape_config_files 等，-dry-run 的时候会报告出来
+	problems []string
+
+	// 这份配置是从哪些文件加载的，也就是 main*.yaml 和 scrape_config_files，/plugins/:name 页面会原样展示这些文件
+	files []string
 }
 
 // GlobalConfig represents essential parts for `global` section of Prometheus config.
@@ -42,8 +56,8 @@ type Config struct {
 type GlobalConfig struct {
 	ScrapeConcurrency int                 `yaml:"scrape_concurrency,omitempty"` // 不能一次性启动太多 target 的抓取，比如 icmp 的抓取，一次性启动太多，会导致 icmp 的抓取超时
 	ScrapeInterval    *promutils.Duration `yaml:"scrape_interval,omitempty"`
-	// ScrapeTimeout     *promutils.Duration `yaml:"scrape_timeout,omitempty"`
-	ExternalLabels *promutils.Labels `yaml:"external_labels,omitempty"`
+	ScrapeTimeout     *promutils.Duration `yaml:"scrape_timeout,omitempty"`
+	ExternalLabels    *promutils.Labels   `yaml:"external_labels,omitempty"`
 
 	MetricRelabelConfigs       []promrelabel.RelabelConfig `yaml:"metric_relabel_configs,omitempty"`
 	ParsedMetricRelabelConfigs *promrelabel.ParsedConfigs  `yaml:"-"`
@@ -58,7 +72,7 @@ type ScrapeConfig struct {
 	JobName           string              `yaml:"job_name"`
 	ScrapeConcurrency int                 `yaml:"scrape_concurrency,omitempty"`
 	ScrapeInterval    *promutils.Duration `yaml:"scrape_interval,omitempty"`
-	// ScrapeTimeout     *promutils.Duration `yaml:"scrape_timeout,omitempty"`
+	ScrapeTimeout     *promutils.Duration `yaml:"scrape_timeout,omitempty"`
 
 	// 抓取数据的逻辑大变，已经不止是 HTTP /metrics 数据的抓取，可能是抓取的 SNMP、也可能抓的 MySQL
 	ScrapeRuleFiles []string `yaml:"scrape_rule_files,omitempty"`
@@ -67,11 +81,25 @@ type ScrapeConfig struct {
 	// MetricsPath    string              `yaml:"metrics_path,omitempty"`
 	// HonorLabels    bool                `yaml:"honor_labels,omitempty"`
 
-	// HonorTimestamps is set to false by default contrary to Prometheus, which sets it to true by default,
-	// because of the issue with gaps on graphs when scraping cadvisor or similar targets, which export invalid timestamps.
+	// HonorTimestamps 决定是否保留插件上报的样本时间（比如 json 插件的 epochTimestamp、prometheus 插件抓到的带时间戳的样本），
+	// 默认和 Prometheus 一样是 true，插件没有设置时间的样本统一使用抓取时间。
+	// 如果目标暴露的时间戳不可信（比如 cadvisor），可以设置为 false，所有样本都使用抓取时间。
 	// See https://github.com/VictoriaMetrics/VictoriaMetrics/issues/4697#issuecomment-1654614799 for details.
-	// move to rules.d
-	// HonorTimestamps bool `yaml:"honor_timestamps,omitempty"`
+	HonorTimestamps *bool `yaml:"honor_timestamps,omitempty"`
+
+	// NoStaleMarkers 设置为 true 之后，series 消失、target 消失、job 被删除的时候不再发送 stale markers，
+	// 默认和 Prometheus 一样会发送，这样图表上不会在 5 分钟内一直显示已经不存在的 series 的旧值。
+	// See https://prometheus.io/docs/prometheus/latest/querying/basics/#staleness
+	NoStaleMarkers *bool `yaml:"no_stale_markers,omitempty"`
+
+	// 每个 target 都有自己的抓取循环，默认根据 target 的 labels 算一个 hash，在 scrape_interval 内均匀错开抓取时间，
+	// 避免同一个 job 的大量 target 在同一时刻一起抓取（比如几百个 MySQL 实例在同一个 proxy 后面）。
+	// scrape_align_interval 让抓取时间对齐到墙上时钟的整点，比如 1m 就是在每分钟的第 0 秒抓取；
+	// scrape_offset 让所有 target 都在 scrape_interval 整点之后的固定偏移量抓取，比如 scrape_interval 是 1m，scrape_offset 是 10s，就是在每分钟的第 10 秒抓取。
+	// 两个都配置的话就是对齐到 scrape_align_interval 整点之后再偏移 scrape_offset，比如 scrape_interval 是 5m，scrape_align_interval 是 1m，scrape_offset 是 10s，就是在某一分钟的第 10 秒开始抓取。
+	// See https://docs.victoriametrics.com/vmagent.html#scraping-big-number-of-targets
+	ScrapeAlignInterval *promutils.Duration `yaml:"scrape_align_interval,omitempty"`
+	ScrapeOffset        *promutils.Duration `yaml:"scrape_offset,omitempty"`
 
 	// move to rules.d
 	// Scheme               string                      `yaml:"scheme,omitempty"`
@@ -84,9 +112,21 @@ type ScrapeConfig struct {
 	ParsedRelabelConfigs       *promrelabel.ParsedConfigs `yaml:"-"`
 	ParsedMetricRelabelConfigs *promrelabel.ParsedConfigs `yaml:"-"`
 
-	// SampleLimit          int                         `yaml:"sample_limit,omitempty"`
+	// SampleLimit 限制每次抓取 metric relabel 之后的样本数，超过了这次抓取就算失败，数据全部丢弃，cprobe_up 为 0
+	SampleLimit int `yaml:"sample_limit,omitempty"`
+
+	// SeriesLimit 限制每个 target 在 series_limit_interval（默认 24h）内的不同 series 数量，超过之后新出现的 series 会被丢弃，
+	// 用来防止配置错误（比如 redis 的 check_keys 匹配了太多 key）导致 series 数量暴涨，把 TSDB 打爆
+	SeriesLimit         int                 `yaml:"series_limit,omitempty"`
+	SeriesLimitInterval *promutils.Duration `yaml:"series_limit_interval,omitempty"`
+
+	// SessionIdleTimeout 只对实现了 plugins.SessionPlugin 的插件（mysql、postgres、oracledb）生效，这些插件会给每个 target 保留连接，抓取之间复用，
+	// 空闲超过 session_idle_timeout（默认 5m）的连接会被关掉，scrape_interval 比它还长的话每次抓取完都会关掉连接。
+	// redis 和 kafka 的 exporter 是在每次采集的时候自己建立连接的，还不支持复用连接
+	SessionIdleTimeout *promutils.Duration `yaml:"session_idle_timeout,omitempty"`
 
 	AzureSDConfigs        []azure.SDConfig        `yaml:"azure_sd_configs,omitempty"`
+	ConsulSDConfigs       []consul.SDConfig       `yaml:"consul_sd_configs,omitempty"`
 	DigitaloceanSDConfigs []digitalocean.SDConfig `yaml:"digitalocean_sd_configs,omitempty"`
 	DNSSDConfigs          []dns.SDConfig          `yaml:"dns_sd_configs,omitempty"`
 	DockerSDConfigs       []docker.SDConfig       `yaml:"docker_sd_configs,omitempty"`
@@ -96,19 +136,19 @@ type ScrapeConfig struct {
 	FileSDConfigs         []FileSDConfig          `yaml:"file_sd_configs,omitempty"`
 	GCESDConfigs          []gce.SDConfig          `yaml:"gce_sd_configs,omitempty"`
 	HTTPSDConfigs         []http.SDConfig         `yaml:"http_sd_configs,omitempty"`
+	InventorySDConfigs    []inventory.SDConfig    `yaml:"inventory_sd_configs,omitempty"`
+	KubernetesSDConfigs   []kubernetes.SDConfig   `yaml:"kubernetes_sd_configs,omitempty"`
+	NacosSDConfigs        []nacos.SDConfig        `yaml:"nacos_sd_configs,omitempty"`
 	OpenStackSDConfigs    []openstack.SDConfig    `yaml:"openstack_sd_configs,omitempty"`
 	StaticConfigs         []StaticConfig          `yaml:"static_configs,omitempty"`
 	YandexCloudSDConfigs  []yandexcloud.SDConfig  `yaml:"yandexcloud_sd_configs,omitempty"`
+	ZookeeperSDConfigs    []zookeeper.SDConfig    `yaml:"zookeeper_sd_configs,omitempty"`
 
 	// move to rules.d
 	// These options are supported only by lib/promscrape.
 	// DisableCompression  bool                       `yaml:"disable_compression,omitempty"`
 	// DisableKeepAlive    bool                       `yaml:"disable_keepalive,omitempty"`
 	// StreamParse         bool                       `yaml:"stream_parse,omitempty"`
-	// ScrapeAlignInterval *promutils.Duration        `yaml:"scrape_align_interval,omitempty"`
-	// ScrapeOffset        *promutils.Duration        `yaml:"scrape_offset,omitempty"`
-	// SeriesLimit         int                        `yaml:"series_limit,omitempty"`
-	// NoStaleMarkers      *bool                      `yaml:"no_stale_markers,omitempty"`
 	// ProxyClientConfig   promauth.ProxyClientConfig `yaml:",inline"`
 
 	// This is set in loadConfig
@@ -121,7 +161,8 @@ type ScrapeConfig struct {
 // See https://prometheus.io/docs/prometheus/latest/configuration/configuration/#file_sd_config
 type FileSDConfig struct {
 	Files []string `yaml:"files"`
-	// `refresh_interval` is ignored. See `-promscrape.fileSDCheckInterval`
+	// RefreshInterval 是重新读取文件的间隔，默认是 job 的 scrape_interval
+	RefreshInterval *promutils.Duration `yaml:"refresh_interval,omitempty"`
 }
 
 // StaticConfig represents essential parts for `static_config` section of Prometheus config.
@@ -130,7 +171,10 @@ type FileSDConfig struct {
 type StaticConfig struct {
 	Targets []string          `yaml:"targets"`
 	Labels  *promutils.Labels `yaml:"labels,omitempty"`
-	Paths   []string          `yaml:"paths,omitempty"` // TODO: 是否要通过这个字段和 CMDB 打通，纠结
+	// Paths 是 targets 在 CMDB 里的业务路径，比如 /bj/trade/order。每个 path 都会生成一份 targets，
+	// 带上 __meta_cmdb_path 等 label，和 inventory_sd_configs 发现的 targets 一样可以按业务路径做 relabel。
+	// __meta_* label 在 relabel 之后会被删掉，想按 path 区分同一个地址的话要用 relabel 把 path 复制到普通 label 上，否则同一个地址只抓取一次
+	Paths []string `yaml:"paths,omitempty"`
 }
 
 func (cfg *Config) unmarshal(data []byte, isStrict bool) error {
@@ -0,0 +1,462 @@
+package probe
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/cprobe/cprobe/discovery/inventory"
+	"github.com/cprobe/cprobe/lib/fs"
+	"github.com/cprobe/cprobe/lib/logger"
+	"github.com/cprobe/cprobe/lib/promutils"
+)
+
+// sdConfig 是各种服务发现配置的公共部分，比如 http.SDConfig、dns.SDConfig
+type sdConfig interface {
+	GetLabels(baseDir string) ([]*promutils.Labels, error)
+}
+
+// sdSource 是 job 里的一项服务发现配置，比如 http_sd_configs 里的第 index 项
+type sdSource struct {
+	typ   string
+	index int
+	// name 用来在日志里区分同类的服务发现配置，比如 http_sd_configs 的 url
+	name     string
+	interval *promutils.Duration
+	cfg      sdConfig
+}
+
+func (src *sdSource) key() string {
+	return fmt.Sprintf("%s/%d", src.typ, src.index)
+}
+
+// refreshInterval 没有配置 refresh_interval 的话，和以前一样每个 scrape_interval 刷新一次
+func (src *sdSource) refreshInterval(scrapeInterval time.Duration) time.Duration {
+	if d := src.interval.Duration(); d > 0 {
+		return d
+	}
+	if scrapeInterval > 0 {
+		return scrapeInterval
+	}
+	return defaultScrapeInterval
+}
+
+// mustStop 释放服务发现配置占用的资源，比如 http client，有些服务发现（比如 yandexcloud）不需要释放
+func (src *sdSource) mustStop() {
+	if c, ok := src.cfg.(interface{ MustStop() }); ok {
+		c.MustStop()
+	}
+}
+
+// sdSources 返回 static_configs 以外所有的服务发现配置，static_configs 不需要刷新
+func (sc *ScrapeConfig) sdSources() []sdSource {
+	var srcs []sdSource
+	for i := range sc.FileSDConfigs {
+		c := &sc.FileSDConfigs[i]
+		srcs = append(srcs, sdSource{typ: "file_sd_configs", index: i, name: strings.Join(c.Files, ","), interval: c.RefreshInterval, cfg: c})
+	}
+	for i := range sc.HTTPSDConfigs {
+		c := &sc.HTTPSDConfigs[i]
+		srcs = append(srcs, sdSource{typ: "http_sd_configs", index: i, name: c.URL, interval: c.RefreshInterval, cfg: c})
+	}
+	for i := range sc.DNSSDConfigs {
+		c := &sc.DNSSDConfigs[i]
+		srcs = append(srcs, sdSource{typ: "dns_sd_configs", index: i, name: strings.Join(c.Names, ","), interval: c.RefreshInterval, cfg: c})
+	}
+	for i := range sc.AzureSDConfigs {
+		c := &sc.AzureSDConfigs[i]
+		srcs = append(srcs, sdSource{typ: "azure_sd_configs", index: i, name: c.SubscriptionID, interval: c.RefreshInterval, cfg: c})
+	}
+	for i := range sc.ConsulSDConfigs {
+		c := &sc.ConsulSDConfigs[i]
+		srcs = append(srcs, sdSource{typ: "consul_sd_configs", index: i, name: c.Server, interval: c.RefreshInterval, cfg: c})
+	}
+	for i := range sc.DockerSDConfigs {
+		c := &sc.DockerSDConfigs[i]
+		srcs = append(srcs, sdSource{typ: "docker_sd_configs", index: i, name: c.Host, interval: c.RefreshInterval, cfg: c})
+	}
+	for i := range sc.DockerSwarmSDConfigs {
+		c := &sc.DockerSwarmSDConfigs[i]
+		srcs = append(srcs, sdSource{typ: "dockerswarm_sd_configs", index: i, name: c.Host, interval: c.RefreshInterval, cfg: c})
+	}
+	for i := range sc.EC2SDConfigs {
+		c := &sc.EC2SDConfigs[i]
+		srcs = append(srcs, sdSource{typ: "ec2_sd_configs", index: i, name: c.Region, interval: c.RefreshInterval, cfg: c})
+	}
+	for i := range sc.EurekaSDConfigs {
+		c := &sc.EurekaSDConfigs[i]
+		srcs = append(srcs, sdSource{typ: "eureka_sd_configs", index: i, name: c.Server, interval: c.RefreshInterval, cfg: c})
+	}
+	for i := range sc.GCESDConfigs {
+		c := &sc.GCESDConfigs[i]
+		srcs = append(srcs, sdSource{typ: "gce_sd_configs", index: i, name: c.Project, interval: c.RefreshInterval, cfg: c})
+	}
+	for i := range sc.DigitaloceanSDConfigs {
+		c := &sc.DigitaloceanSDConfigs[i]
+		srcs = append(srcs, sdSource{typ: "digitalocean_sd_configs", index: i, name: fmt.Sprintf("%s:%d", c.Server, c.Port), interval: c.RefreshInterval, cfg: c})
+	}
+	for i := range sc.OpenStackSDConfigs {
+		c := &sc.OpenStackSDConfigs[i]
+		srcs = append(srcs, sdSource{typ: "openstack_sd_configs", index: i, name: c.IdentityEndpoint, interval: c.RefreshInterval, cfg: c})
+	}
+	for i := range sc.KubernetesSDConfigs {
+		c := &sc.KubernetesSDConfigs[i]
+		srcs = append(srcs, sdSource{typ: "kubernetes_sd_configs", index: i, name: c.Role, interval: c.RefreshInterval, cfg: c})
+	}
+	for i := range sc.YandexCloudSDConfigs {
+		c := &sc.YandexCloudSDConfigs[i]
+		srcs = append(srcs, sdSource{typ: "yandexcloud_sd_configs", index: i, name: c.APIEndpoint, interval: c.RefreshInterval, cfg: c})
+	}
+	for i := range sc.NacosSDConfigs {
+		c := &sc.NacosSDConfigs[i]
+		srcs = append(srcs, sdSource{typ: "nacos_sd_configs", index: i, name: c.Server, interval: c.RefreshInterval, cfg: c})
+	}
+	for i := range sc.InventorySDConfigs {
+		c := &sc.InventorySDConfigs[i]
+		name := c.File
+		if name == "" {
+			name = c.URL
+		}
+		srcs = append(srcs, sdSource{typ: "inventory_sd_configs", index: i, name: name, interval: c.RefreshInterval, cfg: c})
+	}
+	for i := range sc.ZookeeperSDConfigs {
+		c := &sc.ZookeeperSDConfigs[i]
+		srcs = append(srcs, sdSource{typ: "zookeeper_sd_configs", index: i, name: strings.Join(c.Servers, ","), interval: c.RefreshInterval, cfg: c})
+	}
+	return srcs
+}
+
+// jobDiscovery 管理一个 job 的所有服务发现，每项服务发现配置都有一个后台 goroutine 按照 refresh_interval 刷新 targets，
+// 抓取调度只读取刷新好的 targets，不会被慢的服务发现拖住；刷新失败的时候保留上一次成功拿到的 targets，
+// 避免服务发现偶尔出错，target 全部消失，又全部重新出现
+type jobDiscovery struct {
+	mu sync.Mutex
+	// refreshers 对应的配置，reload 之后 ScrapeConfig 会换成新的
+	sc *ScrapeConfig
+	// refreshers 的顺序和配置里的顺序一致，targets 的顺序也就和配置一致
+	refreshers []*sdRefresher
+}
+
+var sdWaitTimeout = flag.Duration("scrape.sdWaitTimeout", 30*time.Second, "How long to wait for the first refresh of a newly added service discovery config before scraping the targets of the job. "+
+	"The targets of the service discovery are picked up on the next sync of the job if the first refresh takes longer")
+
+// getTargets 返回所有服务发现最近一次成功刷新的 targets
+//
+// 配置变化之后，第一次调用会把新的配置交给 refresher；成功刷新过的 refresher 直接返回缓存的 targets，
+// 新加的 refresher 最多等 -scrape.sdWaitTimeout，让 job 启动之后马上就能拿到 targets，
+// 服务发现 hang 住的话也不会卡住 job，ctx 结束或者 quitCh 关闭的时候马上返回，这时候的结果不完整，调用方要丢弃
+func (d *jobDiscovery) getTargets(ctx context.Context, quitCh <-chan struct{}, jobName, plugin string, sc *ScrapeConfig) []*promutils.Labels {
+	// 不能在持有 d.mu 的时候等待，否则 stop 会被卡住
+	d.mu.Lock()
+	if d.sc != sc {
+		d.update(jobName, plugin, sc)
+	}
+	refreshers := d.refreshers
+	d.mu.Unlock()
+
+	// 所有 refresher 一共最多等 -scrape.sdWaitTimeout
+	waitCtx, cancel := context.WithTimeout(ctx, *sdWaitTimeout)
+	defer cancel()
+
+	var targets []*promutils.Labels
+	for _, r := range refreshers {
+		targets = append(targets, r.getTargets(waitCtx, quitCh)...)
+	}
+	return targets
+}
+
+func (d *jobDiscovery) update(jobName, plugin string, sc *ScrapeConfig) {
+	d.sc = sc
+
+	// 同一类服务发现的第几项配置对应同一个 refresher，reload 之后继续使用，上一次成功拿到的 targets 和监控指标都保留
+	oldRefreshers := make(map[string]*sdRefresher, len(d.refreshers))
+	for _, r := range d.refreshers {
+		oldRefreshers[r.key] = r
+	}
+
+	srcs := sc.sdSources()
+	refreshers := make([]*sdRefresher, 0, len(srcs))
+	defaultInterval := sc.ScrapeInterval.Duration()
+	for _, src := range srcs {
+		r, ok := oldRefreshers[src.key()]
+		if ok {
+			delete(oldRefreshers, src.key())
+			r.update(src, defaultInterval)
+		} else {
+			r = newSDRefresher(jobName, plugin, sc.ConfigRef.BaseDir, src, defaultInterval)
+		}
+		refreshers = append(refreshers, r)
+	}
+
+	for _, r := range oldRefreshers {
+		r.stop()
+	}
+	d.refreshers = refreshers
+}
+
+// stop 停掉所有的 refresher，job 被删除或者退出的时候调用
+func (d *jobDiscovery) stop() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, r := range d.refreshers {
+		r.stop()
+	}
+	d.refreshers = nil
+	d.sc = nil
+}
+
+// sdRefresher 在后台按照 refresh_interval 刷新一项服务发现配置的 targets
+type sdRefresher struct {
+	key     string
+	jobName string
+	baseDir string
+
+	updateCh chan struct{}
+	stopCh   chan struct{}
+
+	mu       sync.Mutex
+	src      sdSource
+	interval time.Duration
+	// 配置每更新一次 generation 加一，用老的配置刷新的结果直接丢弃
+	generation uint64
+	// 用当前配置刷新一次之后关闭
+	ready chan struct{}
+	// 配置更新之后，老的配置要在刷新 goroutine 里释放，避免正在刷新的时候被释放
+	staleSources []sdSource
+
+	targets     []*promutils.Labels
+	lastSuccess time.Time
+	// 成功刷新过一次之后，getTargets 直接返回缓存的 targets，不再等待刷新
+	succeeded bool
+
+	metricLabels   string
+	refreshErrors  *metrics.Counter
+	targetsCounter *metrics.Counter
+}
+
+func newSDRefresher(jobName, plugin, baseDir string, src sdSource, defaultInterval time.Duration) *sdRefresher {
+	metricLabels := fmt.Sprintf(`job=%q,plugin=%q,type=%q,index="%d"`, jobName, plugin, src.typ, src.index)
+	r := &sdRefresher{
+		key:      src.key(),
+		jobName:  jobName,
+		baseDir:  baseDir,
+		updateCh: make(chan struct{}, 1),
+		stopCh:   make(chan struct{}),
+		src:      src,
+		interval: src.refreshInterval(defaultInterval),
+		ready:    make(chan struct{}),
+		// 还没有成功刷新过的时候，age 从启动的时候开始算
+		lastSuccess: time.Now(),
+
+		metricLabels:   metricLabels,
+		refreshErrors:  metrics.GetOrCreateCounter(fmt.Sprintf(`cprobe_discovery_errors_total{%s}`, metricLabels)),
+		targetsCounter: metrics.GetOrCreateCounter(fmt.Sprintf(`cprobe_discovery_targets{%s}`, metricLabels)),
+	}
+	metrics.GetOrCreateGauge(fmt.Sprintf(`cprobe_discovery_age_seconds{%s}`, metricLabels), func() float64 {
+		r.mu.Lock()
+		lastSuccess := r.lastSuccess
+		r.mu.Unlock()
+		return time.Since(lastSuccess).Seconds()
+	})
+
+	go r.run()
+	return r
+}
+
+func (r *sdRefresher) run() {
+	for {
+		r.refresh()
+
+		r.mu.Lock()
+		interval := r.interval
+		r.mu.Unlock()
+
+		timer := time.NewTimer(interval)
+		select {
+		case <-timer.C:
+		case <-r.updateCh:
+			timer.Stop()
+		case <-r.stopCh:
+			timer.Stop()
+			r.mu.Lock()
+			src := r.src
+			r.mu.Unlock()
+			src.mustStop()
+			return
+		}
+	}
+}
+
+func (r *sdRefresher) refresh() {
+	r.mu.Lock()
+	src := r.src
+	generation := r.generation
+	staleSources := r.staleSources
+	r.staleSources = nil
+	r.mu.Unlock()
+
+	for i := range staleSources {
+		staleSources[i].mustStop()
+	}
+
+	targets, err := src.cfg.GetLabels(r.baseDir)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if generation != r.generation {
+		// 刷新的过程中配置变了，updateCh 里有信号，马上会用新的配置再刷新一次
+		return
+	}
+	if err != nil {
+		r.refreshErrors.Inc()
+		logger.Errorf("job(%s) %s(%s) refresh targets error: %s; keeping %d targets from the last successful refresh",
+			r.jobName, src.typ, src.name, err, len(r.targets))
+	} else {
+		r.targets = targets
+		r.lastSuccess = time.Now()
+		r.succeeded = true
+		r.targetsCounter.Set(uint64(len(targets)))
+	}
+	select {
+	case <-r.ready:
+	default:
+		close(r.ready)
+	}
+}
+
+// update 换成 reload 之后的配置，并马上刷新一次
+func (r *sdRefresher) update(src sdSource, defaultInterval time.Duration) {
+	r.mu.Lock()
+	r.staleSources = append(r.staleSources, r.src)
+	r.src = src
+	r.interval = src.refreshInterval(defaultInterval)
+	r.generation++
+	r.ready = make(chan struct{})
+	r.mu.Unlock()
+
+	select {
+	case r.updateCh <- struct{}{}:
+	default:
+	}
+}
+
+// getTargets 返回最近一次成功刷新的 targets
+//
+// 还没有成功刷新过的话，等第一次刷新结束，ctx 结束、quitCh 关闭或者 refresher 被停掉的时候不再等待，返回空
+func (r *sdRefresher) getTargets(ctx context.Context, quitCh <-chan struct{}) []*promutils.Labels {
+	r.mu.Lock()
+	ready := r.ready
+	succeeded := r.succeeded
+	targets := r.targets
+	src := r.src
+	r.mu.Unlock()
+
+	if succeeded {
+		return targets
+	}
+
+	select {
+	case <-ready:
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			logger.Warnf("job(%s) %s(%s) the first refresh of targets takes longer than -scrape.sdWaitTimeout=%s; its targets are picked up on the next sync",
+				r.jobName, src.typ, src.name, *sdWaitTimeout)
+		}
+		return nil
+	case <-quitCh:
+		return nil
+	case <-r.stopCh:
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.targets
+}
+
+// stop 停止后台刷新，不等正在进行的刷新结束，服务发现配置由刷新 goroutine 退出的时候释放
+func (r *sdRefresher) stop() {
+	close(r.stopCh)
+
+	metrics.UnregisterMetric(fmt.Sprintf(`cprobe_discovery_errors_total{%s}`, r.metricLabels))
+	metrics.UnregisterMetric(fmt.Sprintf(`cprobe_discovery_targets{%s}`, r.metricLabels))
+	metrics.UnregisterMetric(fmt.Sprintf(`cprobe_discovery_age_seconds{%s}`, r.metricLabels))
+}
+
+// appendStaticTargets 把 static_configs 的 targets 转换成 labels 追加到 dst，filePath 不为空的时候带上 __meta_filepath
+//
+// 配置了 paths 的话，每个 path 都生成一份 targets，带上 __meta_cmdb_path 等 label。
+// 这些 targets 的 __address__ 是一样的，relabel 之后 labels 也一样的话会在 relabelTargets 里合并，只抓取一次
+func appendStaticTargets(dst []*promutils.Labels, c *StaticConfig, filePath string) []*promutils.Labels {
+	paths := c.Paths
+	if len(paths) == 0 {
+		paths = []string{""}
+	}
+	for _, path := range paths {
+		for _, t := range c.Targets {
+			m := promutils.NewLabels(3 + c.Labels.Len())
+			m.AddFrom(c.Labels)
+			m.Add("__address__", t)
+			if filePath != "" {
+				m.Add("__meta_filepath", filePath)
+			}
+			if path != "" {
+				inventory.AddPathLabels(m, path)
+			}
+			m.RemoveDuplicates()
+			dst = append(dst, m)
+		}
+	}
+	return dst
+}
+
+// GetLabels 读取 file_sd_configs 的所有文件，glob 匹配到的文件会全部读取
+//
+// 有文件读取失败的话返回 error，这时候会继续使用上一次成功读取的 targets
+func (c *FileSDConfig) GetLabels(baseDir string) ([]*promutils.Labels, error) {
+	var targets []*promutils.Labels
+	var errs []string
+	for _, file := range c.Files {
+		pathPattern := fs.GetFilepath(baseDir, file)
+		paths := []string{pathPattern}
+		if strings.Contains(pathPattern, "*") {
+			var err error
+			paths, err = filepath.Glob(pathPattern)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("invalid pattern %q: %s", file, err))
+				continue
+			}
+		}
+		for _, path := range paths {
+			stcs, err := loadStaticConfigs(path)
+			if err != nil {
+				errs = append(errs, err.Error())
+				continue
+			}
+
+			pathShort := path
+			if strings.HasPrefix(pathShort, baseDir) {
+				pathShort = path[len(baseDir):]
+				if len(pathShort) > 0 && pathShort[0] == filepath.Separator {
+					pathShort = pathShort[1:]
+				}
+			}
+
+			for i := range stcs {
+				targets = appendStaticTargets(targets, &stcs[i], pathShort)
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return targets, errors.New(strings.Join(errs, "; "))
+	}
+	return targets, nil
+}
@@ -0,0 +1,144 @@
+package probe
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/cprobe/cprobe/lib/promrelabel"
+	"github.com/cprobe/cprobe/lib/promutils"
+)
+
+// testSDConfig returns the labels sent to its ch, GetLabels blocks until then.
+type testSDConfig struct {
+	ch chan []*promutils.Labels
+}
+
+func (c *testSDConfig) GetLabels(baseDir string) ([]*promutils.Labels, error) {
+	labelss, ok := <-c.ch
+	if !ok || labelss == nil {
+		return nil, errors.New("refresh error")
+	}
+	return labelss, nil
+}
+
+func newTestSDRefresher(t *testing.T, cfg sdConfig) *sdRefresher {
+	t.Helper()
+	src := sdSource{typ: "test_sd_configs", name: t.Name(), cfg: cfg}
+	r := newSDRefresher("test", "test", "", src, time.Hour)
+	t.Cleanup(r.stop)
+	return r
+}
+
+func TestSDRefresherGetTargetsHanging(t *testing.T) {
+	cfg := &testSDConfig{ch: make(chan []*promutils.Labels)}
+	r := newTestSDRefresher(t, cfg)
+	defer close(cfg.ch)
+
+	// The first refresh hangs, so getTargets returns nothing after the timeout.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if targets := r.getTargets(ctx, nil); len(targets) != 0 {
+		t.Fatalf("unexpected targets: %v", targets)
+	}
+
+	// quitCh stops waiting too.
+	quitCh := make(chan struct{})
+	close(quitCh)
+	done := make(chan struct{})
+	go func() {
+		r.getTargets(context.Background(), quitCh)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("getTargets ignores quitCh")
+	}
+}
+
+func TestSDRefresherGetTargetsCached(t *testing.T) {
+	cfg := &testSDConfig{ch: make(chan []*promutils.Labels)}
+	r := newTestSDRefresher(t, cfg)
+	defer close(cfg.ch)
+
+	want := []*promutils.Labels{promutils.NewLabelsFromMap(map[string]string{"__address__": "a:1"})}
+	cfg.ch <- want
+	targets := r.getTargets(context.Background(), nil)
+	if len(targets) != 1 || targets[0].Get("__address__") != "a:1" {
+		t.Fatalf("unexpected targets: %v", targets)
+	}
+
+	// The refresh after reload hangs, but the targets from the last successful refresh are returned immediately.
+	r.update(sdSource{typ: "test_sd_configs", name: t.Name(), cfg: cfg}, time.Hour)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	targets = r.getTargets(ctx, nil)
+	if len(targets) != 1 || targets[0].Get("__address__") != "a:1" {
+		t.Fatalf("unexpected targets after reload: %v", targets)
+	}
+
+	// A failed refresh keeps the last good targets.
+	cfg.ch <- nil
+	targets = r.getTargets(context.Background(), nil)
+	if len(targets) != 1 || targets[0].Get("__address__") != "a:1" {
+		t.Fatalf("unexpected targets after failed refresh: %v", targets)
+	}
+}
+
+func TestStaticTargetsWithPaths(t *testing.T) {
+	c := &StaticConfig{
+		Targets: []string{"10.0.0.1:3306", "10.0.0.2:3306"},
+		Paths:   []string{"/bj/trade/order", "/bj/trade/pay"},
+	}
+	targets := appendStaticTargets(nil, c, "")
+	if len(targets) != 4 {
+		t.Fatalf("unexpected number of targets; got %d; want 4", len(targets))
+	}
+
+	f := func(rcs []promrelabel.RelabelConfig, wantTargets []string) {
+		t.Helper()
+		pcs, err := promrelabel.ParseRelabelConfigs(rcs)
+		if err != nil {
+			t.Fatalf("cannot parse relabel configs: %s", err)
+		}
+		j := NewJobGoroutine("mysql", &ScrapeConfig{
+			ConfigRef:            &Config{},
+			JobName:              "mysql",
+			ScrapeConcurrency:    1,
+			ParsedRelabelConfigs: pcs,
+		})
+		activeTargets, droppedTargets := j.relabelTargets("mysql", targets)
+		if len(droppedTargets) != 0 {
+			t.Fatalf("unexpected dropped targets: %v", droppedTargets)
+		}
+		var got []string
+		for _, ts := range activeTargets {
+			got = append(got, ts.labels.String())
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, wantTargets) {
+			t.Fatalf("unexpected targets\ngot\n%q\nwant\n%q", got, wantTargets)
+		}
+	}
+
+	// __meta_cmdb_* labels are removed after relabeling, so the targets for every path collapse into a single target
+	f(nil, []string{
+		`{__address__="10.0.0.1:3306",instance="10.0.0.1:3306",job="mysql"}`,
+		`{__address__="10.0.0.2:3306",instance="10.0.0.2:3306",job="mysql"}`,
+	})
+
+	// the path copied to a regular label keeps a target per path
+	f([]promrelabel.RelabelConfig{{
+		SourceLabels: []string{"__meta_cmdb_path"},
+		TargetLabel:  "path",
+	}}, []string{
+		`{__address__="10.0.0.1:3306",instance="10.0.0.1:3306",job="mysql",path="/bj/trade/order"}`,
+		`{__address__="10.0.0.1:3306",instance="10.0.0.1:3306",job="mysql",path="/bj/trade/pay"}`,
+		`{__address__="10.0.0.2:3306",instance="10.0.0.2:3306",job="mysql",path="/bj/trade/order"}`,
+		`{__address__="10.0.0.2:3306",instance="10.0.0.2:3306",job="mysql",path="/bj/trade/pay"}`,
+	})
+}
@@ -0,0 +1,196 @@
+package probe
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cprobe/cprobe/lib/prompbmarshal"
+	"github.com/cprobe/cprobe/lib/promutils"
+	"github.com/cprobe/cprobe/writer"
+)
+
+// ScrapeOnce scrapes the targets of the given job once and writes the resulting series to w.
+//
+// The series go through the same relabel_configs, metric_relabel_configs and writer relabeling as usual,
+// but nothing is sent to the writers. Only the given target is scraped if target isn't empty,
+// otherwise every target discovered for the job is scraped.
+// format can be "text" (Prometheus text exposition format) or "json".
+func ScrapeOnce(ctx context.Context, w io.Writer, configDirectory, jobName, target, format string) error {
+	if format != "text" && format != "json" {
+		return fmt.Errorf("unsupported format %q; supported values: text, json", format)
+	}
+
+	j, err := findJob(configDirectory, jobName)
+	if err != nil {
+		return err
+	}
+	sc := j.scrapeConfig
+	defer j.discovery.stop()
+
+	targets := j.getTargets(ctx)
+	if target != "" {
+		// 服务发现里有这个 target 的话，带上服务发现拿到的 labels，否则就只有 __address__
+		var found *promutils.Labels
+		for _, t := range targets {
+			if t.Get("__address__") == target {
+				found = t
+				break
+			}
+		}
+		if found == nil {
+			found = promutils.NewLabels(1)
+			found.Add("__address__", target)
+		}
+		targets = []*promutils.Labels{found}
+	}
+	if len(targets) == 0 {
+		return fmt.Errorf("no targets found for job %s", sc.JobName)
+	}
+
+	var results []oneshotResult
+	for _, t := range targets {
+		address := t.Get("__address__")
+		parsedTarget, params := j.parseTarget(sc.JobName, t)
+		if parsedTarget == nil {
+			return fmt.Errorf("target %s is dropped by relabel_configs of job %s", address, sc.JobName)
+		}
+
+		ts := newTargetStatus(t, parsedTarget, params)
+		tss, _, err := j.scrape(ctx, sc, ts)
+		ts.session.close()
+		if err != nil {
+			return err
+		}
+
+		ts.mu.Lock()
+		lastError := ts.lastError
+		ts.mu.Unlock()
+
+		series := writer.DryRun(tss)
+		urls := make([]string, 0, len(series))
+		for url := range series {
+			urls = append(urls, url)
+		}
+		sort.Strings(urls)
+		for _, url := range urls {
+			results = append(results, oneshotResult{
+				Target: address,
+				Writer: url,
+				Error:  lastError,
+				series: series[url],
+			})
+		}
+	}
+
+	if format == "json" {
+		return writeOneshotJSON(w, results)
+	}
+
+	for _, r := range results {
+		fmt.Fprintf(w, "# target: %s\n", r.Target)
+		if r.Writer != "" {
+			fmt.Fprintf(w, "# writer: %s\n", r.Writer)
+		}
+		if r.Error != "" {
+			fmt.Fprintf(w, "# error: %s\n", r.Error)
+		}
+		if _, err := w.Write(prompbmarshal.MarshalExposition(nil, r.series, false)); err != nil {
+			return err
+		}
+		fmt.Fprintln(w)
+	}
+	return nil
+}
+
+// findJob 在所有插件的 main*.yaml 里查找 job，只有一个 job 的时候 jobName 可以为空
+func findJob(configDirectory, jobName string) (*JobGoroutine, error) {
+	pluginDirs, err := listPlugins(configDirectory)
+	if err != nil {
+		return nil, err
+	}
+
+	var jobs []*JobGoroutine
+	var names []string
+	for _, pluginDir := range pluginDirs {
+		entryYamlFilePaths, err := filepath.Glob(filepath.Join(configDirectory, pluginDir, "main*.yaml"))
+		if err != nil {
+			return nil, fmt.Errorf("cannot glob main*.yaml under %s: %w", pluginDir, err)
+		}
+
+		for _, entryYamlFilePath := range entryYamlFilePaths {
+			cfg, err := loadConfig(entryYamlFilePath)
+			if err != nil {
+				return nil, err
+			}
+			for _, sc := range cfg.ScrapeConfigs {
+				if sc == nil {
+					continue
+				}
+				names = append(names, sc.JobName)
+				if jobName == "" || sc.JobName == jobName {
+					jobs = append(jobs, NewJobGoroutine(pluginDir, sc))
+				}
+			}
+		}
+	}
+
+	switch {
+	case len(jobs) == 1:
+		return jobs[0], nil
+	case len(jobs) == 0 && jobName != "":
+		return nil, fmt.Errorf("cannot find job %q; available jobs: %s", jobName, strings.Join(names, ", "))
+	case len(jobs) == 0:
+		return nil, fmt.Errorf("no jobs found under %s", configDirectory)
+	case jobName == "":
+		return nil, fmt.Errorf("more than one job found, pick one of them with -test.job: %s", strings.Join(names, ", "))
+	default:
+		return nil, fmt.Errorf("job %q is defined %d times, narrow it down with -plugins", jobName, len(jobs))
+	}
+}
+
+type oneshotResult struct {
+	Target string `json:"target"`
+	Writer string `json:"writer,omitempty"`
+	Error  string `json:"error,omitempty"`
+
+	series []prompbmarshal.TimeSeries
+}
+
+// writeOneshotJSON 的输出格式和 Prometheus /api/v1/query 返回的 vector 类似，value 是 [秒级时间戳, "值"]
+func writeOneshotJSON(w io.Writer, results []oneshotResult) error {
+	type sample struct {
+		Metric map[string]string `json:"metric"`
+		Value  [2]interface{}    `json:"value"`
+	}
+	type result struct {
+		oneshotResult
+		Series []sample `json:"series"`
+	}
+
+	out := make([]result, 0, len(results))
+	for _, r := range results {
+		series := make([]sample, 0, len(r.series))
+		for _, ts := range r.series {
+			m := make(map[string]string, len(ts.Labels))
+			for _, label := range ts.Labels {
+				m[label.Name] = label.Value
+			}
+			s := ts.Samples[len(ts.Samples)-1]
+			series = append(series, sample{
+				Metric: m,
+				Value:  [2]interface{}{float64(s.Timestamp) / 1e3, strconv.FormatFloat(s.Value, 'g', -1, 64)},
+			})
+		}
+		out = append(out, result{oneshotResult: r, Series: series})
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
@@ -4,12 +4,17 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"io"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/VictoriaMetrics/metrics"
 	"github.com/cprobe/cprobe/lib/fileutil"
+	"github.com/cprobe/cprobe/lib/fs"
 	"github.com/cprobe/cprobe/lib/logger"
+	"github.com/cprobe/cprobe/lib/redact"
 	"github.com/pkg/errors"
 )
 
@@ -17,6 +22,21 @@ var (
 	pluginsFilter = flag.String("plugins", "", "Filter plugins, separated by comma, e.g. -plugins=mysql,redis")
 )
 
+var (
+	configReloads      = metrics.NewCounter(`cprobe_config_reloads_total`)
+	configReloadErrors = metrics.NewCounter(`cprobe_config_reloads_errors_total`)
+
+	configSuccess   atomic.Int64
+	configTimestamp atomic.Int64
+
+	_ = metrics.NewGauge(`cprobe_config_last_reload_successful`, func() float64 {
+		return float64(configSuccess.Load())
+	})
+	_ = metrics.NewGauge(`cprobe_config_last_reload_success_timestamp_seconds`, func() float64 {
+		return float64(configTimestamp.Load())
+	})
+)
+
 func listPlugins(configDirectory string) ([]string, error) {
 	pluginDirs, err := fileutil.DirsUnder(configDirectory)
 	if err != nil {
@@ -58,6 +78,9 @@ func Start(ctx context.Context, configDirectory string) error {
 		}
 	}
 
+	configSuccess.Store(1)
+	configTimestamp.Store(time.Now().Unix())
+
 	return nil
 }
 
@@ -81,14 +104,75 @@ func startPlugin(ctx context.Context, configDirectory, pluginDir string) error {
 	return nil
 }
 
-var PluginCfgs = make(map[string][]*Config)
+// pluginCfgs holds the configs loaded from main*.yaml of every plugin. It is protected by jobsLock.
+var pluginCfgs = make(map[string][]*Config)
+
+// GetPluginConfigs returns a copy of the configs currently in use, grouped by plugin name.
+func GetPluginConfigs() map[string][]*Config {
+	jobsLock.RLock()
+	defer jobsLock.RUnlock()
+
+	ret := make(map[string][]*Config, len(pluginCfgs))
+	for name, cfgs := range pluginCfgs {
+		ret[name] = append([]*Config(nil), cfgs...)
+	}
+	return ret
+}
+
+// WritePluginConfigs writes the config files of the plugin with the given name to w as they are on disk.
+//
+// These are main*.yaml, scrape_config_files and scrape_rule_files of every job.
+// `%{...}` placeholders aren't expanded, so the env vars and secrets they refer to never show up.
+// Passwords, tokens and other secrets written in plain text are replaced with redact.Mask unless showSecrets is set.
+// false is returned if the plugin has no configs.
+func WritePluginConfigs(w io.Writer, name string, showSecrets bool) bool {
+	cfgs, ok := GetPluginConfigs()[name]
+	if !ok {
+		return false
+	}
+
+	for _, cfg := range cfgs {
+		for _, path := range cfg.files {
+			fmt.Fprintf(w, "--- file: %s ---\n", path)
+			writeRawFile(w, path, showSecrets, redact.YAML)
+		}
+		for _, scrapeConfig := range cfg.ScrapeConfigs {
+			if scrapeConfig == nil {
+				continue
+			}
+			fmt.Fprintf(w, "--- job: %s ---\n", scrapeConfig.JobName)
+			for _, ruleFile := range scrapeConfig.ScrapeRuleFiles {
+				fmt.Fprintf(w, "- %s:\n", ruleFile)
+				// 不能用 CacheGetBytes，缓存里是展开了 %{...} 之后的内容
+				writeRawFile(w, fs.GetFilepath(scrapeConfig.ConfigRef.BaseDir, ruleFile), showSecrets, redact.TOML)
+			}
+		}
+	}
+	return true
+}
+
+func writeRawFile(w io.Writer, path string, showSecrets bool, redactFunc func(data []byte) []byte) {
+	data, err := fs.ReadFileOrHTTP(path)
+	if err != nil {
+		fmt.Fprintf(w, "# %s\n", err)
+		return
+	}
+	if !showSecrets {
+		data = redactFunc(data)
+	}
+	fmt.Fprintf(w, "%s\n", data)
+}
 
 func startEntry(ctx context.Context, pluginName, entryYamlFilePath string) error {
 	cfg, err := loadConfig(entryYamlFilePath)
 	if err != nil {
 		return err
 	}
-	PluginCfgs[pluginName] = append(PluginCfgs[pluginName], cfg)
+
+	jobsLock.Lock()
+	defer jobsLock.Unlock()
+
+	pluginCfgs[pluginName] = append(pluginCfgs[pluginName], cfg)
 
 	pluginJobs, has := Jobs[pluginName]
 	if !has {
@@ -114,11 +198,21 @@ func startEntry(ctx context.Context, pluginName, entryYamlFilePath string) error
 
 // Reload 读取磁盘配置文件，与内存中的配置文件进行比较，增删 JobGoroutine
 func Reload(ctx context.Context, configDirectory string) {
-	newJobs, err := readFiles(configDirectory)
+	configReloads.Inc()
+	newJobs, newCfgs, err := readFiles(configDirectory)
 	if err != nil {
 		logger.Errorf("cannot read files: %s", err)
+		configReloadErrors.Inc()
+		configSuccess.Store(0)
 		return
 	}
+	configSuccess.Store(1)
+	configTimestamp.Store(time.Now().Unix())
+
+	jobsLock.Lock()
+	defer jobsLock.Unlock()
+
+	pluginCfgs = newCfgs
 
 	// 遍历内存中的老 Jobs，如果磁盘上的新 Jobs 中没有，就删除
 	for pluginName, jobs := range Jobs {
@@ -153,13 +247,14 @@ func Reload(ctx context.Context, configDirectory string) {
 	}
 }
 
-func readFiles(configDirectory string) (map[string]map[JobID]*JobGoroutine, error) {
+func readFiles(configDirectory string) (map[string]map[JobID]*JobGoroutine, map[string][]*Config, error) {
 	pluginDirs, err := listPlugins(configDirectory)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	newJobs := makeJobs()
+	newCfgs := make(map[string][]*Config)
 
 	for i := 0; i < len(pluginDirs); i++ {
 		pluginDir := pluginDirs[i]
@@ -167,7 +262,7 @@ func readFiles(configDirectory string) (map[string]map[JobID]*JobGoroutine, erro
 
 		entryYamlFilePaths, err := filepath.Glob(filepath.Join(pluginDirPath, "main*.yaml"))
 		if err != nil {
-			return nil, fmt.Errorf("cannot glob main*.yaml under %s: %s", pluginDirPath, err)
+			return nil, nil, fmt.Errorf("cannot glob main*.yaml under %s: %s", pluginDirPath, err)
 		}
 
 		for i := 0; i < len(entryYamlFilePaths); i++ {
@@ -175,13 +270,14 @@ func readFiles(configDirectory string) (map[string]map[JobID]*JobGoroutine, erro
 
 			cfg, err := loadConfig(entryYamlFilePath)
 			if err != nil {
-				return nil, fmt.Errorf("cannot load config %s: %s", entryYamlFilePath, err)
+				return nil, nil, fmt.Errorf("cannot load config %s: %s", entryYamlFilePath, err)
 			}
 
 			pluginJobs, has := newJobs[pluginDir]
 			if !has {
-				return nil, fmt.Errorf("unsupported plugin %s", pluginDir)
+				return nil, nil, fmt.Errorf("unsupported plugin %s", pluginDir)
 			}
+			newCfgs[pluginDir] = append(newCfgs[pluginDir], cfg)
 
 			for i := range cfg.ScrapeConfigs {
 				if cfg.ScrapeConfigs[i] == nil {
@@ -195,5 +291,5 @@ func readFiles(configDirectory string) (map[string]map[JobID]*JobGoroutine, erro
 		}
 	}
 
-	return newJobs, nil
+	return newJobs, newCfgs, nil
 }
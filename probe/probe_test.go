@@ -0,0 +1,90 @@
+package probe
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cprobe/cprobe/types"
+)
+
+func writeTestFile(t *testing.T, path, data string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatalf("cannot create dir for %q: %s", path, err)
+	}
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatalf("cannot write %q: %s", path, err)
+	}
+}
+
+func TestReloadPluginConfigs(t *testing.T) {
+	oldJobs, oldCfgs := Jobs, pluginCfgs
+	Jobs, pluginCfgs = makeJobs(), make(map[string][]*Config)
+	defer func() {
+		Jobs, pluginCfgs = oldJobs, oldCfgs
+	}()
+
+	// ctx 已经取消，新增的 JobGoroutine 启动后马上退出，不会真的去抓取
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	confd := t.TempDir()
+	mainYaml := filepath.Join(confd, types.PluginMySQL, "main.yaml")
+
+	f := func(jobNames ...string) {
+		t.Helper()
+		Reload(ctx, confd)
+
+		cfgs := GetPluginConfigs()[types.PluginMySQL]
+		if len(cfgs) != 1 {
+			t.Fatalf("unexpected number of configs; got %d; want 1", len(cfgs))
+		}
+		var got []string
+		for _, sc := range cfgs[0].ScrapeConfigs {
+			got = append(got, sc.JobName)
+		}
+		if len(got) != len(jobNames) {
+			t.Fatalf("unexpected jobs; got %q; want %q", got, jobNames)
+		}
+		for i := range got {
+			if got[i] != jobNames[i] {
+				t.Fatalf("unexpected jobs; got %q; want %q", got, jobNames)
+			}
+		}
+		if n := len(Jobs[types.PluginMySQL]); n != len(jobNames) {
+			t.Fatalf("unexpected number of job goroutines; got %d; want %d", n, len(jobNames))
+		}
+	}
+
+	writeTestFile(t, mainYaml, `
+scrape_configs:
+- job_name: a
+`)
+	f("a")
+
+	// /config 要能看到 reload 之后的配置
+	writeTestFile(t, mainYaml, `
+scrape_configs:
+- job_name: a
+- job_name: b
+`)
+	f("a", "b")
+
+	writeTestFile(t, mainYaml, `
+scrape_configs:
+- job_name: b
+`)
+	f("b")
+
+	// 加载失败的时候保留之前的配置
+	writeTestFile(t, mainYaml, `scrape_configs: [`)
+	Reload(ctx, confd)
+	if cfgs := GetPluginConfigs()[types.PluginMySQL]; len(cfgs) != 1 || cfgs[0].ScrapeConfigs[0].JobName != "b" {
+		t.Fatalf("configs must be kept after failed reload")
+	}
+	if n := configSuccess.Load(); n != 0 {
+		t.Fatalf("unexpected cprobe_config_last_reload_successful; got %d; want 0", n)
+	}
+}
@@ -3,12 +3,16 @@ package probe
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"path/filepath"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/cespare/xxhash/v2"
+	"github.com/cprobe/cprobe/flags"
 	"github.com/cprobe/cprobe/lib/conv"
 	"github.com/cprobe/cprobe/lib/envtemplate"
 	"github.com/cprobe/cprobe/lib/fs"
@@ -17,12 +21,26 @@ import (
 	"github.com/cprobe/cprobe/lib/promutils"
 	"github.com/cprobe/cprobe/plugins"
 	"github.com/cprobe/cprobe/types"
+	"github.com/cprobe/cprobe/types/metric"
 	"github.com/cprobe/cprobe/writer"
 	"gopkg.in/yaml.v2"
 )
 
 var (
 	Jobs = makeJobs()
+	// Reload 和 http 接口（比如 /targets）会并发读写 Jobs，需要加锁
+	jobsLock sync.RWMutex
+
+	errScrapeTimeout = errors.New("scrape timeout exceeded")
+
+	ruleFileCacheHits          = metrics.NewCounter(`cprobe_rule_file_cache_hits_total`)
+	ruleFileCacheMisses        = metrics.NewCounter(`cprobe_rule_file_cache_misses_total`)
+	pluginConfigCacheHits      = metrics.NewCounter(`cprobe_plugin_config_cache_hits_total`)
+	pluginConfigCacheMisses    = metrics.NewCounter(`cprobe_plugin_config_cache_misses_total`)
+	metricRelabelSeriesDropped = metrics.NewCounter(`cprobe_series_dropped_total{reason="metric_relabel"}`)
+	invalidValueSeriesDropped  = metrics.NewCounter(`cprobe_series_dropped_total{reason="invalid_value"}`)
+	scrapesAbandoned           = metrics.NewCounter(`cprobe_scrapes_abandoned_total`)
+	scrapesSkipped             = metrics.NewCounter(`cprobe_scrapes_skipped_total{reason="previous_scrape_running"}`)
 )
 
 type JobID struct {
@@ -35,13 +53,38 @@ type JobGoroutine struct {
 	scrapeConfig *ScrapeConfig
 	quitChan     chan struct{}
 	sync.RWMutex
+
+	// 这个 job 所有 target 的抓取循环共用的并发控制，scrape_concurrency 变化的时候会换一个新的
+	semaphore chan struct{}
+
+	// 最近一轮抓取的 target 状态，key 是 relabel 之后的 labels
+	targetsLock    sync.RWMutex
+	activeTargets  map[string]*targetStatus
+	droppedTargets []*promutils.Labels
+
+	// 解析好的插件配置，key 是 rule 文件内容的 hash，rule 文件不变就不用每次抓取都重新解析
+	// target 可以通过 __param_rule_files 使用不同的 rule 文件，所以一个 job 可能有多份配置
+	pluginConfigsLock sync.Mutex
+	pluginConfigs     map[uint64]*cachedPluginConfig
+
+	// 除了 static_configs 之外的服务发现都在后台刷新
+	discovery jobDiscovery
 }
 
+type cachedPluginConfig struct {
+	config   any
+	lastUsed time.Time
+}
+
+// 超过这个时间没有用到的插件配置会被清理掉，比如 rule 文件修改之前的配置
+const pluginConfigCacheExpiration = 10 * time.Minute
+
 func NewJobGoroutine(plugin string, scrapeConfig *ScrapeConfig) *JobGoroutine {
 	return &JobGoroutine{
 		plugin:       plugin,
 		quitChan:     make(chan struct{}),
 		scrapeConfig: scrapeConfig,
+		semaphore:    make(chan struct{}, scrapeConfig.ScrapeConcurrency),
 	}
 }
 
@@ -49,6 +92,10 @@ func (j *JobGoroutine) UpdateConfig(scrapeConfig *ScrapeConfig) {
 	j.Lock()
 	defer j.Unlock()
 	j.scrapeConfig = scrapeConfig
+	if cap(j.semaphore) != scrapeConfig.ScrapeConcurrency {
+		// 正在抓取的 target 还会把槽位还给老的 channel，不受影响
+		j.semaphore = make(chan struct{}, scrapeConfig.ScrapeConcurrency)
+	}
 }
 
 func (j *JobGoroutine) GetInterval() time.Duration {
@@ -57,6 +104,30 @@ func (j *JobGoroutine) GetInterval() time.Duration {
 	return j.scrapeConfig.ScrapeInterval.Duration()
 }
 
+func (j *JobGoroutine) GetTimeout() time.Duration {
+	j.RLock()
+	defer j.RUnlock()
+	return j.scrapeConfig.ScrapeTimeout.Duration()
+}
+
+func (j *JobGoroutine) GetHonorTimestamps() bool {
+	j.RLock()
+	defer j.RUnlock()
+	return j.scrapeConfig.HonorTimestamps == nil || *j.scrapeConfig.HonorTimestamps
+}
+
+func (j *JobGoroutine) GetNoStaleMarkers() bool {
+	j.RLock()
+	defer j.RUnlock()
+	return j.scrapeConfig.NoStaleMarkers != nil && *j.scrapeConfig.NoStaleMarkers
+}
+
+func (j *JobGoroutine) GetSessionIdleTimeout() time.Duration {
+	j.RLock()
+	defer j.RUnlock()
+	return j.scrapeConfig.SessionIdleTimeout.Duration()
+}
+
 func (j *JobGoroutine) GetJobName() string {
 	j.RLock()
 	defer j.RUnlock()
@@ -69,61 +140,117 @@ func (j *JobGoroutine) GetRuleFiles() []string {
 	return j.scrapeConfig.ScrapeRuleFiles
 }
 
+// Start 按照 scrape_interval 周期性的做服务发现和 relabel，每个 target 启动一个单独的抓取循环，
+// target 消失了就停掉它的抓取循环，job 被删除的时候停掉所有的抓取循环
 func (j *JobGoroutine) Start(ctx context.Context) {
+	// key 是 relabel 之后的 labels，只在当前 goroutine 里读写，不用加锁
+	loops := make(map[string]*scrapeLoop)
+
 	timer := time.NewTimer(0)
 	defer timer.Stop()
 
-	var start time.Time
 	for {
 		select {
 		case <-timer.C:
-			start = time.Now()
-			j.run(ctx)
-			next := j.GetInterval() - time.Since(start)
-			if next < 0 {
-				next = 0
-			}
-			timer.Reset(next)
+			j.syncTargets(ctx, loops)
+			timer.Reset(j.GetInterval())
 		case <-j.quitChan:
+			j.discovery.stop()
+			targets := stopScrapeLoops(loops)
+			// job 被删除了，之前发送过的 series 都要发送 stale markers
+			if !j.GetNoStaleMarkers() {
+				sendStaleMarkers(targets)
+			}
 			return
 		case <-ctx.Done():
+			j.discovery.stop()
+			stopScrapeLoops(loops)
 			return
 		}
 	}
 }
 
-// 拿到这个 job 相关的 targets + relabel + scrape_rules，按照并发度创建 goroutine 拉取数据
-// 不同的 job 其 targets 获取方式和列表可能是类似的，scrape_rules 也可能是一样的，所以这里可以缓存，缓存时间可以短一点，比如 5s
-// targets 可能很多，要做一下并发度控制，并发度可以在 job 粒度自定义，每个 yaml 的 global 部分也可以有一个全局的并发度配置
-// 通过 wait group 等待所有的 goroutine 抓取完毕，统一做 metric_relabel_configs，然后发送给 writer
-func (j *JobGoroutine) run(ctx context.Context) {
+// syncTargets 拿到这个 job 相关的 targets，统一做 relabel，给新出现的 target 启动抓取循环，停掉已经消失的 target 的抓取循环
+// 不同的 job 其 targets 获取方式和列表可能是类似的，scrape_rules 也可能是一样的，所以 rule 文件做了缓存，缓存时间可以短一点，比如 5s
+func (j *JobGoroutine) syncTargets(ctx context.Context, loops map[string]*scrapeLoop) {
 	jobName := j.GetJobName()
 
-	// rule 文件都是 toml 格式，可以直接拼在一起，用户要自己保证正确性
-	// json 和 yaml 格式的文件，很难直接拼在一起，所以 rule 选择 toml 格式
-	ruleFiles := j.GetRuleFiles()
-	// if len(ruleFiles) == 0 {
-	// 	logger.Errorf("job(%s) has no rule files", jobName)
-	// 	return
-	// }
+	// 拿到这个 job 相关的 targets
+	targets := j.getTargets(ctx)
+	select {
+	case <-ctx.Done():
+		return
+	case <-j.quitChan:
+		// 等服务发现的时候 job 被停掉了，targets 不完整，不能据此停掉抓取循环
+		return
+	default:
+	}
+	metrics.GetOrCreateCounter(fmt.Sprintf(`cprobe_targets_discovered{job=%q,plugin=%q}`, jobName, j.plugin)).Set(uint64(len(targets)))
+
+	activeTargets, droppedTargets := j.relabelTargets(jobName, targets)
+	j.setTargets(activeTargets, droppedTargets)
+
+	// 停掉已经消失的 target 的抓取循环，要等抓取循环退出之后再发送 stale markers，否则 stale markers 后面可能又跟着一次抓取的数据
+	var vanished []*scrapeLoop
+	for key, loop := range loops {
+		if _, has := activeTargets[key]; !has {
+			vanished = append(vanished, loop)
+			delete(loops, key)
+		}
+	}
+	if len(vanished) > 0 {
+		noStaleMarkers := j.GetNoStaleMarkers()
+		go func() {
+			targets := make([]*targetStatus, 0, len(vanished))
+			for _, loop := range vanished {
+				loop.stop()
+				targets = append(targets, loop.ts)
+			}
+			if !noStaleMarkers {
+				sendStaleMarkers(targets)
+			}
+		}()
+	}
 
+	// 新出现的 target 启动抓取循环
+	for key, ts := range activeTargets {
+		if _, has := loops[key]; has {
+			continue
+		}
+		loop := newScrapeLoop(j, key, ts)
+		loops[key] = loop
+		go loop.run(ctx)
+	}
+}
+
+// readRuleFiles 读取并拼接 rule 文件，一般是 job 的 scrape_rule_files，target 设置了 __param_rule_files 的话就是这个 target 自己的 rule 文件
+// rule 文件都是 toml 格式，可以直接拼在一起，用户要自己保证正确性
+// json 和 yaml 格式的文件，很难直接拼在一起，所以 rule 选择 toml 格式
+func readRuleFiles(baseDir string, ruleFiles []string) ([]byte, error) {
 	var bytesBuffer bytes.Buffer
-	var err error
 	for _, ruleFile := range ruleFiles {
-		ruleFilePath := fs.GetFilepath(j.scrapeConfig.ConfigRef.BaseDir, ruleFile)
+		ruleFilePath := fs.GetFilepath(baseDir, ruleFile)
 
 		data := CacheGetBytes(ruleFilePath)
-		if data == nil {
+		if data != nil {
+			ruleFileCacheHits.Inc()
+		} else {
+			ruleFileCacheMisses.Inc()
+			var err error
 			data, err = fs.ReadFileOrHTTP(ruleFilePath)
 			if err != nil {
-				logger.Errorf("job(%s) read rule file(%s) error: %s", jobName, ruleFile, err)
-				return
+				return nil, fmt.Errorf("read rule file(%s) error: %w", ruleFile, err)
 			}
 
-			data, err = envtemplate.ReplaceBytes(data)
+			// 只有 conf.d 下面运维自己写的本地 rule 文件才展开 %{file:...} 这类密钥占位符，
+			// 通过 HTTP 拉取的或者 conf.d 之外的 rule 文件只展开环境变量，避免被人利用读取任意文件、执行任意命令
+			if isLocalConfigFile(baseDir, ruleFilePath) {
+				data, err = envtemplate.ReplaceBytes(data)
+			} else {
+				data, err = envtemplate.ReplaceEnvBytes(data)
+			}
 			if err != nil {
-				logger.Errorf("job(%s) replace env in rule file(%s) error: %s", jobName, ruleFile, err)
-				return
+				return nil, fmt.Errorf("replace env in rule file(%s) error: %w", ruleFile, err)
 			}
 
 			CacheSetBytes(ruleFilePath, data, time.Second*5)
@@ -134,144 +261,421 @@ func (j *JobGoroutine) run(ctx context.Context) {
 		bytesBuffer.Write([]byte("\n"))
 	}
 
-	tomlBytes := bytesBuffer.Bytes()
+	return bytesBuffer.Bytes(), nil
+}
+
+// checkTargetRuleFiles 检查 target 通过 __param_rule_files 指定的 rule 文件
+//
+// 这个 label 可以来自服务发现，不能完全信任，所以只允许插件目录 baseDir 下面的相对路径，
+// 不允许绝对路径、.. 和 http(s) 地址，否则被人控制了服务发现，就可以让 cprobe 读取任意文件当作插件配置
+func checkTargetRuleFiles(baseDir string, ruleFiles []string) error {
+	for _, ruleFile := range ruleFiles {
+		if _, err := plugins.ParamFilepath(baseDir, plugins.ParamRuleFiles, ruleFile); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isLocalConfigFile 判断 path 是不是 conf.d 下面的本地文件，baseDir 是插件目录，也就是 conf.d/<plugin>
+func isLocalConfigFile(baseDir, path string) bool {
+	if fs.IsHTTPURL(path) {
+		return false
+	}
+	return isUnderDir(filepath.Dir(baseDir), path)
+}
+
+// isUnderDir 判断 path 清理掉 .. 之后是否还在 dir 下面
+func isUnderDir(dir, path string) bool {
+	rel, err := filepath.Rel(filepath.Clean(dir), filepath.Clean(path))
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel)
+}
+
+// parsePluginConfig 返回这次抓取要用的插件配置
+//
+// 插件配置实现了 plugins.Cloner 或 plugins.Immutable（或者是 nil）的话，同样的 rule 文件内容只解析一次，
+// Cloner 每次抓取拿到的是一份拷贝，Immutable 所有 target 共用同一份；
+// 其他插件还是每个 target 每次抓取都 ParseConfig，插件里可以放心大胆的更新 config，不用担心并发安全问题
+func (j *JobGoroutine) parsePluginConfig(plugin plugins.Plugin, h uint64, baseDir string, tomlBytes []byte) (any, error) {
+	now := time.Now()
+
+	j.pluginConfigsLock.Lock()
+	cached, ok := j.pluginConfigs[h]
+	if ok {
+		cached.lastUsed = now
+	}
+	j.pluginConfigsLock.Unlock()
+	if ok {
+		pluginConfigCacheHits.Inc()
+		return sharePluginConfig(cached.config), nil
+	}
+
+	pluginConfigCacheMisses.Inc()
+	config, err := plugin.ParseConfig(baseDir, tomlBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	switch config.(type) {
+	case nil, plugins.Cloner, plugins.Immutable:
+	default:
+		return config, nil
+	}
+
+	j.pluginConfigsLock.Lock()
+	for k, cached := range j.pluginConfigs {
+		if now.Sub(cached.lastUsed) > pluginConfigCacheExpiration {
+			delete(j.pluginConfigs, k)
+		}
+	}
+	if j.pluginConfigs == nil {
+		j.pluginConfigs = make(map[uint64]*cachedPluginConfig)
+	}
+	j.pluginConfigs[h] = &cachedPluginConfig{config: config, lastUsed: now}
+	j.pluginConfigsLock.Unlock()
+
+	return sharePluginConfig(config), nil
+}
+
+// pluginConfigHash 返回插件配置的 hash，插件配置是由 baseDir 和 rule 文件内容决定的
+func pluginConfigHash(baseDir string, tomlBytes []byte) uint64 {
+	d := xxhash.New()
+	_, _ = d.WriteString(baseDir)
+	_, _ = d.Write([]byte{0})
+	_, _ = d.Write(tomlBytes)
+	return d.Sum64()
+}
+
+func sharePluginConfig(config any) any {
+	if c, ok := config.(plugins.Cloner); ok {
+		return c.Clone()
+	}
+	return config
+}
+
+// scrapeTarget 抓取一次 target，然后发送给 writer
+func (j *JobGoroutine) scrapeTarget(ctx context.Context, ts *targetStatus) {
+	j.RLock()
+	sc := j.scrapeConfig
+	semaphore := j.semaphore
+	j.RUnlock()
+
+	// 上一次超时被放弃的抓取还没返回（插件不理会 ctx），这一轮就跳过，免得同一个 target 的抓取 goroutine 越堆越多
+	if ts.runningAbandonedScrape() != nil {
+		scrapesSkipped.Inc()
+		logger.Warnf("job(%s) skip scraping target %s, because the previous scrape is still running", sc.JobName, ts.labels.Get("__address__"))
+		return
+	}
+
+	// 控制并发度的 channel，大量的 target 并发抓取的话可能会有问题，比如 icmp 的抓取，一次性启动太多，会导致 icmp 的抓取超时
+	select {
+	case semaphore <- struct{}{}:
+	case <-ctx.Done():
+		return
+	}
+	defer func() {
+		// 抓取超时被放弃的话，抓取 goroutine 真正返回之后才归还槽位，scrape_concurrency 才能真正限制住并发
+		if done := ts.runningAbandonedScrape(); done != nil {
+			go func() {
+				<-done
+				<-semaphore
+			}()
+			return
+		}
+		<-semaphore
+	}()
+
+	ret, now, err := j.scrape(ctx, sc, ts)
+	if err != nil {
+		return
+	}
+
+	// 上一轮有、这一轮没有的 series（包括抓取失败的情况）发送 stale markers
+	if sc.NoStaleMarkers != nil && *sc.NoStaleMarkers {
+		ts.resetSentSeries()
+	} else {
+		ret = append(ret, ts.staleMarkers(ret, now.UnixMilli())...)
+	}
+
+	writer.WriteTimeSeries(ret)
+}
+
+// scrape 抓取一次 target，把数据做格式转换和 metric relabel，返回最终的 series 和抓取时间
+// 插件或者 rule 文件有问题的时候返回 error，这时候没有任何数据；抓取失败不算 error，体现在 cprobe_up 等指标里
+func (j *JobGoroutine) scrape(ctx context.Context, sc *ScrapeConfig, ts *targetStatus) ([]prompbmarshal.TimeSeries, time.Time, error) {
+	jobName := sc.JobName
 
 	plugin, has := plugins.GetPlugin(j.plugin)
 	if !has {
-		logger.Errorf("job(%s) unknown plugin: %s", jobName, j.plugin)
-		return
+		err := fmt.Errorf("unknown plugin: %s", j.plugin)
+		logger.Errorf("job(%s) %s", jobName, err)
+		return nil, time.Time{}, err
 	}
 
-	// 等待所有 target 抓取完毕的 wait group
-	var wg sync.WaitGroup
+	if err := initPlugin(j.plugin, plugin); err != nil {
+		logger.Errorf("job(%s) cannot init plugin %s: %s", jobName, j.plugin, err)
+		err = fmt.Errorf("cannot init plugin: %w", err)
+		ts.update(time.Now(), 0, 0, err)
+		return nil, time.Time{}, err
+	}
 
-	// 控制并发度的 channel，大量的 target 并发抓取的话可能会有问题，比如 icmp 的抓取，一次性启动太多，会导致 icmp 的抓取超时
-	var se = make(chan struct{}, j.scrapeConfig.ScrapeConcurrency)
+	ruleFiles := sc.ScrapeRuleFiles
+	if len(ts.ruleFiles) > 0 {
+		if err := checkTargetRuleFiles(sc.ConfigRef.BaseDir, ts.ruleFiles); err != nil {
+			logger.Errorf("job(%s) target(%s) %s", jobName, ts.labels.Get("__address__"), err)
+			ts.update(time.Now(), 0, 0, err)
+			return nil, time.Time{}, err
+		}
+		ruleFiles = ts.ruleFiles
+	}
+	tomlBytes, err := readRuleFiles(sc.ConfigRef.BaseDir, ruleFiles)
+	if err != nil {
+		logger.Errorf("job(%s) %s", jobName, err)
+		ts.update(time.Now(), 0, 0, err)
+		return nil, time.Time{}, err
+	}
 
-	// 拿到这个 job 相关的 targets
-	targets := j.getTargets()
+	// 是否保留插件上报的样本时间
+	honorTimestamps := sc.HonorTimestamps == nil || *sc.HonorTimestamps
 
-	// 每个 target 分别去抓取数据，注意要控制并发度
-	for _, target := range targets {
-		parsedTarget := j.parseTarget(jobName, target)
-		if parsedTarget == nil {
-			continue
+	// 每个 target 的抓取时长上限，超时之后直接放弃，避免某个 hang 住的 target 长期占用并发槽位
+	timeout := sc.ScrapeTimeout.Duration()
+
+	pt := ts.labels
+	targetAddress := pt.Get("__address__")
+
+	configHash := pluginConfigHash(sc.ConfigRef.BaseDir, tomlBytes)
+	config, err := j.parsePluginConfig(plugin, configHash, sc.ConfigRef.BaseDir, tomlBytes)
+	if err != nil {
+		logger.Errorf("job(%s) parse plugin config error: %s", jobName, err)
+		err = fmt.Errorf("cannot parse plugin config: %w", err)
+		ts.update(time.Now(), 0, 0, err)
+		return nil, time.Time{}, err
+	}
+
+	scrapeFunc := func(ctx context.Context, ss *types.Samples) error {
+		return plugin.Scrape(ctx, targetAddress, config, ts.params, ss)
+	}
+	if sp, ok := plugin.(plugins.SessionPlugin); ok {
+		// 复用这个 target 上次抓取的连接
+		idleTimeout := sc.SessionIdleTimeout.Duration()
+		scrapeFunc = func(ctx context.Context, ss *types.Samples) error {
+			session, err := ts.session.acquire(ctx, sp, targetAddress, config, ts.params, configHash, idleTimeout)
+			if err != nil {
+				return err
+			}
+			err = sp.ScrapeSession(ctx, session, ss)
+			ts.session.release(session, configHash, err)
+			return err
 		}
+	}
 
-		se <- struct{}{}
-		wg.Add(1)
-		go func(pt *promutils.Labels) {
-			defer func() {
-				<-se
-				wg.Done()
-			}()
+	now := time.Now()
+	ss, abandoned, err := scrapeWithTimeout(ctx, scrapeFunc, timeout)
+	if abandoned != nil {
+		ts.setAbandonedScrape(abandoned)
+	}
 
-			targetAddress := pt.Get("__address__")
+	duration := time.Since(now)
+	metrics.GetOrCreateHistogram(fmt.Sprintf(`cprobe_scrape_duration_seconds{job=%q,plugin=%q}`, jobName, j.plugin)).Update(duration.Seconds())
 
-			// 准备一个并发安全的容器，传给 Scrape 方法，Scrape 方法会把抓取到的数据放进去，外层还要做 relabel 然后最终发给 writer
-			ss := types.NewSamples()
+	// 把抓取到的数据做格式转换，转换成 []prompbmarshal.TimeSeries
+	ret := toTimeSeries(ss.PopBackAll(), pt, sc, now, honorTimestamps)
 
-			// 每个 target 分别 ParseConfig，对性能有一丢丢影响，好处是插件里就可以放心大胆的更新 config 了，不用担心并发安全问题
-			// 后面再看看是否有更好的提升性能的办法
-			config, err := plugin.ParseConfig(j.scrapeConfig.ConfigRef.BaseDir, tomlBytes)
+	// metric relabel 之后的样本数超过 sample_limit，这次抓取就算失败，数据全部丢弃，避免把 TSDB 打爆
+	if err == nil && sc.SampleLimit > 0 && len(ret) > sc.SampleLimit {
+		metrics.GetOrCreateCounter(fmt.Sprintf(`cprobe_samples_dropped_total{job=%q,plugin=%q,reason="sample_limit"}`, jobName, j.plugin)).Add(len(ret))
+		err = fmt.Errorf("the number of samples %d after metric relabeling exceeds sample_limit %d", len(ret), sc.SampleLimit)
+		ret = nil
+	}
+	if err != nil {
+		logger.Errorf("failed to scrape. job: %s, plugin: %s, target: %s, error: %s", jobName, j.plugin, targetAddress, err)
+	}
+
+	// 超过 series_limit 的新 series 直接丢弃，已经见过的 series 不受影响
+	if sc.SeriesLimit > 0 {
+		var dropped int
+		ret, dropped = ts.applySeriesLimit(ret, sc.SeriesLimit, sc.SeriesLimitInterval.Duration())
+		if dropped > 0 {
+			metrics.GetOrCreateCounter(fmt.Sprintf(`cprobe_series_dropped_total{job=%q,plugin=%q,reason="series_limit"}`, jobName, j.plugin)).Add(dropped)
+		}
+	} else {
+		ts.stopSeriesLimiter()
+	}
+
+	// 下面这几个抓取状态相关的指标不受 sample_limit 和 series_limit 的限制
+	ss.AddMetric(j.plugin, map[string]interface{}{"cprobe_duration_seconds": duration.Seconds()})
+
+	if err != nil {
+		ss.AddMetric(j.plugin, map[string]interface{}{"cprobe_up": 0.0})
+		ss.AddMetric(j.plugin, map[string]interface{}{"cprobe_error": 1.0}, map[string]string{"error": err.Error()})
+		ss.AddMetric(j.plugin, map[string]interface{}{"cprobe_timestamp": now.Unix() * -1}) // negative timestamp means error
+	} else {
+		ss.AddMetric(j.plugin, map[string]interface{}{"cprobe_up": 1.0})
+		ss.AddMetric(j.plugin, map[string]interface{}{"cprobe_error": 0.0}, map[string]string{"error": ""})
+		ss.AddMetric(j.plugin, map[string]interface{}{"cprobe_timestamp": now.Unix()})
+	}
+	ret = append(ret, toTimeSeries(ss.PopBackAll(), pt, sc, now, honorTimestamps)...)
+
+	ts.update(now, duration, len(ret), err)
+	if flags.PullMode {
+		ts.setSeries(ret)
+	}
+
+	return ret, now, nil
+}
+
+// toTimeSeries 把插件抓取到的数据转换成 []prompbmarshal.TimeSeries，并做 metric relabel
+func toTimeSeries(ms []metric.Metric, pt *promutils.Labels, sc *ScrapeConfig, now time.Time, honorTimestamps bool) []prompbmarshal.TimeSeries {
+	// 最终转换之后的数据结果集
+	var ret []prompbmarshal.TimeSeries
+
+	// now := int64(fasttime.UnixTimestamp() * 1000) // s -> ms
+	for i := range ms {
+		// 统一在这里设置时间，插件自己设置了时间的话，由 honor_timestamps 决定是否保留
+		if ms[i].Time() == 0 || !honorTimestamps {
+			ms[i].SetTime(now.UnixMilli())
+		}
+
+		// 一个 telegraf metric 有多个 fields，每个 field 都是一个 prometheus metric
+		tags := ms[i].Tags()
+		fields := ms[i].Fields()
+
+		for k, v := range fields {
+			float64v, err := conv.ToFloat64(v)
 			if err != nil {
-				logger.Errorf("job(%s) parse plugin config error: %s", jobName, err)
-				return
+				invalidValueSeriesDropped.Inc()
+				continue
 			}
 
-			now := time.Now()
-			if err = plugin.Scrape(ctx, targetAddress, config, ss); err != nil {
-				logger.Errorf("failed to scrape. job: %s, plugin: %s, target: %s, error: %s", jobName, j.plugin, targetAddress, err)
+			item := promutils.NewLabels(len(tags) + pt.Len())
+
+			for _, lb := range pt.GetLabels() {
+				if lb.Name == "__address__" {
+					continue
+				}
+				item.Add(lb.Name, lb.Value)
 			}
 
-			ss.AddMetric(j.plugin, map[string]interface{}{"cprobe_duration_seconds": time.Since(now).Seconds()})
+			for tagk, tagv := range tags {
+				item.Add(tagk, tagv)
+			}
 
-			if err != nil {
-				ss.AddMetric(j.plugin, map[string]interface{}{"cprobe_up": 0.0})
-				ss.AddMetric(j.plugin, map[string]interface{}{"cprobe_error": 1.0}, map[string]string{"error": err.Error()})
-				ss.AddMetric(j.plugin, map[string]interface{}{"cprobe_timestamp": now.Unix() * -1}) // negative timestamp means error
+			if len(k) == 0 {
+				item.Add("__name__", ms[i].Name())
 			} else {
-				ss.AddMetric(j.plugin, map[string]interface{}{"cprobe_up": 1.0})
-				ss.AddMetric(j.plugin, map[string]interface{}{"cprobe_error": 0.0}, map[string]string{"error": ""})
-				ss.AddMetric(j.plugin, map[string]interface{}{"cprobe_timestamp": now.Unix()})
+				name := ms[i].Name()
+				if len(name) == 0 {
+					item.Add("__name__", k)
+				} else {
+					item.Add("__name__", name+"_"+k)
+				}
 			}
 
-			// 把抓取到的数据做格式转换，转换成 []prompbmarshal.TimeSeries
-			metrics := ss.PopBackAll()
+			item.RemoveDuplicates()
 
-			// 最终转换之后的数据结果集
-			var ret []prompbmarshal.TimeSeries
+			// metric relabel
+			item.Labels = sc.ParsedMetricRelabelConfigs.Apply(item.Labels, 0)
+			item.RemoveMetaLabels()
+			if item.Len() == 0 {
+				// metric_relabel_configs 把所有的 labels 都干掉了，说明这条数据不要了
+				metricRelabelSeriesDropped.Inc()
+				continue
+			}
 
-			// now := int64(fasttime.UnixTimestamp() * 1000) // s -> ms
-			for i := range metrics {
-				// 统一在这里设置时间
-				if metrics[i].Time() == 0 {
-					metrics[i].SetTime(now.UnixMilli())
-				}
+			point := prompbmarshal.Sample{
+				Value:     float64v,
+				Timestamp: ms[i].Time(),
+			}
 
-				// 一个 telegraf metric 有多个 fields，每个 field 都是一个 prometheus metric
-				tags := metrics[i].Tags()
-				fields := metrics[i].Fields()
-
-				for k, v := range fields {
-					float64v, err := conv.ToFloat64(v)
-					if err != nil {
-						continue
-					}
-
-					item := promutils.NewLabels(len(tags) + pt.Len())
-
-					for _, lb := range pt.GetLabels() {
-						if lb.Name == "__address__" {
-							continue
-						}
-						item.Add(lb.Name, lb.Value)
-					}
-
-					for tagk, tagv := range tags {
-						item.Add(tagk, tagv)
-					}
-
-					if len(k) == 0 {
-						item.Add("__name__", metrics[i].Name())
-					} else {
-						name := metrics[i].Name()
-						if len(name) == 0 {
-							item.Add("__name__", k)
-						} else {
-							item.Add("__name__", name+"_"+k)
-						}
-					}
-
-					item.RemoveDuplicates()
-
-					// metric relabel
-					item.Labels = j.scrapeConfig.ParsedMetricRelabelConfigs.Apply(item.Labels, 0)
-					item.RemoveMetaLabels()
-
-					point := prompbmarshal.Sample{
-						Value:     float64v,
-						Timestamp: now.UnixMilli(),
-					}
-
-					ts := prompbmarshal.TimeSeries{
-						Labels:  item.Labels,
-						Samples: []prompbmarshal.Sample{point},
-					}
-
-					ret = append(ret, ts)
-				}
+			ts := prompbmarshal.TimeSeries{
+				Labels:  item.Labels,
+				Samples: []prompbmarshal.Sample{point},
 			}
 
-			writer.WriteTimeSeries(ret)
+			ret = append(ret, ts)
+		}
+	}
+
+	return ret
+}
+
+// scrapeWithTimeout 给每个 target 的抓取设置 deadline，返回抓取到的数据
+// 有些插件不理会 ctx（比如 consul、memcached、kafka），所以 Scrape 放到单独的 goroutine 里执行，
+// deadline 到了就直接放弃，不再等它返回，它后续写入的数据也会被丢弃。
+// 放弃的时候返回一个 channel，抓取 goroutine 真正返回的时候会被 close，调用方据此归还并发槽位
+func scrapeWithTimeout(ctx context.Context, scrape func(ctx context.Context, ss *types.Samples) error, timeout time.Duration) (*types.Samples, <-chan struct{}, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	// 准备一个并发安全的容器，传给 Scrape 方法，Scrape 方法会把抓取到的数据放进去，外层还要做 relabel 然后最终发给 writer
+	ss := types.NewSamples()
+
+	errCh := make(chan error, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		errCh <- scrape(ctx, ss)
+	}()
+
+	var abandoned <-chan struct{}
+	select {
+	case err := <-errCh:
+		if err == nil || ctx.Err() != context.DeadlineExceeded {
+			return ss, nil, err
+		}
+	case <-ctx.Done():
+		select {
+		case <-done:
+		default:
+			scrapesAbandoned.Inc()
+			abandoned = done
+		}
+	}
 
-		}(parsedTarget)
+	if ctx.Err() == context.DeadlineExceeded {
+		// 超时的 target 已经抓到的部分数据不可信，直接丢弃
+		return types.NewSamples(), abandoned, fmt.Errorf("%w: %s", errScrapeTimeout, timeout)
 	}
 
-	wg.Wait()
+	return types.NewSamples(), abandoned, ctx.Err()
+}
+
+// relabelTargets 统一对 targets 做 relabel，返回每个 target 的状态，key 是 relabel 之后的 labels 加上插件参数。
+// 被 relabel 丢弃的 target 也要记录，方便排查
+//
+// 相同 labels 和插件参数的 target 只抓取一次。比如 static_configs 配置了多个 paths，同一个地址会有多份只是 __meta_cmdb_* 不同的 targets，
+// relabel 没有把 __meta_cmdb_* 复制到普通 label 上的话，它们在这里合并成一个 target
+func (j *JobGoroutine) relabelTargets(jobName string, targets []*promutils.Labels) (map[string]*targetStatus, []*promutils.Labels) {
+	activeTargets := make(map[string]*targetStatus, len(targets))
+	var droppedTargets []*promutils.Labels
+	for _, target := range targets {
+		discoveredLabels := promutils.NewLabels(1 + target.Len())
+		discoveredLabels.Add("job", jobName)
+		discoveredLabels.AddFrom(target)
+		discoveredLabels.RemoveDuplicates()
+
+		parsedTarget, params := j.parseTarget(jobName, target)
+		if parsedTarget == nil {
+			droppedTargets = append(droppedTargets, discoveredLabels)
+			continue
+		}
+
+		key := parsedTarget.String() + params.String()
+		if _, has := activeTargets[key]; has {
+			continue
+		}
+
+		activeTargets[key] = j.getTargetStatus(key, discoveredLabels, parsedTarget, params)
+	}
+	return activeTargets, droppedTargets
 }
 
-func (j *JobGoroutine) parseTarget(job string, target *promutils.Labels) *promutils.Labels {
+// parseTarget 对 target 做 relabel，返回 relabel 之后的 labels 和 __param_* labels 里的插件参数，target 被丢弃的话返回 nil
+func (j *JobGoroutine) parseTarget(job string, target *promutils.Labels) (*promutils.Labels, plugins.Params) {
 	labels := promutils.GetLabels()
 	defer promutils.PutLabels(labels)
 
@@ -292,24 +696,53 @@ func (j *JobGoroutine) parseTarget(job string, target *promutils.Labels) *promut
 
 	labels.RemoveDuplicates()
 	labels.Labels = j.scrapeConfig.ParsedRelabelConfigs.Apply(labels.Labels, 0)
+	params := popParams(labels)
 	labels.RemoveMetaLabels()
 
 	if labels.Len() == 0 {
-		return nil
+		return nil, nil
 	}
 
 	if labels.Get("__address__") == "" {
-		return nil
+		return nil, nil
 	}
 
 	labelsCopy := labels.Clone()
 	labelsCopy.Sort()
 
-	return labelsCopy
+	return labelsCopy, params
+}
+
+// popParams 从 relabel 之后的 labels 里取出并删掉 __param_* labels，作为插件参数，值为空的 label 忽略
+// 这些 label 里可能有密码之类的信息，不能出现在监控数据里
+func popParams(labels *promutils.Labels) plugins.Params {
+	var params plugins.Params
+	dst := labels.Labels[:0]
+	for _, label := range labels.Labels {
+		if !strings.HasPrefix(label.Name, plugins.ParamLabelPrefix) {
+			dst = append(dst, label)
+			continue
+		}
+		if label.Value == "" {
+			continue
+		}
+		if params == nil {
+			params = make(plugins.Params)
+		}
+		params[label.Name[len(plugins.ParamLabelPrefix):]] = label.Value
+	}
+	labels.Labels = dst
+	return params
 }
 
 func (j *JobGoroutine) Stop() {
 	close(j.quitChan)
+
+	jobName := j.GetJobName()
+	metrics.UnregisterMetric(fmt.Sprintf(`cprobe_targets_discovered{job=%q,plugin=%q}`, jobName, j.plugin))
+	metrics.UnregisterMetric(fmt.Sprintf(`cprobe_scrape_duration_seconds{job=%q,plugin=%q}`, jobName, j.plugin))
+	metrics.UnregisterMetric(fmt.Sprintf(`cprobe_samples_dropped_total{job=%q,plugin=%q,reason="sample_limit"}`, jobName, j.plugin))
+	metrics.UnregisterMetric(fmt.Sprintf(`cprobe_series_dropped_total{job=%q,plugin=%q,reason="series_limit"}`, jobName, j.plugin))
 }
 
 func loadStaticConfigs(path string) ([]StaticConfig, error) {
@@ -317,7 +750,8 @@ func loadStaticConfigs(path string) ([]StaticConfig, error) {
 	if err != nil {
 		return nil, fmt.Errorf("cannot read `static_configs` from %q: %w", path, err)
 	}
-	data, err = envtemplate.ReplaceBytes(data)
+	// file_sd 的文件是服务发现提供的内容，不展开密钥占位符
+	data, err = envtemplate.ReplaceEnvBytes(data)
 	if err != nil {
 		return nil, fmt.Errorf("cannot expand environment vars in %q: %w", path, err)
 	}
@@ -328,162 +762,17 @@ func loadStaticConfigs(path string) ([]StaticConfig, error) {
 	return stcs, nil
 }
 
-func (j *JobGoroutine) getTargets() (targets []*promutils.Labels) {
-	baseDir := j.scrapeConfig.ConfigRef.BaseDir
-
-	for _, c := range j.scrapeConfig.StaticConfigs {
-		for _, t := range c.Targets {
-			m := promutils.NewLabels(1 + c.Labels.Len())
-			m.AddFrom(c.Labels)
-			m.Add("__address__", t)
-			m.RemoveDuplicates()
-			targets = append(targets, m)
-		}
-	}
-
-	for _, c := range j.scrapeConfig.FileSDConfigs {
-		for _, file := range c.Files {
-			pathPattern := fs.GetFilepath(baseDir, file)
-			paths := []string{pathPattern}
-			if strings.Contains(pathPattern, "*") {
-				var err error
-				paths, err = filepath.Glob(pathPattern)
-				if err != nil {
-					// Do not return this error, since other files may contain valid scrape configs.
-					logger.Errorf("skipping entry %q in `file_sd_config->files` for job_name=%s because of error: %s", file, j.scrapeConfig.JobName, err)
-					continue
-				}
-			}
-			for _, path := range paths {
-				stcs, err := loadStaticConfigs(path)
-				if err != nil {
-					// Do not return this error, since other paths may contain valid scrape configs.
-					logger.Errorf("skipping file %s for job_name=%s at `file_sd_configs` because of error: %s", path, j.scrapeConfig.JobName, err)
-					continue
-				}
-
-				pathShort := path
-				if strings.HasPrefix(pathShort, baseDir) {
-					pathShort = path[len(baseDir):]
-					if len(pathShort) > 0 && pathShort[0] == filepath.Separator {
-						pathShort = pathShort[1:]
-					}
-				}
-
-				for _, stc := range stcs {
-					for _, t := range stc.Targets {
-						m := promutils.NewLabels(2 + stc.Labels.Len())
-						m.AddFrom(stc.Labels)
-						m.Add("__address__", t)
-						m.Add("__meta_filepath", pathShort)
-						m.RemoveDuplicates()
-						targets = append(targets, m)
-					}
-				}
-			}
-		}
-	}
-
-	for _, c := range j.scrapeConfig.HTTPSDConfigs {
-		arr, err := c.GetLabels(baseDir)
-		if err != nil {
-			logger.Errorf("job(%s) http_sd_configs(%s) get targets error: %s", j.scrapeConfig.JobName, c.URL, err)
-			continue
-		}
-		targets = append(targets, arr...)
-	}
-
-	// TODO: 下面的代码是 copilot 自动生成的，尚未验证过，对于 cprobe 而言，核心就是 static、file_sd、http_sd 基本就够用了
-
-	for _, c := range j.scrapeConfig.DNSSDConfigs {
-		arr, err := c.GetLabels(baseDir)
-		if err != nil {
-			logger.Errorf("job(%s) dns_sd_configs(%s) get targets error: %s", j.scrapeConfig.JobName, c.Names, err)
-			continue
-		}
-		targets = append(targets, arr...)
-	}
-
-	for _, c := range j.scrapeConfig.AzureSDConfigs {
-		arr, err := c.GetLabels(baseDir)
-		if err != nil {
-			logger.Errorf("job(%s) azure_sd_configs(%s) get targets error: %s", j.scrapeConfig.JobName, c.SubscriptionID, err)
-			continue
-		}
-		targets = append(targets, arr...)
-	}
-
-	for _, c := range j.scrapeConfig.DockerSDConfigs {
-		arr, err := c.GetLabels(baseDir)
-		if err != nil {
-			logger.Errorf("job(%s) docker_sd_configs(%s) get targets error: %s", j.scrapeConfig.JobName, c.Host, err)
-			continue
-		}
-		targets = append(targets, arr...)
-	}
-
-	for _, c := range j.scrapeConfig.DockerSwarmSDConfigs {
-		arr, err := c.GetLabels(baseDir)
-		if err != nil {
-			logger.Errorf("job(%s) dockerswarm_sd_configs(%s) get targets error: %s", j.scrapeConfig.JobName, c.Host, err)
-			continue
-		}
-		targets = append(targets, arr...)
-	}
-
-	for _, c := range j.scrapeConfig.EC2SDConfigs {
-		arr, err := c.GetLabels(baseDir)
-		if err != nil {
-			logger.Errorf("job(%s) ec2_sd_configs(%s) get targets error: %s", j.scrapeConfig.JobName, c.Region, err)
-			continue
-		}
-		targets = append(targets, arr...)
-	}
-
-	for _, c := range j.scrapeConfig.EurekaSDConfigs {
-		arr, err := c.GetLabels(baseDir)
-		if err != nil {
-			logger.Errorf("job(%s) eureka_sd_configs(%s) get targets error: %s", j.scrapeConfig.JobName, c.Server, err)
-			continue
-		}
-		targets = append(targets, arr...)
-	}
-
-	for _, c := range j.scrapeConfig.GCESDConfigs {
-		arr, err := c.GetLabels(baseDir)
-		if err != nil {
-			logger.Errorf("job(%s) gce_sd_configs(%s) get targets error: %s", j.scrapeConfig.JobName, c.Project, err)
-			continue
-		}
-		targets = append(targets, arr...)
-	}
-
-	for _, c := range j.scrapeConfig.DigitaloceanSDConfigs {
-		arr, err := c.GetLabels(baseDir)
-		if err != nil {
-			logger.Errorf("job(%s) digitalocean_sd_configs(%s:%d) get targets error: %s", j.scrapeConfig.JobName, c.Server, c.Port, err)
-			continue
-		}
-		targets = append(targets, arr...)
-	}
-
-	for _, c := range j.scrapeConfig.OpenStackSDConfigs {
-		arr, err := c.GetLabels(baseDir)
-		if err != nil {
-			logger.Errorf("job(%s) openstack_sd_configs(%s) get targets error: %s", j.scrapeConfig.JobName, c.IdentityEndpoint, err)
-			continue
-		}
-		targets = append(targets, arr...)
-	}
+// getTargets 返回 static_configs 里的 targets，以及其他服务发现在后台最近一次成功刷新的 targets
+//
+// ctx 结束或者 job 被停掉的时候返回的 targets 不完整，调用方要丢弃
+func (j *JobGoroutine) getTargets(ctx context.Context) (targets []*promutils.Labels) {
+	j.RLock()
+	sc := j.scrapeConfig
+	j.RUnlock()
 
-	for _, c := range j.scrapeConfig.YandexCloudSDConfigs {
-		arr, err := c.GetLabels(baseDir)
-		if err != nil {
-			logger.Errorf("job(%s) yandexcloud_sd_configs(%s) get targets error: %s", j.scrapeConfig.JobName, c.APIEndpoint, err)
-			continue
-		}
-		targets = append(targets, arr...)
+	for i := range sc.StaticConfigs {
+		targets = appendStaticTargets(targets, &sc.StaticConfigs[i], "")
 	}
 
-	return
+	return append(targets, j.discovery.getTargets(ctx, j.quitChan, sc.JobName, j.plugin, sc)...)
 }
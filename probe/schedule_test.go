@@ -0,0 +1,498 @@
+package probe
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cprobe/cprobe/lib/prompbmarshal"
+	"github.com/cprobe/cprobe/lib/promutils"
+	"github.com/cprobe/cprobe/plugins"
+	"github.com/cprobe/cprobe/types"
+	"github.com/cprobe/cprobe/types/metric"
+)
+
+func TestCheckTargetRuleFiles(t *testing.T) {
+	baseDir := filepath.Join(t.TempDir(), "conf.d", "mysql")
+
+	f := func(ruleFiles []string, ok bool) {
+		t.Helper()
+		err := checkTargetRuleFiles(baseDir, ruleFiles)
+		if ok && err != nil {
+			t.Fatalf("unexpected error for %q: %s", ruleFiles, err)
+		}
+		if !ok && err == nil {
+			t.Fatalf("expecting non-nil error for %q", ruleFiles)
+		}
+	}
+
+	f([]string{"rule.toml"}, true)
+	f([]string{"rule_head.toml", "rules/10.1.2.3.toml"}, true)
+	f([]string{"./rules/../rule.toml"}, false)
+
+	// absolute paths
+	f([]string{"/etc/passwd"}, false)
+	f([]string{"rule.toml", filepath.Join(baseDir, "rule.toml")}, false)
+
+	// parent dirs
+	f([]string{"../redis/rule.toml"}, false)
+	f([]string{"rules/../../redis/rule.toml"}, false)
+	f([]string{".."}, false)
+
+	// urls
+	f([]string{"http://attacker/rule.toml"}, false)
+	f([]string{"https://attacker/rule.toml"}, false)
+	f([]string{"file:///etc/passwd"}, false)
+}
+
+func TestIsLocalConfigFile(t *testing.T) {
+	confd := filepath.Join(t.TempDir(), "conf.d")
+	baseDir := filepath.Join(confd, "mysql")
+
+	f := func(path string, want bool) {
+		t.Helper()
+		if got := isLocalConfigFile(baseDir, path); got != want {
+			t.Fatalf("unexpected result for %q; got %v; want %v", path, got, want)
+		}
+	}
+
+	f(filepath.Join(baseDir, "rule.toml"), true)
+	f(filepath.Join(confd, "common", "rule.toml"), true)
+	f(filepath.Join(baseDir, "..", "..", "rule.toml"), false)
+	f("/etc/cprobe/rule.toml", false)
+	f("http://cmdb/rule.toml", false)
+}
+
+func TestScrapeWithTimeoutAbandoned(t *testing.T) {
+	// 插件不理会 ctx，超时之后还在运行
+	unblock := make(chan struct{})
+	scrape := func(ctx context.Context, ss *types.Samples) error {
+		<-unblock
+		return nil
+	}
+	ts := &targetStatus{}
+
+	_, abandoned, err := scrapeWithTimeout(context.Background(), scrape, 10*time.Millisecond)
+	if !errors.Is(err, errScrapeTimeout) {
+		t.Fatalf("unexpected error: %v; want %v", err, errScrapeTimeout)
+	}
+	if abandoned == nil {
+		t.Fatalf("expecting non-nil abandoned channel")
+	}
+	ts.setAbandonedScrape(abandoned)
+	if ts.runningAbandonedScrape() == nil {
+		t.Fatalf("expecting running abandoned scrape")
+	}
+
+	close(unblock)
+	select {
+	case <-abandoned:
+	case <-time.After(time.Second):
+		t.Fatalf("abandoned channel isn't closed after the scrape returned")
+	}
+	if ts.runningAbandonedScrape() != nil {
+		t.Fatalf("unexpected running abandoned scrape after the scrape returned")
+	}
+}
+
+func TestScrapeWithTimeoutSuccess(t *testing.T) {
+	scrape := func(ctx context.Context, ss *types.Samples) error {
+		return nil
+	}
+	_, abandoned, err := scrapeWithTimeout(context.Background(), scrape, time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if abandoned != nil {
+		t.Fatalf("unexpected abandoned channel for finished scrape")
+	}
+}
+
+func TestPopParams(t *testing.T) {
+	f := func(labels map[string]string, wantLabels map[string]string, wantParams plugins.Params) {
+		t.Helper()
+		x := promutils.NewLabelsFromMap(labels)
+		x.Sort()
+		params := popParams(x)
+		if !reflect.DeepEqual(params, wantParams) {
+			t.Fatalf("unexpected params; got %v; want %v", params, wantParams)
+		}
+		want := promutils.NewLabelsFromMap(wantLabels)
+		want.Sort()
+		if x.String() != want.String() {
+			t.Fatalf("unexpected labels; got %s; want %s", x, want)
+		}
+	}
+
+	// 没有 __param_* labels
+	f(map[string]string{}, map[string]string{}, nil)
+	f(map[string]string{
+		"__address__": "10.0.0.1:3306",
+		"job":         "mysql",
+	}, map[string]string{
+		"__address__": "10.0.0.1:3306",
+		"job":         "mysql",
+	}, nil)
+
+	// __param_* labels 变成插件参数，从 labels 里删掉
+	f(map[string]string{
+		"__address__":                       "10.0.0.1:3306",
+		"__param_user":                      "monitor",
+		"__param_password":                  "secret",
+		"__param_" + plugins.ParamRuleFiles: "rules/mysql.toml",
+		"job":                               "mysql",
+	}, map[string]string{
+		"__address__": "10.0.0.1:3306",
+		"job":         "mysql",
+	}, plugins.Params{
+		"user":                 "monitor",
+		"password":             "secret",
+		plugins.ParamRuleFiles: "rules/mysql.toml",
+	})
+
+	// 值为空的 __param_* label 等于没有设置，比如被 relabel 清空了
+	f(map[string]string{
+		"__address__":    "10.0.0.1:3306",
+		"__param_user":   "",
+		"__param_dbname": "orders",
+	}, map[string]string{
+		"__address__": "10.0.0.1:3306",
+	}, plugins.Params{
+		"dbname": "orders",
+	})
+	f(map[string]string{
+		"__address__":  "10.0.0.1:3306",
+		"__param_user": "",
+	}, map[string]string{
+		"__address__": "10.0.0.1:3306",
+	}, nil)
+
+	// 只有 __param_ 前缀的 labels 才是插件参数
+	f(map[string]string{
+		"__address__": "10.0.0.1:3306",
+		"param_user":  "monitor",
+		"__params":    "x",
+	}, map[string]string{
+		"__address__": "10.0.0.1:3306",
+		"param_user":  "monitor",
+		"__params":    "x",
+	}, nil)
+}
+
+// testPluginConfig 是可以修改的插件配置，Clone 返回一份拷贝
+type testPluginConfig struct {
+	rules []string
+}
+
+func (c *testPluginConfig) Clone() any {
+	return &testPluginConfig{rules: append([]string(nil), c.rules...)}
+}
+
+type testImmutablePluginConfig struct {
+	rules string
+}
+
+func (*testImmutablePluginConfig) Immutable() {}
+
+type testMutablePluginConfig struct {
+	rules string
+}
+
+// testPlugin 记录 ParseConfig 的调用次数，newConfig 决定返回哪种插件配置
+type testPlugin struct {
+	parses    int
+	newConfig func(bs []byte) any
+}
+
+func (p *testPlugin) ParseConfig(baseDir string, bs []byte) (any, error) {
+	p.parses++
+	return p.newConfig(bs), nil
+}
+
+func (p *testPlugin) Scrape(ctx context.Context, target string, cfg any, params plugins.Params, ss *types.Samples) error {
+	return nil
+}
+
+func TestParsePluginConfigCache(t *testing.T) {
+	f := func(newConfig func(bs []byte) any, wantParses int) {
+		t.Helper()
+		j := &JobGoroutine{}
+		p := &testPlugin{newConfig: newConfig}
+		rulesA := []byte("a")
+		rulesB := []byte("b")
+		hashA := pluginConfigHash("conf.d/test", rulesA)
+		hashB := pluginConfigHash("conf.d/test", rulesB)
+		if hashA == hashB {
+			t.Fatalf("config hash must depend on rule file contents")
+		}
+
+		// 同样的 rule 文件内容命中缓存，内容变了 hash 也变了，要重新解析
+		for _, bs := range [][]byte{rulesA, rulesA, rulesB, rulesB, rulesA} {
+			if _, err := j.parsePluginConfig(p, pluginConfigHash("conf.d/test", bs), "conf.d/test", bs); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+		}
+		if p.parses != wantParses {
+			t.Fatalf("unexpected number of ParseConfig calls; got %d; want %d", p.parses, wantParses)
+		}
+	}
+
+	// Immutable 和 Cloner 每份 rule 文件内容只解析一次
+	f(func(bs []byte) any { return &testImmutablePluginConfig{rules: string(bs)} }, 2)
+	f(func(bs []byte) any { return &testPluginConfig{rules: []string{string(bs)}} }, 2)
+	// 其他插件配置每次都要解析
+	f(func(bs []byte) any { return &testMutablePluginConfig{rules: string(bs)} }, 5)
+}
+
+func TestParsePluginConfigShare(t *testing.T) {
+	j := &JobGoroutine{}
+	bs := []byte("a")
+	h := pluginConfigHash("conf.d/test", bs)
+
+	// Immutable 的配置所有 target 共用同一份
+	immutable := &testPlugin{newConfig: func(bs []byte) any { return &testImmutablePluginConfig{rules: string(bs)} }}
+	c1, _ := j.parsePluginConfig(immutable, h, "conf.d/test", bs)
+	c2, _ := j.parsePluginConfig(immutable, h, "conf.d/test", bs)
+	if c1 != c2 {
+		t.Fatalf("immutable config must be shared")
+	}
+
+	// Cloner 每次拿到的是一份拷贝，修改它不影响缓存里的配置
+	j = &JobGoroutine{}
+	cloner := &testPlugin{newConfig: func(bs []byte) any { return &testPluginConfig{rules: []string{string(bs)}} }}
+	c1, _ = j.parsePluginConfig(cloner, h, "conf.d/test", bs)
+	c1.(*testPluginConfig).rules[0] = "modified"
+	c2, _ = j.parsePluginConfig(cloner, h, "conf.d/test", bs)
+	if c1 == c2 {
+		t.Fatalf("cloner config must be copied for every scrape")
+	}
+	if rules := c2.(*testPluginConfig).rules; !reflect.DeepEqual(rules, []string{"a"}) {
+		t.Fatalf("cached config is modified by scrape; got rules %q", rules)
+	}
+	if cloner.parses != 1 {
+		t.Fatalf("unexpected number of ParseConfig calls; got %d; want 1", cloner.parses)
+	}
+}
+
+func TestParsePluginConfigEviction(t *testing.T) {
+	j := &JobGoroutine{}
+	p := &testPlugin{newConfig: func(bs []byte) any { return &testImmutablePluginConfig{rules: string(bs)} }}
+	parse := func(s string) {
+		t.Helper()
+		bs := []byte(s)
+		if _, err := j.parsePluginConfig(p, pluginConfigHash("conf.d/test", bs), "conf.d/test", bs); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	parse("old")
+	parse("recent")
+	hashOld := pluginConfigHash("conf.d/test", []byte("old"))
+	hashRecent := pluginConfigHash("conf.d/test", []byte("recent"))
+
+	// old 超过 pluginConfigCacheExpiration 没有用到，比如 rule 文件已经改掉了
+	j.pluginConfigs[hashOld].lastUsed = time.Now().Add(-pluginConfigCacheExpiration - time.Minute)
+
+	// 缓存新的配置的时候清理过期的配置
+	parse("new")
+	if _, ok := j.pluginConfigs[hashOld]; ok {
+		t.Fatalf("expired plugin config must be evicted")
+	}
+	if _, ok := j.pluginConfigs[hashRecent]; !ok {
+		t.Fatalf("recently used plugin config must stay in the cache")
+	}
+
+	// 被清理掉的配置再用到的时候要重新解析
+	parses := p.parses
+	parse("old")
+	if p.parses != parses+1 {
+		t.Fatalf("evicted plugin config must be parsed again")
+	}
+}
+
+func TestToTimeSeriesTimestamps(t *testing.T) {
+	now := time.Date(2023, 6, 1, 10, 0, 0, 0, time.UTC)
+	pluginTime := now.Add(-time.Minute).UnixMilli()
+
+	f := func(tm int64, honorTimestamps bool, want int64) {
+		t.Helper()
+		ms := []metric.Metric{
+			metric.New("mysql", map[string]string{"db": "orders"}, map[string]interface{}{"up": 1.0}, tm),
+		}
+		pt := promutils.NewLabelsFromMap(map[string]string{
+			"__address__": "10.0.0.1:3306",
+			"instance":    "10.0.0.1:3306",
+			"job":         "mysql",
+		})
+		tss := toTimeSeries(ms, pt, &ScrapeConfig{}, now, honorTimestamps)
+		if len(tss) != 1 || len(tss[0].Samples) != 1 {
+			t.Fatalf("expecting a single sample; got %v", tss)
+		}
+		if got := tss[0].Samples[0].Timestamp; got != want {
+			t.Fatalf("unexpected timestamp for tm=%d, honor_timestamps=%v; got %d; want %d", tm, honorTimestamps, got, want)
+		}
+	}
+
+	// honor_timestamps 的时候保留插件上报的时间
+	f(pluginTime, true, pluginTime)
+	// 否则用抓取时间
+	f(pluginTime, false, now.UnixMilli())
+	// 插件没有上报时间的时候总是用抓取时间
+	f(0, true, now.UnixMilli())
+	f(0, false, now.UnixMilli())
+}
+
+// testSeriesPlugin 每次抓取上报 __param_series 条 series
+type testSeriesPlugin struct{}
+
+func (*testSeriesPlugin) ParseConfig(baseDir string, bs []byte) (any, error) {
+	return nil, nil
+}
+
+func (*testSeriesPlugin) Scrape(ctx context.Context, target string, cfg any, params plugins.Params, ss *types.Samples) error {
+	n, _ := strconv.Atoi(params.Get("series"))
+	for i := 0; i < n; i++ {
+		ss.AddMetric("test", map[string]interface{}{"value": float64(i)}, map[string]string{"id": strconv.Itoa(i)})
+	}
+	return nil
+}
+
+func init() {
+	plugins.RegisterPlugin("test_series", &testSeriesPlugin{})
+}
+
+// newTestSeriesJob 返回抓取一次 test_series 插件的函数，error 是这次抓取的 lastError
+func newTestSeriesJob(t *testing.T, sc *ScrapeConfig) func(series int) ([]prompbmarshal.TimeSeries, error) {
+	t.Helper()
+	sc.ConfigRef = &Config{BaseDir: t.TempDir()}
+	sc.JobName = "test"
+	sc.ScrapeConcurrency = 1
+	sc.ScrapeTimeout = promutils.NewDuration(time.Second)
+	j := NewJobGoroutine("test_series", sc)
+
+	target := promutils.NewLabelsFromMap(map[string]string{
+		"__address__": "10.0.0.1:9100",
+		"job":         "test",
+	})
+	ts := newTargetStatus(target, target, nil)
+	t.Cleanup(ts.stopSeriesLimiter)
+
+	scrape := func(series int) ([]prompbmarshal.TimeSeries, error) {
+		t.Helper()
+		ts.params = plugins.Params{"series": strconv.Itoa(series)}
+		tss, _, err := j.scrape(context.Background(), sc, ts)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		ts.mu.Lock()
+		lastError := ts.lastError
+		ts.mu.Unlock()
+		if lastError != "" {
+			return tss, errors.New(lastError)
+		}
+		return tss, nil
+	}
+	return scrape
+}
+
+// seriesValues 返回 tss 里 __name__ 对应的值，test_value 的 series 用 id label 区分
+func seriesValues(tss []prompbmarshal.TimeSeries) map[string]float64 {
+	m := make(map[string]float64)
+	for _, ts := range tss {
+		var name, id string
+		for _, label := range ts.Labels {
+			switch label.Name {
+			case "__name__":
+				name = label.Value
+			case "id":
+				id = label.Value
+			}
+		}
+		if id != "" {
+			name += "{id=" + id + "}"
+		}
+		m[name] = ts.Samples[0].Value
+	}
+	return m
+}
+
+func countTestSeries(tss []prompbmarshal.TimeSeries) int {
+	n := 0
+	for name := range seriesValues(tss) {
+		if strings.HasPrefix(name, "test_value{") {
+			n++
+		}
+	}
+	return n
+}
+
+func TestScrapeSampleLimit(t *testing.T) {
+	scrape := newTestSeriesJob(t, &ScrapeConfig{SampleLimit: 3})
+
+	// 不超过 sample_limit 的抓取正常
+	tss, err := scrape(3)
+	if err != nil {
+		t.Fatalf("unexpected scrape error: %s", err)
+	}
+	values := seriesValues(tss)
+	if n := countTestSeries(tss); n != 3 {
+		t.Fatalf("unexpected number of series; got %d; want 3", n)
+	}
+	if values["test_series_cprobe_up"] != 1 {
+		t.Fatalf("unexpected cprobe_up; got %v; want 1", values["test_series_cprobe_up"])
+	}
+
+	// 超过 sample_limit 的抓取算失败，数据全部丢弃，只剩下 cprobe_up 等抓取状态指标
+	tss, err = scrape(4)
+	if err == nil || !strings.Contains(err.Error(), "exceeds sample_limit 3") {
+		t.Fatalf("expecting sample_limit error; got %v", err)
+	}
+	values = seriesValues(tss)
+	if n := countTestSeries(tss); n != 0 {
+		t.Fatalf("series over sample_limit must be dropped; got %d series", n)
+	}
+	if values["test_series_cprobe_up"] != 0 {
+		t.Fatalf("unexpected cprobe_up; got %v; want 0", values["test_series_cprobe_up"])
+	}
+	if values["test_series_cprobe_error"] != 1 {
+		t.Fatalf("unexpected cprobe_error; got %v; want 1", values["test_series_cprobe_error"])
+	}
+}
+
+func TestScrapeSeriesLimit(t *testing.T) {
+	scrape := newTestSeriesJob(t, &ScrapeConfig{
+		SeriesLimit:         3,
+		SeriesLimitInterval: promutils.NewDuration(time.Hour),
+	})
+
+	tss, err := scrape(2)
+	if err != nil {
+		t.Fatalf("unexpected scrape error: %s", err)
+	}
+	if n := countTestSeries(tss); n != 2 {
+		t.Fatalf("unexpected number of series; got %d; want 2", n)
+	}
+
+	// 超过 series_limit 的新 series 被丢弃，已经见过的 series 不受影响，抓取本身不算失败
+	tss, err = scrape(5)
+	if err != nil {
+		t.Fatalf("unexpected scrape error: %s", err)
+	}
+	values := seriesValues(tss)
+	if n := countTestSeries(tss); n != 3 {
+		t.Fatalf("unexpected number of series over series_limit; got %d; want 3", n)
+	}
+	for _, id := range []string{"0", "1"} {
+		if _, ok := values["test_value{id="+id+"}"]; !ok {
+			t.Fatalf("existing series id=%s must keep flowing; got %v", id, values)
+		}
+	}
+	if values["test_series_cprobe_up"] != 1 {
+		t.Fatalf("unexpected cprobe_up; got %v; want 1", values["test_series_cprobe_up"])
+	}
+}
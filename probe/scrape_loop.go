@@ -0,0 +1,141 @@
+package probe
+
+import (
+	"context"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// scrapeLoop 是单个 target 的抓取循环，每个 target 在 scrape_interval 内的抓取时间是固定的，
+// 这样同一个 job 的大量 target 不会在同一时刻一起抓取
+type scrapeLoop struct {
+	job *JobGoroutine
+	key string
+	ts  *targetStatus
+
+	stopCh chan struct{}
+	doneCh chan struct{}
+}
+
+func newScrapeLoop(job *JobGoroutine, key string, ts *targetStatus) *scrapeLoop {
+	return &scrapeLoop{
+		job:    job,
+		key:    key,
+		ts:     ts,
+		stopCh: make(chan struct{}),
+		doneCh: make(chan struct{}),
+	}
+}
+
+func (sl *scrapeLoop) run(ctx context.Context) {
+	defer close(sl.doneCh)
+	defer sl.ts.stopSeriesLimiter()
+	defer sl.ts.session.close()
+
+	interval := sl.job.GetInterval()
+
+	timer := time.NewTimer(sl.firstScrapeDelay(interval, time.Now()))
+	select {
+	case <-timer.C:
+	case <-sl.stopCh:
+		timer.Stop()
+		return
+	case <-ctx.Done():
+		timer.Stop()
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		sl.job.scrapeTarget(ctx, sl.ts)
+
+		// reload 之后 scrape_interval 可能变了
+		if d := sl.job.GetInterval(); d != interval {
+			interval = d
+			ticker.Reset(interval)
+		}
+
+		// 下次抓取之前连接就会空闲超时，没必要一直占着
+		if interval > sl.job.GetSessionIdleTimeout() {
+			sl.ts.session.closeIdle()
+		}
+
+		select {
+		case <-ticker.C:
+		case <-sl.stopCh:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// stop 停止抓取循环，等正在进行的抓取结束之后才返回
+func (sl *scrapeLoop) stop() {
+	close(sl.stopCh)
+	<-sl.doneCh
+}
+
+// firstScrapeDelay 计算第一次抓取之前要等待的时间，算法和 vmagent 一样
+//
+// 默认根据 target 的 labels 算 hash，在 scrape_interval 内找一个固定的位置，cprobe 重启之后同一个 target 的抓取时间也不会变；
+// 配置了 scrape_align_interval 就对齐到墙上时钟，配置了 scrape_offset 就对齐到 scrape_interval（或者 scrape_align_interval）之后再加上 scrape_offset
+func (sl *scrapeLoop) firstScrapeDelay(interval time.Duration, now time.Time) time.Duration {
+	if interval <= 0 {
+		return 0
+	}
+
+	sl.job.RLock()
+	alignInterval := sl.job.scrapeConfig.ScrapeAlignInterval.Duration()
+	offset := sl.job.scrapeConfig.ScrapeOffset.Duration()
+	sl.job.RUnlock()
+
+	return scrapeDelay(sl.key, interval, alignInterval, offset, now)
+}
+
+func scrapeDelay(key string, interval, alignInterval, offset time.Duration, now time.Time) time.Duration {
+	if alignInterval <= 0 && offset > 0 {
+		alignInterval = interval
+	}
+
+	var delay uint64
+	if alignInterval <= 0 {
+		h := xxhash.Sum64String(key)
+		delay = uint64(float64(interval) * (float64(h) / (1 << 64)))
+		sleepOffset := uint64(now.UnixNano()) % uint64(interval)
+		if delay < sleepOffset {
+			delay += uint64(interval)
+		}
+		delay -= sleepOffset
+	} else {
+		// 找到下一个满足 (t - offset) % alignInterval == 0 的时刻 t
+		d := uint64(alignInterval)
+		var off uint64
+		if offset > 0 {
+			off = uint64(offset) % d
+		}
+		phase := (uint64(now.UnixNano()) + d - off) % d
+		delay = (d - phase) % d
+		// scrape_align_interval 比 scrape_interval 大的话，第一次抓取也不会等超过 scrape_interval
+		delay %= uint64(interval)
+	}
+	return time.Duration(delay)
+}
+
+// stopScrapeLoops 停掉所有的抓取循环，返回这些抓取循环对应的 target
+func stopScrapeLoops(loops map[string]*scrapeLoop) []*targetStatus {
+	for _, loop := range loops {
+		close(loop.stopCh)
+	}
+
+	targets := make([]*targetStatus, 0, len(loops))
+	for key, loop := range loops {
+		<-loop.doneCh
+		targets = append(targets, loop.ts)
+		delete(loops, key)
+	}
+	return targets
+}
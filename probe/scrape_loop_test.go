@@ -0,0 +1,75 @@
+package probe
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestScrapeDelay(t *testing.T) {
+	base := time.Date(2023, 6, 1, 10, 0, 0, 0, time.UTC)
+
+	f := func(interval, alignInterval, offset time.Duration, now time.Time, want time.Duration) {
+		t.Helper()
+		got := scrapeDelay("target", interval, alignInterval, offset, now)
+		if got != want {
+			t.Fatalf("unexpected delay for interval=%s, align=%s, offset=%s, now=%s; got %s; want %s",
+				interval, alignInterval, offset, now.Format(time.RFC3339Nano), got, want)
+		}
+	}
+
+	// 对齐到 scrape_align_interval
+	f(time.Minute, time.Minute, 0, base, 0)
+	f(time.Minute, time.Minute, 0, base.Add(15*time.Second), 45*time.Second)
+	f(time.Minute, 10*time.Second, 0, base.Add(15*time.Second), 5*time.Second)
+
+	// scrape_offset 对齐到 scrape_interval 之后再偏移
+	f(time.Minute, 0, 10*time.Second, base, 10*time.Second)
+	f(time.Minute, 0, 10*time.Second, base.Add(15*time.Second), 55*time.Second)
+	f(time.Minute, 0, 10*time.Second, base.Add(10*time.Second), 0)
+	// scrape_offset 比 scrape_interval 大
+	f(time.Minute, 0, 70*time.Second, base, 10*time.Second)
+
+	// scrape_align_interval 和 scrape_offset 同时配置的时候两个都生效
+	f(5*time.Minute, time.Minute, 10*time.Second, base, 10*time.Second)
+	f(5*time.Minute, time.Minute, 10*time.Second, base.Add(15*time.Second), 55*time.Second)
+	f(5*time.Minute, time.Minute, 10*time.Second, base.Add(2*time.Minute+10*time.Second), 0)
+
+	// scrape_align_interval 比 scrape_interval 大，第一次抓取不超过 scrape_interval，之后的抓取会落在对齐的时刻上
+	f(time.Minute, 5*time.Minute, 0, base.Add(2*time.Minute+30*time.Second), 30*time.Second)
+	f(time.Minute, 5*time.Minute, 10*time.Second, base.Add(2*time.Minute+30*time.Second), 40*time.Second)
+}
+
+func TestScrapeDelayHashSpread(t *testing.T) {
+	interval := time.Minute
+	base := time.Date(2023, 6, 1, 10, 0, 0, 0, time.UTC)
+
+	// 同一个 target 在不同时刻计算出来的抓取时间点是固定的
+	for i := 0; i < 10; i++ {
+		now := base.Add(time.Duration(i) * 7 * time.Second)
+		delay := scrapeDelay("target", interval, 0, 0, now)
+		if delay < 0 || delay >= interval {
+			t.Fatalf("delay must be in [0, %s); got %s", interval, delay)
+		}
+		want := scrapeDelay("target", interval, 0, 0, base)
+		if got := now.Add(delay).Sub(base) % interval; got != want {
+			t.Fatalf("unexpected scrape time offset at %s; got %s; want %s", now, got, want)
+		}
+	}
+
+	// 不同的 target 分散在 scrape_interval 内
+	const n = 100
+	var buckets [4]int
+	for i := 0; i < n; i++ {
+		delay := scrapeDelay(fmt.Sprintf("target-%d", i), interval, 0, 0, base)
+		if delay < 0 || delay >= interval {
+			t.Fatalf("delay must be in [0, %s); got %s", interval, delay)
+		}
+		buckets[delay*time.Duration(len(buckets))/interval]++
+	}
+	for i, cnt := range buckets {
+		if cnt == 0 {
+			t.Fatalf("no targets are scheduled in the quarter #%d of scrape_interval; buckets: %v", i, buckets)
+		}
+	}
+}
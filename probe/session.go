@@ -0,0 +1,144 @@
+package probe
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/cprobe/cprobe/lib/logger"
+	"github.com/cprobe/cprobe/plugins"
+)
+
+var (
+	pluginSessionsCreated = metrics.NewCounter(`cprobe_plugin_sessions_created_total`)
+	pluginSessionsClosed  = metrics.NewCounter(`cprobe_plugin_sessions_closed_total`)
+	pluginSessionErrors   = metrics.NewCounter(`cprobe_plugin_session_errors_total`)
+)
+
+var (
+	// 已经 Init 成功的插件，退出的时候要 Close
+	initializedPluginsLock sync.Mutex
+	initializedPlugins     = make(map[string]plugins.Plugin)
+)
+
+// initPlugin 在插件第一次抓取之前调用插件的 Init，失败的话下次抓取的时候再试
+func initPlugin(name string, plugin plugins.Plugin) error {
+	initializedPluginsLock.Lock()
+	defer initializedPluginsLock.Unlock()
+
+	if _, ok := initializedPlugins[name]; ok {
+		return nil
+	}
+
+	if p, ok := plugin.(plugins.Initializer); ok {
+		if err := p.Init(); err != nil {
+			return err
+		}
+	}
+
+	initializedPlugins[name] = plugin
+	return nil
+}
+
+// ClosePlugins calls Close of every plugin, which has been initialized.
+//
+// It should be called on shutdown after the ctx passed to Start is canceled.
+func ClosePlugins() {
+	initializedPluginsLock.Lock()
+	defer initializedPluginsLock.Unlock()
+
+	for name, plugin := range initializedPlugins {
+		if p, ok := plugin.(plugins.Closer); ok {
+			if err := p.Close(); err != nil {
+				logger.Errorf("cannot close plugin %s: %s", name, err)
+			}
+		}
+		delete(initializedPlugins, name)
+	}
+}
+
+// targetSession 保存插件（实现了 plugins.SessionPlugin）为单个 target 建立的会话，比如数据库连接池，抓取之间复用
+//
+// 抓取的时候把会话取出来，抓取结束再放回去，所以同一个会话不会被并发使用；
+// 抓取超时之后插件可能还在用这个会话，这时候下一次抓取会新建一个会话，插件返回之后旧的会话会被关掉
+type targetSession struct {
+	mu       sync.Mutex
+	session  plugins.Session
+	hash     uint64
+	lastUsed time.Time
+	closed   bool
+}
+
+// acquire 取出可以复用的会话，没有的话就新建一个
+// 插件配置变了（hash 不同）或者空闲时间超过了 idleTimeout 的会话不再复用
+func (s *targetSession) acquire(ctx context.Context, sp plugins.SessionPlugin, target string, cfg any, params plugins.Params, hash uint64, idleTimeout time.Duration) (plugins.Session, error) {
+	s.mu.Lock()
+	session := s.session
+	expired := session != nil && (s.hash != hash || time.Since(s.lastUsed) > idleTimeout)
+	s.session = nil
+	s.mu.Unlock()
+
+	if expired {
+		closeSession(session)
+		session = nil
+	}
+	if session != nil {
+		return session, nil
+	}
+
+	session, err := sp.NewSession(ctx, target, cfg, params)
+	if err != nil {
+		pluginSessionErrors.Inc()
+		return nil, err
+	}
+	pluginSessionsCreated.Inc()
+	return session, nil
+}
+
+// release 抓取结束之后把会话放回去，抓取失败的话直接关掉，下次抓取重新建立
+func (s *targetSession) release(session plugins.Session, hash uint64, scrapeErr error) {
+	if scrapeErr != nil {
+		closeSession(session)
+		return
+	}
+
+	s.mu.Lock()
+	if s.closed || s.session != nil {
+		s.mu.Unlock()
+		closeSession(session)
+		return
+	}
+	s.session = session
+	s.hash = hash
+	s.lastUsed = time.Now()
+	s.mu.Unlock()
+}
+
+// closeIdle 关掉当前没有在用的会话，以后的抓取还会新建会话
+func (s *targetSession) closeIdle() {
+	s.mu.Lock()
+	session := s.session
+	s.session = nil
+	s.mu.Unlock()
+
+	if session != nil {
+		closeSession(session)
+	}
+}
+
+// close 关掉会话，target 消失之后调用，之后放回来的会话也会被直接关掉
+func (s *targetSession) close() {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+
+	s.closeIdle()
+}
+
+func closeSession(session plugins.Session) {
+	pluginSessionsClosed.Inc()
+	if err := session.Close(); err != nil {
+		logger.Warnf("cannot close plugin session: %s", err)
+	}
+}
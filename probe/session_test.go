@@ -0,0 +1,163 @@
+package probe
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/cprobe/cprobe/plugins"
+	"github.com/cprobe/cprobe/types"
+)
+
+type testSession struct {
+	id     int
+	closed bool
+}
+
+func (s *testSession) Close() error {
+	s.closed = true
+	return nil
+}
+
+// testSessionPlugin 记录建立过的所有会话
+type testSessionPlugin struct {
+	sessions []*testSession
+
+	inits     int
+	initErr   error
+	closes    int
+	newErr    error
+	scrapeErr error
+}
+
+func (p *testSessionPlugin) ParseConfig(baseDir string, bs []byte) (any, error) {
+	return nil, nil
+}
+
+func (p *testSessionPlugin) Scrape(ctx context.Context, target string, cfg any, params plugins.Params, ss *types.Samples) error {
+	return nil
+}
+
+func (p *testSessionPlugin) NewSession(ctx context.Context, target string, cfg any, params plugins.Params) (plugins.Session, error) {
+	if p.newErr != nil {
+		return nil, p.newErr
+	}
+	s := &testSession{id: len(p.sessions)}
+	p.sessions = append(p.sessions, s)
+	return s, nil
+}
+
+func (p *testSessionPlugin) ScrapeSession(ctx context.Context, s plugins.Session, ss *types.Samples) error {
+	return p.scrapeErr
+}
+
+func (p *testSessionPlugin) Init() error {
+	p.inits++
+	return p.initErr
+}
+
+func (p *testSessionPlugin) Close() error {
+	p.closes++
+	return nil
+}
+
+func TestTargetSession(t *testing.T) {
+	p := &testSessionPlugin{}
+	var ts targetSession
+
+	// scrape 模拟 scrapeTarget 里的一次抓取，返回这次用的会话
+	scrape := func(hash uint64, idleTimeout time.Duration) *testSession {
+		t.Helper()
+		s, err := ts.acquire(context.Background(), p, "10.0.0.1:5432", nil, nil, hash, idleTimeout)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		err = p.ScrapeSession(context.Background(), s, types.NewSamples())
+		ts.release(s, hash, err)
+		return s.(*testSession)
+	}
+
+	// 抓取之间复用同一个会话
+	s0 := scrape(1, time.Hour)
+	if s := scrape(1, time.Hour); s != s0 {
+		t.Fatalf("session must be reused between scrapes")
+	}
+	if s0.closed || len(p.sessions) != 1 {
+		t.Fatalf("unexpected sessions: %d created, closed=%v", len(p.sessions), s0.closed)
+	}
+
+	// 插件配置变了，旧的会话关掉，新建一个
+	s1 := scrape(2, time.Hour)
+	if s1 == s0 || !s0.closed {
+		t.Fatalf("session must be recreated after plugin config change")
+	}
+
+	// 空闲超过 session_idle_timeout 的会话关掉，新建一个
+	time.Sleep(20 * time.Millisecond)
+	s2 := scrape(2, 10*time.Millisecond)
+	if s2 == s1 || !s1.closed {
+		t.Fatalf("session must be recreated after session_idle_timeout")
+	}
+
+	// 抓取失败的会话直接关掉，下次抓取重新建立
+	p.scrapeErr = errors.New("broken connection")
+	if s := scrape(2, time.Hour); s != s2 || !s2.closed {
+		t.Fatalf("session must be closed after failed scrape")
+	}
+	p.scrapeErr = nil
+	s3 := scrape(2, time.Hour)
+	if s3 == s2 {
+		t.Fatalf("session must be recreated after failed scrape")
+	}
+
+	// closeIdle 关掉空闲的会话
+	ts.closeIdle()
+	if !s3.closed {
+		t.Fatalf("idle session must be closed by closeIdle")
+	}
+
+	// target 消失之后，正在用的会话放回来的时候直接关掉
+	s, err := ts.acquire(context.Background(), p, "10.0.0.1:5432", nil, nil, 2, time.Hour)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ts.close()
+	ts.release(s, 2, nil)
+	if !s.(*testSession).closed {
+		t.Fatalf("session released after close must be closed")
+	}
+
+	// NewSession 失败的话返回 error
+	var ts2 targetSession
+	p.newErr = errors.New("cannot connect")
+	if _, err := ts2.acquire(context.Background(), p, "10.0.0.1:5432", nil, nil, 1, time.Hour); err == nil {
+		t.Fatalf("expecting non-nil error")
+	}
+}
+
+func TestInitAndClosePlugins(t *testing.T) {
+	p := &testSessionPlugin{initErr: errors.New("init error")}
+	const name = "test_session"
+
+	// Init 失败的话下次抓取再试
+	if err := initPlugin(name, p); err == nil {
+		t.Fatalf("expecting non-nil error")
+	}
+	p.initErr = nil
+	for i := 0; i < 3; i++ {
+		if err := initPlugin(name, p); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	if p.inits != 2 {
+		t.Fatalf("unexpected number of Init calls; got %d; want 2", p.inits)
+	}
+
+	// 退出的时候 Close 只调用一次
+	ClosePlugins()
+	ClosePlugins()
+	if p.closes != 1 {
+		t.Fatalf("unexpected number of Close calls; got %d; want 1", p.closes)
+	}
+}
@@ -0,0 +1,451 @@
+package probe
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/cprobe/cprobe/lib/bloomfilter"
+	"github.com/cprobe/cprobe/lib/decimal"
+	"github.com/cprobe/cprobe/lib/prompbmarshal"
+	"github.com/cprobe/cprobe/lib/promutils"
+	"github.com/cprobe/cprobe/lib/redact"
+	"github.com/cprobe/cprobe/plugins"
+	"github.com/cprobe/cprobe/writer"
+)
+
+const (
+	healthUnknown = "unknown"
+	healthUp      = "up"
+	healthDown    = "down"
+)
+
+// targetStatus 记录单个 target 最近一次的抓取状态，供 /targets 页面和 /api/v1/targets 接口使用
+type targetStatus struct {
+	// relabel 之后的 labels，抓取时就是用的这份
+	labels *promutils.Labels
+	// __param_* labels 里的插件参数，__param_rule_files 单独拿出来放在 ruleFiles 里，插件看不到
+	params    plugins.Params
+	ruleFiles []string
+
+	mu sync.Mutex
+	// relabel 之前的 labels，也就是服务发现拿到的原始 labels
+	discoveredLabels   *promutils.Labels
+	lastScrapeTime     time.Time
+	lastScrapeDuration time.Duration
+	lastError          string
+	samplesScraped     int
+	health             string
+
+	// 最近一次抓取到的数据，只有 pull 模式下才保存，供 /metrics/probe 和 /federate 使用
+	series []prompbmarshal.TimeSeries
+
+	// 上一轮发送给 writer 的 series，key 是 seriesKey，用来生成 stale markers
+	sentSeries map[string][]prompbmarshal.Label
+
+	// 配置了 series_limit 才会创建，记录 series_limit_interval 内见过的 series
+	seriesLimiter         *bloomfilter.Limiter
+	seriesLimiterInterval time.Duration
+
+	// 插件实现了 plugins.SessionPlugin 才会用到，抓取之间复用的连接
+	session targetSession
+
+	// 超时被放弃、但是还没有返回的那次抓取，抓取 goroutine 返回的时候会被 close
+	abandonedScrape <-chan struct{}
+}
+
+func newTargetStatus(discoveredLabels, labels *promutils.Labels, params plugins.Params) *targetStatus {
+	var ruleFiles []string
+	if v := params.Get(plugins.ParamRuleFiles); v != "" {
+		for _, ruleFile := range strings.Split(v, ",") {
+			if ruleFile = strings.TrimSpace(ruleFile); ruleFile != "" {
+				ruleFiles = append(ruleFiles, ruleFile)
+			}
+		}
+
+		// params 是 parseTarget 新建的，可以直接修改
+		delete(params, plugins.ParamRuleFiles)
+		if len(params) == 0 {
+			params = nil
+		}
+	}
+
+	return &targetStatus{
+		discoveredLabels: discoveredLabels,
+		labels:           labels,
+		params:           params,
+		ruleFiles:        ruleFiles,
+		health:           healthUnknown,
+	}
+}
+
+func (ts *targetStatus) update(scrapeTime time.Time, duration time.Duration, samplesScraped int, err error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	ts.lastScrapeTime = scrapeTime
+	ts.lastScrapeDuration = duration
+	ts.samplesScraped = samplesScraped
+	if err != nil {
+		ts.lastError = err.Error()
+		ts.health = healthDown
+	} else {
+		ts.lastError = ""
+		ts.health = healthUp
+	}
+}
+
+// setAbandonedScrape 记录超时被放弃的抓取，scrapeTarget 据此在它真正返回之前一直占着并发槽位，也不会开始下一次抓取
+func (ts *targetStatus) setAbandonedScrape(done <-chan struct{}) {
+	ts.mu.Lock()
+	ts.abandonedScrape = done
+	ts.mu.Unlock()
+}
+
+// runningAbandonedScrape 返回超时被放弃、但是还在运行的那次抓取，没有的话返回 nil
+func (ts *targetStatus) runningAbandonedScrape() <-chan struct{} {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.abandonedScrape == nil {
+		return nil
+	}
+	select {
+	case <-ts.abandonedScrape:
+		ts.abandonedScrape = nil
+		return nil
+	default:
+		return ts.abandonedScrape
+	}
+}
+
+// setSeries 保存一份 tss 的拷贝，tss 后面还要交给 writer，writer 会原地修改 labels
+func (ts *targetStatus) setSeries(tss []prompbmarshal.TimeSeries) {
+	series := make([]prompbmarshal.TimeSeries, len(tss))
+	for i := range tss {
+		series[i] = prompbmarshal.TimeSeries{
+			Labels:  append([]prompbmarshal.Label(nil), tss[i].Labels...),
+			Samples: append([]prompbmarshal.Sample(nil), tss[i].Samples...),
+		}
+	}
+
+	ts.mu.Lock()
+	ts.series = series
+	ts.mu.Unlock()
+}
+
+// ActiveTarget is the status of a target, which is being scraped.
+//
+// The json shape follows activeTargets of Prometheus /api/v1/targets,
+// see https://prometheus.io/docs/prometheus/latest/querying/api/#targets
+type ActiveTarget struct {
+	DiscoveredLabels   map[string]string `json:"discoveredLabels"`
+	Labels             map[string]string `json:"labels"`
+	ScrapePool         string            `json:"scrapePool"`
+	ScrapeURL          string            `json:"scrapeUrl"`
+	GlobalURL          string            `json:"globalUrl"`
+	LastError          string            `json:"lastError"`
+	LastScrape         time.Time         `json:"lastScrape"`
+	LastScrapeDuration float64           `json:"lastScrapeDuration"`
+	LastSamplesScraped int               `json:"lastSamplesScraped"`
+	Health             string            `json:"health"`
+	ScrapeInterval     string            `json:"scrapeInterval"`
+	ScrapeTimeout      string            `json:"scrapeTimeout"`
+	Plugin             string            `json:"plugin"`
+}
+
+// DroppedTarget is a discovered target, which has been dropped by relabel_configs.
+type DroppedTarget struct {
+	DiscoveredLabels map[string]string `json:"discoveredLabels"`
+	ScrapePool       string            `json:"scrapePool"`
+}
+
+func (j *JobGoroutine) setTargets(activeTargets map[string]*targetStatus, droppedTargets []*promutils.Labels) {
+	j.targetsLock.Lock()
+	defer j.targetsLock.Unlock()
+	j.activeTargets = activeTargets
+	j.droppedTargets = droppedTargets
+}
+
+// getTargetStatus 返回上一轮同一个 target 的状态对象，这样页面上不会因为新一轮抓取开始而丢掉上次的抓取结果
+func (j *JobGoroutine) getTargetStatus(key string, discoveredLabels, labels *promutils.Labels, params plugins.Params) *targetStatus {
+	j.targetsLock.RLock()
+	ts, has := j.activeTargets[key]
+	j.targetsLock.RUnlock()
+
+	if !has {
+		return newTargetStatus(discoveredLabels, labels, params)
+	}
+
+	ts.mu.Lock()
+	ts.discoveredLabels = discoveredLabels
+	ts.mu.Unlock()
+
+	return ts
+}
+
+// discoveredLabelsMap 返回 discoveredLabels 的 map，除非 showSecrets，否则 __param_password 这类 label 的值会被替换成 redact.Mask
+func discoveredLabelsMap(discoveredLabels *promutils.Labels, showSecrets bool) map[string]string {
+	m := discoveredLabels.ToMap()
+	if !showSecrets {
+		redact.Labels(m)
+	}
+	return m
+}
+
+func (j *JobGoroutine) getActiveTargets(showSecrets bool) []ActiveTarget {
+	jobName := j.GetJobName()
+	interval := j.GetInterval().String()
+	timeout := j.GetTimeout().String()
+
+	j.targetsLock.RLock()
+	defer j.targetsLock.RUnlock()
+
+	ret := make([]ActiveTarget, 0, len(j.activeTargets))
+	for _, ts := range j.activeTargets {
+		labels := ts.labels.Clone()
+		address := labels.Get("__address__")
+		labels.RemoveLabelsWithDoubleUnderscorePrefix()
+
+		ts.mu.Lock()
+		ret = append(ret, ActiveTarget{
+			DiscoveredLabels:   discoveredLabelsMap(ts.discoveredLabels, showSecrets),
+			Labels:             labels.ToMap(),
+			ScrapePool:         jobName,
+			ScrapeURL:          address,
+			GlobalURL:          address,
+			LastError:          ts.lastError,
+			LastScrape:         ts.lastScrapeTime,
+			LastScrapeDuration: ts.lastScrapeDuration.Seconds(),
+			LastSamplesScraped: ts.samplesScraped,
+			Health:             ts.health,
+			ScrapeInterval:     interval,
+			ScrapeTimeout:      timeout,
+			Plugin:             j.plugin,
+		})
+		ts.mu.Unlock()
+	}
+
+	return ret
+}
+
+func (j *JobGoroutine) getDroppedTargets(showSecrets bool) []DroppedTarget {
+	jobName := j.GetJobName()
+
+	j.targetsLock.RLock()
+	defer j.targetsLock.RUnlock()
+
+	ret := make([]DroppedTarget, 0, len(j.droppedTargets))
+	for _, labels := range j.droppedTargets {
+		ret = append(ret, DroppedTarget{
+			DiscoveredLabels: discoveredLabelsMap(labels, showSecrets),
+			ScrapePool:       jobName,
+		})
+	}
+
+	return ret
+}
+
+// GetActiveTargets returns the status of all the targets being scraped, sorted by job and address.
+//
+// Secrets in discovered labels such as `__param_password` are replaced with redact.Mask unless showSecrets is set.
+func GetActiveTargets(showSecrets bool) []ActiveTarget {
+	jobsLock.RLock()
+	var ret []ActiveTarget
+	for _, jobs := range Jobs {
+		for _, job := range jobs {
+			ret = append(ret, job.getActiveTargets(showSecrets)...)
+		}
+	}
+	jobsLock.RUnlock()
+
+	sort.Slice(ret, func(i, k int) bool {
+		if ret[i].ScrapePool != ret[k].ScrapePool {
+			return ret[i].ScrapePool < ret[k].ScrapePool
+		}
+		return ret[i].ScrapeURL < ret[k].ScrapeURL
+	})
+
+	return ret
+}
+
+// GetDroppedTargets returns all the targets dropped by relabel_configs, sorted by job.
+//
+// Secrets in discovered labels are replaced with redact.Mask unless showSecrets is set.
+func GetDroppedTargets(showSecrets bool) []DroppedTarget {
+	jobsLock.RLock()
+	var ret []DroppedTarget
+	for _, jobs := range Jobs {
+		for _, job := range jobs {
+			ret = append(ret, job.getDroppedTargets(showSecrets)...)
+		}
+	}
+	jobsLock.RUnlock()
+
+	sort.SliceStable(ret, func(i, k int) bool {
+		return ret[i].ScrapePool < ret[k].ScrapePool
+	})
+
+	return ret
+}
+
+// staleMarkers 记录本轮发送给 writer 的 series，返回上一轮发送过、这一轮没有了的 series 的 stale markers
+func (ts *targetStatus) staleMarkers(tss []prompbmarshal.TimeSeries, timestamp int64) []prompbmarshal.TimeSeries {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	sentSeries := make(map[string][]prompbmarshal.Label, len(tss))
+	var buf []byte
+	for i := range tss {
+		buf = appendSeriesKey(buf[:0], tss[i].Labels)
+		key := string(buf)
+		if labels, has := ts.sentSeries[key]; has {
+			sentSeries[key] = labels
+			delete(ts.sentSeries, key)
+			continue
+		}
+		// writer 会原地修改 labels，这里要存一份拷贝
+		sentSeries[key] = append([]prompbmarshal.Label(nil), tss[i].Labels...)
+	}
+
+	// 剩下的就是这一轮没有了的 series
+	ret := newStaleMarkers(ts.sentSeries, timestamp)
+	ts.sentSeries = sentSeries
+	return ret
+}
+
+// allStaleMarkers 返回上一轮发送过的所有 series 的 stale markers，target 消失或者 job 被删除的时候使用
+func (ts *targetStatus) allStaleMarkers(timestamp int64) []prompbmarshal.TimeSeries {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	ret := newStaleMarkers(ts.sentSeries, timestamp)
+	ts.sentSeries = nil
+	return ret
+}
+
+// resetSentSeries 在关闭了 no_stale_markers 之后释放之前记录的 series
+func (ts *targetStatus) resetSentSeries() {
+	ts.mu.Lock()
+	ts.sentSeries = nil
+	ts.mu.Unlock()
+}
+
+// applySeriesLimit 丢弃超过 limit 的新 series，返回保留下来的 series 和丢弃的数量
+func (ts *targetStatus) applySeriesLimit(tss []prompbmarshal.TimeSeries, limit int, interval time.Duration) ([]prompbmarshal.TimeSeries, int) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	// series_limit 或者 series_limit_interval 在 reload 之后变了，就重新开始计数
+	if ts.seriesLimiter != nil && (ts.seriesLimiter.MaxItems() != limit || ts.seriesLimiterInterval != interval) {
+		ts.seriesLimiter.MustStop()
+		ts.seriesLimiter = nil
+	}
+	if ts.seriesLimiter == nil {
+		ts.seriesLimiter = bloomfilter.NewLimiter(limit, interval)
+		ts.seriesLimiterInterval = interval
+	}
+
+	dst := tss[:0]
+	var buf []byte
+	for i := range tss {
+		buf = appendSeriesKey(buf[:0], tss[i].Labels)
+		if !ts.seriesLimiter.Add(xxhash.Sum64(buf)) {
+			continue
+		}
+		dst = append(dst, tss[i])
+	}
+	return dst, len(tss) - len(dst)
+}
+
+func (ts *targetStatus) stopSeriesLimiter() {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.seriesLimiter != nil {
+		ts.seriesLimiter.MustStop()
+		ts.seriesLimiter = nil
+	}
+}
+
+func newStaleMarkers(series map[string][]prompbmarshal.Label, timestamp int64) []prompbmarshal.TimeSeries {
+	if len(series) == 0 {
+		return nil
+	}
+
+	ret := make([]prompbmarshal.TimeSeries, 0, len(series))
+	for _, labels := range series {
+		ret = append(ret, prompbmarshal.TimeSeries{
+			Labels: labels,
+			Samples: []prompbmarshal.Sample{{
+				Value:     decimal.StaleNaN,
+				Timestamp: timestamp,
+			}},
+		})
+	}
+	return ret
+}
+
+func appendSeriesKey(dst []byte, labels []prompbmarshal.Label) []byte {
+	for i := range labels {
+		dst = append(dst, labels[i].Name...)
+		dst = append(dst, 0xff)
+		dst = append(dst, labels[i].Value...)
+		dst = append(dst, 0xfe)
+	}
+	return dst
+}
+
+// sendStaleMarkers 给 targets 上一轮发送过的所有 series 发送 stale markers
+func sendStaleMarkers(targets []*targetStatus) {
+	timestamp := time.Now().UnixMilli()
+
+	var tss []prompbmarshal.TimeSeries
+	for _, ts := range targets {
+		tss = append(tss, ts.allStaleMarkers(timestamp)...)
+	}
+	writer.WriteTimeSeries(tss)
+}
+
+func (j *JobGoroutine) getLatestSeries() []prompbmarshal.TimeSeries {
+	j.targetsLock.RLock()
+	defer j.targetsLock.RUnlock()
+
+	var ret []prompbmarshal.TimeSeries
+	for _, ts := range j.activeTargets {
+		ts.mu.Lock()
+		ret = append(ret, ts.series...)
+		ts.mu.Unlock()
+	}
+	return ret
+}
+
+// GetLatestSeries returns the samples of the latest scrape of every active target in pull mode.
+//
+// Only the given jobs are returned if jobNames isn't empty.
+// The returned series must not be modified, since they are shared with subsequent calls.
+func GetLatestSeries(jobNames ...string) []prompbmarshal.TimeSeries {
+	jobsLock.RLock()
+	defer jobsLock.RUnlock()
+
+	var ret []prompbmarshal.TimeSeries
+	for _, jobs := range Jobs {
+		for _, job := range jobs {
+			if len(jobNames) > 0 && !containsString(jobNames, job.GetJobName()) {
+				continue
+			}
+			ret = append(ret, job.getLatestSeries()...)
+		}
+	}
+	return ret
+}
+
+func containsString(a []string, s string) bool {
+	for _, x := range a {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
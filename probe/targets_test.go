@@ -0,0 +1,150 @@
+package probe
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/cprobe/cprobe/lib/decimal"
+	"github.com/cprobe/cprobe/lib/prompbmarshal"
+)
+
+func newTestTimeSeries(names ...string) []prompbmarshal.TimeSeries {
+	tss := make([]prompbmarshal.TimeSeries, 0, len(names))
+	for _, name := range names {
+		tss = append(tss, prompbmarshal.TimeSeries{
+			Labels: []prompbmarshal.Label{
+				{Name: "__name__", Value: name},
+				{Name: "instance", Value: "db1"},
+			},
+			Samples: []prompbmarshal.Sample{{Value: 1, Timestamp: 1000}},
+		})
+	}
+	return tss
+}
+
+// staleMarkerNames 检查 stale markers 的值和时间，返回排好序的 __name__
+func staleMarkerNames(t *testing.T, tss []prompbmarshal.TimeSeries, timestamp int64) []string {
+	t.Helper()
+	var names []string
+	for _, ts := range tss {
+		if len(ts.Samples) != 1 || !decimal.IsStaleNaN(ts.Samples[0].Value) || ts.Samples[0].Timestamp != timestamp {
+			t.Fatalf("unexpected stale marker samples %v for %v; want a single StaleNaN at %d", ts.Samples, ts.Labels, timestamp)
+		}
+		for _, label := range ts.Labels {
+			if label.Name == "__name__" {
+				names = append(names, label.Value)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestStaleMarkers(t *testing.T) {
+	ts := &targetStatus{}
+	timestamp := int64(1000)
+
+	f := func(names []string, want []string) {
+		t.Helper()
+		timestamp += 1000
+		tss := newTestTimeSeries(names...)
+		got := staleMarkerNames(t, ts.staleMarkers(tss, timestamp), timestamp)
+
+		// writer 会原地修改 labels，不能影响记录下来的 series
+		for i := range tss {
+			tss[i].Labels[0].Value = "modified"
+		}
+
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("unexpected stale markers for %q; got %q; want %q", names, got, want)
+		}
+	}
+
+	// 第一轮没有 stale markers
+	f([]string{"up", "mysql_up"}, nil)
+	// 和上一轮一样
+	f([]string{"mysql_up", "up"}, nil)
+	// 少了 mysql_up，多了 mysql_uptime
+	f([]string{"up", "mysql_uptime"}, []string{"mysql_up"})
+	// 抓取失败，什么都没有
+	f(nil, []string{"mysql_uptime", "up"})
+	// stale markers 只发送一次
+	f(nil, nil)
+	// 恢复之后又能正常记录
+	f([]string{"up"}, nil)
+}
+
+func TestAllStaleMarkers(t *testing.T) {
+	f := func(names []string, want []string) {
+		t.Helper()
+		ts := &targetStatus{}
+		ts.staleMarkers(newTestTimeSeries(names...), 1000)
+
+		got := staleMarkerNames(t, ts.allStaleMarkers(2000), 2000)
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("unexpected stale markers for %q; got %q; want %q", names, got, want)
+		}
+
+		// 发送过一次之后就不再有 stale markers
+		if tss := ts.allStaleMarkers(3000); len(tss) != 0 {
+			t.Fatalf("unexpected stale markers after allStaleMarkers: %v", tss)
+		}
+	}
+
+	f(nil, nil)
+	f([]string{"up"}, []string{"up"})
+	f([]string{"up", "mysql_up", "mysql_uptime"}, []string{"mysql_up", "mysql_uptime", "up"})
+}
+
+func TestApplySeriesLimit(t *testing.T) {
+	ts := &targetStatus{}
+	defer ts.stopSeriesLimiter()
+
+	f := func(names []string, limit int, interval time.Duration, want []string, wantDropped int) {
+		t.Helper()
+		tss, dropped := ts.applySeriesLimit(newTestTimeSeries(names...), limit, interval)
+		var got []string
+		for _, x := range tss {
+			got = append(got, x.Labels[0].Value)
+		}
+		if !reflect.DeepEqual(got, want) || dropped != wantDropped {
+			t.Fatalf("unexpected result for %q; got %q, %d dropped; want %q, %d dropped", names, got, dropped, want, wantDropped)
+		}
+	}
+
+	// 新 series 超过 series_limit 之后被丢弃，已经见过的 series 不受影响
+	f([]string{"a", "b"}, 3, time.Hour, []string{"a", "b"}, 0)
+	f([]string{"a", "b", "c", "d", "e"}, 3, time.Hour, []string{"a", "b", "c"}, 2)
+	f([]string{"c", "d", "a"}, 3, time.Hour, []string{"c", "a"}, 1)
+
+	// series_limit 变了就重新开始计数
+	f([]string{"d", "e"}, 4, time.Hour, []string{"d", "e"}, 0)
+}
+
+func TestApplySeriesLimitReset(t *testing.T) {
+	ts := &targetStatus{}
+	defer ts.stopSeriesLimiter()
+
+	interval := 50 * time.Millisecond
+	if _, dropped := ts.applySeriesLimit(newTestTimeSeries("a", "b"), 2, interval); dropped != 0 {
+		t.Fatalf("unexpected dropped series: %d", dropped)
+	}
+	if _, dropped := ts.applySeriesLimit(newTestTimeSeries("c"), 2, interval); dropped != 1 {
+		t.Fatalf("new series over series_limit must be dropped; got %d dropped", dropped)
+	}
+
+	// series_limit_interval 过了之后重新计数，新的 series 又能发送了
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		tss, _ := ts.applySeriesLimit(newTestTimeSeries("c"), 2, interval)
+		if len(tss) == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("series limiter isn't reset after series_limit_interval")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -49,22 +49,25 @@ func (s *Samples) AddPromMetric(m prometheus.Metric) error {
 		tags[v.GetName()] = v.GetValue()
 	}
 
+	// 0 means the metric has no timestamp, the scheduler will use the scrape time
+	tm := pb.GetTimestampMs()
+
 	if pb.Gauge != nil {
-		s.AddMetric(desc.Name(), map[string]interface{}{
+		s.AddMetricWithTime(desc.Name(), map[string]interface{}{
 			"": pb.Gauge.GetValue(),
-		}, tags)
+		}, tm, tags)
 	} else if pb.Counter != nil {
-		s.AddMetric(desc.Name(), map[string]interface{}{
+		s.AddMetricWithTime(desc.Name(), map[string]interface{}{
 			"": pb.Counter.GetValue(),
-		}, tags)
+		}, tm, tags)
 	} else if pb.Summary != nil {
 		s.handleSummary(pb, desc.Name(), tags)
 	} else if pb.Histogram != nil {
 		s.handleHistogram(pb, desc.Name(), tags)
 	} else {
-		s.AddMetric(desc.Name(), map[string]interface{}{
+		s.AddMetricWithTime(desc.Name(), map[string]interface{}{
 			"": pb.Untyped.GetValue(),
-		}, tags)
+		}, tm, tags)
 	}
 
 	return nil
@@ -73,16 +76,17 @@ func (s *Samples) AddPromMetric(m prometheus.Metric) error {
 func (s *Samples) handleSummary(pb *dto.Metric, metricName string, tags map[string]string) {
 	count := pb.GetSummary().GetSampleCount()
 	sum := pb.GetSummary().GetSampleSum()
+	tm := pb.GetTimestampMs()
 
-	s.AddMetric(metricName, map[string]interface{}{
+	s.AddMetricWithTime(metricName, map[string]interface{}{
 		"count": count,
 		"sum":   sum,
-	}, tags)
+	}, tm, tags)
 
 	for _, q := range pb.GetSummary().Quantile {
-		s.AddMetric(metricName, map[string]interface{}{
+		s.AddMetricWithTime(metricName, map[string]interface{}{
 			"quantile": q.GetValue(),
-		}, tags, map[string]string{
+		}, tm, tags, map[string]string{
 			"quantile": fmt.Sprint(q.GetQuantile()),
 		})
 	}
@@ -91,24 +95,25 @@ func (s *Samples) handleSummary(pb *dto.Metric, metricName string, tags map[stri
 func (s *Samples) handleHistogram(pb *dto.Metric, metricName string, tags map[string]string) {
 	count := pb.GetHistogram().GetSampleCount()
 	sum := pb.GetHistogram().GetSampleSum()
+	tm := pb.GetTimestampMs()
 
-	s.AddMetric(metricName, map[string]interface{}{
+	s.AddMetricWithTime(metricName, map[string]interface{}{
 		"count": count,
 		"sum":   sum,
-	}, tags)
+	}, tm, tags)
 
-	s.AddMetric(metricName, map[string]interface{}{
+	s.AddMetricWithTime(metricName, map[string]interface{}{
 		"bucket": count,
-	}, tags, map[string]string{
+	}, tm, tags, map[string]string{
 		"le": "+Inf",
 	})
 
 	for _, b := range pb.GetHistogram().Bucket {
 		le := fmt.Sprint(b.GetUpperBound())
 		value := float64(b.GetCumulativeCount())
-		s.AddMetric(metricName, map[string]interface{}{
+		s.AddMetricWithTime(metricName, map[string]interface{}{
 			"bucket": value,
-		}, tags, map[string]string{
+		}, tm, tags, map[string]string{
 			"le": le,
 		})
 	}
@@ -150,7 +155,7 @@ func (s *Samples) AddMetricFamilies(mfs []*dto.MetricFamily) {
 				s.handleHistogram(m, metricName, tags)
 			} else {
 				fields := getNameAndValue(m, metricName)
-				s.AddMetric("", fields, tags)
+				s.AddMetricWithTime("", fields, m.GetTimestampMs(), tags)
 			}
 		}
 	}
@@ -221,6 +226,12 @@ func (s *Samples) addMetricsBody(buf []byte) error {
 }
 
 func (s *Samples) AddMetric(mesurement string, fields map[string]interface{}, tagss ...map[string]string) {
+	s.AddMetricWithTime(mesurement, fields, 0, tagss...)
+}
+
+// AddMetricWithTime is like AddMetric, but carries the timestamp (in milliseconds) reported by the target.
+// tm=0 means the scrape time should be used.
+func (s *Samples) AddMetricWithTime(mesurement string, fields map[string]interface{}, tm int64, tagss ...map[string]string) {
 	tags := make(map[string]string)
 	for i := range tagss {
 		for k, v := range tagss[i] {
@@ -228,7 +239,7 @@ func (s *Samples) AddMetric(mesurement string, fields map[string]interface{}, ta
 		}
 	}
 
-	m := metric.New(mesurement, tags, fields, 0)
+	m := metric.New(mesurement, tags, fields, tm)
 	s.slist.PushFront(m)
 }
 
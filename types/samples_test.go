@@ -0,0 +1,92 @@
+package types
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// timestamps 返回 ss 里所有 metric 的时间，key 是 metric name 和 field name
+func timestamps(ss *Samples) map[string]int64 {
+	m := make(map[string]int64)
+	for _, metric := range ss.PopBackAll() {
+		for field := range metric.Fields() {
+			m[metric.Name()+"|"+field] = metric.Time()
+		}
+	}
+	return m
+}
+
+func TestAddMetricWithTime(t *testing.T) {
+	ss := NewSamples()
+	ss.AddMetric("without_time", map[string]interface{}{"value": 1})
+	ss.AddMetricWithTime("with_time", map[string]interface{}{"value": 1}, 1700000000123)
+
+	got := timestamps(ss)
+	if got["without_time|value"] != 0 {
+		t.Fatalf("AddMetric must leave zero timestamp; got %d", got["without_time|value"])
+	}
+	if got["with_time|value"] != 1700000000123 {
+		t.Fatalf("AddMetricWithTime must keep the timestamp; got %d", got["with_time|value"])
+	}
+}
+
+func TestAddPromMetricTimestamp(t *testing.T) {
+	desc := prometheus.NewDesc("mysql_up", "help", nil, nil)
+	tm := time.UnixMilli(1700000000123)
+
+	f := func(m prometheus.Metric, want int64) {
+		t.Helper()
+		ss := NewSamples()
+		if err := ss.AddPromMetric(m); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		for key, got := range timestamps(ss) {
+			if got != want {
+				t.Fatalf("unexpected timestamp for %s; got %d; want %d", key, got, want)
+			}
+		}
+	}
+
+	f(prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, 1), 0)
+	f(prometheus.NewMetricWithTimestamp(tm, prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, 1)), tm.UnixMilli())
+	f(prometheus.NewMetricWithTimestamp(tm, prometheus.MustNewConstMetric(desc, prometheus.CounterValue, 1)), tm.UnixMilli())
+	f(prometheus.NewMetricWithTimestamp(tm, prometheus.MustNewConstSummary(desc, 3, 6, map[float64]float64{0.5: 2})), tm.UnixMilli())
+	f(prometheus.NewMetricWithTimestamp(tm, prometheus.MustNewConstHistogram(desc, 3, 6, map[float64]uint64{1: 1, 5: 3})), tm.UnixMilli())
+}
+
+func TestAddMetricsBodyTimestamp(t *testing.T) {
+	body := `# HELP with_time help
+# TYPE with_time gauge
+with_time 1 1700000000123
+# HELP without_time help
+# TYPE without_time gauge
+without_time 2
+# HELP latency help
+# TYPE latency histogram
+latency_bucket{le="1"} 1 1700000000456
+latency_bucket{le="+Inf"} 3 1700000000456
+latency_sum 6 1700000000456
+latency_count 3 1700000000456
+`
+	ss := NewSamples()
+	if err := ss.AddMetricsBody([]byte(body), http.Header{}, false); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	got := timestamps(ss)
+	want := map[string]int64{
+		"|with_time":     1700000000123,
+		"|without_time":  0,
+		"latency|count":  1700000000456,
+		"latency|sum":    1700000000456,
+		"latency|bucket": 1700000000456,
+	}
+	for key, tm := range want {
+		if got[key] != tm {
+			t.Fatalf("unexpected timestamp for %s; got %d; want %d; all timestamps: %v", key, got[key], tm, got)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package writer
+
+import (
+	"time"
+
+	"github.com/cprobe/cprobe/lib/logger"
+	"github.com/cprobe/cprobe/lib/prompbmarshal"
+	"github.com/golang/snappy"
+)
+
+// addTimeSeries 把 series 放到 writer 的缓冲区里，攒够 max_series_per_request 条或者 max_block_size 字节就打包成一个请求
+// 这样很多 target 的数据可以合并成一个请求发送，而不是每个 target 每次抓取都发一个小请求
+func (w *Writer) addTimeSeries(tss []prompbmarshal.TimeSeries) {
+	w.pendingLock.Lock()
+	defer w.pendingLock.Unlock()
+
+	for i := range tss {
+		w.pending = append(w.pending, tss[i])
+		// 按 protobuf 编码之后的大小估算，不算 WriteRequest 本身的开销
+		w.pendingSize += tss[i].Size()
+		if len(w.pending) >= w.MaxSeriesPerRequest || w.pendingSize >= w.MaxBlockSize {
+			w.flushPendingLocked()
+		}
+	}
+}
+
+func (w *Writer) flushPending() {
+	w.pendingLock.Lock()
+	w.flushPendingLocked()
+	w.pendingLock.Unlock()
+}
+
+func (w *Writer) flushPendingLocked() {
+	if len(w.pending) == 0 {
+		return
+	}
+
+	wr := prompbmarshal.WriteRequest{
+		Timeseries: w.pending,
+	}
+
+	bs, err := wr.Marshal()
+	if err != nil {
+		logger.Warnf("cannot marshal WriteRequest: %s", err)
+	} else {
+		w.queue.Push(snappy.Encode(nil, bs))
+	}
+
+	w.pending = prompbmarshal.ResetTimeSeries(w.pending)
+	w.pendingSize = 0
+}
+
+// startFlusher 定期把缓冲区里的数据发出去，避免量小的时候数据迟迟攒不够一个请求
+func (w *Writer) startFlusher() {
+	defer close(w.flusherDone)
+
+	ticker := time.NewTicker(w.FlushInterval.Duration())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.stopCh:
+			return
+		case <-ticker.C:
+			w.flushPending()
+		}
+	}
+}
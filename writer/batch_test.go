@@ -0,0 +1,172 @@
+package writer
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cprobe/cprobe/lib/prompb"
+	"github.com/cprobe/cprobe/lib/prompbmarshal"
+	"github.com/cprobe/cprobe/lib/promutils"
+	"github.com/golang/snappy"
+)
+
+// testQueue 代替真正的队列和 sender，记录每个请求里的 series
+type testQueue struct {
+	mu     sync.Mutex
+	blocks [][]string
+}
+
+func (q *testQueue) Push(block []byte) {
+	bs, err := snappy.Decode(nil, block)
+	if err != nil {
+		panic(err)
+	}
+	var wr prompb.WriteRequest
+	if err := wr.Unmarshal(bs); err != nil {
+		panic(err)
+	}
+	var ids []string
+	for _, ts := range wr.Timeseries {
+		for _, label := range ts.Labels {
+			if string(label.Name) == "id" {
+				ids = append(ids, string(label.Value))
+			}
+		}
+	}
+
+	q.mu.Lock()
+	q.blocks = append(q.blocks, ids)
+	q.mu.Unlock()
+}
+
+func (q *testQueue) Pop() ([]byte, func(), bool) { return nil, nil, false }
+
+func (q *testQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.blocks)
+}
+
+func (q *testQueue) MustClose() {}
+
+// batchSizes 返回每个请求里的 series 数量
+func (q *testQueue) batchSizes() []int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	sizes := make([]int, len(q.blocks))
+	for i, ids := range q.blocks {
+		sizes[i] = len(ids)
+	}
+	return sizes
+}
+
+func newTestBatchSeries(start, n int) []prompbmarshal.TimeSeries {
+	tss := make([]prompbmarshal.TimeSeries, 0, n)
+	for i := start; i < start+n; i++ {
+		tss = append(tss, prompbmarshal.TimeSeries{
+			Labels: []prompbmarshal.Label{
+				{Name: "__name__", Value: "up"},
+				{Name: "id", Value: strconv.Itoa(i)},
+			},
+			Samples: []prompbmarshal.Sample{{Value: 1, Timestamp: 1700000000000}},
+		})
+	}
+	return tss
+}
+
+func TestAddTimeSeriesBatches(t *testing.T) {
+	seriesSize := newTestBatchSeries(0, 1)[0].Size()
+
+	f := func(maxSeries, maxBlockSize int, batches []int, want []int) {
+		t.Helper()
+		q := &testQueue{}
+		w := &Writer{
+			MaxSeriesPerRequest: maxSeries,
+			MaxBlockSize:        maxBlockSize,
+			queue:               q,
+		}
+		start := 0
+		for _, n := range batches {
+			w.addTimeSeries(newTestBatchSeries(start, n))
+			start += n
+		}
+		// Close 的时候把缓冲区里剩下的数据打包
+		w.flushPending()
+
+		got := q.batchSizes()
+		if len(got) != len(want) {
+			t.Fatalf("unexpected batches; got %v; want %v", got, want)
+		}
+		for i := range got {
+			if got[i] != want[i] {
+				t.Fatalf("unexpected batches; got %v; want %v", got, want)
+			}
+		}
+
+		// series 的顺序不变，也不会重复或者丢失
+		next := 0
+		for _, ids := range q.blocks {
+			for _, id := range ids {
+				if id != strconv.Itoa(next) {
+					t.Fatalf("unexpected series %s; want %d", id, next)
+				}
+				next++
+			}
+		}
+	}
+
+	// max_series_per_request，多个 target 的数据合并到一个请求里，超过的拆到下一个请求
+	f(3, 1<<20, []int{2, 5}, []int{3, 3, 1})
+	f(3, 1<<20, []int{1, 1, 1}, []int{3})
+	f(3, 1<<20, []int{6}, []int{3, 3})
+	f(100, 1<<20, []int{2, 5}, []int{7})
+
+	// max_block_size，按估算的大小拆分
+	f(100, 2*seriesSize, []int{5}, []int{2, 2, 1})
+	f(100, 2*seriesSize+1, []int{5}, []int{3, 2})
+
+	// 两个条件满足任一个就打包
+	f(2, 3*seriesSize, []int{5}, []int{2, 2, 1})
+	f(3, 2*seriesSize, []int{5}, []int{2, 2, 1})
+
+	// 没有数据的时候不发送空请求
+	f(3, 1<<20, nil, []int{})
+}
+
+func TestStartFlusher(t *testing.T) {
+	q := &testQueue{}
+	w := &Writer{
+		MaxSeriesPerRequest: 100,
+		MaxBlockSize:        1 << 20,
+		FlushInterval:       promutils.NewDuration(20 * time.Millisecond),
+		queue:               q,
+		stopCh:              make(chan struct{}),
+		flusherDone:         make(chan struct{}),
+	}
+	go w.startFlusher()
+	defer func() {
+		close(w.stopCh)
+		<-w.flusherDone
+	}()
+
+	// 数据量攒不够一个请求，到了 flush_interval 也要发出去
+	w.addTimeSeries(newTestBatchSeries(0, 2))
+	deadline := time.Now().Add(5 * time.Second)
+	for q.Len() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("pending series aren't flushed after flush_interval")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := q.batchSizes(); len(got) != 1 || got[0] != 2 {
+		t.Fatalf("unexpected batches after flush_interval; got %v; want [2]", got)
+	}
+
+	// 缓冲区空了之后不会发送空请求
+	time.Sleep(100 * time.Millisecond)
+	if got := q.batchSizes(); len(got) != 1 {
+		t.Fatalf("unexpected batches for empty buffer; got %v; want [2]", got)
+	}
+}
@@ -4,9 +4,7 @@ import (
 	"fmt"
 	"strings"
 
-	"github.com/cprobe/cprobe/lib/logger"
 	"github.com/cprobe/cprobe/lib/prompbmarshal"
-	"github.com/golang/snappy"
 )
 
 func WriteTimeSeries(tss []prompbmarshal.TimeSeries) {
@@ -38,36 +36,59 @@ func WriteTimeSeries(tss []prompbmarshal.TimeSeries) {
 		new(relabelCtx).appendExtraLabels(tss, WriterConfig.Global.ExtraLabels.Labels)
 	}
 
-	if len(WriterConfig.Writers) == 1 {
-		WriterConfig.Writers[0].writeTimeSeries(tss)
+	tss = WriterConfig.Global.aggregators.Push(tss)
+	writeToWriters(tss)
+}
+
+// writeToWriters 把 series 分发给各个 writer，全局流式聚合的结果也从这里发出去
+func writeToWriters(tss []prompbmarshal.TimeSeries) {
+	if len(tss) == 0 {
 		return
 	}
 
-	for i := range WriterConfig.Writers {
-		if i == len(WriterConfig.Writers)-1 {
+	routes := WriterConfig.router.route(tss)
+
+	last := -1
+	for i := range routes {
+		if len(routes[i]) > 0 {
+			last = i
+		}
+	}
+
+	for i := range routes {
+		if len(routes[i]) == 0 {
+			continue
+		}
+
+		if i == last {
 			// last one
-			WriterConfig.Writers[i].writeTimeSeries(tss)
+			WriterConfig.Writers[i].writeTimeSeries(routes[i])
 		} else {
-			newVectors := make([]prompbmarshal.TimeSeries, len(tss))
-			for j := range tss {
-				newVectors[j] = prompbmarshal.TimeSeries{
-					Labels:  make([]prompbmarshal.Label, 0, len(tss[j].Labels)),
-					Samples: tss[j].Samples,
-				}
-				newVectors[j].Labels = append(newVectors[j].Labels, tss[j].Labels...)
-			}
-			WriterConfig.Writers[i].writeTimeSeries(newVectors)
+			WriterConfig.Writers[i].writeTimeSeries(cloneTimeSeries(routes[i]))
 		}
 	}
 }
 
 func (w *Writer) writeTimeSeries(tss []prompbmarshal.TimeSeries) {
+	tss = w.relabelTimeSeries(tss)
+
+	tss = w.aggregators.Push(tss)
+	if len(tss) == 0 {
+		return
+	}
+
+	w.addTimeSeries(tss)
+}
+
+// relabelTimeSeries 追加 writer 的 extra_labels，然后做全局和 writer 自己的 metric_relabel_configs
+func (w *Writer) relabelTimeSeries(tss []prompbmarshal.TimeSeries) []prompbmarshal.TimeSeries {
 	// append writer extra labels
 	if w.ExtraLabels != nil && len(w.ExtraLabels.Labels) > 0 {
 		new(relabelCtx).appendExtraLabels(tss, w.ExtraLabels.Labels)
 	}
 
 	// relabel
+	count := len(tss)
 	if WriterConfig.Global.ParsedRelabelConfigs.Len() > 0 {
 		tss = new(relabelCtx).applyRelabeling(tss, WriterConfig.Global.ParsedRelabelConfigs)
 	}
@@ -75,22 +96,47 @@ func (w *Writer) writeTimeSeries(tss []prompbmarshal.TimeSeries) {
 	if w.ParsedRelabelConfigs.Len() > 0 {
 		tss = new(relabelCtx).applyRelabeling(tss, w.ParsedRelabelConfigs)
 	}
+	w.seriesDropped.Add(count - len(tss))
 
-	req := prompbmarshal.WriteRequest{
-		Timeseries: tss,
+	return tss
+}
+
+// DryRun returns the series, which would be sent to every writer for tss, keyed by writer url.
+//
+// tss is passed through the same extra_labels, routing and metric_relabel_configs as WriteTimeSeries does,
+// but nothing is sent. Stream aggregation is skipped, since it needs samples over an interval.
+// tss is returned under an empty key if no writers are configured.
+func DryRun(tss []prompbmarshal.TimeSeries) map[string][]prompbmarshal.TimeSeries {
+	tss = cloneTimeSeries(tss)
+
+	if *writerDisable || len(WriterConfig.Writers) == 0 {
+		return map[string][]prompbmarshal.TimeSeries{"": tss}
 	}
 
-	bs, err := req.Marshal()
-	if err != nil {
-		logger.Warnf("cannot marshal WriteRequest: %s", err)
-		return
+	if WriterConfig.Global != nil && WriterConfig.Global.ExtraLabels != nil && len(WriterConfig.Global.ExtraLabels.Labels) > 0 {
+		new(relabelCtx).appendExtraLabels(tss, WriterConfig.Global.ExtraLabels.Labels)
 	}
 
-	httpReq, err := w.NewRequest(snappy.Encode(nil, bs))
-	if err != nil {
-		logger.Warnf("cannot create http request: %s", err)
-		return
+	ret := make(map[string][]prompbmarshal.TimeSeries)
+	routes := WriterConfig.router.route(tss)
+	for i := range routes {
+		if len(routes[i]) == 0 {
+			continue
+		}
+		w := WriterConfig.Writers[i]
+		ret[w.URL] = append(ret[w.URL], w.relabelTimeSeries(cloneTimeSeries(routes[i]))...)
 	}
+	return ret
+}
 
-	w.RequestQueue.PushFront(httpReq)
+// cloneTimeSeries 复制 labels，relabel 会原地修改 labels
+func cloneTimeSeries(tss []prompbmarshal.TimeSeries) []prompbmarshal.TimeSeries {
+	ret := make([]prompbmarshal.TimeSeries, len(tss))
+	for i := range tss {
+		ret[i] = prompbmarshal.TimeSeries{
+			Labels:  append(make([]prompbmarshal.Label, 0, len(tss[i].Labels)), tss[i].Labels...),
+			Samples: tss[i].Samples,
+		}
+	}
+	return ret
 }
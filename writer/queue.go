@@ -0,0 +1,75 @@
+package writer
+
+import (
+	"github.com/cprobe/cprobe/lib/listx"
+	"github.com/cprobe/cprobe/lib/persistentqueue"
+)
+
+// blockQueue 缓存待发送的数据，每个 block 是一个 snappy 压缩之后的 WriteRequest
+type blockQueue interface {
+	Push(block []byte)
+	// Pop 取出最早写入的 block，队列为空时 ok 为 false
+	// block 处理完之后（无论发送成功还是放弃）必须调用 done，磁盘队列在 done 之后才会真正删掉这个 block
+	Pop() (block []byte, done func(), ok bool)
+	Len() int
+	MustClose()
+}
+
+// memoryQueue 是默认的内存队列，进程退出时队列里的数据会丢失
+type memoryQueue struct {
+	list *listx.SafeList[[]byte]
+}
+
+func newMemoryQueue() *memoryQueue {
+	return &memoryQueue{
+		list: listx.NewSafeList[[]byte](),
+	}
+}
+
+func (mq *memoryQueue) Push(block []byte) {
+	mq.list.PushFront(block)
+}
+
+func (mq *memoryQueue) Pop() ([]byte, func(), bool) {
+	bs := mq.list.PopBackN(1)
+	if len(bs) == 0 {
+		return nil, nil, false
+	}
+	return bs[0], func() {}, true
+}
+
+func (mq *memoryQueue) Len() int {
+	return mq.list.Len()
+}
+
+func (mq *memoryQueue) MustClose() {}
+
+// diskQueue 把数据落盘，remote write 后端不可用或者 cprobe 重启时数据不丢
+type diskQueue struct {
+	pq *persistentqueue.Queue
+}
+
+func newDiskQueue(path string, maxDiskUsageBytes int64) *diskQueue {
+	if maxDiskUsageBytes < 0 {
+		maxDiskUsageBytes = 0
+	}
+	return &diskQueue{
+		pq: persistentqueue.MustOpen(path, uint64(maxDiskUsageBytes)),
+	}
+}
+
+func (dq *diskQueue) Push(block []byte) {
+	dq.pq.MustWriteBlock(block)
+}
+
+func (dq *diskQueue) Pop() ([]byte, func(), bool) {
+	return dq.pq.MustReadBlockNonblocking(nil)
+}
+
+func (dq *diskQueue) Len() int {
+	return dq.pq.PendingBlocks()
+}
+
+func (dq *diskQueue) MustClose() {
+	dq.pq.MustClose()
+}
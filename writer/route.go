@@ -0,0 +1,121 @@
+package writer
+
+import (
+	"github.com/cespare/xxhash/v2"
+	"github.com/cprobe/cprobe/lib/prompbmarshal"
+)
+
+// router 决定每条 series 发给哪些 writer
+//
+// 没有配置 shard_group 的 writer，只要 match 匹配（不配置 match 就是全部匹配）就会收到这条 series；
+// shard_group 相同的一组 writer 分摊数据，每条 series 只发给组内 match 匹配的 writer 中的一个，
+// 用 rendezvous hashing 选择，组内增减 writer 的时候只有少量 series 会换到别的 writer 上
+type router struct {
+	writers []*Writer
+	// 没有配置 shard_group 的 writer 在 writers 中的下标
+	standalone []int
+	// 每个 shard_group 里的 writer 在 writers 中的下标
+	shardGroups [][]int
+	// 所有 writer 都没有配置 match 和 shard_group，每条 series 发给所有 writer，不用逐条判断
+	fanout bool
+}
+
+func newRouter(writers []*Writer) *router {
+	r := &router{
+		writers: writers,
+		fanout:  true,
+	}
+
+	groupIdx := make(map[string]int)
+	for i, w := range writers {
+		if w.match != nil || w.ShardGroup != "" {
+			r.fanout = false
+		}
+
+		if w.ShardGroup == "" {
+			r.standalone = append(r.standalone, i)
+			continue
+		}
+
+		idx, has := groupIdx[w.ShardGroup]
+		if !has {
+			idx = len(r.shardGroups)
+			groupIdx[w.ShardGroup] = idx
+			r.shardGroups = append(r.shardGroups, nil)
+		}
+		r.shardGroups[idx] = append(r.shardGroups[idx], i)
+	}
+
+	return r
+}
+
+// route 返回的 slice 和 writers 一一对应，是每个 writer 要发送的 series，返回的 series 和 tss 共用 labels
+func (r *router) route(tss []prompbmarshal.TimeSeries) [][]prompbmarshal.TimeSeries {
+	ret := make([][]prompbmarshal.TimeSeries, len(r.writers))
+
+	if r.fanout {
+		for i := range ret {
+			ret[i] = tss
+		}
+		return ret
+	}
+
+	for i := range tss {
+		labels := tss[i].Labels
+
+		for _, idx := range r.standalone {
+			if r.writers[idx].match.Match(labels) {
+				ret[idx] = append(ret[idx], tss[i])
+			}
+		}
+
+		if len(r.shardGroups) == 0 {
+			continue
+		}
+
+		h := labelsHash(labels)
+		for _, group := range r.shardGroups {
+			best := -1
+			var bestScore uint64
+			for _, idx := range group {
+				w := r.writers[idx]
+				if !w.match.Match(labels) {
+					continue
+				}
+				score := mix64(h ^ w.shardKey)
+				if best < 0 || score > bestScore {
+					best = idx
+					bestScore = score
+				}
+			}
+			if best >= 0 {
+				ret[best] = append(ret[best], tss[i])
+			}
+		}
+	}
+
+	return ret
+}
+
+// labelsHash 和 labels 的顺序无关，同一个 series 每次都落到同一个 writer 上
+func labelsHash(labels []prompbmarshal.Label) uint64 {
+	var h uint64
+	var buf []byte
+	for i := range labels {
+		buf = append(buf[:0], labels[i].Name...)
+		buf = append(buf, 0xff)
+		buf = append(buf, labels[i].Value...)
+		h += xxhash.Sum64(buf)
+	}
+	return h
+}
+
+// mix64 is the finalizer from splitmix64, see https://prng.di.unimi.it/splitmix64.c
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
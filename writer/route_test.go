@@ -0,0 +1,181 @@
+package writer
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/cprobe/cprobe/lib/prompbmarshal"
+	"github.com/cprobe/cprobe/lib/promrelabel"
+)
+
+func newTestWriter(t *testing.T, url, match, shardGroup string) *Writer {
+	t.Helper()
+	w := &Writer{
+		URL:        url,
+		ShardGroup: shardGroup,
+	}
+	if match != "" {
+		w.Match = &promrelabel.IfExpression{}
+		if err := w.Match.Parse(match); err != nil {
+			t.Fatalf("cannot parse match %q: %s", match, err)
+		}
+	}
+	if err := w.parseRelabeling(); err != nil {
+		t.Fatalf("cannot parse relabeling for writer %s: %s", url, err)
+	}
+	return w
+}
+
+func newTestSeries(job, instance string) prompbmarshal.TimeSeries {
+	return prompbmarshal.TimeSeries{
+		Labels: []prompbmarshal.Label{
+			{Name: "__name__", Value: "up"},
+			{Name: "job", Value: job},
+			{Name: "instance", Value: instance},
+		},
+	}
+}
+
+// routedInstances 返回每个 writer 收到的 series 的 instance label
+func routedInstances(ret [][]prompbmarshal.TimeSeries) [][]string {
+	result := make([][]string, len(ret))
+	for i, tss := range ret {
+		for _, ts := range tss {
+			for _, label := range ts.Labels {
+				if label.Name == "instance" {
+					result[i] = append(result[i], label.Value)
+				}
+			}
+		}
+	}
+	return result
+}
+
+func TestRouterRoute(t *testing.T) {
+	f := func(writers []*Writer, tss []prompbmarshal.TimeSeries, want [][]string) {
+		t.Helper()
+		got := routedInstances(newRouter(writers).route(tss))
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("unexpected routing\ngot\n%q\nwant\n%q", got, want)
+		}
+	}
+
+	tss := []prompbmarshal.TimeSeries{
+		newTestSeries("mysql", "db1"),
+		newTestSeries("redis", "cache1"),
+		newTestSeries("kafka", "mq1"),
+	}
+
+	// 没有 match 和 shard_group 的 writer 收到所有 series
+	f([]*Writer{
+		newTestWriter(t, "http://a/api/v1/write", "", ""),
+		newTestWriter(t, "http://b/api/v1/write", "", ""),
+	}, tss, [][]string{
+		{"db1", "cache1", "mq1"},
+		{"db1", "cache1", "mq1"},
+	})
+
+	// 配置了 match 的 writer 只收到匹配的 series，不配置 match 的 writer 收到所有 series，一条 series 可以发给多个 writer；
+	// 没有任何 writer 匹配的 series 不发送
+	f([]*Writer{
+		newTestWriter(t, "http://mysql/api/v1/write", `{job="mysql"}`, ""),
+		newTestWriter(t, "http://db/api/v1/write", `{job=~"mysql|redis"}`, ""),
+		newTestWriter(t, "http://default/api/v1/write", "", ""),
+	}, tss, [][]string{
+		{"db1"},
+		{"db1", "cache1"},
+		{"db1", "cache1", "mq1"},
+	})
+	f([]*Writer{
+		newTestWriter(t, "http://mysql/api/v1/write", `{job="mysql"}`, ""),
+		newTestWriter(t, "http://redis/api/v1/write", `{job="redis"}`, ""),
+	}, tss, [][]string{
+		{"db1"},
+		{"cache1"},
+	})
+
+	// shard_group 里只有 match 匹配的 writer 参与分摊，组内没有匹配的 writer 的话这个组不发送，
+	// 不影响 shard_group 之外的 writer
+	f([]*Writer{
+		newTestWriter(t, "http://shard-mysql/api/v1/write", `{job="mysql"}`, "shard"),
+		newTestWriter(t, "http://shard-redis/api/v1/write", `{job="redis"}`, "shard"),
+		newTestWriter(t, "http://default/api/v1/write", "", ""),
+	}, tss, [][]string{
+		{"db1"},
+		{"cache1"},
+		{"db1", "cache1", "mq1"},
+	})
+}
+
+func TestRouterShardGroup(t *testing.T) {
+	var tss []prompbmarshal.TimeSeries
+	for i := 0; i < 1000; i++ {
+		tss = append(tss, newTestSeries("mysql", fmt.Sprintf("db%d", i)))
+	}
+
+	members := []*Writer{
+		newTestWriter(t, "http://vm1/api/v1/write", "", "vm"),
+		newTestWriter(t, "http://vm2/api/v1/write", "", "vm"),
+		newTestWriter(t, "http://vm3/api/v1/write", "", "vm"),
+	}
+	standalone := newTestWriter(t, "http://backup/api/v1/write", "", "")
+
+	assignment := func(writers []*Writer) map[string]string {
+		t.Helper()
+		ret := newRouter(writers).route(tss)
+		m := make(map[string]string, len(tss))
+		for i, instances := range routedInstances(ret) {
+			if writers[i].ShardGroup == "" {
+				if len(instances) != len(tss) {
+					t.Fatalf("writer %s without shard_group must receive all the %d series; got %d", writers[i].URL, len(tss), len(instances))
+				}
+				continue
+			}
+			for _, instance := range instances {
+				if prev, has := m[instance]; has {
+					t.Fatalf("series %s is sent to both %s and %s in the same shard_group", instance, prev, writers[i].URL)
+				}
+				m[instance] = writers[i].URL
+			}
+		}
+		if len(m) != len(tss) {
+			t.Fatalf("every series must be sent to exactly one writer in the shard_group; got %d of %d", len(m), len(tss))
+		}
+		return m
+	}
+
+	before := assignment(append([]*Writer{standalone}, members...))
+
+	// 每个 writer 都分到一部分数据
+	perWriter := make(map[string]int)
+	for _, url := range before {
+		perWriter[url]++
+	}
+	for _, w := range members {
+		if n := perWriter[w.URL]; n < len(tss)/10 {
+			t.Fatalf("too few series are sent to %s: %d of %d", w.URL, n, len(tss))
+		}
+	}
+
+	// 同样的 writers 每次的分配结果都一样，和 writer 的顺序无关
+	again := assignment([]*Writer{members[2], members[0], standalone, members[1]})
+	if !reflect.DeepEqual(before, again) {
+		t.Fatalf("shard assignment must be stable")
+	}
+
+	// 去掉一个 writer 之后，只有原来发给它的 series 换到别的 writer 上
+	removed := members[1].URL
+	after := assignment([]*Writer{standalone, members[0], members[2]})
+	for instance, url := range before {
+		if url == removed {
+			if after[instance] == removed {
+				t.Fatalf("series %s is still sent to the removed writer", instance)
+			}
+			continue
+		}
+		if after[instance] != url {
+			t.Fatalf("series %s moved from %s to %s after removing %s", instance, url, after[instance], removed)
+		}
+	}
+}
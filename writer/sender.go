@@ -1,51 +1,182 @@
 package writer
 
 import (
+	"io"
+	"math/rand"
 	"net/http"
-	"strings"
+	"strconv"
 	"time"
 
 	"github.com/cprobe/cprobe/lib/logger"
 )
 
 func (w *Writer) StartSender() {
+	defer close(w.senderDone)
+
 	semaphone := make(chan struct{}, w.Concurrency)
 
 	for {
-		rs := w.RequestQueue.PopBackN(1)
-		if len(rs) == 0 {
-			time.Sleep(time.Millisecond * 300)
+		select {
+		case <-w.stopCh:
+			return
+		default:
+		}
+
+		block, done, ok := w.queue.Pop()
+		if !ok {
+			select {
+			case <-w.stopCh:
+				return
+			case <-time.After(time.Millisecond * 300):
+			}
 			continue
 		}
 
-		semaphone <- struct{}{}
-		go func(req *http.Request) {
+		select {
+		case <-w.stopCh:
+			// 没有调用 done，磁盘队列里的这个 block 重启之后会再次发送
+			return
+		case semaphone <- struct{}{}:
+		}
+
+		go func(block []byte) {
 			defer func() {
 				<-semaphone
 			}()
 
-			w.send(req)
-		}(rs[0])
+			if w.send(block) {
+				done()
+			}
+		}(block)
 	}
 }
 
-func (w *Writer) send(req *http.Request) {
+// send 发送一个 block，返回 false 表示 writer 正在关闭，block 还没有处理完
+func (w *Writer) send(block []byte) bool {
+	var delay time.Duration
 	for i := 0; i < w.RetryTimes; i++ {
-		res, err := w.Client.Do(req)
-		if err == nil {
-			if res.StatusCode/100 != 2 {
-				logger.Errorf("unexpected status code %d from %q", res.StatusCode, req.URL)
-				return
+		if i > 0 {
+			w.retries.Inc()
+			if !w.sleep(delay) {
+				return false
 			}
-			return
 		}
 
-		if strings.Contains(err.Error(), "onnection") {
-			logger.Errorf("error sending request to %q: %s, retry #%d", req.URL, err, i+1)
-			time.Sleep(time.Duration(w.RequestTimeoutMillis) * time.Millisecond)
+		// http.Request 的 body 发送一次之后就读不出来了，每次重试都要重新构造
+		req, err := w.NewRequest(block)
+		if err != nil {
+			logger.Errorf("cannot create http request: %s", err)
+			w.requestsRejected.Inc()
+			return true
+		}
+
+		res, err := w.Client.Do(req)
+		if err != nil {
+			w.errors.Inc()
+			w.requestsFailed.Inc()
+			delay = w.retryDelay(i, 0)
+			logger.Errorf("error sending request to %q: %s, attempt #%d, next retry in %s", w.URL, err, i+1, delay)
 			continue
 		}
 
-		logger.Errorf("error sending request to %q: %s", req.URL, err)
+		if res.StatusCode/100 == 2 {
+			_, _ = io.Copy(io.Discard, res.Body)
+			res.Body.Close()
+			w.requestsOK.Inc()
+			w.bytesSent.Add(len(block))
+			return true
+		}
+
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		res.Body.Close()
+		w.requestsFailed.Inc()
+
+		// 4xx 一般是数据本身有问题，重试也没用，直接丢掉，429 除外
+		if res.StatusCode != http.StatusTooManyRequests && res.StatusCode/100 != 5 {
+			logger.Errorf("unexpected status code %d from %q, dropping the request: %s", res.StatusCode, w.URL, body)
+			w.requestsRejected.Inc()
+			return true
+		}
+
+		delay = w.retryDelay(i, parseRetryAfter(res.Header.Get("Retry-After")))
+		logger.Errorf("unexpected status code %d from %q: %s, attempt #%d, next retry in %s", res.StatusCode, w.URL, body, i+1, delay)
+	}
+
+	logger.Errorf("cannot send request to %q after %d attempts, dropping it", w.URL, w.RetryTimes)
+	w.retriesExhausted.Inc()
+	return true
+}
+
+// retryDelay 计算第 attempt 次失败之后的等待时间
+// 服务端给了 Retry-After 就听服务端的，但最长不超过 max_retry_interval_millis，避免一个异常的响应让 sender 停很久；
+// 否则从 retry_interval_millis 开始指数退避，最长 max_retry_interval_millis，并加上随机抖动
+func (w *Writer) retryDelay(attempt int, retryAfter time.Duration) time.Duration {
+	minInterval := time.Duration(w.RetryIntervalMillis) * time.Millisecond
+	maxInterval := time.Duration(w.MaxRetryIntervalMillis) * time.Millisecond
+
+	if retryAfter > 0 {
+		if retryAfter > maxInterval {
+			return maxInterval
+		}
+		return retryAfter
+	}
+
+	interval := minInterval
+	for i := 0; i < attempt && interval < maxInterval; i++ {
+		interval *= 2
+	}
+	if interval > maxInterval {
+		interval = maxInterval
+	}
+
+	// 在 [interval/2, interval) 之间随机，避免多个 cprobe 同时重试，但不小于 retry_interval_millis
+	half := interval / 2
+	if half <= 0 {
+		return interval
+	}
+	delay := half + time.Duration(rand.Int63n(int64(half)))
+	if delay < minInterval {
+		delay = minInterval
+	}
+	return delay
+}
+
+// sleep 返回 false 表示 writer 正在关闭
+func (w *Writer) sleep(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-w.stopCh:
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// parseRetryAfter 解析 Retry-After header，支持秒数和 HTTP 日期两种格式
+// see https://developer.mozilla.org/en-US/docs/Web/HTTP/Headers/Retry-After
+func parseRetryAfter(s string) time.Duration {
+	if s == "" {
+		return 0
+	}
+
+	if secs, err := strconv.Atoi(s); err == nil {
+		if secs <= 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+
+	t, err := http.ParseTime(s)
+	if err != nil {
+		logger.Warnf("cannot parse Retry-After header %q: %s", s, err)
+		return 0
+	}
+
+	d := time.Until(t)
+	if d < 0 {
+		return 0
 	}
+	return d
 }
@@ -0,0 +1,70 @@
+package writer
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	f := func(s string, want time.Duration) {
+		t.Helper()
+		if got := parseRetryAfter(s); got != want {
+			t.Fatalf("unexpected result for parseRetryAfter(%q); got %s; want %s", s, got, want)
+		}
+	}
+
+	// seconds
+	f("", 0)
+	f("0", 0)
+	f("-5", 0)
+	f("120", 2*time.Minute)
+
+	// invalid values
+	f("soon", 0)
+	f("1.5", 0)
+
+	// HTTP-date in the past
+	f("Wed, 21 Oct 2015 07:28:00 GMT", 0)
+
+	// HTTP-date in the future
+	got := parseRetryAfter(time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+	if got <= 58*time.Minute || got > time.Hour {
+		t.Fatalf("unexpected result for HTTP-date an hour later; got %s", got)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	w := &Writer{
+		RetryIntervalMillis:    1000,
+		MaxRetryIntervalMillis: 10000,
+	}
+
+	// Retry-After is used as is, but is capped by max_retry_interval_millis
+	f := func(retryAfter, want time.Duration) {
+		t.Helper()
+		if got := w.retryDelay(0, retryAfter); got != want {
+			t.Fatalf("unexpected delay for Retry-After %s; got %s; want %s", retryAfter, got, want)
+		}
+	}
+	f(5*time.Second, 5*time.Second)
+	f(10*time.Second, 10*time.Second)
+	f(3*time.Hour, 10*time.Second)
+
+	// exponential backoff with jitter in [max(interval/2, retry_interval_millis), interval)
+	fRange := func(attempt int, min, max time.Duration) {
+		t.Helper()
+		for i := 0; i < 100; i++ {
+			got := w.retryDelay(attempt, 0)
+			if got < min || got >= max {
+				t.Fatalf("unexpected delay for attempt %d; got %s; want [%s, %s)", attempt, got, min, max)
+			}
+		}
+	}
+	fRange(0, time.Second, time.Second+1)
+	fRange(1, time.Second, 2*time.Second)
+	fRange(2, 2*time.Second, 4*time.Second)
+	fRange(3, 4*time.Second, 8*time.Second)
+	fRange(4, 5*time.Second, 10*time.Second)
+	fRange(100, 5*time.Second, 10*time.Second)
+}
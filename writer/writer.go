@@ -7,16 +7,22 @@ import (
 	"net/http"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/cespare/xxhash/v2"
+	"github.com/cprobe/cprobe/flags"
 	"github.com/cprobe/cprobe/lib/cgroup"
 	"github.com/cprobe/cprobe/lib/clienttls"
 	"github.com/cprobe/cprobe/lib/fileutil"
 	"github.com/cprobe/cprobe/lib/httpproxy"
-	"github.com/cprobe/cprobe/lib/listx"
+	"github.com/cprobe/cprobe/lib/logger"
 	"github.com/cprobe/cprobe/lib/netutil"
+	"github.com/cprobe/cprobe/lib/prompbmarshal"
 	"github.com/cprobe/cprobe/lib/promrelabel"
 	"github.com/cprobe/cprobe/lib/promutils"
+	"github.com/cprobe/cprobe/lib/streamaggr"
 	"github.com/pkg/errors"
 )
 
@@ -27,26 +33,72 @@ var (
 )
 
 type Writer struct {
-	URL                  string                      `yaml:"url"`
-	RetryTimes           int                         `yaml:"retry_times"`
-	RetryIntervalMillis  int64                       `yaml:"retry_interval_millis"`
-	BasicAuthUser        string                      `yaml:"basic_auth_user"`
-	BasicAuthPass        string                      `yaml:"basic_auth_pass"`
-	Headers              []string                    `yaml:"headers"`
-	ConnectTimeoutMillis int64                       `yaml:"connect_timeout_millis"`
-	RequestTimeoutMillis int64                       `yaml:"request_timeout_millis"`
-	MaxIdleConnsPerHost  int                         `yaml:"max_idle_conns_per_host"`
-	Concurrency          int                         `yaml:"concurrency"`
-	ProxyURL             string                      `yaml:"proxy_url"`
-	Interface            string                      `yaml:"interface"`
-	FollowRedirects      bool                        `yaml:"follow_redirects"`
-	ExtraLabels          *promutils.Labels           `yaml:"extra_labels"`
-	RelabelConfigs       []promrelabel.RelabelConfig `yaml:"metric_relabel_configs"`
-	ParsedRelabelConfigs *promrelabel.ParsedConfigs  `yaml:"-"`
+	URL                    string                      `yaml:"url"`
+	RetryTimes             int                         `yaml:"retry_times"`
+	RetryIntervalMillis    int64                       `yaml:"retry_interval_millis"`
+	MaxRetryIntervalMillis int64                       `yaml:"max_retry_interval_millis"`
+	BasicAuthUser          string                      `yaml:"basic_auth_user"`
+	BasicAuthPass          string                      `yaml:"basic_auth_pass" secret:"true"`
+	Headers                []string                    `yaml:"headers"`
+	ConnectTimeoutMillis   int64                       `yaml:"connect_timeout_millis"`
+	RequestTimeoutMillis   int64                       `yaml:"request_timeout_millis"`
+	MaxIdleConnsPerHost    int                         `yaml:"max_idle_conns_per_host"`
+	Concurrency            int                         `yaml:"concurrency"`
+	ProxyURL               string                      `yaml:"proxy_url"`
+	Interface              string                      `yaml:"interface"`
+	FollowRedirects        bool                        `yaml:"follow_redirects"`
+	ExtraLabels            *promutils.Labels           `yaml:"extra_labels"`
+	RelabelConfigs         []promrelabel.RelabelConfig `yaml:"metric_relabel_configs"`
+	ParsedRelabelConfigs   *promrelabel.ParsedConfigs  `yaml:"-"`
+
+	// 只发送 match 匹配的 series，语法和 relabel 的 if 一样，比如 '{job="mysql"}'，if 是 match 的别名
+	// 判断用的是追加了 global extra_labels、还没有做 relabel 的 labels
+	Match *promrelabel.IfExpression `yaml:"match,omitempty"`
+	If    *promrelabel.IfExpression `yaml:"if,omitempty"`
+	// shard_group 相同的一组 writer 按 series 做一致性 hash 分摊数据，每条 series 只发给其中一个 writer
+	ShardGroup string `yaml:"shard_group,omitempty"`
+
+	// 对 relabel 之后的 series 做流式聚合，聚合结果只发给当前 writer
+	StreamAggrConfigs []*streamaggr.Config `yaml:"stream_aggr,omitempty"`
+
+	// 多个 target 的 series 先在内存里攒成一批，满足任一条件就打包成一个请求：
+	// series 数量达到 max_series_per_request，估算大小达到 max_block_size 字节，距离上次打包超过 flush_interval
+	MaxSeriesPerRequest int                 `yaml:"max_series_per_request"`
+	MaxBlockSize        int                 `yaml:"max_block_size"`
+	FlushInterval       *promutils.Duration `yaml:"flush_interval"`
+
+	// 配置了 tmp_data_path 之后，待发送的数据会先写到磁盘队列里，类似 vmagent 的 -remoteWrite.tmpDataPath
+	// 每个 writer 的数据放在 tmp_data_path 下以 url 的 hash 命名的子目录里
+	TmpDataPath string `yaml:"tmp_data_path"`
+	// 磁盘队列最多占用的空间，超过之后丢弃最老的数据，0 表示不限制
+	MaxDiskUsageBytes int64 `yaml:"max_disk_usage_bytes"`
 
 	clienttls.ClientConfig `yaml:",inline"`
-	Client                 *http.Client                   `yaml:"-"`
-	RequestQueue           *listx.SafeList[*http.Request] `yaml:"-"`
+	Client                 *http.Client `yaml:"-"`
+
+	match    *promrelabel.IfExpression
+	shardKey uint64
+
+	aggregators *streamaggr.Aggregators
+
+	queue      blockQueue
+	stopCh     chan struct{}
+	senderDone chan struct{}
+
+	pendingLock sync.Mutex
+	pending     []prompbmarshal.TimeSeries
+	pendingSize int
+	flusherDone chan struct{}
+
+	bytesSent      *metrics.Counter
+	requestsOK     *metrics.Counter
+	retries        *metrics.Counter
+	errors         *metrics.Counter
+	seriesDropped  *metrics.Counter
+	requestsFailed *metrics.Counter
+
+	requestsRejected *metrics.Counter
+	retriesExhausted *metrics.Counter
 }
 
 func (w *Writer) Parse() error {
@@ -66,6 +118,18 @@ func (w *Writer) Parse() error {
 		w.MaxIdleConnsPerHost = 2
 	}
 
+	if w.MaxSeriesPerRequest <= 0 {
+		w.MaxSeriesPerRequest = 10000
+	}
+
+	if w.MaxBlockSize <= 0 {
+		w.MaxBlockSize = 8 * 1024 * 1024
+	}
+
+	if w.FlushInterval == nil || w.FlushInterval.Duration() <= 0 {
+		w.FlushInterval = promutils.NewDuration(time.Second)
+	}
+
 	// http client
 	dialer := &net.Dialer{
 		Timeout: time.Duration(w.ConnectTimeoutMillis) * time.Millisecond,
@@ -110,14 +174,35 @@ func (w *Writer) Parse() error {
 		}
 	}
 
-	// relabel configs
-	w.ParsedRelabelConfigs, err = promrelabel.ParseRelabelConfigs(w.RelabelConfigs)
-	if err != nil {
+	if err = w.parseRelabeling(); err != nil {
 		return err
 	}
 
+	// stream aggregation
+	w.aggregators, err = streamaggr.NewAggregators(w.StreamAggrConfigs, w.addTimeSeries)
+	if err != nil {
+		return fmt.Errorf("cannot parse stream_aggr for writer %s: %w", w.URL, err)
+	}
+
 	// request queue
-	w.RequestQueue = listx.NewSafeList[*http.Request]()
+	if w.TmpDataPath != "" {
+		queuePath := filepath.Join(w.TmpDataPath, fmt.Sprintf("%016X", xxhash.Sum64String(w.URL)))
+		w.queue = newDiskQueue(queuePath, w.MaxDiskUsageBytes)
+	} else {
+		w.queue = newMemoryQueue()
+	}
+
+	// self metrics
+	metrics.GetOrCreateGauge(fmt.Sprintf(`cprobe_remotewrite_queue_length{url=%q}`, w.URL), func() float64 {
+		return float64(w.queue.Len())
+	})
+	w.bytesSent = metrics.GetOrCreateCounter(fmt.Sprintf(`cprobe_remotewrite_bytes_sent_total{url=%q}`, w.URL))
+	w.requestsOK = metrics.GetOrCreateCounter(fmt.Sprintf(`cprobe_remotewrite_requests_total{url=%q,status="ok"}`, w.URL))
+	w.requestsFailed = metrics.GetOrCreateCounter(fmt.Sprintf(`cprobe_remotewrite_requests_total{url=%q,status="failed"}`, w.URL))
+	w.retries = metrics.GetOrCreateCounter(fmt.Sprintf(`cprobe_remotewrite_retries_total{url=%q}`, w.URL))
+	w.errors = metrics.GetOrCreateCounter(fmt.Sprintf(`cprobe_remotewrite_errors_total{url=%q}`, w.URL))
+	w.requestsRejected = metrics.GetOrCreateCounter(fmt.Sprintf(`cprobe_remotewrite_requests_dropped_total{url=%q,reason="rejected"}`, w.URL))
+	w.retriesExhausted = metrics.GetOrCreateCounter(fmt.Sprintf(`cprobe_remotewrite_requests_dropped_total{url=%q,reason="retries_exhausted"}`, w.URL))
 
 	if w.RetryTimes <= 0 {
 		w.RetryTimes = 100
@@ -127,20 +212,75 @@ func (w *Writer) Parse() error {
 		w.RetryIntervalMillis = 3000
 	}
 
+	if w.MaxRetryIntervalMillis <= 0 {
+		w.MaxRetryIntervalMillis = 60000
+	}
+
+	if w.MaxRetryIntervalMillis < w.RetryIntervalMillis {
+		w.MaxRetryIntervalMillis = w.RetryIntervalMillis
+	}
+
+	w.stopCh = make(chan struct{})
+	w.senderDone = make(chan struct{})
+	w.flusherDone = make(chan struct{})
 	go w.StartSender()
+	go w.startFlusher()
+
+	return nil
+}
+
+// parseRelabeling 解析 relabel 和路由相关的配置，-test 模式下只需要这部分，不启动队列和 sender
+func (w *Writer) parseRelabeling() error {
+	// relabel configs
+	var err error
+	w.ParsedRelabelConfigs, err = promrelabel.ParseRelabelConfigs(w.RelabelConfigs)
+	if err != nil {
+		return err
+	}
+
+	// routing
+	if w.Match != nil && w.If != nil {
+		return fmt.Errorf("match and if cannot be set at the same time for writer %s", w.URL)
+	}
+	w.match = w.Match
+	if w.match == nil {
+		w.match = w.If
+	}
+	w.shardKey = xxhash.Sum64String(w.URL)
+
+	w.seriesDropped = metrics.GetOrCreateCounter(fmt.Sprintf(`cprobe_series_dropped_total{reason="writer_relabel",url=%q}`, w.URL))
 
 	return nil
 }
 
+// Close stops the sender and closes the queue.
+// The data, which is still in the disk queue, is sent after the restart.
+func (w *Writer) Close() {
+	w.aggregators.MustStop()
+	close(w.stopCh)
+	<-w.senderDone
+	<-w.flusherDone
+	// 缓冲区里还没打包的数据也放到队列里，磁盘队列的话重启之后还能发出去
+	w.flushPending()
+	w.queue.MustClose()
+}
+
 type Global struct {
 	ExtraLabels          *promutils.Labels           `yaml:"extra_labels"`
 	RelabelConfigs       []promrelabel.RelabelConfig `yaml:"metric_relabel_configs"`
 	ParsedRelabelConfigs *promrelabel.ParsedConfigs  `yaml:"-"`
+
+	// 全局的流式聚合，在分发给各个 writer 之前做，聚合结果和其他 series 一样按 match/shard_group 分发
+	StreamAggrConfigs []*streamaggr.Config `yaml:"stream_aggr,omitempty"`
+
+	aggregators *streamaggr.Aggregators
 }
 
 type WriterYaml struct {
 	Global  *Global   `yaml:"global"`
 	Writers []*Writer `yaml:"writers"`
+
+	router *router
 }
 
 func (wy *WriterYaml) Parse() (err error) {
@@ -155,6 +295,65 @@ func (wy *WriterYaml) Parse() (err error) {
 		return err
 	}
 
+	wy.router = newRouter(wy.Writers)
+
+	wy.Global.aggregators, err = streamaggr.NewAggregators(wy.Global.StreamAggrConfigs, writeToWriters)
+	if err != nil {
+		return fmt.Errorf("cannot parse global stream_aggr: %w", err)
+	}
+
+	return nil
+}
+
+// Close closes all the writers. It must be called before the process exits,
+// otherwise the data in disk queues could be sent twice after the restart.
+func Close() {
+	if WriterConfig.Global != nil {
+		WriterConfig.Global.aggregators.MustStop()
+	}
+	for i := range WriterConfig.Writers {
+		WriterConfig.Writers[i].Close()
+	}
+}
+
+// InitDryRun reads writer.yaml from configDirectory and parses only extra_labels, metric_relabel_configs,
+// match and shard_group, which are needed by DryRun.
+//
+// Neither queues nor senders are started, so it is safe to call while another cprobe
+// uses the same tmp_data_path. Close mustn't be called after InitDryRun.
+func InitDryRun(configDirectory string) error {
+	if *writerDisable {
+		return nil
+	}
+
+	writerFile := filepath.Join(configDirectory, "writer.yaml")
+	if !fileutil.IsFile(writerFile) {
+		return fmt.Errorf("writer.file %s does not exist", writerFile)
+	}
+
+	wy := &WriterYaml{}
+	if err := fileutil.ReadYaml(writerFile, wy); err != nil {
+		return errors.Wrap(err, "cannot read writer config")
+	}
+
+	if wy.Global == nil {
+		wy.Global = &Global{}
+	}
+
+	var err error
+	wy.Global.ParsedRelabelConfigs, err = promrelabel.ParseRelabelConfigs(wy.Global.RelabelConfigs)
+	if err != nil {
+		return errors.Wrap(err, "cannot parse global metric_relabel_configs")
+	}
+
+	for _, w := range wy.Writers {
+		if err := w.parseRelabeling(); err != nil {
+			return errors.Wrapf(err, "cannot parse writer %s", w.URL)
+		}
+	}
+	wy.router = newRouter(wy.Writers)
+
+	WriterConfig = wy
 	return nil
 }
 
@@ -166,6 +365,11 @@ func Init(configDirectory string) error {
 	writerFile := filepath.Join(configDirectory, "writer.yaml")
 
 	if !fileutil.IsExist(writerFile) {
+		if flags.PullMode {
+			// pull 模式下可以只让 Prometheus 来拉数据，不配置 remote write
+			logger.Infof("writer.file %s does not exist, samples are only exposed at /metrics/probe", writerFile)
+			return nil
+		}
 		return fmt.Errorf("writer.file %s does not exist", writerFile)
 	}
 